@@ -0,0 +1,34 @@
+package dto
+
+import "time"
+
+// API key of user. Only hash of key is stored, key itself is shown once on creation
+type ApiKeyDto struct {
+	Id        string
+	Name      string
+	UserId    string
+	KeyHash   string
+	CreatedAt time.Time
+}
+
+// Authenticated caller of api.
+// Admin can manage API keys and act on behalf of any user.
+// Scopes limit allowed routes, nil scopes means caller is not limited (API keys)
+type PrincipalDto struct {
+	UserId string
+	KeyId  string
+	Admin  bool
+	Scopes []string
+}
+
+func (p *PrincipalDto) HasScope(scope string) bool {
+	if p.Scopes == nil {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
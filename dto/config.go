@@ -1,31 +1,291 @@
 package dto
 
+import "time"
+
 // struct to store all configs from file
 type Config struct {
-	Server  ServerConfig
-	Aws     AwsConfig
-	MongoDb MongoDbConfig
+	Server     ServerConfig
+	Aws        AwsConfig
+	MongoDb    MongoDbConfig
+	Delivery   DeliveryConfig
+	Signing    SigningConfig
+	Presets    map[string]PresetConfig
+	Eager      EagerConfig
+	Jobs       JobsConfig
+	Webhooks   WebhooksConfig
+	Auth       AuthConfig
+	RateLimit  RateLimitConfig
+	Quotas     QuotaConfig
+	Health     HealthConfig
+	Tracing    TracingConfig
+	Log        LogConfig
+	Fetch      FetchConfig
+	Batch      BatchConfig
+	Import     ImportConfig
+	Erasure    ErasureConfig
+	Lifecycle  LifecycleConfig
+	Coalescing CoalescingConfig
+	Cache      CacheConfig
+}
+
+// duration value in config file, for example "30s" or "24h"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
 }
 
 // config for main server
+// Timeouts are applied to http.Server, zero value means no timeout.
+// ShutdownTimeout limits draining of in-flight requests and background tasks on SIGINT/SIGTERM.
+// During ShutdownDelay readiness check fails but requests are still accepted, so load balancer can stop routing traffic.
+// StreamTimeout replaces read and write timeouts of export, batch and import requests, zero value means no timeout
 type ServerConfig struct {
-	ServerPort string `toml:"serverPort"`
-	LogLevel   string `toml:"logLevel"`
+	ServerPort        string   `toml:"serverPort"`
+	LogLevel          string   `toml:"logLevel"`
+	ReadTimeout       Duration `toml:"readTimeout"`
+	ReadHeaderTimeout Duration `toml:"readHeaderTimeout"`
+	WriteTimeout      Duration `toml:"writeTimeout"`
+	IdleTimeout       Duration `toml:"idleTimeout"`
+	ShutdownTimeout   Duration `toml:"shutdownTimeout"`
+	ShutdownDelay     Duration `toml:"shutdownDelay"`
+	StreamTimeout     Duration `toml:"streamTimeout"`
 }
 
 // config for Amazon S3 server
+// AwsEndpoint is url of S3 compatible storage, empty value means Amazon S3
 type AwsConfig struct {
 	AwsAccessKeyId     string `toml:"awsAccessKeyId"`
 	AwsSecretAccessKey string `toml:"awsSecretAccessKey"`
 	AwsRegion          string `toml:"awsRegion"`
 	AwsBucket          string `toml:"awsBucket"`
+	AwsEndpoint        string `toml:"awsEndpoint"`
 }
 
 // config for NoSql DB MongoDb
 type MongoDbConfig struct {
-	Username   string `toml:"username"`
-	Password   string `toml:"password"`
-	Address    string `toml:"address"`
-	Store      string `toml:"store"`
-	Collection string `toml:"collection"`
+	Username           string `toml:"username"`
+	Password           string `toml:"password"`
+	Address            string `toml:"address"`
+	Store              string `toml:"store"`
+	Collection         string `toml:"collection"`
+	JobsCollection     string `toml:"jobsCollection"`
+	WebhooksCollection string `toml:"webhooksCollection"`
+	ApiKeysCollection  string `toml:"apiKeysCollection"`
+	ErasuresCollection string `toml:"erasuresCollection"`
+	LocksCollection    string `toml:"locksCollection"`
+}
+
+// config for on-the-fly image delivery
+type DeliveryConfig struct {
+	CacheControl string `toml:"cacheControl"`
+	BaseUrl      string `toml:"baseUrl"`
+}
+
+// config for signing on-the-fly delivery urls
+// Secret is required, application does not start without it
+type SigningConfig struct {
+	Secret     string   `toml:"secret"`
+	DefaultTtl Duration `toml:"defaultTtl"`
+}
+
+// config of named transformation preset, for example
+// thumb = {width=150,height=150,mode="fill",format="jpeg",quality=80}
+type PresetConfig struct {
+	Width   int    `toml:"width"`
+	Height  int    `toml:"height"`
+	Mode    string `toml:"mode"`
+	Format  string `toml:"format"`
+	Quality int    `toml:"quality"`
+}
+
+// config for generating preset variants when original image is uploaded
+// In async mode variants are generated after response is sent
+type EagerConfig struct {
+	Presets []string `toml:"presets"`
+	Async   bool     `toml:"async"`
+}
+
+// config for asynchronous jobs and worker pool which processes all resize workflows
+// Store: "memory" (default) or "mongo"
+// MaxMemory: bytes of estimated memory of images resized at once, zero means no limit
+type JobsConfig struct {
+	Workers   int      `toml:"workers"`
+	QueueSize int      `toml:"queueSize"`
+	MaxMemory int64    `toml:"maxMemory"`
+	Store     string   `toml:"store"`
+	Retention Duration `toml:"retention"`
+}
+
+// config for callbacks sent to callback_url when resize workflow finished
+// Failed deliveries are retried with exponential backoff: InitialBackoff, 2*InitialBackoff, ... up to MaxBackoff
+// Store: "memory" (default) or "mongo"
+// Callback urls are checked like source urls of FetchConfig by AllowHosts, DenyHosts and AllowPrivate, redirects are not followed.
+// Callbacks are delivered by Workers from queue of QueueSize, callback is dropped if queue is full
+type WebhooksConfig struct {
+	Secret         string   `toml:"secret"`
+	Timeout        Duration `toml:"timeout"`
+	MaxAttempts    int      `toml:"maxAttempts"`
+	InitialBackoff Duration `toml:"initialBackoff"`
+	MaxBackoff     Duration `toml:"maxBackoff"`
+	Store          string   `toml:"store"`
+	Retention      Duration `toml:"retention"`
+	AllowHosts     []string `toml:"allowHosts"`
+	DenyHosts      []string `toml:"denyHosts"`
+	AllowPrivate   bool     `toml:"allowPrivate"`
+	Workers        int      `toml:"workers"`
+	QueueSize      int      `toml:"queueSize"`
+}
+
+// config for authentication of /api requests
+// Mode: "" (no authentication, user_id from request is used), "apikey" or "jwt"
+// AdminKey gives access to admin endpoints, like API keys management
+type AuthConfig struct {
+	Mode     string    `toml:"mode"`
+	AdminKey string    `toml:"adminKey"`
+	Jwt      JwtConfig `toml:"jwt"`
+}
+
+// config for verification of JWT bearer tokens
+// HS256 tokens are verified with Secret, RS256 tokens with keys from JWKS file.
+// UserClaim is used as user id ("sub" by default), ScopeClaim contains granted scopes ("scope" by default)
+type JwtConfig struct {
+	Secret     string   `toml:"secret"`
+	JwksFile   string   `toml:"jwksFile"`
+	Audience   string   `toml:"audience"`
+	UserClaim  string   `toml:"userClaim"`
+	ScopeClaim string   `toml:"scopeClaim"`
+	Leeway     Duration `toml:"leeway"`
+}
+
+// config for rate limiting of /api requests by token bucket per caller (API key, user or client IP)
+// Cheap routes (list, job state) and expensive routes (resize) have separate budgets.
+// X-Forwarded-For header is used as client IP only if TrustForwardedFor is set
+type RateLimitConfig struct {
+	Cheap             RateLimitBudget `toml:"cheap"`
+	Expensive         RateLimitBudget `toml:"expensive"`
+	TrustForwardedFor bool            `toml:"trustForwardedFor"`
+}
+
+// Rate is count of requests per second, Burst is max count of requests at once.
+// Zero rate disables limit
+type RateLimitBudget struct {
+	Rate  float64 `toml:"rate"`
+	Burst int     `toml:"burst"`
+}
+
+// config for per-user quotas, zero value means no limit
+// Megapixels of generated variants are counted per UTC day
+type QuotaConfig struct {
+	MaxOriginals        int64   `toml:"maxOriginals"`
+	MaxVariants         int64   `toml:"maxVariants"`
+	MaxBytes            int64   `toml:"maxBytes"`
+	MaxMegapixelsPerDay float64 `toml:"maxMegapixelsPerDay"`
+}
+
+// config for readiness checks of dependencies (Mongo, S3)
+// Result of checks is cached for CacheTtl, every check is limited by Timeout
+type HealthConfig struct {
+	CacheTtl Duration `toml:"cacheTtl"`
+	Timeout  Duration `toml:"timeout"`
+}
+
+// config for OpenTelemetry tracing
+// Exporter: "" (tracing disabled, only trace context is propagated), "otlp" (OTLP over http to Endpoint),
+// "stdout" or "file" (spans are written as JSON to File). SampleRatio is used for traces without sampled parent,
+// zero value means all traces are sampled
+type TracingConfig struct {
+	Exporter    string  `toml:"exporter"`
+	Endpoint    string  `toml:"endpoint"`
+	Insecure    bool    `toml:"insecure"`
+	File        string  `toml:"file"`
+	ServiceName string  `toml:"serviceName"`
+	SampleRatio float64 `toml:"sampleRatio"`
+}
+
+// config for log output, level is set by Server.LogLevel
+// Format: "text" (default) or "json". FieldNames renames standard fields of JSON output:
+// "time", "level", "msg", "request_id" and "trace_id". Fields are added to every log entry, for example name of environment
+type LogConfig struct {
+	Format     string            `toml:"format"`
+	FieldNames map[string]string `toml:"fieldNames"`
+	Fields     map[string]string `toml:"fields"`
+}
+
+// config for downloading source images by source_url
+// MaxSize limits size of downloaded image, Timeout limits whole download including redirects.
+// Host lists contain host names, entry also matches all subdomains. Hosts from DenyHosts are always rejected,
+// if AllowHosts is set, only listed hosts are allowed. Private, loopback and link-local addresses are blocked
+// after DNS resolution unless AllowPrivate is set. Negative MaxRedirects disables redirects
+type FetchConfig struct {
+	MaxSize      int64    `toml:"maxSize"`
+	Timeout      Duration `toml:"timeout"`
+	MaxRedirects int      `toml:"maxRedirects"`
+	AllowHosts   []string `toml:"allowHosts"`
+	DenyHosts    []string `toml:"denyHosts"`
+	AllowPrivate bool     `toml:"allowPrivate"`
+}
+
+// config for batch resize requests
+// MaxItems limits count of file and size pairs in one batch, MaxSize limits size of whole request.
+// Concurrency is count of files of one batch processed at once, processing itself is done by common worker pool
+type BatchConfig struct {
+	MaxItems    int   `toml:"maxItems"`
+	MaxSize     int64 `toml:"maxSize"`
+	Concurrency int   `toml:"concurrency"`
+}
+
+// config for ZIP import of images
+// MaxSize limits size of uploaded archive. MaxEntries, MaxEntrySize and MaxTotalSize limit count of image entries
+// and their uncompressed sizes, so archive cannot unpack to more than configured amount of data.
+// MaxItems limits count of generated variants (images multiplied by sizes)
+type ImportConfig struct {
+	MaxSize      int64 `toml:"maxSize"`
+	MaxEntries   int   `toml:"maxEntries"`
+	MaxEntrySize int64 `toml:"maxEntrySize"`
+	MaxTotalSize int64 `toml:"maxTotalSize"`
+	MaxItems     int   `toml:"maxItems"`
+}
+
+// config for erasure of all user data
+// Erasure report is signed with Secret, it must differ from Signing.Secret. Erasure is disabled if it is empty
+type ErasureConfig struct {
+	Secret string `toml:"secret"`
+}
+
+// config for lifecycle policies of stored images, zero value disables policy
+// VariantTtl: variants not accessed longer than this are deleted, last variant of original is kept.
+// OriginalRetention: originals are deleted with all variants after this period since upload.
+// MaxVariants: count of variants per original, least recently accessed are evicted.
+// Interval: period of policies run by server, zero means policies are run only by "lifecycle" command
+type LifecycleConfig struct {
+	VariantTtl        Duration `toml:"variantTtl"`
+	OriginalRetention Duration `toml:"originalRetention"`
+	MaxVariants       int      `toml:"maxVariants"`
+	Interval          Duration `toml:"interval"`
+}
+
+// config for coalescing of concurrent requests of the same variant
+// Requests are always coalesced inside one instance. With DistributedLock variant is also locked in DbStore,
+// so only one instance generates it. Lock expires after LockTtl if instance holding it failed.
+// Other instances wait up to LockWait for variant, after that they generate it without lock
+type CoalescingConfig struct {
+	DistributedLock bool     `toml:"distributedLock"`
+	LockTtl         Duration `toml:"lockTtl"`
+	LockWait        Duration `toml:"lockWait"`
+}
+
+// config for in-memory caches of recently used images, zero budget disables cache
+// OriginalsMaxBytes: originals which were uploaded or downloaded recently, they are resized without download from cloud.
+// DecodedOriginals: decoded originals are cached too, they are counted as 4 bytes per pixel.
+// VariantsMaxBytes: content of variants served by delivery. Entries expire after Ttl, zero means no expiration
+type CacheConfig struct {
+	OriginalsMaxBytes int64    `toml:"originalsMaxBytes"`
+	DecodedOriginals  bool     `toml:"decodedOriginals"`
+	VariantsMaxBytes  int64    `toml:"variantsMaxBytes"`
+	Ttl               Duration `toml:"ttl"`
 }
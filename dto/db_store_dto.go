@@ -1,5 +1,7 @@
 package dto
 
+import "time"
+
 type DbImageStoreDAO struct {
 	UserId           string
 	PicId            uint32
@@ -7,4 +9,22 @@ type DbImageStoreDAO struct {
 	ResizedImageUrl  string
 	ResizedWidth     int
 	ResizedHeight    int
+	Format           string
+	Mode             string
+	Quality          int
+	Preset           string
+	// sizes of files in bytes, for usage quotas
+	OriginalSize int64
+	ResizedSize  int64
+	CreatedAt    time.Time
+	// updated when variant is found in DB instead of generating, used by lifecycle policies
+	LastAccessedAt time.Time
+}
+
+// Consumption of user storage and processing
+type UsageDto struct {
+	Originals       int64
+	Variants        int64
+	Bytes           int64
+	MegapixelsToday float64
 }
@@ -0,0 +1,27 @@
+package dto
+
+import "time"
+
+// Erasure states
+const (
+	ErasureStateInProgress = "in_progress"
+	ErasureStateCompleted  = "completed"
+)
+
+// Progress of erasure of all user data. Counters are accumulated by all attempts,
+// so interrupted erasure can be continued by next request
+type ErasureDto struct {
+	UserId            string
+	State             string
+	Attempts          int
+	Files             int64
+	Images            int64
+	ApiKeys           int64
+	Jobs              int64
+	WebhookDeliveries int64
+	StartedAt         time.Time
+	UpdatedAt         time.Time
+	CompletedAt       time.Time
+	// HMAC signature of erasure report, set when erasure completed
+	Signature string
+}
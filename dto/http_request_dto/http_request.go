@@ -6,21 +6,82 @@ type BaseRequestDto struct {
 }
 
 type SizeRequestDto struct {
-	Width  int `json:"width" validate:"min=1"`
-	Height int `json:"height" validate:"min=1"`
+	Width  int    `schema:"width" json:"width" validate:"min=1"`
+	Height int    `schema:"height" json:"height" validate:"min=1"`
+	Preset string `schema:"preset" json:"preset"`
 }
 
+// Output params of resized image, values set in request override params of preset
+type TransformRequestDto struct {
+	Format  string `schema:"format" json:"format"`
+	Mode    string `schema:"mode" json:"mode"`
+	Quality int    `schema:"quality" json:"quality" validate:"min=0,max=100"`
+}
+
+// Image is sent as multipart file, raw request body or downloaded by service from SourceUrl
 type ResizeImageRequestParamsDto struct {
 	BaseRequestDto
 	SizeRequestDto
+	TransformRequestDto
+	CallbackUrl string `schema:"callback_url" json:"callback_url"`
+	SourceUrl   string `schema:"source_url" json:"source_url"`
+}
+
+// Json resize request, Image is base64 encoded content or data uri ("data:image/png;base64,...")
+type ResizeImageJsonRequestDto struct {
+	ResizeImageRequestParamsDto
+	Image    string `json:"image"`
+	Filename string `json:"filename"`
+}
+
+// Params of batch resize. Files without own item are resized to shared Sizes
+type ResizeBatchRequestDto struct {
+	BaseRequestDto
+	Sizes []*SizeRequestDto     `json:"sizes"`
+	Items []*ResizeBatchItemDto `json:"items"`
+}
+
+// Sizes of one file of batch, File is name of multipart file
+type ResizeBatchItemDto struct {
+	File  string            `json:"file"`
+	Sizes []*SizeRequestDto `json:"sizes"`
 }
 
 type ResizeImageByImageIdRequestParamsDto struct {
 	BaseRequestDto
 	SizeRequestDto
-	ImageId uint32 `schema:"image_id" json:"image_id"`
+	ImageId     uint32 `schema:"image_id" json:"image_id"`
+	CallbackUrl string `json:"callback_url"`
 }
 
 type RequestsHistoryListRequestDto struct {
 	BaseRequestDto
 }
+
+type ImageDeliveryRequestDto struct {
+	SizeRequestDto
+	UserId  string `validate:"regexp=^[-a-zA-Z0-9]+$"`
+	ImageId uint32
+	Format  string
+}
+
+type VariantRequestDto struct {
+	SizeRequestDto
+	Format string `json:"format"`
+}
+
+type SignUrlRequestDto struct {
+	BaseRequestDto
+	ImageId   uint32               `json:"image_id"`
+	Variants  []*VariantRequestDto `json:"variants"`
+	ExpiresIn int64                `json:"expires_in" validate:"min=0"`
+}
+
+type EraseUserRequestDto struct {
+	UserId string `validate:"nonzero,regexp=^[-a-zA-Z0-9]+$"`
+}
+
+type ApiKeyRequestDto struct {
+	UserId string `json:"user_id" validate:"nonzero,regexp=^[-a-zA-Z0-9]+$"`
+	Name   string `json:"name"`
+}
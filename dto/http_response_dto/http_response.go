@@ -1,5 +1,7 @@
 package http_response_dto
 
+import "time"
+
 type BaseResponseDto struct {
 	UserId    string `json:"user_id"`
 	RequestId string `json:"request_id"`
@@ -9,9 +11,69 @@ type BaseResponseDto struct {
 
 type ResizeImageResponseDto struct {
 	BaseResponseDto
-	ImageId           uint32 `json:"image_id"`
-	OriginalImagePath string `json:"original_image_path"`
-	ResizedImagePath  string `json:"resized_image_path"`
+	ImageId           uint32              `json:"image_id"`
+	OriginalImagePath string              `json:"original_image_path"`
+	ResizedImagePath  string              `json:"resized_image_path"`
+	Variants          []*PresetVariantDto `json:"variants,omitempty"`
+}
+
+type ResizeBatchResponseDto struct {
+	BaseResponseDto
+	Results []*ResizeBatchItemResultDto `json:"results"`
+}
+
+// Result of one size of one file of batch, Index is position of item in batch.
+// Failed item has own error code, other items are not affected
+type ResizeBatchItemResultDto struct {
+	Index  int    `json:"index"`
+	File   string `json:"file"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Preset string `json:"preset,omitempty"`
+	ResizeImageResponseDto
+}
+
+// Description of exported library, saved as manifest.json in export archive
+type ExportManifestDto struct {
+	UserId     string            `json:"user_id"`
+	ExportedAt time.Time         `json:"exported_at"`
+	Images     []*ExportImageDto `json:"images"`
+}
+
+type ExportImageDto struct {
+	ImageId  uint32              `json:"image_id"`
+	Original *ExportFileDto      `json:"original"`
+	Variants []*ExportVariantDto `json:"variants"`
+}
+
+// Path is location of file in archive, it is empty if file cannot be downloaded, Error describes the reason
+type ExportFileDto struct {
+	Path  string `json:"path,omitempty"`
+	Url   string `json:"url"`
+	Size  int64  `json:"size"`
+	Error string `json:"error,omitempty"`
+}
+
+type ExportVariantDto struct {
+	ExportFileDto
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Format    string    `json:"format,omitempty"`
+	Mode      string    `json:"mode,omitempty"`
+	Quality   int       `json:"quality,omitempty"`
+	Preset    string    `json:"preset,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Variant of eager preset. Url is delivery url, it is available even before variant generated.
+// ResizedImagePath is set only if variant already generated
+type PresetVariantDto struct {
+	Preset           string `json:"preset"`
+	Width            int    `json:"width"`
+	Height           int    `json:"height"`
+	Format           string `json:"format"`
+	Url              string `json:"url"`
+	ResizedImagePath string `json:"resized_image_path,omitempty"`
 }
 
 type UserImagesListResponseDto struct {
@@ -30,3 +92,120 @@ type UserResizedImageDbInfoDto struct {
 	Width  int
 	Height int
 }
+
+type SignUrlResponseDto struct {
+	BaseResponseDto
+	ImageId uint32          `json:"image_id"`
+	Urls    []*SignedUrlDto `json:"urls"`
+}
+
+type SignedUrlDto struct {
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Format    string `json:"format"`
+	Preset    string `json:"preset,omitempty"`
+	Url       string `json:"url"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+}
+
+type JobResponseDto struct {
+	BaseResponseDto
+	JobId  string                  `json:"job_id"`
+	State  string                  `json:"state"`
+	Stage  string                  `json:"stage"`
+	Result *ResizeImageResponseDto `json:"result,omitempty"`
+}
+
+type UserErasureResponseDto struct {
+	BaseResponseDto
+	Report *ErasureReportDto `json:"report,omitempty"`
+}
+
+// Counts of deleted files and records. Signature is HMAC-SHA256 of report json without signature field
+type ErasureReportDto struct {
+	UserId                   string    `json:"user_id"`
+	State                    string    `json:"state"`
+	Attempts                 int       `json:"attempts"`
+	FilesDeleted             int64     `json:"files_deleted"`
+	ImagesDeleted            int64     `json:"images_deleted"`
+	ApiKeysDeleted           int64     `json:"api_keys_deleted"`
+	JobsDeleted              int64     `json:"jobs_deleted"`
+	WebhookDeliveriesDeleted int64     `json:"webhook_deliveries_deleted"`
+	StartedAt                time.Time `json:"started_at"`
+	CompletedAt              time.Time `json:"completed_at"`
+	Signature                string    `json:"signature,omitempty"`
+}
+
+type WebhookDeliveriesResponseDto struct {
+	BaseResponseDto
+	Deliveries []*WebhookDeliveryInfoDto `json:"deliveries"`
+}
+
+type WebhookDeliveryInfoDto struct {
+	Url        string `json:"url"`
+	Attempt    int    `json:"attempt"`
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error,omitempty"`
+	Delivered  bool   `json:"delivered"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
+// Key is set only in response on key creation
+type ApiKeyResponseDto struct {
+	BaseResponseDto
+	KeyId     string `json:"key_id"`
+	Name      string `json:"name,omitempty"`
+	Key       string `json:"key,omitempty"`
+	CreatedAt int64  `json:"created_at,omitempty"`
+}
+
+type ApiKeysListResponseDto struct {
+	BaseResponseDto
+	Keys []*ApiKeyInfoDto `json:"keys"`
+}
+
+type ApiKeyInfoDto struct {
+	KeyId     string `json:"key_id"`
+	Name      string `json:"name"`
+	UserId    string `json:"user_id"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// Zero limit means no limit
+type UsageResponseDto struct {
+	BaseResponseDto
+	Usage  *UsageInfoDto `json:"usage"`
+	Limits *UsageInfoDto `json:"limits"`
+}
+
+type UsageInfoDto struct {
+	Originals       int64   `json:"originals"`
+	Variants        int64   `json:"variants"`
+	Bytes           int64   `json:"bytes"`
+	MegapixelsToday float64 `json:"megapixels_today"`
+}
+
+// Status is "ok" or "fail" ("draining" while server is shutting down)
+type HealthResponseDto struct {
+	Status       string                          `json:"status"`
+	Dependencies map[string]*DependencyStatusDto `json:"dependencies,omitempty"`
+}
+
+type DependencyStatusDto struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latency_ms"`
+	CheckedAt int64  `json:"checked_at"`
+}
+
+// Error response of API v2, RFC 7807 problem details.
+// Code is numeric error code of API v1, kept as extension member
+type ProblemDto struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      int    `json:"code"`
+	RequestId string `json:"request_id,omitempty"`
+}
@@ -0,0 +1,39 @@
+package dto
+
+import (
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"time"
+)
+
+// Job states
+const (
+	JobStateQueued    = "queued"
+	JobStateRunning   = "running"
+	JobStateSucceeded = "succeeded"
+	JobStateFailed    = "failed"
+)
+
+// Job progress stages
+const (
+	JobStageQueued      = "queued"
+	JobStageDownloading = "downloading"
+	JobStageResizing    = "resizing"
+	JobStageUploading   = "uploading"
+	JobStageSaving      = "saving"
+	JobStagePresets     = "presets"
+	JobStageDone        = "done"
+)
+
+// Asynchronous resize job, Result is set when job finished (successfully or not)
+type JobDto struct {
+	Id        string
+	UserId    string
+	RequestId string
+	State     string
+	Stage     string
+	Result    *http_response_dto.ResizeImageResponseDto
+	// result is sent to this url when job finished
+	CallbackUrl string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
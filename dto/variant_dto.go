@@ -0,0 +1,32 @@
+package dto
+
+// Resize modes
+// - resize: stretch image to requested size
+// - fit: scale image to fit requested size, aspect ratio is kept
+// - fill: scale and crop image (from center) to fill requested size
+const (
+	ResizeModeResize = "resize"
+	ResizeModeFit    = "fit"
+	ResizeModeFill   = "fill"
+)
+
+// Params of resized image (variant of original image)
+// Empty Format means format of original image, empty Mode means ResizeModeResize
+// and zero Quality means default encoder quality.
+// Preset is the name of config preset variant was built from
+type VariantDto struct {
+	Width   int
+	Height  int
+	Format  string
+	Mode    string
+	Quality int
+	Preset  string
+}
+
+func IsValidResizeMode(mode string) bool {
+	switch mode {
+	case "", ResizeModeResize, ResizeModeFit, ResizeModeFill:
+		return true
+	}
+	return false
+}
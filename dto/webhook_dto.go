@@ -0,0 +1,15 @@
+package dto
+
+import "time"
+
+// One attempt of sending resize result to callback url
+type WebhookDeliveryDto struct {
+	RequestId  string
+	UserId     string
+	Url        string
+	Attempt    int
+	StatusCode int
+	Error      string
+	Delivered  bool
+	CreatedAt  time.Time
+}
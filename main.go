@@ -1,48 +1,162 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/senseyman/image-media-processor/dto"
 	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/service"
 	"github.com/senseyman/image-media-processor/service/db"
+	"github.com/senseyman/image-media-processor/service/jobs"
+	"github.com/senseyman/image-media-processor/service/logging"
 	"github.com/senseyman/image-media-processor/service/media"
 	"github.com/senseyman/image-media-processor/service/store"
+	"github.com/senseyman/image-media-processor/service/tracing"
+	"github.com/senseyman/image-media-processor/service/webhooks"
 	"github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var (
 	configPath = "./config.toml"
 )
 
+// time for closing DB connections and flushing traces on exit
+const CloseTimeout = 10 * time.Second
+
 /*
 	main func start application:
 	- init config
-	- init logger
+	- init logger and tracing
 	- create main services for data processing
-	- run api server
+	- run one-shot command if it passed in args
+	- run api server until SIGINT/SIGTERM, then drain requests and close DB connections
 */
 func main() {
 	cfg := readConfig()
 	logger := configureLogger(cfg)
 
-	apiServer := createServer(cfg, logger)
+	shutdownTracing, err := tracing.Init(&cfg.Tracing)
+	if err != nil {
+		logger.Fatalf("Cannot configure tracing: %v", err)
+	}
+
+	apiServer, mongoDbService := createServer(cfg, logger)
+
+	if len(os.Args) > 1 {
+		runCommand(apiServer, logger, os.Args[1:])
+		disconnectDb(mongoDbService, logger, CloseTimeout)
+		flushTraces(shutdownTracing, logger)
+		return
+	}
 
 	logger.Info("Starting application...")
 
-	if err := apiServer.Start(); err != nil {
-		logger.Fatalf("Cannot start api server: %v", err)
-		panic(err)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- apiServer.Start()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-serverErr:
+		if err != nil {
+			logger.Fatalf("Cannot start api server: %v", err)
+			panic(err)
+		}
+		return
+	case sig := <-signals:
+		logger.Infof("Got signal %s, stopping application...", sig)
+	}
+
+	shutdownTimeout := cfg.Server.ShutdownTimeout.Duration
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = server.DefaultShutdownTimeout
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := apiServer.Shutdown(ctx); err != nil {
+		logger.Errorf("Api server was not stopped gracefully: %v", err)
+	}
+	disconnectDb(mongoDbService, logger, CloseTimeout)
+	flushTraces(shutdownTracing, logger)
+	logger.Info("Application stopped")
 }
 
-// register all necessary services and return api server instance
-func createServer(cfg *dto.Config, logger *logrus.Logger) *server.APIServer {
+// register all necessary services and return api server instance with DB service for closing on exit
+func createServer(cfg *dto.Config, logger *logrus.Logger) (*server.APIServer, *db.MongoDbService) {
 	logger.Info("Registering services...")
 	imgProcessor := media.NewImageService(logger)
 	awsService := store.NewAwsService(&cfg.Aws, logger)
 	mongoDbService := db.NewMongoDbService(&cfg.MongoDb, logger)
-	return server.NewAPIServer(cfg.Server.ServerPort, logger, imgProcessor, awsService, mongoDbService)
+
+	var jobStore service.JobStore
+	switch cfg.Jobs.Store {
+	case "mongo":
+		jobStore = mongoDbService
+	default:
+		jobStore = jobs.NewMemoryJobStore(cfg.Jobs.Retention.Duration)
+	}
+
+	var webhookLog service.WebhookLogStore
+	switch cfg.Webhooks.Store {
+	case "mongo":
+		webhookLog = mongoDbService
+	default:
+		webhookLog = webhooks.NewMemoryDeliveryLog(cfg.Webhooks.Retention.Duration)
+	}
+	return server.NewAPIServer(cfg, logger, imgProcessor, awsService, mongoDbService, jobStore, webhookLog), mongoDbService
+}
+
+// close DB connections after all processing finished
+func disconnectDb(mongoDbService *db.MongoDbService, logger *logrus.Logger, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := mongoDbService.Disconnect(ctx); err != nil {
+		logger.Errorf("Cannot disconnect from DB: %v", err)
+	}
+}
+
+// send spans which are not exported yet
+func flushTraces(shutdownTracing func(ctx context.Context) error, logger *logrus.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), CloseTimeout)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Errorf("Cannot flush traces: %v", err)
+	}
+}
+
+// run one-shot command instead of api server:
+// - reprocess <preset>: regenerate all variants of preset after its definition changed
+// - lifecycle: apply lifecycle policies once, e.g. from cron when scheduler of server is disabled
+func runCommand(apiServer *server.APIServer, logger *logrus.Logger, args []string) {
+	switch args[0] {
+	case "reprocess":
+		if len(args) < 2 {
+			logger.Fatal("Preset name is required: reprocess <preset>")
+		}
+		count, err := apiServer.ReprocessPreset(args[1])
+		if err != nil {
+			logger.Fatalf("Cannot reprocess preset %s: %v", args[1], err)
+		}
+		logger.Infof("Preset %s reprocessed. Regenerated variants: %d", args[1], count)
+	case "lifecycle":
+		stats, err := apiServer.ApplyLifecyclePolicies()
+		if err != nil {
+			logger.Fatalf("Cannot apply lifecycle policies: %v", err)
+		}
+		logger.Infof("Lifecycle policies applied. Expired originals: %d, expired variants: %d, evicted variants: %d",
+			stats.ExpiredOriginals, stats.ExpiredVariants, stats.EvictedVariants)
+	default:
+		logger.Fatalf("Unknown command: %s", args[0])
+	}
 }
 
 // Reading configs from config file. File is required
@@ -52,22 +166,48 @@ func readConfig() *dto.Config {
 		fmt.Printf("Cannot read config file: %v", err)
 		panic(err)
 	}
+	if err := server.ValidatePresets(cfg.Presets); err != nil {
+		fmt.Printf("Invalid presets in config file: %v", err)
+		panic(err)
+	}
+	if err := server.ValidateEagerPresets(&cfg); err != nil {
+		fmt.Printf("Invalid eager presets in config file: %v", err)
+		panic(err)
+	}
+	if err := server.ValidateSigning(&cfg.Signing); err != nil {
+		fmt.Printf("Invalid signing config: %v", err)
+		panic(err)
+	}
+	if err := server.ValidateErasure(&cfg); err != nil {
+		fmt.Printf("Invalid erasure config: %v", err)
+		panic(err)
+	}
+	if err := server.ValidateAuth(&cfg.Auth); err != nil {
+		fmt.Printf("Invalid auth config: %v", err)
+		panic(err)
+	}
+	if err := server.ValidateWebhooks(&cfg.Webhooks); err != nil {
+		fmt.Printf("Invalid webhooks config: %v", err)
+		panic(err)
+	}
+	if err := tracing.ValidateTracing(&cfg.Tracing); err != nil {
+		fmt.Printf("Invalid tracing config: %v", err)
+		panic(err)
+	}
+	if err := logging.ValidateLog(&cfg.Log); err != nil {
+		fmt.Printf("Invalid log config: %v", err)
+		panic(err)
+	}
 	return &cfg
 }
 
 // creating logger instance for logging every action in app
 func configureLogger(cfg *dto.Config) *logrus.Logger {
-	level, err := logrus.ParseLevel(cfg.Server.LogLevel)
+	logger, err := logging.NewLogger(cfg.Server.LogLevel, &cfg.Log)
 	if err != nil {
 		fmt.Printf("Cannot configure logger: %v", err)
 		panic(err)
 	}
-	logger := logrus.New()
-	logger.SetLevel(level)
-
-	logger.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp: true,
-	})
 
 	return logger
 }
@@ -1,10 +1,15 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
 	"github.com/senseyman/image-media-processor/service"
+	"github.com/senseyman/image-media-processor/service/metrics"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"time"
 )
 
 // - process/resize image
@@ -19,9 +24,14 @@ type APIServer struct {
 	logger           *logrus.Logger
 	address          string
 	router           *mux.Router
+	httpServer       *http.Server
+	shutdownDelay    time.Duration
 	requestProcessor *ApiServerRequestProcessor
 }
 
+// used if shutdown timeout is not set in config
+const DefaultShutdownTimeout = 30 * time.Second
+
 var (
 	NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
@@ -29,38 +39,145 @@ var (
 )
 
 // create new instance of APIServer
-func NewAPIServer(bindAddr string, logger *logrus.Logger, imgProcessor service.MediaProcessor, cloudStore service.CloudStore, dbStore service.DbStore) *APIServer {
+func NewAPIServer(cfg *dto.Config, logger *logrus.Logger, imgProcessor service.MediaProcessor, cloudStore service.CloudStore, dbStore service.DbStore, jobStore service.JobStore, webhookLog service.WebhookLogStore) *APIServer {
+	router := mux.NewRouter()
 	return &APIServer{
-		logger:           logger,
-		address:          bindAddr,
-		router:           mux.NewRouter(),
-		requestProcessor: NewApiServerRequestProcessor(logger, imgProcessor, cloudStore, dbStore),
+		logger:  logger,
+		address: cfg.Server.ServerPort,
+		router:  router,
+		httpServer: &http.Server{
+			Addr:              cfg.Server.ServerPort,
+			Handler:           router,
+			ReadTimeout:       cfg.Server.ReadTimeout.Duration,
+			ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout.Duration,
+			WriteTimeout:      cfg.Server.WriteTimeout.Duration,
+			IdleTimeout:       cfg.Server.IdleTimeout.Duration,
+		},
+		shutdownDelay:    cfg.Server.ShutdownDelay.Duration,
+		requestProcessor: NewApiServerRequestProcessor(cfg, logger, imgProcessor, cloudStore, dbStore, jobStore, webhookLog),
 	}
 }
 
-// Starting APIServer using port from config
+// Starting APIServer using port from config.
+// Returns nil after server was stopped by Shutdown
 func (s *APIServer) Start() error {
 	s.logger.Infof("Starting api server. Port %s ", s.address)
 	s.registerRouters()
-	return http.ListenAndServe(s.address, s.router)
+	s.requestProcessor.StartLifecycleScheduler()
+	if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Graceful stop: fail readiness check for shutdown delay, close listeners, wait for in-flight requests and then for background tasks
+// (jobs, eager presets, webhooks). Both steps are limited by ctx deadline
+func (s *APIServer) Shutdown(ctx context.Context) error {
+	s.logger.Info("Shutting down api server...")
+	s.requestProcessor.StartDraining()
+	if s.shutdownDelay > 0 {
+		s.logger.Infof("Readiness check is failing, waiting %s before closing listeners", s.shutdownDelay)
+		select {
+		case <-time.After(s.shutdownDelay):
+		case <-ctx.Done():
+		}
+	}
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		return fmt.Errorf("cannot drain in-flight requests: %v", err)
+	}
+	if err := s.requestProcessor.Shutdown(ctx); err != nil {
+		return fmt.Errorf("cannot finish background tasks: %v", err)
+	}
+	s.logger.Info("Api server stopped")
+	return nil
 }
 
 func (s *APIServer) registerRouters() {
 	s.logger.Info("Registering api routers...")
+	s.router.Use(s.requestProcessor.AssignRequestId)
+	s.router.Use(s.requestProcessor.TraceRequests)
+	s.router.Use(s.requestProcessor.InstrumentRequests)
+	// v2 is registered before /api prefix, it has own chain of middlewares
+	s.registerRouteV2(s.router)
+
 	api := s.router.PathPrefix("/api").Subrouter()
 	api.NotFoundHandler = NotFoundHandler
+	api.Use(s.requestProcessor.Authenticate)
 
 	s.registerRouteV1(api)
+	s.registerRouteDelivery(s.router)
+	s.registerRouteHealth(s.router)
+	s.registerRouteMetrics(s.router)
 }
 
 func (s *APIServer) registerRouteV1(parentRouter *mux.Router) {
 	apiV1 := parentRouter.PathPrefix("/v1").Subrouter()
 
 	apiV1.NotFoundHandler = NotFoundHandler
+	s.registerApiRoutes(apiV1)
+}
+
+// API v2 has the same routes as v1, errors are sent as RFC 7807 problem details.
+// Problem details middleware goes before authentication, so authentication errors are problems too
+func (s *APIServer) registerRouteV2(parentRouter *mux.Router) {
+	apiV2 := parentRouter.PathPrefix("/api/v2").Subrouter()
+
+	apiV2.NotFoundHandler = NotFoundHandler
+	apiV2.Use(s.requestProcessor.ProblemDetails)
+	apiV2.Use(s.requestProcessor.Authenticate)
+	s.registerApiRoutes(apiV2)
+}
+
+func (s *APIServer) registerApiRoutes(apiRouter *mux.Router) {
+	p := s.requestProcessor
+	// routes which process images are limited by expensive budget
+	apiRouter.Handle("/resize", p.RateLimitExpensive(p.RequireScope(ScopeImagesWrite, p.HandleResizeRequest))).Methods(http.MethodPost)
+	apiRouter.Handle("/images", p.RateLimitExpensive(p.RequireScope(ScopeImagesWrite, p.HandleResizeRequest))).Methods(http.MethodPut)
+	apiRouter.Handle("/resize-batch", p.RateLimitExpensive(p.RequireScope(ScopeImagesWrite, p.Streaming(p.HandleResizeBatchRequest)))).Methods(http.MethodPost)
+	apiRouter.Handle("/import", p.RateLimitExpensive(p.RequireScope(ScopeImagesWrite, p.Streaming(p.HandleImportRequest)))).Methods(http.MethodPost)
+	apiRouter.Handle("/resize-by-id", p.RateLimitExpensive(p.RequireScope(ScopeImagesWrite, p.HandleResizeByIdRequest))).Methods(http.MethodPost)
+	apiRouter.Handle("/jobs", p.RateLimitExpensive(p.RequireScope(ScopeImagesWrite, p.HandleCreateJobRequest))).Methods(http.MethodPost)
+	apiRouter.Handle("/list", p.RateLimitCheap(p.RequireScope(ScopeImagesRead, p.HandleListHistoryRequest))).Methods(http.MethodGet)
+	apiRouter.Handle("/sign", p.RateLimitCheap(p.RequireScope(ScopeImagesRead, p.HandleSignUrlRequest))).Methods(http.MethodPost)
+	apiRouter.Handle("/jobs/{id}", p.RateLimitCheap(p.RequireScope(ScopeImagesRead, p.HandleGetJobRequest))).Methods(http.MethodGet)
+	apiRouter.Handle("/export", p.RateLimitExpensive(p.RequireScope(ScopeImagesRead, p.Streaming(p.HandleExportRequest)))).Methods(http.MethodGet)
+	apiRouter.Handle("/usage", p.RateLimitCheap(p.RequireScope(ScopeImagesRead, p.HandleUsageRequest))).Methods(http.MethodGet)
+	apiRouter.Handle("/webhooks/deliveries", p.RateLimitCheap(p.RequireScope(ScopeImagesRead, p.HandleWebhookDeliveriesRequest))).Methods(http.MethodGet)
+
+	apiRouter.Handle("/users/{user_id}", p.RequireAdmin(http.HandlerFunc(p.HandleEraseUserRequest))).Methods(http.MethodDelete)
+
+	admin := apiRouter.PathPrefix("/admin").Subrouter()
+	admin.Use(p.RequireAdmin)
+	admin.HandleFunc("/keys", p.HandleCreateApiKeyRequest).Methods(http.MethodPost)
+	admin.HandleFunc("/keys", p.HandleListApiKeysRequest).Methods(http.MethodGet)
+	admin.HandleFunc("/keys/{id}", p.HandleDeleteApiKeyRequest).Methods(http.MethodDelete)
+}
+
+// on-the-fly image delivery, can be used as origin for CDN
+func (s *APIServer) registerRouteDelivery(parentRouter *mux.Router) {
+	parentRouter.Handle(DeliveryRoutePath, s.requestProcessor.VerifyUrlSignature(http.HandlerFunc(s.requestProcessor.HandleImageDeliveryRequest))).
+		Methods(http.MethodGet, http.MethodHead)
+}
+
+// probes for orchestrator, without authentication and rate limiting
+func (s *APIServer) registerRouteHealth(parentRouter *mux.Router) {
+	parentRouter.HandleFunc(HealthPath, s.requestProcessor.HandleHealthRequest).Methods(http.MethodGet, http.MethodHead)
+	parentRouter.HandleFunc(ReadinessPath, s.requestProcessor.HandleReadinessRequest).Methods(http.MethodGet, http.MethodHead)
+}
+
+// metrics for Prometheus scraping, should be closed for public access on ingress
+func (s *APIServer) registerRouteMetrics(parentRouter *mux.Router) {
+	parentRouter.Handle(MetricsPath, metrics.Handler()).Methods(http.MethodGet)
+}
+
+// Regenerate all variants of preset, see ApiServerRequestProcessor.ReprocessPreset
+func (s *APIServer) ReprocessPreset(name string) (int, error) {
+	return s.requestProcessor.ReprocessPreset(name)
+}
 
-	apiV1.HandleFunc("/resize", s.requestProcessor.HandleResizeRequest).Methods(http.MethodPost)
-	apiV1.HandleFunc("/resize-by-id", s.requestProcessor.HandleResizeByIdRequest).Methods(http.MethodPost)
-	apiV1.HandleFunc("/list", s.requestProcessor.HandleListHistoryRequest).Methods(http.MethodGet)
+// Apply lifecycle policies once, see ApiServerRequestProcessor.ApplyLifecyclePolicies
+func (s *APIServer) ApplyLifecyclePolicies() (*LifecycleStats, error) {
+	return s.requestProcessor.ApplyLifecyclePolicies(context.Background())
 }
 
 func (s *APIServer) GetRouter() *mux.Router {
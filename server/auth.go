@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/service/auth"
+	"github.com/senseyman/image-media-processor/utils"
+	"net/http"
+	"strings"
+)
+
+// Authentication of /api requests.
+// Authenticated principal is stored in request context, handlers take user id from it
+
+const (
+	ApiKeyHeader = "X-Api-Key"
+
+	AuthModeNone   = ""
+	AuthModeApiKey = "apikey"
+	AuthModeJwt    = "jwt"
+
+	DefaultUserClaim  = "sub"
+	DefaultScopeClaim = "scope"
+
+	ScopeImagesRead  = "images:read"
+	ScopeImagesWrite = "images:write"
+)
+
+type principalKey struct{}
+
+// Prefixes of placeholder secrets from example configs, application does not start with them
+var placeholderSecrets = []string{"change-me", "changeme"}
+
+func isPlaceholderSecret(secret string) bool {
+	lower := strings.ToLower(secret)
+	for _, placeholder := range placeholderSecrets {
+		if strings.HasPrefix(lower, placeholder) {
+			return true
+		}
+	}
+	return false
+}
+
+func ValidateAuth(cfg *dto.AuthConfig) error {
+	if isPlaceholderSecret(cfg.AdminKey) {
+		return fmt.Errorf("admin key is placeholder value from example config")
+	}
+	switch cfg.Mode {
+	case AuthModeNone:
+		return nil
+	case AuthModeApiKey:
+		// API keys are created only by admin endpoints
+		if len(cfg.AdminKey) == 0 {
+			return fmt.Errorf("admin key is not set")
+		}
+		return nil
+	case AuthModeJwt:
+		_, err := auth.NewJwtVerifier(&cfg.Jwt)
+		return err
+	default:
+		return fmt.Errorf("unknown auth mode %s", cfg.Mode)
+	}
+}
+
+func withPrincipal(ctx context.Context, principal *dto.PrincipalDto) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// Authenticated caller of request, nil if authentication is disabled
+func principalFromContext(ctx context.Context) *dto.PrincipalDto {
+	principal, _ := ctx.Value(principalKey{}).(*dto.PrincipalDto)
+	return principal
+}
+
+// User whose data is processed by request. Authenticated user can access only his own data,
+// so user id from request is replaced. Admin and requests without authentication keep user id from request
+func authorizedUserId(r *http.Request, requested string) string {
+	principal := principalFromContext(r.Context())
+	if principal == nil || principal.Admin {
+		return requested
+	}
+	return principal.UserId
+}
+
+// Check that authenticated caller can access data of user
+func canAccessUser(r *http.Request, userId string) bool {
+	principal := principalFromContext(r.Context())
+	return principal == nil || principal.Admin || principal.UserId == userId
+}
+
+// Middleware for authentication of caller by API key or JWT bearer token, depending on auth mode.
+// Admin key is accepted in all modes, so API keys can be managed before authentication enabled
+func (s *ApiServerRequestProcessor) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := s.apiKeyPrincipal(r.Context(), r.Header.Get(ApiKeyHeader))
+		if principal == nil && s.cfg.Auth.Mode == AuthModeJwt {
+			principal = s.jwtPrincipal(r.Header.Get("Authorization"))
+		}
+		if principal == nil && s.cfg.Auth.Mode != AuthModeNone {
+			s.log(r.Context()).Errorf("%s: %s", utils.ErrMsgUnauthorized, r.URL.Path)
+			s.writeAuthError(w, &processingError{http.StatusUnauthorized, utils.ErrUnauthorizedCode, utils.ErrMsgUnauthorized, nil})
+			return
+		}
+		if principal != nil {
+			r = r.WithContext(withPrincipal(r.Context(), principal))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Middleware for admin endpoints
+func (s *ApiServerRequestProcessor) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := principalFromContext(r.Context())
+		if principal == nil {
+			s.log(r.Context()).Errorf("%s: %s", utils.ErrMsgUnauthorized, r.URL.Path)
+			s.writeAuthError(w, &processingError{http.StatusUnauthorized, utils.ErrUnauthorizedCode, utils.ErrMsgUnauthorized, nil})
+			return
+		}
+		if !principal.Admin {
+			s.log(r.Context()).Errorf("%s: %s", utils.ErrMsgForbidden, r.URL.Path)
+			s.writeAuthError(w, &processingError{http.StatusForbidden, utils.ErrForbiddenCode, utils.ErrMsgForbidden, nil})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Middleware for routes which need scope, callers without limited scopes are allowed
+func (s *ApiServerRequestProcessor) RequireScope(scope string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := principalFromContext(r.Context())
+		if principal != nil && !principal.HasScope(scope) {
+			s.log(r.Context()).Errorf("%s: %s requires scope %s", utils.ErrMsgForbidden, r.URL.Path, scope)
+			s.writeAuthError(w, &processingError{http.StatusForbidden, utils.ErrForbiddenCode, utils.ErrMsgForbidden, nil})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Find principal by API key, nil if key is unknown
+func (s *ApiServerRequestProcessor) apiKeyPrincipal(ctx context.Context, key string) *dto.PrincipalDto {
+	if len(key) == 0 {
+		return nil
+	}
+	adminKey := s.cfg.Auth.AdminKey
+	if len(adminKey) > 0 && subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) == 1 {
+		return &dto.PrincipalDto{Admin: true}
+	}
+	if s.cfg.Auth.Mode != AuthModeApiKey {
+		return nil
+	}
+
+	apiKey := s.dbStore.GetApiKeyByHash(ctx, utils.HashApiKey(key))
+	if apiKey == nil {
+		return nil
+	}
+	return &dto.PrincipalDto{UserId: apiKey.UserId, KeyId: apiKey.Id}
+}
+
+// Find principal by bearer token from Authorization header, nil if token is invalid
+func (s *ApiServerRequestProcessor) jwtPrincipal(authorization string) *dto.PrincipalDto {
+	const bearerPrefix = "bearer "
+	if len(authorization) <= len(bearerPrefix) || !strings.EqualFold(authorization[:len(bearerPrefix)], bearerPrefix) {
+		return nil
+	}
+	if s.tokenVerifier == nil {
+		return nil
+	}
+
+	claims, err := s.tokenVerifier.Verify(strings.TrimSpace(authorization[len(bearerPrefix):]))
+	if err != nil {
+		s.logger.Warnf("Invalid bearer token: %v", err)
+		return nil
+	}
+
+	userClaim := s.cfg.Auth.Jwt.UserClaim
+	if len(userClaim) == 0 {
+		userClaim = DefaultUserClaim
+	}
+	userId, _ := claims[userClaim].(string)
+	if len(userId) == 0 {
+		s.logger.Warnf("Bearer token has no user claim %s", userClaim)
+		return nil
+	}
+
+	scopeClaim := s.cfg.Auth.Jwt.ScopeClaim
+	if len(scopeClaim) == 0 {
+		scopeClaim = DefaultScopeClaim
+	}
+	scopes := auth.StringsClaim(claims, scopeClaim)
+	if scopes == nil {
+		// token without scopes has no access to scoped routes
+		scopes = make([]string, 0)
+	}
+	return &dto.PrincipalDto{UserId: userId, Scopes: scopes}
+}
+
+func (s *ApiServerRequestProcessor) writeAuthError(w http.ResponseWriter, perr *processingError) {
+	w.Header().Set("Content-Type", "application/json")
+	writeErrStatus(w, perr)
+	answer := &http_response_dto.BaseResponseDto{ErrCode: perr.errCode, ErrMsg: perr.errMsg}
+	err := json.NewEncoder(w).Encode(answer)
+	if err != nil {
+		s.logger.Errorf("Cannot send response: %v", err)
+	}
+}
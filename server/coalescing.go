@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/service/metrics"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Concurrent requests of the same missing variant are coalesced by canonical variant key:
+// only the first request runs resize workflow, others wait for its result.
+// With Coalescing.DistributedLock workflow also holds lock in DbStore, so instances do not generate
+// the same variant at once. Uploads are not coalesced, every upload carries its own original
+
+const (
+	DefaultCoalescingLockTtl  = 2 * time.Minute
+	DefaultCoalescingLockWait = 30 * time.Second
+
+	// period of variant lookups while its lock is held by other instance
+	lockPollInterval = 200 * time.Millisecond
+)
+
+// Result of variant generation shared by coalesced requests.
+// Content is empty if variant was generated by other instance or finished request
+type variantResult struct {
+	img     *dto.DbImageStoreDAO
+	content []byte
+	perr    *processingError
+}
+
+type variantFlight struct {
+	done   chan struct{}
+	result *variantResult
+}
+
+// generations of variants in progress by key
+type variantFlights struct {
+	mu      sync.Mutex
+	flights map[string]*variantFlight
+}
+
+// Run fn once for all concurrent calls with the same key, shared is true for calls which got result of other call
+func (g *variantFlights) do(key string, fn func() *variantResult) (result *variantResult, shared bool) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return f.result, true
+	}
+	if g.flights == nil {
+		g.flights = map[string]*variantFlight{}
+	}
+	f := &variantFlight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	// waiting calls are released even if fn panics
+	defer func() {
+		if f.result == nil {
+			f.result = &variantResult{perr: &processingError{http.StatusInternalServerError, utils.ErrCannotResizeImageCode, utils.ErrMsgCannotResizeImage, nil}}
+		}
+		g.mu.Lock()
+		delete(g.flights, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+
+	f.result = fn()
+	return f.result, false
+}
+
+// Canonical key of variant, requests answered by the same DB record have the same key.
+// Variants of different users are never shared, so ownership checks of workflow are not skipped
+func variantKey(userId string, imageId uint32, variant *dto.VariantDto) string {
+	mode := variant.Mode
+	if len(mode) == 0 {
+		mode = dto.ResizeModeResize
+	}
+	return fmt.Sprintf("%s/%d/%dx%d/%s/%s/%d", userId, imageId, variant.Width, variant.Height, mode, variant.Format, variant.Quality)
+}
+
+// Generate missing variant once for all concurrent requests.
+// Generation is not bound to request which started it, so disconnect of its client does not fail waiting requests.
+// It is limited by Coalescing.LockTtl like lock of variant
+func (s *ApiServerRequestProcessor) generateVariantOnce(
+	ctx context.Context,
+	userId string,
+	imageId uint32,
+	variant *dto.VariantDto,
+	logEntity *logrus.Entry,
+	generate func(ctx context.Context) *variantResult) *variantResult {
+
+	key := variantKey(userId, imageId, variant)
+	result, shared := s.variantFlights.do(key, func() *variantResult {
+		timeout := s.cfg.Coalescing.LockTtl.Duration
+		if timeout <= 0 {
+			timeout = DefaultCoalescingLockTtl
+		}
+		flightCtx := detachedContext(ctx)
+		if isWithinWorker(ctx) {
+			// generation started by job is already executed by worker
+			flightCtx = withinWorker(flightCtx)
+		}
+		ctx, cancel := context.WithTimeout(flightCtx, timeout)
+		defer cancel()
+
+		release, exist := s.lockVariant(ctx, key, userId, imageId, variant, logEntity)
+		defer release()
+		if exist != nil {
+			return &variantResult{img: exist}
+		}
+		// variant could be generated by finished request or other instance after it was looked up
+		if exist = s.dbStore.GetImage(ctx, userId, imageId, variant); exist != nil {
+			return &variantResult{img: exist}
+		}
+		return generate(ctx)
+	})
+
+	if shared {
+		metrics.CoalescedRequests.Inc()
+		logEntity.Info("Variant generated by concurrent request")
+	}
+	return result
+}
+
+// Take lock of variant in DbStore. While lock is held by other instance, variant is looked up in DB until it appears.
+// If lock cannot be taken in Coalescing.LockWait or DbStore fails, variant is generated without lock
+func (s *ApiServerRequestProcessor) lockVariant(
+	ctx context.Context,
+	key string,
+	userId string,
+	imageId uint32,
+	variant *dto.VariantDto,
+	logEntity *logrus.Entry) (release func(), exist *dto.DbImageStoreDAO) {
+
+	release = func() {}
+	cfg := s.cfg.Coalescing
+	if !cfg.DistributedLock {
+		return release, nil
+	}
+	ttl := cfg.LockTtl.Duration
+	if ttl <= 0 {
+		ttl = DefaultCoalescingLockTtl
+	}
+	wait := cfg.LockWait.Duration
+	if wait <= 0 {
+		wait = DefaultCoalescingLockWait
+	}
+
+	owner, err := utils.GenerateRandomId()
+	if err != nil {
+		logEntity.Warnf("Cannot generate owner of variant lock, generating variant without lock: %v", err)
+		return release, nil
+	}
+	lockKey := "variant/" + key
+	deadline := time.Now().Add(wait)
+	for {
+		acquired, err := s.dbStore.AcquireLock(ctx, lockKey, owner, ttl)
+		if err != nil {
+			logEntity.Warnf("Cannot acquire lock of variant, generating variant without lock: %v", err)
+			return release, nil
+		}
+		if acquired {
+			return func() {
+				if err := s.dbStore.ReleaseLock(ctx, lockKey, owner); err != nil {
+					logEntity.Warnf("Cannot release lock of variant, it expires in %s: %v", ttl, err)
+				}
+			}, nil
+		}
+
+		if exist = s.dbStore.GetImage(ctx, userId, imageId, variant); exist != nil {
+			return release, exist
+		}
+		if time.Now().After(deadline) {
+			logEntity.Warn("Variant is not generated by other instance in time, generating variant without lock")
+			return release, nil
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"path/filepath"
+)
+
+// Check that every eager preset is defined in presets section
+func ValidateEagerPresets(cfg *dto.Config) error {
+	for _, name := range cfg.Eager.Presets {
+		if _, ok := cfg.Presets[name]; !ok {
+			return fmt.Errorf("eager preset %q is not defined", name)
+		}
+	}
+	return nil
+}
+
+// Variants of eager presets for original image
+// Presets without format are made in format of original image
+func (s *ApiServerRequestProcessor) eagerVariants(filename string) []*dto.VariantDto {
+	origFormat, _ := utils.NormalizeImageFormat(filepath.Ext(filename))
+	variants := make([]*dto.VariantDto, 0, len(s.cfg.Eager.Presets))
+	for _, name := range s.cfg.Eager.Presets {
+		variant := presetVariant(name, s.cfg.Presets[name])
+		if len(variant.Format) == 0 {
+			variant.Format = origFormat
+		}
+		variants = append(variants, variant)
+	}
+	return variants
+}
+
+// Delivery urls of planned variants
+func (s *ApiServerRequestProcessor) planVariantUrls(userId string, imageId uint32, variants []*dto.VariantDto) []*http_response_dto.PresetVariantDto {
+	expiresAt := s.defaultUrlExpiry()
+	planned := make([]*http_response_dto.PresetVariantDto, 0, len(variants))
+	for _, v := range variants {
+		planned = append(planned, &http_response_dto.PresetVariantDto{
+			Preset: v.Preset,
+			Width:  v.Width,
+			Height: v.Height,
+			Format: v.Format,
+			Url:    s.deliveryUrl(userId, imageId, v, expiresAt),
+		})
+	}
+	return planned
+}
+
+// Plan variants of eager presets for just uploaded original and generate them from the same decoded image.
+// Planned urls are returned immediately, in async mode variants are generated in background
+func (s *ApiServerRequestProcessor) processEagerPresets(
+	ctx context.Context,
+	src *sourceImage,
+	imageId uint32,
+	userId string,
+	originalImagePath string,
+	logEntity *logrus.Entry) []*http_response_dto.PresetVariantDto {
+
+	if len(s.cfg.Eager.Presets) == 0 {
+		return nil
+	}
+
+	variants := s.eagerVariants(src.name)
+	planned := s.planVariantUrls(userId, imageId, variants)
+
+	if s.cfg.Eager.Async {
+		// request context is finished after response sent
+		asyncCtx := detachedContext(ctx)
+		s.backgroundTasks.Add(1)
+		err := s.workers.Submit(func() {
+			defer s.backgroundTasks.Done()
+			s.generateVariants(asyncCtx, src, variants, imageId, userId, originalImagePath, logEntity)
+		})
+		if err != nil {
+			s.backgroundTasks.Done()
+			logEntity.Warnf("Eager presets skipped, they will be generated on first delivery request: %v", err)
+		}
+		return planned
+	}
+
+	paths := s.generateVariants(ctx, src, variants, imageId, userId, originalImagePath, logEntity)
+	for i, p := range planned {
+		p.ResizedImagePath = paths[i]
+	}
+	return planned
+}
+
+// Generate variants which were not processed before, return cloud paths of variants.
+// Failed variant has empty path, it will be generated on first delivery request
+func (s *ApiServerRequestProcessor) generateVariants(
+	ctx context.Context,
+	src *sourceImage,
+	variants []*dto.VariantDto,
+	imageId uint32,
+	userId string,
+	originalImagePath string,
+	logEntity *logrus.Entry) []string {
+
+	paths := make([]string, len(variants))
+	for i, variant := range variants {
+		logEntry := logEntity.WithField("Preset", variant.Preset)
+
+		if exist := s.findVariant(ctx, userId, imageId, variant); exist != nil {
+			paths[i] = exist.ResizedImageUrl
+			continue
+		}
+
+		answer := &http_response_dto.ResizeImageResponseDto{}
+		answer.OriginalImagePath = originalImagePath
+		_, perr := s.processImageResizeWorkflow(ctx, src, variant, imageId, userId, answer, logEntry, false)
+		if perr != nil {
+			logEntry.Errorf("Cannot generate preset variant: %s", perr.errMsg)
+			continue
+		}
+		paths[i] = answer.ResizedImagePath
+		logEntry.Info("Preset variant generated")
+	}
+	return paths
+}
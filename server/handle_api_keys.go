@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_request_dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// Function to handle admin request for new API key of user.
+// Key is returned only in this response, only its hash is stored
+func (s *ApiServerRequestProcessor) HandleCreateApiKeyRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	answer := &http_response_dto.ApiKeyResponseDto{}
+	jsonEncoder := json.NewEncoder(w)
+	s.log(r.Context()).Info("Got admin request")
+
+	if r.Body == nil {
+		s.log(r.Context()).Error(utils.ErrMsgEmptyRequest)
+		writeErrResponseApiKeyRequest(w, answer, http.StatusBadRequest, utils.ErrEmptyRequestCode, utils.ErrMsgEmptyRequest)
+		err := jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+
+	rDto := http_request_dto.ApiKeyRequestDto{}
+	err := json.NewDecoder(r.Body).Decode(&rDto)
+	if err != nil {
+		s.log(r.Context()).Errorf("Cannot parse request: %v", err)
+		writeErrResponseApiKeyRequest(w, answer, http.StatusBadRequest, utils.ErrCannotParseRequestParamsCode, utils.ErrMsgCannotParseRequestParams)
+		err = jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+
+	// validate user request after mapping
+	err = s.requestValidator.Validate(rDto)
+	if err != nil {
+		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgInvalidRequestParamValues, err)
+		s.log(r.Context()).Errorf(errMsg)
+		writeErrResponseApiKeyRequest(w, answer, http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg)
+		err = jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+	answer.UserId = rDto.UserId
+
+	key, err := utils.GenerateApiKey()
+	var keyId string
+	if err == nil {
+		keyId, err = utils.GenerateRandomId()
+	}
+	apiKey := &dto.ApiKeyDto{
+		Id:        keyId,
+		Name:      rDto.Name,
+		UserId:    rDto.UserId,
+		KeyHash:   utils.HashApiKey(key),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err == nil {
+		err = s.dbStore.InsertApiKey(r.Context(), apiKey)
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgSaveInfoToDB, err)
+		s.log(r.Context()).Errorf(errMsg)
+		writeErrResponseApiKeyRequest(w, answer, http.StatusInternalServerError, utils.ErrSaveInfoToDBCode, utils.ErrMsgSaveInfoToDB)
+		err = jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+
+	s.log(r.Context()).WithFields(logrus.Fields{
+		"UserId": apiKey.UserId,
+		"KeyId":  apiKey.Id,
+	}).Info("API key created")
+
+	answer.KeyId = apiKey.Id
+	answer.Name = apiKey.Name
+	answer.Key = key
+	answer.CreatedAt = apiKey.CreatedAt.Unix()
+
+	w.WriteHeader(http.StatusCreated)
+	err = jsonEncoder.Encode(answer)
+	if err != nil {
+		s.log(r.Context()).Errorf("Cannot send response: %v", err)
+	}
+}
+
+// Function to handle admin request for list of all API keys, keys themselves are not returned
+func (s *ApiServerRequestProcessor) HandleListApiKeysRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	answer := &http_response_dto.ApiKeysListResponseDto{}
+	jsonEncoder := json.NewEncoder(w)
+	s.log(r.Context()).Info("Got admin request")
+
+	keys := s.dbStore.FindAllApiKeys(r.Context())
+	if keys == nil {
+		s.log(r.Context()).Error(utils.ErrMsgCannotGetApiKeys)
+		writeErrResponseApiKeysListRequest(w, answer, http.StatusInternalServerError, utils.ErrCannotGetApiKeysCode, utils.ErrMsgCannotGetApiKeys)
+		err := jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+
+	answer.Keys = make([]*http_response_dto.ApiKeyInfoDto, 0, len(keys))
+	for _, key := range keys {
+		answer.Keys = append(answer.Keys, &http_response_dto.ApiKeyInfoDto{
+			KeyId:     key.Id,
+			Name:      key.Name,
+			UserId:    key.UserId,
+			CreatedAt: key.CreatedAt.Unix(),
+		})
+	}
+
+	err := jsonEncoder.Encode(answer)
+	if err != nil {
+		s.log(r.Context()).Errorf("Cannot send response: %v", err)
+	}
+}
+
+// Function to handle admin request for revoking API key
+func (s *ApiServerRequestProcessor) HandleDeleteApiKeyRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	answer := &http_response_dto.ApiKeyResponseDto{}
+	jsonEncoder := json.NewEncoder(w)
+	s.log(r.Context()).Info("Got admin request")
+
+	keyId := mux.Vars(r)["id"]
+	answer.KeyId = keyId
+
+	found, err := s.dbStore.DeleteApiKey(r.Context(), keyId)
+	if err != nil {
+		s.log(r.Context()).Errorf("Cannot delete API key %s: %v", keyId, err)
+		writeErrResponseApiKeyRequest(w, answer, http.StatusInternalServerError, utils.ErrSaveInfoToDBCode, utils.ErrMsgSaveInfoToDB)
+		err = jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+	if !found {
+		s.log(r.Context()).Errorf("%s: %s", utils.ErrMsgApiKeyNotFound, keyId)
+		writeErrResponseApiKeyRequest(w, answer, http.StatusNotFound, utils.ErrApiKeyNotFoundCode, utils.ErrMsgApiKeyNotFound)
+		err = jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+
+	s.log(r.Context()).WithField("KeyId", keyId).Info("API key deleted")
+	err = jsonEncoder.Encode(answer)
+	if err != nil {
+		s.log(r.Context()).Errorf("Cannot send response: %v", err)
+	}
+}
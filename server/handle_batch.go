@@ -0,0 +1,340 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_request_dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultBatchMaxItems    = 100
+	DefaultBatchMaxSize     = 500 << 20
+	DefaultBatchConcurrency = 4
+
+	NdjsonContentType = "application/x-ndjson"
+)
+
+// file of batch with all its sizes
+type batchFile struct {
+	// name of multipart file or path of archive entry, items of request are matched by it
+	name string
+	// content is read only when file is processed
+	read  func() ([]byte, error)
+	items []*batchItem
+}
+
+type batchItem struct {
+	index   int
+	size    *http_request_dto.SizeRequestDto
+	variant *dto.VariantDto
+}
+
+// Function to handle batch resize request: multipart with many files in 'files' parts and params.
+// Every file is resized to its own or shared sizes, result of every size is reported separately.
+// If client accepts application/x-ndjson, results are streamed in order of completion
+func (s *ApiServerRequestProcessor) HandleResizeBatchRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	answer := &http_response_dto.ResizeBatchResponseDto{}
+	s.log(r.Context()).Info("Got user request")
+
+	rDto, files, perr := s.parseResizeBatchRequest(w, r)
+	if perr != nil {
+		writeErrResponseBatchRequest(w, answer, perr.serverCode, perr.errCode, perr.errMsg)
+		if err := json.NewEncoder(w).Encode(answer); err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+	s.writeBatchResults(w, r, answer, rDto, files)
+}
+
+// Process batch and send results of all items, json response is sent after all items processed
+func (s *ApiServerRequestProcessor) writeBatchResults(w http.ResponseWriter, r *http.Request, answer *http_response_dto.ResizeBatchResponseDto,
+	rDto *http_request_dto.ResizeBatchRequestDto, files []*batchFile) {
+
+	answer.UserId = rDto.UserId
+	answer.RequestId = rDto.RequestId
+
+	if strings.Contains(r.Header.Get("Accept"), NdjsonContentType) {
+		w.Header().Set("Content-Type", NdjsonContentType)
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+		encoder := json.NewEncoder(w)
+		s.processResizeBatch(r.Context(), rDto, files, func(result *http_response_dto.ResizeBatchItemResultDto) {
+			if err := encoder.Encode(result); err != nil {
+				s.log(r.Context()).Errorf("Cannot send response: %v", err)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		})
+		return
+	}
+
+	s.processResizeBatch(r.Context(), rDto, files, func(result *http_response_dto.ResizeBatchItemResultDto) {
+		answer.Results = append(answer.Results, result)
+	})
+	sort.Slice(answer.Results, func(i, j int) bool {
+		return answer.Results[i].Index < answer.Results[j].Index
+	})
+	if err := json.NewEncoder(w).Encode(answer); err != nil {
+		s.log(r.Context()).Errorf("Cannot send response: %v", err)
+	}
+}
+
+// Read multipart batch request, resolve sizes of every file and check limits of batch
+func (s *ApiServerRequestProcessor) parseResizeBatchRequest(w http.ResponseWriter, r *http.Request) (
+	*http_request_dto.ResizeBatchRequestDto, []*batchFile, *processingError) {
+
+	maxSize := s.cfg.Batch.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultBatchMaxSize
+	}
+	if r.Body == nil {
+		s.log(r.Context()).Error(utils.ErrMsgEmptyRequest)
+		return nil, nil, &processingError{http.StatusBadRequest, utils.ErrEmptyRequestCode, utils.ErrMsgEmptyRequest, nil}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	if err := r.ParseMultipartForm(MaxUploadMemory); err != nil {
+		s.log(r.Context()).Errorf("Cannot pars multipart form: %v", err)
+		if isBodyTooLarge(err) {
+			return nil, nil, &processingError{http.StatusRequestEntityTooLarge, utils.ErrRequestTooLargeCode, utils.ErrMsgRequestTooLarge, nil}
+		}
+		return nil, nil, &processingError{http.StatusBadRequest, utils.ErrEmptyRequestCode, utils.ErrMsgEmptyRequest, nil}
+	}
+
+	params := r.FormValue("params")
+	if len(params) == 0 {
+		s.log(r.Context()).Error(utils.ErrMsgParamsNotSetInRequest)
+		return nil, nil, &processingError{http.StatusBadRequest, utils.ErrParamsNotSetInRequestCode, utils.ErrMsgParamsNotSetInRequest, nil}
+	}
+	rDto := &http_request_dto.ResizeBatchRequestDto{}
+	if err := json.Unmarshal([]byte(params), rDto); err != nil {
+		s.log(r.Context()).Errorf("%s : %v", utils.ErrMsgCannotParseRequestParams, err)
+		return nil, nil, &processingError{http.StatusBadRequest, utils.ErrCannotParseRequestParamsCode, utils.ErrMsgCannotParseRequestParams, nil}
+	}
+
+	headers := r.MultipartForm.File["files"]
+	if len(headers) == 0 {
+		s.log(r.Context()).Error(utils.ErrMsgFileNotFoundInRequest)
+		return nil, nil, &processingError{http.StatusBadRequest, utils.ErrFileNotFoundInRequestCode, utils.ErrMsgFileNotFoundInRequest, nil}
+	}
+
+	// authenticated user can resize only his own images
+	rDto.UserId = authorizedUserId(r, rDto.UserId)
+
+	files := make([]*batchFile, 0, len(headers))
+	for _, h := range headers {
+		files = append(files, &batchFile{name: h.Filename, read: multipartFileReader(h)})
+	}
+	maxItems := s.cfg.Batch.MaxItems
+	if maxItems <= 0 {
+		maxItems = DefaultBatchMaxItems
+	}
+	err := s.planBatch(rDto, files, maxItems)
+	if err == nil {
+		err = s.requestValidator.Validate(rDto.BaseRequestDto)
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgInvalidRequestParamValues, err)
+		s.log(r.Context()).Errorf(errMsg)
+		return nil, nil, &processingError{http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg, nil}
+	}
+	return rDto, files, nil
+}
+
+// Match files with their sizes, items are numbered in order of files and their sizes.
+// Zero maxItems means count of items is not limited
+func (s *ApiServerRequestProcessor) planBatch(rDto *http_request_dto.ResizeBatchRequestDto, files []*batchFile, maxItems int) error {
+	fileSizes := make(map[string][]*http_request_dto.SizeRequestDto, len(rDto.Items))
+	for _, item := range rDto.Items {
+		fileSizes[item.File] = item.Sizes
+	}
+	for name := range fileSizes {
+		found := false
+		for _, f := range files {
+			found = found || f.name == name
+		}
+		if !found {
+			return fmt.Errorf("file %q of items is not found in batch", name)
+		}
+	}
+
+	count := 0
+	for _, f := range files {
+		sizes, ok := fileSizes[f.name]
+		if !ok {
+			sizes = rDto.Sizes
+		}
+		if len(sizes) == 0 {
+			return fmt.Errorf("sizes of file %q are not set", f.name)
+		}
+
+		for _, size := range sizes {
+			if size == nil {
+				return fmt.Errorf("empty size of file %q", f.name)
+			}
+			// sizes can be shared by files, so every item resolves own copy
+			itemSize := *size
+			variant, err := s.resolveVariant(&itemSize)
+			if err == nil {
+				err = s.requestValidator.Validate(itemSize)
+			}
+			if err != nil {
+				return fmt.Errorf("file %q: %v", f.name, err)
+			}
+			f.items = append(f.items, &batchItem{index: count, size: &itemSize, variant: variant})
+			count++
+		}
+	}
+	if maxItems > 0 && count > maxItems {
+		return fmt.Errorf("batch has %d items, limit is %d", count, maxItems)
+	}
+	return nil
+}
+
+// Content of multipart file of batch
+func multipartFileReader(header *multipart.FileHeader) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		file, err := header.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return ioutil.ReadAll(file)
+	}
+}
+
+// Process files of batch by bounded count of goroutines, sizes of one file are processed one by one,
+// so file is decoded once. emit is called for every item result, calls are serialized
+func (s *ApiServerRequestProcessor) processResizeBatch(ctx context.Context, rDto *http_request_dto.ResizeBatchRequestDto, files []*batchFile,
+	emit func(result *http_response_dto.ResizeBatchItemResultDto)) {
+
+	concurrency := s.cfg.Batch.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+
+	var (
+		wg      sync.WaitGroup
+		emitMtx sync.Mutex
+	)
+	slots := make(chan struct{}, concurrency)
+	for _, f := range files {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(f *batchFile) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			s.processBatchFile(ctx, rDto, f, func(result *http_response_dto.ResizeBatchItemResultDto) {
+				emitMtx.Lock()
+				defer emitMtx.Unlock()
+				emit(result)
+			})
+		}(f)
+	}
+	wg.Wait()
+}
+
+// Resize one file of batch to all its sizes. Original is uploaded with first successful size
+func (s *ApiServerRequestProcessor) processBatchFile(ctx context.Context, rDto *http_request_dto.ResizeBatchRequestDto, f *batchFile,
+	emit func(result *http_response_dto.ResizeBatchItemResultDto)) {
+
+	var src *sourceImage
+	content, err := f.read()
+	if err != nil {
+		s.log(ctx).Errorf("%s %s: %v", utils.ErrMsgFileNotFoundInRequest, f.name, err)
+	} else {
+		// path of archive entry is not used in name of image
+		src = &sourceImage{name: path.Base(f.name), content: content}
+	}
+
+	originalPath := ""
+	for _, item := range f.items {
+		result := &http_response_dto.ResizeBatchItemResultDto{
+			Index:  item.index,
+			File:   f.name,
+			Width:  item.size.Width,
+			Height: item.size.Height,
+			Preset: item.size.Preset,
+		}
+		answer := &result.ResizeImageResponseDto
+		answer.UserId = rDto.UserId
+		answer.RequestId = rDto.RequestId
+
+		var perr *processingError
+		switch {
+		case src == nil:
+			perr = &processingError{http.StatusBadRequest, utils.ErrFileNotFoundInRequestCode, utils.ErrMsgFileNotFoundInRequest, err}
+		case len(originalPath) == 0:
+			itemDto := &http_request_dto.ResizeImageRequestParamsDto{BaseRequestDto: rDto.BaseRequestDto, SizeRequestDto: *item.size}
+			perr = s.runInPool(func() *processingError {
+				return s.processResizeRequest(ctx, itemDto, src, item.variant, answer)
+			})
+			if perr == nil {
+				originalPath = answer.OriginalImagePath
+			}
+		default:
+			perr = s.runInPool(func() *processingError {
+				return s.processBatchVariant(ctx, rDto, src, item.variant, originalPath, answer)
+			})
+		}
+		if perr != nil {
+			answer.ErrCode = perr.errCode
+			answer.ErrMsg = perr.errMsg
+		}
+		emit(result)
+	}
+}
+
+// Resize already uploaded original of batch file to one more size
+func (s *ApiServerRequestProcessor) processBatchVariant(
+	ctx context.Context,
+	rDto *http_request_dto.ResizeBatchRequestDto,
+	src *sourceImage,
+	variant *dto.VariantDto,
+	originalPath string,
+	answer *http_response_dto.ResizeImageResponseDto) *processingError {
+
+	imageId, err := utils.GenerateImageIdByOriginalName(src.name)
+	if err != nil {
+		errMsg := fmt.Sprintf("%s: %v", utils.ErrImageIdGenerate, err)
+		s.log(ctx).Errorf(errMsg)
+		return &processingError{http.StatusBadRequest, utils.ErrImageIdGenerateCode, errMsg, nil}
+	}
+	answer.ImageId = imageId
+
+	logEntry := s.log(ctx).WithFields(logrus.Fields{
+		"UserId":    rDto.UserId,
+		"RequestId": rDto.RequestId,
+		"Width":     variant.Width,
+		"Height":    variant.Height,
+		"Preset":    variant.Preset,
+		"Filename":  src.name,
+		"PictureId": imageId,
+	})
+
+	if exist := s.findVariant(ctx, rDto.UserId, imageId, variant); exist != nil {
+		logEntry.Warn("This picture already processed by the same request params")
+		answer.OriginalImagePath = exist.OriginalImageUrl
+		answer.ResizedImagePath = exist.ResizedImageUrl
+		return nil
+	}
+
+	answer.OriginalImagePath = originalPath
+	_, perr := s.processImageResizeWorkflow(ctx, src, variant, imageId, rDto.UserId, answer, logEntry, false)
+	return perr
+}
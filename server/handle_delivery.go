@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_request_dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DeliveryRoutePath = "/img/{user}/{image_id:[0-9]+}/{width:[0-9]+}x{height:[0-9]+}.{format:[a-zA-Z]+}"
+
+	DefaultDeliveryCacheControl = "public, max-age=86400"
+)
+
+// Function to handle on-the-fly image delivery request.
+// Looking for requested variant in DB, generate it from original image on a miss
+// and stream image bytes back with http caching headers (ETag, Last-Modified, Cache-Control).
+// Conditional and range requests are supported
+func (s *ApiServerRequestProcessor) HandleImageDeliveryRequest(w http.ResponseWriter, r *http.Request) {
+	answer := &http_response_dto.ResizeImageResponseDto{}
+	s.log(r.Context()).Info("Got user request")
+
+	var variant *dto.VariantDto
+	rDto, err := parseDeliveryRequestVars(mux.Vars(r))
+	if err == nil {
+		// validate user request after mapping
+		rDto.Preset = r.URL.Query().Get("preset")
+		err = s.requestValidator.Validate(rDto)
+	}
+	if err == nil {
+		rDto.Format, err = utils.NormalizeImageFormat(rDto.Format)
+	}
+	if err == nil {
+		variant, err = s.resolveDeliveryVariant(rDto)
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgInvalidRequestParamValues, err)
+		s.log(r.Context()).Errorf(errMsg)
+		s.writeDeliveryError(w, answer, &processingError{http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg, nil})
+		return
+	}
+
+	answer.UserId = rDto.UserId
+	answer.ImageId = rDto.ImageId
+
+	logEntry := s.log(r.Context()).WithFields(logrus.Fields{
+		"UserId":  rDto.UserId,
+		"ImageId": rDto.ImageId,
+		"Width":   rDto.Width,
+		"Height":  rDto.Height,
+		"Format":  rDto.Format,
+		"Preset":  rDto.Preset,
+	})
+
+	var (
+		content []byte
+		perr    *processingError
+	)
+
+	img := s.findVariant(r.Context(), rDto.UserId, rDto.ImageId, variant)
+	if img != nil {
+		// client already has actual version, nothing to download
+		if etagMatches(r.Header.Get("If-None-Match"), variantETag(img)) {
+			s.writeVariantHeaders(w, img)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		content, perr = s.loadVariant(r.Context(), img, logEntry)
+	} else {
+		logEntry.Info("Variant not found, generating it from original image")
+		result := s.generateVariantOnce(r.Context(), rDto.UserId, rDto.ImageId, variant, logEntry, func(ctx context.Context) *variantResult {
+			result := &variantResult{}
+			result.perr = s.runInPool(func() *processingError {
+				var gerr *processingError
+				result.img, result.content, gerr = s.generateVariant(ctx, rDto, variant, answer, logEntry)
+				return gerr
+			})
+			return result
+		})
+		img, content, perr = result.img, result.content, result.perr
+
+		// variant generated by other instance is found in DB, its content is downloaded
+		if perr == nil && content == nil {
+			content, perr = s.loadVariant(r.Context(), img, logEntry)
+		}
+	}
+
+	if perr != nil {
+		s.writeDeliveryError(w, answer, perr)
+		return
+	}
+
+	s.writeVariantHeaders(w, img)
+	http.ServeContent(w, r, path.Base(img.ResizedImageUrl), img.CreatedAt, bytes.NewReader(content))
+}
+
+// download already processed variant from cloud store
+func (s *ApiServerRequestProcessor) loadVariant(ctx context.Context, img *dto.DbImageStoreDAO, logEntity *logrus.Entry) ([]byte, *processingError) {
+	if content := s.cachedVariant(img.UserId, img.ResizedImageUrl); content != nil {
+		return content, nil
+	}
+
+	file, err := s.cloudStore.Download(ctx, img.ResizedImageUrl, img.UserId, img.PicId)
+	if err != nil {
+		logEntity.Errorf("Cannot download image from cloud store: %v", err)
+		return nil, downloadError(err, http.StatusInternalServerError)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		logEntity.Errorf("Cannot read downloaded image: %v", err)
+		return nil, &processingError{http.StatusInternalServerError, utils.ErrLoadFileCode, utils.ErrMsgLoadFile, nil}
+	}
+	s.cacheVariant(img.UserId, img.ResizedImageUrl, content)
+	return content, nil
+}
+
+// resize original image using main workflow and return info about new variant with its bytes
+func (s *ApiServerRequestProcessor) generateVariant(
+	ctx context.Context,
+	rDto *http_request_dto.ImageDeliveryRequestDto,
+	variant *dto.VariantDto,
+	answer *http_response_dto.ResizeImageResponseDto,
+	logEntity *logrus.Entry) (*dto.DbImageStoreDAO, []byte, *processingError) {
+
+	orig, err := s.dbStore.GetImageByImageId(ctx, rDto.UserId, rDto.ImageId)
+	if err != nil {
+		logEntity.Errorf("Cannot find original image: %v", err)
+		return nil, nil, imageLookupError(err, http.StatusNotFound)
+	}
+
+	src, perr := s.loadOriginal(ctx, rDto.UserId, rDto.ImageId, orig.OriginalImageUrl, http.StatusInternalServerError, logEntity)
+	if perr != nil {
+		return nil, nil, perr
+	}
+
+	answer.OriginalImagePath = orig.OriginalImageUrl
+	content, perr := s.processImageResizeWorkflow(ctx, src, variant, rDto.ImageId, rDto.UserId, answer, logEntity, false)
+	if perr != nil {
+		return nil, nil, perr
+	}
+	s.cacheOriginal(rDto.UserId, orig.OriginalImageUrl, src)
+	s.cacheVariant(rDto.UserId, answer.ResizedImagePath, content)
+
+	return &dto.DbImageStoreDAO{
+		UserId:           rDto.UserId,
+		PicId:            rDto.ImageId,
+		OriginalImageUrl: orig.OriginalImageUrl,
+		ResizedImageUrl:  answer.ResizedImagePath,
+		ResizedWidth:     variant.Width,
+		ResizedHeight:    variant.Height,
+		Format:           variant.Format,
+		Mode:             variant.Mode,
+		Quality:          variant.Quality,
+		Preset:           variant.Preset,
+		ResizedSize:      int64(len(content)),
+		CreatedAt:        time.Now().UTC(),
+	}, content, nil
+}
+
+// Build variant params of delivery request. Size and format in path
+// should match preset if it set, so one variant is never served by different urls
+func (s *ApiServerRequestProcessor) resolveDeliveryVariant(rDto *http_request_dto.ImageDeliveryRequestDto) (*dto.VariantDto, error) {
+	if len(rDto.Preset) == 0 {
+		return &dto.VariantDto{Width: rDto.Width, Height: rDto.Height, Format: rDto.Format}, nil
+	}
+	p, ok := s.cfg.Presets[rDto.Preset]
+	if !ok {
+		return nil, fmt.Errorf("unknown preset %q", rDto.Preset)
+	}
+	variant := presetVariant(rDto.Preset, p)
+	if len(variant.Format) == 0 {
+		variant.Format = rDto.Format
+	}
+	if variant.Width != rDto.Width || variant.Height != rDto.Height || variant.Format != rDto.Format {
+		return nil, fmt.Errorf("url does not match preset %q", rDto.Preset)
+	}
+	return variant, nil
+}
+
+func (s *ApiServerRequestProcessor) writeVariantHeaders(w http.ResponseWriter, img *dto.DbImageStoreDAO) {
+	cacheControl := s.cfg.Delivery.CacheControl
+	if len(cacheControl) == 0 {
+		cacheControl = DefaultDeliveryCacheControl
+	}
+	w.Header().Set("ETag", variantETag(img))
+	w.Header().Set("Cache-Control", cacheControl)
+	if len(img.Format) > 0 {
+		w.Header().Set("Content-Type", "image/"+img.Format)
+	}
+}
+
+func (s *ApiServerRequestProcessor) writeDeliveryError(w http.ResponseWriter, answer *http_response_dto.ResizeImageResponseDto, perr *processingError) {
+	w.Header().Set("Content-Type", "application/json")
+	writeErrResponseResizeRequest(w, answer, perr)
+	err := json.NewEncoder(w).Encode(answer)
+	if err != nil {
+		s.logger.Errorf("Cannot send response: %v", err)
+	}
+}
+
+func parseDeliveryRequestVars(vars map[string]string) (*http_request_dto.ImageDeliveryRequestDto, error) {
+	imageId, err := strconv.ParseUint(vars["image_id"], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	width, err := strconv.Atoi(vars["width"])
+	if err != nil {
+		return nil, err
+	}
+	height, err := strconv.Atoi(vars["height"])
+	if err != nil {
+		return nil, err
+	}
+	return &http_request_dto.ImageDeliveryRequestDto{
+		SizeRequestDto: http_request_dto.SizeRequestDto{Width: width, Height: height},
+		UserId:         vars["user"],
+		ImageId:        uint32(imageId),
+		Format:         vars["format"],
+	}, nil
+}
+
+// Variant stored by unique cloud path and never changed after upload,
+// so path hash is used as strong entity tag
+func variantETag(img *dto.DbImageStoreDAO) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(img.ResizedImageUrl))
+	return fmt.Sprintf("\"%x\"", h.Sum64())
+}
+
+// check If-None-Match header value against entity tag
+func etagMatches(header, etag string) bool {
+	if len(header) == 0 {
+		return false
+	}
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
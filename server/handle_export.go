@@ -0,0 +1,168 @@
+package server
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/schema"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_request_dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// name of file with description of exported images, it is the last entry of archive
+const ExportManifestName = "manifest.json"
+
+// Function to handle export of user library. Response is ZIP archive streamed while files are downloaded
+// from cloud store: originals and variants are grouped in directories by image id, manifest.json describes them.
+// File which cannot be downloaded is skipped and its error is written to manifest
+func (s *ApiServerRequestProcessor) HandleExportRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	answer := &http_response_dto.BaseResponseDto{}
+	s.log(r.Context()).Info("Got user request")
+
+	rDto := http_request_dto.BaseRequestDto{}
+	err := schema.NewDecoder().Decode(&rDto, r.URL.Query())
+	if err == nil {
+		// authenticated user can export only his own images
+		rDto.UserId = authorizedUserId(r, rDto.UserId)
+		err = s.requestValidator.Validate(rDto)
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgInvalidRequestParamValues, err)
+		s.log(r.Context()).Errorf(errMsg)
+		writeErrResponseExportRequest(w, answer, http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg)
+		if err = json.NewEncoder(w).Encode(answer); err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+	answer.UserId = rDto.UserId
+	answer.RequestId = rDto.RequestId
+
+	logEntity := s.log(r.Context()).WithFields(logrus.Fields{
+		"userId":    rDto.UserId,
+		"requestId": rDto.RequestId,
+	})
+
+	logEntity.Info("Searching user images in DB")
+	allImgs := s.dbStore.FindAllPictureByUserId(r.Context(), rDto.UserId)
+	if allImgs == nil {
+		logEntity.Error(utils.ErrMsgCannotGetUserImages)
+		writeErrResponseExportRequest(w, answer, http.StatusInternalServerError, utils.ErrCannotGetUserImagesCode, utils.ErrMsgCannotGetUserImages)
+		if err = json.NewEncoder(w).Encode(answer); err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+	logEntity.Infof("Found records in DB: %d", len(allImgs))
+
+	// status is sent with first bytes of archive, errors after that can only break the stream
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="export-%s.zip"`, rDto.UserId))
+	w.WriteHeader(http.StatusOK)
+
+	if err = s.writeExportArchive(r.Context(), w, rDto.UserId, allImgs, logEntity); err != nil {
+		logEntity.Errorf("Cannot send export archive: %v", err)
+	}
+}
+
+// Write archive with originals, variants and manifest. Original is shared by all records of image
+func (s *ApiServerRequestProcessor) writeExportArchive(ctx context.Context, w io.Writer, userId string, imgs []*dto.DbImageStoreDAO, logEntity *logrus.Entry) error {
+	archive := zip.NewWriter(w)
+	manifest := &http_response_dto.ExportManifestDto{
+		UserId:     userId,
+		ExportedAt: time.Now().UTC(),
+		Images:     make([]*http_response_dto.ExportImageDto, 0),
+	}
+	exported := map[uint32]*http_response_dto.ExportImageDto{}
+	written := map[string]bool{}
+
+	for _, img := range imgs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		image := exported[img.PicId]
+		if image == nil {
+			image = &http_response_dto.ExportImageDto{ImageId: img.PicId, Variants: make([]*http_response_dto.ExportVariantDto, 0)}
+			exported[img.PicId] = image
+			manifest.Images = append(manifest.Images, image)
+
+			image.Original = &http_response_dto.ExportFileDto{Url: img.OriginalImageUrl}
+			if err := s.exportFile(ctx, archive, img, img.OriginalImageUrl, image.Original, written, logEntity); err != nil {
+				return err
+			}
+		}
+		if len(img.ResizedImageUrl) == 0 {
+			continue
+		}
+
+		variant := &http_response_dto.ExportVariantDto{
+			ExportFileDto: http_response_dto.ExportFileDto{Url: img.ResizedImageUrl},
+			Width:         img.ResizedWidth,
+			Height:        img.ResizedHeight,
+			Format:        img.Format,
+			Mode:          img.Mode,
+			Quality:       img.Quality,
+			Preset:        img.Preset,
+			CreatedAt:     img.CreatedAt,
+		}
+		image.Variants = append(image.Variants, variant)
+		if err := s.exportFile(ctx, archive, img, img.ResizedImageUrl, &variant.ExportFileDto, written, logEntity); err != nil {
+			return err
+		}
+	}
+	entry, err := archive.Create(ExportManifestName)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(manifest); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// Download file from cloud store and copy it to archive. Download error is kept in manifest,
+// error of archive writing is returned because stream is broken
+func (s *ApiServerRequestProcessor) exportFile(ctx context.Context, archive *zip.Writer, img *dto.DbImageStoreDAO, url string,
+	fileDto *http_response_dto.ExportFileDto, written map[string]bool, logEntity *logrus.Entry) error {
+
+	file, err := s.cloudStore.Download(ctx, url, img.UserId, img.PicId)
+	if err != nil {
+		logEntity.Warnf("Cannot download %q from cloud store: %v", url, err)
+		fileDto.Error = fmt.Sprintf("%s: %v", utils.ErrMsgLoadFile, err)
+		return nil
+	}
+	// delete downloaded file from FS
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	name := fmt.Sprintf("%d/%s", img.PicId, path.Base(url))
+	for i := 1; written[name]; i++ {
+		ext := path.Ext(url)
+		name = fmt.Sprintf("%d/%s_%d%s", img.PicId, path.Base(url[:len(url)-len(ext)]), i, ext)
+	}
+
+	entry, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(entry, file)
+	if err != nil {
+		return err
+	}
+	written[name] = true
+	fileDto.Path = name
+	fileDto.Size = size
+	return nil
+}
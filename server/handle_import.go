@@ -0,0 +1,205 @@
+package server
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto/http_request_dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/utils"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	DefaultImportMaxSize      = 500 << 20
+	DefaultImportMaxEntries   = 500
+	DefaultImportMaxEntrySize = 50 << 20
+	DefaultImportMaxTotalSize = 1 << 30
+	DefaultImportMaxItems     = 1000
+)
+
+// Function to handle import of ZIP archive with images. Archive is sent in 'file' part of multipart request,
+// params are the same as params of batch resize, items are matched by path of entry in archive.
+// Every image entry is processed like file of batch, results have the same format
+func (s *ApiServerRequestProcessor) HandleImportRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	answer := &http_response_dto.ResizeBatchResponseDto{}
+	s.log(r.Context()).Info("Got user request")
+
+	rDto, files, archiveFile, perr := s.parseImportRequest(w, r)
+	if perr != nil {
+		writeErrResponseBatchRequest(w, answer, perr.serverCode, perr.errCode, perr.errMsg)
+		if err := json.NewEncoder(w).Encode(answer); err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+	// archive entries are read from multipart file while items are processed
+	defer archiveFile.Close()
+	s.writeBatchResults(w, r, answer, rDto, files)
+}
+
+// Read multipart request with archive and check archive entries against limits
+func (s *ApiServerRequestProcessor) parseImportRequest(w http.ResponseWriter, r *http.Request) (
+	rDto *http_request_dto.ResizeBatchRequestDto, files []*batchFile, file multipart.File, perr *processingError) {
+
+	maxSize := s.cfg.Import.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultImportMaxSize
+	}
+	if r.Body == nil {
+		s.log(r.Context()).Error(utils.ErrMsgEmptyRequest)
+		return nil, nil, nil, &processingError{http.StatusBadRequest, utils.ErrEmptyRequestCode, utils.ErrMsgEmptyRequest, nil}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	if err := r.ParseMultipartForm(MaxUploadMemory); err != nil {
+		s.log(r.Context()).Errorf("Cannot pars multipart form: %v", err)
+		if isBodyTooLarge(err) {
+			return nil, nil, nil, &processingError{http.StatusRequestEntityTooLarge, utils.ErrRequestTooLargeCode, utils.ErrMsgRequestTooLarge, nil}
+		}
+		return nil, nil, nil, &processingError{http.StatusBadRequest, utils.ErrEmptyRequestCode, utils.ErrMsgEmptyRequest, nil}
+	}
+
+	upload, handler, err := r.FormFile("file")
+	if err != nil {
+		s.log(r.Context()).Errorf("%s : %v", utils.ErrMsgFileNotFoundInRequest, err)
+		return nil, nil, nil, &processingError{http.StatusBadRequest, utils.ErrFileNotFoundInRequestCode, utils.ErrMsgFileNotFoundInRequest, nil}
+	}
+	defer func() {
+		if perr != nil {
+			upload.Close()
+		}
+	}()
+
+	params := r.FormValue("params")
+	if len(params) == 0 {
+		s.log(r.Context()).Error(utils.ErrMsgParamsNotSetInRequest)
+		return nil, nil, nil, &processingError{http.StatusBadRequest, utils.ErrParamsNotSetInRequestCode, utils.ErrMsgParamsNotSetInRequest, nil}
+	}
+	rDto = &http_request_dto.ResizeBatchRequestDto{}
+	if err := json.Unmarshal([]byte(params), rDto); err != nil {
+		s.log(r.Context()).Errorf("%s : %v", utils.ErrMsgCannotParseRequestParams, err)
+		return nil, nil, nil, &processingError{http.StatusBadRequest, utils.ErrCannotParseRequestParamsCode, utils.ErrMsgCannotParseRequestParams, nil}
+	}
+
+	// authenticated user can import only to his own library
+	rDto.UserId = authorizedUserId(r, rDto.UserId)
+
+	archive, err := zip.NewReader(upload, handler.Size)
+	if err != nil {
+		errMsg := fmt.Sprintf("%s: file is not ZIP archive: %v", utils.ErrMsgInvalidRequestParamValues, err)
+		s.log(r.Context()).Errorf(errMsg)
+		return nil, nil, nil, &processingError{http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg, nil}
+	}
+	files, perr = s.archiveImages(archive)
+	if perr != nil {
+		s.log(r.Context()).Errorf(perr.errMsg)
+		return nil, nil, nil, perr
+	}
+	if len(files) == 0 {
+		s.log(r.Context()).Error("Archive has no images")
+		return nil, nil, nil, &processingError{http.StatusBadRequest, utils.ErrFileNotFoundInRequestCode, utils.ErrMsgFileNotFoundInRequest, nil}
+	}
+
+	maxItems := s.cfg.Import.MaxItems
+	if maxItems <= 0 {
+		maxItems = DefaultImportMaxItems
+	}
+	err = s.planBatch(rDto, files, maxItems)
+	if err == nil {
+		err = s.requestValidator.Validate(rDto.BaseRequestDto)
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgInvalidRequestParamValues, err)
+		s.log(r.Context()).Errorf(errMsg)
+		return nil, nil, nil, &processingError{http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg, nil}
+	}
+	return rDto, files, upload, nil
+}
+
+// Image entries of archive. Directories, hidden and not image files are skipped.
+// Archive with unsafe entry path or exceeding limits is rejected as a whole
+func (s *ApiServerRequestProcessor) archiveImages(archive *zip.Reader) ([]*batchFile, *processingError) {
+	maxEntries := s.cfg.Import.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = DefaultImportMaxEntries
+	}
+	maxEntrySize := s.cfg.Import.MaxEntrySize
+	if maxEntrySize <= 0 {
+		maxEntrySize = DefaultImportMaxEntrySize
+	}
+	maxTotalSize := s.cfg.Import.MaxTotalSize
+	if maxTotalSize <= 0 {
+		maxTotalSize = DefaultImportMaxTotalSize
+	}
+
+	files := make([]*batchFile, 0)
+	var totalSize uint64
+	for _, entry := range archive.File {
+		if !isSafeEntryPath(entry.Name) {
+			errMsg := fmt.Sprintf("%s: unsafe path of archive entry %q", utils.ErrMsgInvalidRequestParamValues, entry.Name)
+			return nil, &processingError{http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg, nil}
+		}
+		if !isImageEntry(entry) {
+			continue
+		}
+
+		if len(files) == maxEntries {
+			errMsg := fmt.Sprintf("%s: archive has more than %d images", utils.ErrMsgInvalidRequestParamValues, maxEntries)
+			return nil, &processingError{http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg, nil}
+		}
+		totalSize += entry.UncompressedSize64
+		if entry.UncompressedSize64 > uint64(maxEntrySize) || totalSize > uint64(maxTotalSize) {
+			return nil, &processingError{http.StatusRequestEntityTooLarge, utils.ErrRequestTooLargeCode, utils.ErrMsgRequestTooLarge, nil}
+		}
+		files = append(files, &batchFile{name: entry.Name, read: archiveEntryReader(entry, maxEntrySize)})
+	}
+	return files, nil
+}
+
+// Content of archive entry. Size in entry header can be forged, so content is limited while reading
+func archiveEntryReader(entry *zip.File, maxSize int64) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		reader, err := entry.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		content, err := ioutil.ReadAll(io.LimitReader(reader, maxSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(content)) > maxSize {
+			return nil, fmt.Errorf("entry is larger than %d bytes", maxSize)
+		}
+		return content, nil
+	}
+}
+
+// Entry path must be relative and stay inside of archive root (zip slip)
+func isSafeEntryPath(name string) bool {
+	if len(name) == 0 || strings.Contains(name, "\\") || strings.Contains(name, ":") || path.IsAbs(name) {
+		return false
+	}
+	cleaned := path.Clean(name)
+	return cleaned != ".." && !strings.HasPrefix(cleaned, "../")
+}
+
+// Files of supported image formats, metadata of archivers (like __MACOSX/ and .DS_Store) is skipped
+func isImageEntry(entry *zip.File) bool {
+	if entry.FileInfo().IsDir() || strings.HasPrefix(entry.Name, "__MACOSX/") {
+		return false
+	}
+	base := path.Base(entry.Name)
+	if strings.HasPrefix(base, ".") {
+		return false
+	}
+	_, err := utils.NormalizeImageFormat(path.Ext(base))
+	return err == nil
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/service/tracing"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resize workflow of job, fills result by processing results
+type jobTask func(ctx context.Context, result *http_response_dto.ResizeImageResponseDto) *processingError
+
+type stageReporterKey struct{}
+
+// Add to context function which is called on every workflow stage
+func withStageReporter(ctx context.Context, report func(stage string)) context.Context {
+	return context.WithValue(ctx, stageReporterKey{}, report)
+}
+
+// Report workflow stage, if context has stage reporter
+func reportStage(ctx context.Context, stage string) {
+	if report, ok := ctx.Value(stageReporterKey{}).(func(string)); ok {
+		report(stage)
+	}
+}
+
+// Function to handle user request for asynchronous resizing.
+// Request has the same format as /resize (multipart with file and params)
+// or /resize-by-id (json). Job is queued and its id is returned immediately
+func (s *ApiServerRequestProcessor) HandleCreateJobRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	answer := &http_response_dto.JobResponseDto{}
+	jsonEncoder := json.NewEncoder(w)
+	s.log(r.Context()).Info("Got user request")
+
+	var (
+		task        jobTask
+		userId      string
+		requestId   string
+		callbackUrl string
+		perr        *processingError
+	)
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		rDto, src, variant, err := s.parseResizeRequest(w, r)
+		if err == nil {
+			userId, requestId, callbackUrl = rDto.UserId, rDto.RequestId, rDto.CallbackUrl
+			task = func(ctx context.Context, result *http_response_dto.ResizeImageResponseDto) *processingError {
+				return s.processResizeRequest(ctx, rDto, src, variant, result)
+			}
+		}
+		perr = err
+	} else {
+		rDto, variant, err := s.parseResizeByIdRequest(r)
+		if err == nil {
+			userId, requestId, callbackUrl = rDto.UserId, rDto.RequestId, rDto.CallbackUrl
+			task = func(ctx context.Context, result *http_response_dto.ResizeImageResponseDto) *processingError {
+				result.ImageId = rDto.ImageId
+				return s.processResizeByIdRequest(ctx, rDto, variant, result)
+			}
+		}
+		perr = err
+	}
+
+	if perr != nil {
+		writeErrResponseJobRequest(w, answer, perr.serverCode, perr.errCode, perr.errMsg)
+		err := jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+
+	// save it for response identification on outside
+	answer.UserId = userId
+	answer.RequestId = requestId
+
+	jobId, err := utils.GenerateRandomId()
+	now := time.Now().UTC()
+	job := &dto.JobDto{
+		Id:          jobId,
+		UserId:      userId,
+		RequestId:   requestId,
+		State:       dto.JobStateQueued,
+		Stage:       dto.JobStageQueued,
+		CallbackUrl: callbackUrl,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err == nil {
+		err = s.jobStore.SaveJob(job)
+	}
+	if err != nil {
+		s.log(r.Context()).Errorf("Cannot create job: %v", err)
+		writeErrResponseJobRequest(w, answer, http.StatusInternalServerError, utils.ErrSaveInfoToDBCode, utils.ErrMsgSaveInfoToDB)
+		err = jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+
+	// job is owned by worker after submit
+	fillJobResponse(answer, job)
+	jobCtx := detachedContext(r.Context())
+	s.backgroundTasks.Add(1)
+	err = s.workers.Submit(func() {
+		defer s.backgroundTasks.Done()
+		s.runJob(withinWorker(jobCtx), job, task)
+	})
+	if err != nil {
+		s.backgroundTasks.Done()
+		s.log(r.Context()).Warnf("%s: %v", utils.ErrMsgProcessingQueueFull, err)
+		s.finishJob(r.Context(), job, nil, &processingError{http.StatusServiceUnavailable, utils.ErrProcessingQueueFullCode, utils.ErrMsgProcessingQueueFull, nil})
+		fillJobResponse(answer, job)
+		w.Header().Set("Retry-After", strconv.Itoa(RetryAfterSeconds))
+		writeErrResponseJobRequest(w, answer, http.StatusServiceUnavailable, utils.ErrProcessingQueueFullCode, utils.ErrMsgProcessingQueueFull)
+		err = jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+
+	s.log(r.Context()).WithFields(logrus.Fields{
+		"UserId":    userId,
+		"RequestId": requestId,
+		"JobId":     jobId,
+	}).Info("Job queued")
+
+	w.WriteHeader(http.StatusAccepted)
+	err = jsonEncoder.Encode(answer)
+	if err != nil {
+		s.log(r.Context()).Errorf("Cannot send response: %v", err)
+	}
+}
+
+// Function to handle user request for job state
+func (s *ApiServerRequestProcessor) HandleGetJobRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	answer := &http_response_dto.JobResponseDto{}
+	jsonEncoder := json.NewEncoder(w)
+	s.log(r.Context()).Info("Got user request")
+
+	jobId := mux.Vars(r)["id"]
+	job := s.jobStore.GetJob(jobId)
+	// job of other user is reported as not found
+	if job == nil || !canAccessUser(r, job.UserId) {
+		s.log(r.Context()).Errorf("%s: %s", utils.ErrMsgJobNotFound, jobId)
+		answer.JobId = jobId
+		writeErrResponseJobRequest(w, answer, http.StatusNotFound, utils.ErrJobNotFoundCode, utils.ErrMsgJobNotFound)
+		err := jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+
+	fillJobResponse(answer, job)
+	err := jsonEncoder.Encode(answer)
+	if err != nil {
+		s.log(r.Context()).Errorf("Cannot send response: %v", err)
+	}
+}
+
+// Execute job workflow, every stage change is saved to job store.
+// ctx keeps trace of request which created job
+func (s *ApiServerRequestProcessor) runJob(ctx context.Context, job *dto.JobDto, task jobTask) {
+	ctx, span := tracing.Tracer().Start(ctx, "job", trace.WithAttributes(attribute.String("job.id", job.Id)))
+	defer span.End()
+
+	s.updateJob(ctx, job, dto.JobStateRunning, dto.JobStageQueued)
+
+	ctx = withStageReporter(ctx, func(stage string) {
+		s.updateJob(ctx, job, dto.JobStateRunning, stage)
+	})
+
+	result := &http_response_dto.ResizeImageResponseDto{}
+	result.UserId = job.UserId
+	result.RequestId = job.RequestId
+	perr := task(ctx, result)
+	if perr != nil {
+		span.SetStatus(codes.Error, perr.errMsg)
+	}
+
+	s.finishJob(ctx, job, result, perr)
+	s.notifyCallback(ctx, job.CallbackUrl, result)
+}
+
+func (s *ApiServerRequestProcessor) updateJob(ctx context.Context, job *dto.JobDto, state, stage string) {
+	job.State = state
+	job.Stage = stage
+	job.UpdatedAt = time.Now().UTC()
+	if err := s.jobStore.SaveJob(job); err != nil {
+		s.log(ctx).WithField("JobId", job.Id).Errorf("Cannot save job state: %v", err)
+	}
+}
+
+// Save final job state and result, error info is added to result if job failed
+func (s *ApiServerRequestProcessor) finishJob(ctx context.Context, job *dto.JobDto, result *http_response_dto.ResizeImageResponseDto, perr *processingError) {
+	if result == nil {
+		result = &http_response_dto.ResizeImageResponseDto{}
+		result.UserId = job.UserId
+		result.RequestId = job.RequestId
+	}
+	job.Result = result
+	state := dto.JobStateSucceeded
+	if perr != nil {
+		result.ErrCode = perr.errCode
+		result.ErrMsg = perr.errMsg
+		state = dto.JobStateFailed
+	}
+	s.updateJob(ctx, job, state, dto.JobStageDone)
+	s.log(ctx).WithField("JobId", job.Id).Infof("Job finished: %s", state)
+}
+
+func fillJobResponse(answer *http_response_dto.JobResponseDto, job *dto.JobDto) {
+	answer.UserId = job.UserId
+	answer.RequestId = job.RequestId
+	answer.JobId = job.Id
+	answer.State = job.State
+	answer.Stage = job.Stage
+	answer.Result = job.Result
+}
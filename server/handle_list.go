@@ -20,16 +20,16 @@ func (s *ApiServerRequestProcessor) HandleListHistoryRequest(w http.ResponseWrit
 
 	answer := &http_response_dto.UserImagesListResponseDto{}
 	jsonEncoder := json.NewEncoder(w)
-	s.logger.Info("Got user request")
+	s.log(r.Context()).Info("Got user request")
 
 	err := r.ParseForm()
 	if err != nil {
 		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgInvalidRequestParamValues, err)
-		s.logger.Errorf(errMsg)
+		s.log(r.Context()).Errorf(errMsg)
 		writeErrResponseListRequest(w, answer, http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg)
 		err = jsonEncoder.Encode(answer)
 		if err != nil {
-			s.logger.Errorf("Cannot send response: %v", err)
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
 		}
 		return
 	}
@@ -39,38 +39,41 @@ func (s *ApiServerRequestProcessor) HandleListHistoryRequest(w http.ResponseWrit
 	err = schema.NewDecoder().Decode(&rDto, r.URL.Query())
 	if err != nil {
 		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgInvalidRequestParamValues, err)
-		s.logger.Errorf(errMsg)
+		s.log(r.Context()).Errorf(errMsg)
 		writeErrResponseListRequest(w, answer, http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg)
 		err = jsonEncoder.Encode(answer)
 		if err != nil {
-			s.logger.Errorf("Cannot send response: %v", err)
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
 		}
 		return
 	}
 
+	// authenticated user can see only his own images
+	rDto.UserId = authorizedUserId(r, rDto.UserId)
+
 	// validate user request after mapping
 	err = s.requestValidator.Validate(rDto)
 	if err != nil {
 		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgInvalidRequestParamValues, err)
-		s.logger.Errorf(errMsg)
+		s.log(r.Context()).Errorf(errMsg)
 		writeErrResponseListRequest(w, answer, http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg)
 		err = jsonEncoder.Encode(answer)
 		if err != nil {
-			s.logger.Errorf("Cannot send response: %v", err)
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
 		}
 		return
 	}
 	answer.UserId = rDto.UserId
 	answer.RequestId = rDto.RequestId
 
-	logEntity := s.logger.WithFields(logrus.Fields{
+	logEntity := s.log(r.Context()).WithFields(logrus.Fields{
 		"userId":    rDto.UserId,
 		"requestId": rDto.RequestId,
 	})
 
 	logEntity.Info("Searching user images in DB")
 	// try to find all images in DB by userId
-	allImgs := s.dbStore.FindAllPictureByUserId(rDto.UserId)
+	allImgs := s.dbStore.FindAllPictureByUserId(r.Context(), rDto.UserId)
 
 	if allImgs == nil {
 		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgCannotGetUserImages, err)
@@ -78,7 +81,7 @@ func (s *ApiServerRequestProcessor) HandleListHistoryRequest(w http.ResponseWrit
 		writeErrResponseListRequest(w, answer, http.StatusInternalServerError, utils.ErrCannotGetUserImagesCode, errMsg)
 		err = jsonEncoder.Encode(answer)
 		if err != nil {
-			s.logger.Errorf("Cannot send response: %v", err)
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
 		}
 		return
 	}
@@ -90,7 +93,7 @@ func (s *ApiServerRequestProcessor) HandleListHistoryRequest(w http.ResponseWrit
 	// send answer to caller
 	err = jsonEncoder.Encode(answer)
 	if err != nil {
-		s.logger.Errorf("Cannot send response: %v", err)
+		s.log(r.Context()).Errorf("Cannot send response: %v", err)
 	}
 }
 
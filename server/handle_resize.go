@@ -2,17 +2,35 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/senseyman/image-media-processor/dto"
 	"github.com/senseyman/image-media-processor/dto/http_request_dto"
 	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/service/metrics"
+	"github.com/senseyman/image-media-processor/service/tracing"
 	"github.com/senseyman/image-media-processor/utils"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"image"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"os"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// max size of multipart request with image
+	MaxUploadSize = 100 << 20
+	// part of multipart request kept in memory, rest is stored in temporary files
+	MaxUploadMemory = 32 << 20
 )
 
 // Function to handle and process user request for resizing image.
@@ -22,92 +40,176 @@ func (s *ApiServerRequestProcessor) HandleResizeRequest(w http.ResponseWriter, r
 	w.Header().Add("Content-Type", "application/json")
 
 	answer := &http_response_dto.ResizeImageResponseDto{}
-	jsonEncoder := json.NewEncoder(w)
-	s.logger.Info("Got user request")
-
-	// max ~ 100 MB
-	if err := r.ParseMultipartForm(100 << 20); err != nil {
-		s.logger.Errorf("Cannot pars multipart form: %v", err)
-		writeErrResponseResizeRequest(w, answer, http.StatusBadRequest, utils.ErrEmptyRequestCode, utils.ErrMsgEmptyRequest)
-		err = jsonEncoder.Encode(answer)
-		if err != nil {
-			s.logger.Errorf("Cannot send response: %v", err)
-		}
-		return
+	s.log(r.Context()).Info("Got user request")
+
+	rDto, src, variant, perr := s.parseResizeRequest(w, r)
+	if perr == nil {
+		// save it for response identification on outside
+		answer.UserId = rDto.UserId
+		answer.RequestId = rDto.RequestId
+
+		// main workflow is processed by worker pool
+		perr = s.runInPool(func() *processingError {
+			return s.processResizeRequest(r.Context(), rDto, src, variant, answer)
+		})
+	}
+
+	s.writeResizeResponse(w, answer, perr)
+	if rDto != nil {
+		s.notifyCallback(r.Context(), rDto.CallbackUrl, answer)
+	}
+}
+
+func (s *ApiServerRequestProcessor) HandleResizeByIdRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	answer := &http_response_dto.ResizeImageResponseDto{}
+	s.log(r.Context()).Info("Got user request")
+
+	rDto, variant, perr := s.parseResizeByIdRequest(r)
+	if perr == nil {
+		// save it for response identification on outside
+		answer.UserId = rDto.UserId
+		answer.RequestId = rDto.RequestId
+		answer.ImageId = rDto.ImageId
+
+		// main workflow is processed by worker pool, concurrent requests of the same variant wait for it
+		perr = s.processResizeByIdRequest(r.Context(), rDto, variant, answer)
+	}
+
+	s.writeResizeResponse(w, answer, perr)
+	if rDto != nil {
+		s.notifyCallback(r.Context(), rDto.CallbackUrl, answer)
+	}
+}
+
+// Read resize request with image and resize params. Image is sent as multipart file (POST),
+// base64 field of json (POST with application/json), raw body (PUT) or downloaded from source url
+func (s *ApiServerRequestProcessor) parseResizeRequest(w http.ResponseWriter, r *http.Request) (
+	*http_request_dto.ResizeImageRequestParamsDto, *sourceImage, *dto.VariantDto, *processingError) {
+
+	if r.Body == nil {
+		s.log(r.Context()).Error(utils.ErrMsgEmptyRequest)
+		return nil, nil, nil, &processingError{http.StatusBadRequest, utils.ErrEmptyRequestCode, utils.ErrMsgEmptyRequest, nil}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+
+	var (
+		rDto *http_request_dto.ResizeImageRequestParamsDto
+		src  *sourceImage
+		perr *processingError
+	)
+	switch {
+	case r.Method == http.MethodPut:
+		rDto, src, perr = s.readRawResizeRequest(r)
+	case isJsonRequest(r):
+		rDto, src, perr = s.readJsonResizeRequest(r)
+	default:
+		rDto, src, perr = s.readMultipartResizeRequest(r)
+	}
+	if perr != nil {
+		return nil, nil, nil, perr
+	}
+	if src == nil && len(rDto.SourceUrl) == 0 {
+		s.log(r.Context()).Errorf("%s : %v", utils.ErrMsgFileNotFoundInRequest, http.ErrMissingFile)
+		return nil, nil, nil, &processingError{http.StatusBadRequest, utils.ErrFileNotFoundInRequestCode, utils.ErrMsgFileNotFoundInRequest, nil}
+	}
+
+	// authenticated user can resize only his own images
+	rDto.UserId = authorizedUserId(r, rDto.UserId)
+
+	// resolve preset and validate user request after mapping
+	variant, err := s.resolveVariant(&rDto.SizeRequestDto)
+	if err == nil {
+		err = s.requestValidator.Validate(rDto)
+	}
+	if err == nil {
+		err = applyTransform(variant, &rDto.TransformRequestDto)
+	}
+	if err == nil {
+		err = s.validateCallbackUrl(rDto.CallbackUrl)
+	}
+	if err == nil {
+		err = s.validateSourceUrl(rDto.SourceUrl, src != nil)
 	}
-	// getting file from request using tag 'file'
-	file, handler, err := r.FormFile("file")
 	if err != nil {
-		s.logger.Errorf("%s : %v", utils.ErrMsgFileNotFoundInRequest, err)
-		writeErrResponseResizeRequest(w, answer, http.StatusBadRequest, utils.ErrFileNotFoundInRequestCode, utils.ErrMsgFileNotFoundInRequest)
-		err = jsonEncoder.Encode(answer)
-		if err != nil {
-			s.logger.Errorf("Cannot send response: %v", err)
-		}
-		return
+		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgInvalidRequestParamValues, err)
+		s.log(r.Context()).Errorf(errMsg)
+		return nil, nil, nil, &processingError{http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg, nil}
 	}
 
-	// getting params from request using param name 'params'
-	params := r.FormValue("params")
-	if len(params) == 0 {
-		s.logger.Errorf("%s : %v", utils.ErrMsgParamsNotSetInRequest, err)
-		writeErrResponseResizeRequest(w, answer, http.StatusBadRequest, utils.ErrParamsNotSetInRequestCode, utils.ErrMsgParamsNotSetInRequest)
-		err = jsonEncoder.Encode(answer)
-		if err != nil {
-			s.logger.Errorf("Cannot send response: %v", err)
-		}
-		return
+	if src == nil {
+		// image is downloaded by worker, when processing started
+		src = &sourceImage{url: rDto.SourceUrl}
 	}
+	return rDto, src, variant, nil
+}
 
-	// decode params to struct
-	rDto := http_request_dto.ResizeImageRequestParamsDto{}
-	err = json.Unmarshal([]byte(params), &rDto)
+// Read json request with image id and resize params
+func (s *ApiServerRequestProcessor) parseResizeByIdRequest(r *http.Request) (
+	*http_request_dto.ResizeImageByImageIdRequestParamsDto, *dto.VariantDto, *processingError) {
+
+	rDto := &http_request_dto.ResizeImageByImageIdRequestParamsDto{}
+
+	if r.Body == nil {
+		s.log(r.Context()).Error(utils.ErrMsgEmptyRequest)
+		return nil, nil, &processingError{http.StatusBadRequest, utils.ErrEmptyRequestCode, utils.ErrMsgEmptyRequest, nil}
+	}
+	err := json.NewDecoder(r.Body).Decode(rDto)
 	if err != nil {
-		s.logger.Errorf("%s : %v", utils.ErrMsgCannotParseRequestParams, err)
-		writeErrResponseResizeRequest(w, answer, http.StatusBadRequest, utils.ErrCannotParseRequestParamsCode, utils.ErrMsgCannotParseRequestParams)
-		err = jsonEncoder.Encode(answer)
-		if err != nil {
-			s.logger.Errorf("Cannot send response: %v", err)
-		}
-		return
+		s.log(r.Context()).Errorf("Cannot parse request: %v", err)
+		return nil, nil, &processingError{http.StatusBadRequest, utils.ErrCannotParseRequestParamsCode, utils.ErrMsgCannotParseRequestParams, nil}
 	}
 
-	// validate user request after mapping
-	err = s.requestValidator.Validate(rDto)
+	// authenticated user can resize only his own images
+	rDto.UserId = authorizedUserId(r, rDto.UserId)
+
+	// resolve preset and validate user request after mapping
+	variant, err := s.resolveVariant(&rDto.SizeRequestDto)
+	if err == nil {
+		err = s.requestValidator.Validate(rDto)
+	}
+	if err == nil {
+		err = s.validateCallbackUrl(rDto.CallbackUrl)
+	}
 	if err != nil {
 		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgInvalidRequestParamValues, err)
-		s.logger.Errorf(errMsg)
-		writeErrResponseResizeRequest(w, answer, http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg)
-		err = jsonEncoder.Encode(answer)
-		if err != nil {
-			s.logger.Errorf("Cannot send response: %v", err)
-		}
-		return
+		s.log(r.Context()).Errorf(errMsg)
+		return nil, nil, &processingError{http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg, nil}
 	}
 
-	// save it for response identification on outside
-	answer.UserId = rDto.UserId
-	answer.RequestId = rDto.RequestId
+	return rDto, variant, nil
+}
+
+// Resize uploaded image, upload both images to cloud and generate eager presets
+func (s *ApiServerRequestProcessor) processResizeRequest(
+	ctx context.Context,
+	rDto *http_request_dto.ResizeImageRequestParamsDto,
+	src *sourceImage,
+	variant *dto.VariantDto,
+	answer *http_response_dto.ResizeImageResponseDto) *processingError {
+
+	if len(src.url) > 0 {
+		reportStage(ctx, dto.JobStageDownloading)
+		if perr := s.fetchSourceImage(ctx, src); perr != nil {
+			return perr
+		}
+	}
 
 	// generate image id
-	imageId, err := utils.GenerateImageIdByOriginalName(handler.Filename)
+	imageId, err := utils.GenerateImageIdByOriginalName(src.name)
 	if err != nil {
 		errMsg := fmt.Sprintf("%s: %v", utils.ErrImageIdGenerate, err)
-		s.logger.Errorf(errMsg)
-		writeErrResponseResizeRequest(w, answer, http.StatusBadRequest, utils.ErrImageIdGenerateCode, errMsg)
-		err = jsonEncoder.Encode(answer)
-		if err != nil {
-			s.logger.Errorf("Cannot send response: %v", err)
-		}
-		return
+		s.log(ctx).Errorf(errMsg)
+		return &processingError{http.StatusBadRequest, utils.ErrImageIdGenerateCode, errMsg, nil}
 	}
 
-	logEntry := s.logger.WithFields(logrus.Fields{
+	logEntry := s.log(ctx).WithFields(logrus.Fields{
 		"UserId":    rDto.UserId,
 		"RequestId": rDto.RequestId,
 		"Width":     rDto.Width,
 		"Height":    rDto.Height,
-		"Filename":  handler.Filename,
+		"Preset":    rDto.Preset,
+		"Filename":  src.name,
 		"PictureId": imageId,
 	})
 
@@ -116,226 +218,306 @@ func (s *ApiServerRequestProcessor) HandleResizeRequest(w http.ResponseWriter, r
 	// check in DB if this picture already exist with the same resizing params
 	// if exist - return known info for this picture
 	// else - continue processing request
-	existEl := s.dbStore.GetImage(imageId, rDto.Width, rDto.Height)
+	existEl := s.findVariant(ctx, rDto.UserId, imageId, variant)
 	if existEl != nil {
 		logEntry.Warn("This picture already processed by the same request params")
 
 		answer.ImageId = imageId
 		answer.OriginalImagePath = existEl.OriginalImageUrl
 		answer.ResizedImagePath = existEl.ResizedImageUrl
-		err = jsonEncoder.Encode(answer)
-		if err != nil {
-			s.logger.Errorf("Cannot send response: %v", err)
+		if len(s.cfg.Eager.Presets) > 0 {
+			answer.Variants = s.planVariantUrls(rDto.UserId, imageId, s.eagerVariants(src.name))
 		}
-		return
+		return nil
 	}
 
 	// main workflow
-	s.processImageResizeWorkflow(file, handler.Filename, rDto.Width, rDto.Height, imageId, rDto.UserId, w, answer, logEntry, true)
-
-	// send answer to caller
-	err = jsonEncoder.Encode(answer)
-	if err != nil {
-		s.logger.Errorf("Cannot send response: %v", err)
+	_, perr := s.processImageResizeWorkflow(ctx, src, variant, imageId, rDto.UserId, answer, logEntry, true)
+	if perr != nil {
+		return perr
 	}
+	// new variants of uploaded image are usually requested soon
+	s.cacheOriginal(rDto.UserId, answer.OriginalImagePath, src)
 
+	// original already decoded, so configured presets are made from it
+	reportStage(ctx, dto.JobStagePresets)
+	answer.Variants = s.processEagerPresets(ctx, src, imageId, rDto.UserId, answer.OriginalImagePath, logEntry)
+	return nil
 }
 
-func (s *ApiServerRequestProcessor) HandleResizeByIdRequest(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Content-Type", "application/json")
-	answer := &http_response_dto.ResizeImageResponseDto{}
-	jsonEncoder := json.NewEncoder(w)
-	s.logger.Info("Got user request")
-
-	rDto := http_request_dto.ResizeImageByImageIdRequestParamsDto{}
+// Resize previously uploaded image, original is downloaded from cloud
+func (s *ApiServerRequestProcessor) processResizeByIdRequest(
+	ctx context.Context,
+	rDto *http_request_dto.ResizeImageByImageIdRequestParamsDto,
+	variant *dto.VariantDto,
+	answer *http_response_dto.ResizeImageResponseDto) *processingError {
 
-	if r.Body == nil {
-		s.logger.Error(utils.ErrMsgEmptyRequest)
-		writeErrResponseResizeRequest(w, answer, http.StatusBadRequest, utils.ErrEmptyRequestCode, utils.ErrMsgEmptyRequest)
-		err := jsonEncoder.Encode(answer)
-		if err != nil {
-			s.logger.Errorf("Cannot send response: %v", err)
-		}
-		return
-	}
-	err := json.NewDecoder(r.Body).Decode(&rDto)
-	if err != nil {
-		s.logger.Errorf("Cannot parse request: %v", err)
-		writeErrResponseResizeRequest(w, answer, http.StatusBadRequest, utils.ErrCannotParseRequestParamsCode, utils.ErrMsgCannotParseRequestParams)
-		err = jsonEncoder.Encode(answer)
-		if err != nil {
-			s.logger.Errorf("Cannot send response: %v", err)
-		}
-		return
-	}
-
-	// validate user request after mapping
-	err = s.requestValidator.Validate(rDto)
-	if err != nil {
-		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgInvalidRequestParamValues, err)
-		s.logger.Errorf(errMsg)
-		writeErrResponseResizeRequest(w, answer, http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg)
-		err = jsonEncoder.Encode(answer)
-		if err != nil {
-			s.logger.Errorf("Cannot send response: %v", err)
-		}
-		return
-	}
-
-	// save it for response identification on outside
-	answer.UserId = rDto.UserId
-	answer.RequestId = rDto.RequestId
-	answer.ImageId = rDto.ImageId
-
-	logEntry := s.logger.WithFields(logrus.Fields{
+	logEntry := s.log(ctx).WithFields(logrus.Fields{
 		"UserId":         rDto.UserId,
 		"RequestId":      rDto.RequestId,
 		"ImageId":        rDto.ImageId,
 		"Request width":  rDto.Width,
 		"Request height": rDto.Height,
+		"Preset":         rDto.Preset,
 	})
 
 	// check if this image already exist with the same size params
-	exist := s.dbStore.GetImage(rDto.ImageId, rDto.Width, rDto.Height)
+	exist := s.findVariant(ctx, rDto.UserId, rDto.ImageId, variant)
 	if exist != nil {
 		logEntry.Warn("Image already processed with this size params")
 		answer.OriginalImagePath = exist.OriginalImageUrl
 		answer.ResizedImagePath = exist.ResizedImageUrl
-		err = jsonEncoder.Encode(answer)
-		if err != nil {
-			s.logger.Errorf("Cannot send response: %v", err)
-		}
-		return
+		return nil
 	}
 
-	// Try to find one image from DB by imageId to get original image url
-	img := s.dbStore.GetImageByImageId(rDto.ImageId)
-	if img == nil {
-		logEntry.Error("This image never processed by user requests")
-		writeErrResponseResizeRequest(w, answer, http.StatusBadRequest, utils.ErrImageNotFoundCode, utils.ErrMsgImageNotFound)
-		err = jsonEncoder.Encode(answer)
-		if err != nil {
-			s.logger.Errorf("Cannot send response: %v", err)
+	result := s.generateVariantOnce(ctx, rDto.UserId, rDto.ImageId, variant, logEntry, func(ctx context.Context) *variantResult {
+		perr := s.runInWorker(ctx, func() *processingError {
+			return s.resizeStoredOriginal(ctx, rDto, variant, answer, logEntry)
+		})
+		return &variantResult{
+			img:  &dto.DbImageStoreDAO{OriginalImageUrl: answer.OriginalImagePath, ResizedImageUrl: answer.ResizedImagePath},
+			perr: perr,
 		}
-		return
+	})
+	if result.perr != nil {
+		return result.perr
 	}
+	answer.OriginalImagePath = result.img.OriginalImageUrl
+	answer.ResizedImagePath = result.img.ResizedImageUrl
+	return nil
+}
+
+// Download original of previously uploaded image from cloud and resize it
+func (s *ApiServerRequestProcessor) resizeStoredOriginal(
+	ctx context.Context,
+	rDto *http_request_dto.ResizeImageByImageIdRequestParamsDto,
+	variant *dto.VariantDto,
+	answer *http_response_dto.ResizeImageResponseDto,
+	logEntry *logrus.Entry) *processingError {
 
-	// try to download files using image url
-	file, err := s.cloudStore.Download(img.OriginalImageUrl, rDto.UserId, rDto.ImageId)
+	// Try to find one image of user from DB by imageId to get original image url
+	img, err := s.dbStore.GetImageByImageId(ctx, rDto.UserId, rDto.ImageId)
 	if err != nil {
-		logEntry.Errorf("Cannot download image from cloud store: %v", err)
-		writeErrResponseResizeRequest(w, answer, http.StatusBadRequest, utils.ErrLoadFileCode, utils.ErrMsgLoadFile)
-		err = jsonEncoder.Encode(answer)
-		if err != nil {
-			s.logger.Errorf("Cannot send response: %v", err)
-		}
-		return
+		logEntry.Errorf("Cannot find original image: %v", err)
+		return imageLookupError(err, http.StatusBadRequest)
 	}
 
-	// delete downloaded file from FS
-	defer os.Remove(file.Name())
-
-	// main workflow
-	s.processImageResizeWorkflow(file, file.Name(), rDto.Width, rDto.Height, rDto.ImageId, rDto.UserId, w, answer, logEntry, false)
+	// try to download files using image url, recently processed original is taken from cache
+	reportStage(ctx, dto.JobStageDownloading)
+	src, perr := s.loadOriginal(ctx, rDto.UserId, rDto.ImageId, img.OriginalImageUrl, http.StatusBadRequest, logEntry)
+	if perr != nil {
+		return perr
+	}
 
 	// we don't save original image again to cloud, so need to set to answer original path using info from DB
 	answer.OriginalImagePath = img.OriginalImageUrl
 
+	// main workflow
+	_, perr = s.processImageResizeWorkflow(ctx, src, variant, rDto.ImageId, rDto.UserId, answer, logEntry, false)
+	if perr != nil {
+		return perr
+	}
+	s.cacheOriginal(rDto.UserId, img.OriginalImageUrl, src)
+	return nil
+}
+
+// Send answer of resize request to caller, error info is added if processing failed
+func (s *ApiServerRequestProcessor) writeResizeResponse(w http.ResponseWriter, answer *http_response_dto.ResizeImageResponseDto, perr *processingError) {
+	if perr != nil {
+		if perr.serverCode == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", strconv.Itoa(RetryAfterSeconds))
+		}
+		writeErrResponseResizeRequest(w, answer, perr)
+	}
+
 	// send answer to caller
-	err = jsonEncoder.Encode(answer)
+	err := json.NewEncoder(w).Encode(answer)
 	if err != nil {
 		s.logger.Errorf("Cannot send response: %v", err)
 	}
+}
+
+// original image of resize workflow
+// It is decoded only once, even if several variants are made from it
+type sourceImage struct {
+	name    string
+	content []byte
+	decoded image.Image
+	// remote image, content is empty until it is downloaded
+	url string
+}
+
+func newSourceImage(origFile io.Reader, filename string) *sourceImage {
+	// unreadable content fails on decoding
+	content, _ := ioutil.ReadAll(origFile)
+	return &sourceImage{name: filename, content: content}
+}
 
+// Name of stored original is taken from its cloud url, downloaded file can be named differently
+func storedOriginalName(originalUrl string) string {
+	if u, err := url.Parse(originalUrl); err == nil && len(u.Path) > 0 {
+		return path.Base(u.Path)
+	}
+	return path.Base(originalUrl)
 }
 
 func (s *ApiServerRequestProcessor) resizeImg(
-	origFile io.Reader, filename string,
-	width, height int,
-	w http.ResponseWriter,
-	answer *http_response_dto.ResizeImageResponseDto,
-	logEntity *logrus.Entry) *dto.FileInfoDto {
+	ctx context.Context,
+	src *sourceImage,
+	variant *dto.VariantDto,
+	logEntity *logrus.Entry) (*dto.FileInfoDto, *processingError) {
+
+	// image is decoded and resized only when its estimated memory fits into budget
+	size := s.estimateResizeMemory(ctx, src, variant)
+	if err := s.memory.Reserve(size); err != nil {
+		logEntity.Errorf("%s: %v, estimated %d bytes", utils.ErrMsgImageTooLarge, err, size)
+		return nil, &processingError{http.StatusRequestEntityTooLarge, utils.ErrImageTooLargeCode, utils.ErrMsgImageTooLarge, nil}
+	}
+	defer s.memory.Release(size)
+
+	var err error
+	if src.decoded == nil {
+		metrics.ObserveImageBytes(metrics.DirectionInput, len(src.content))
+		src.decoded, err = s.imgProcessor.Decode(ctx, bytes.NewReader(src.content))
+	}
 
 	// resizing image with user request params
-	resizedFileInfoDto, err := s.imgProcessor.Resize(origFile, filename, width, height)
+	var resizedFileInfoDto *dto.FileInfoDto
+	if err == nil {
+		resizedFileInfoDto, err = s.imgProcessor.Resize(ctx, src.decoded, src.name, variant)
+	}
 
 	if err != nil {
 		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgCannotResizeImage, err)
 		logEntity.Errorf(errMsg)
-		writeErrResponseResizeRequest(w, answer, http.StatusInternalServerError, utils.ErrCannotResizeImageCode, errMsg)
-		return nil
+		return nil, &processingError{http.StatusInternalServerError, utils.ErrCannotResizeImageCode, errMsg, err}
 	}
 
-	return resizedFileInfoDto
+	return resizedFileInfoDto, nil
 }
 
-func (s *ApiServerRequestProcessor) uploadFileToCloud(imageId uint32, userId string, upld []*dto.FileInfoDto,
-	w http.ResponseWriter,
+// Memory of resize estimated by size of original. Image which header cannot be decoded
+// is not estimated, decoding of such image fails anyway
+func (s *ApiServerRequestProcessor) estimateResizeMemory(ctx context.Context, src *sourceImage, variant *dto.VariantDto) int64 {
+	if src.decoded != nil {
+		bounds := src.decoded.Bounds()
+		return resizeMemory(bounds.Dx(), bounds.Dy(), variant)
+	}
+	cfg, err := s.imgProcessor.DecodeConfig(ctx, bytes.NewReader(src.content))
+	if err != nil {
+		return 0
+	}
+	return resizeMemory(cfg.Width, cfg.Height, variant)
+}
+
+func (s *ApiServerRequestProcessor) uploadFileToCloud(ctx context.Context, imageId uint32, userId string, upld []*dto.FileInfoDto,
 	answer *http_response_dto.ResizeImageResponseDto,
-	logEntity *logrus.Entry) *dto.CloudResponseDto {
+	logEntity *logrus.Entry) (*dto.CloudResponseDto, *processingError) {
 
 	// upload files to cloud
-	cloudResp, err := s.cloudStore.Upload(imageId, userId, upld)
+	started := time.Now()
+	cloudResp, err := s.cloudStore.Upload(ctx, imageId, userId, upld)
+	metrics.ObserveStage(metrics.StageUpload, started)
 
 	if err != nil {
 		logEntity.Errorf("%s. RequestId: %s. Err: %v", utils.ErrMsgUploadImage, answer.RequestId, err)
-		writeErrResponseResizeRequest(w, answer, http.StatusInternalServerError, utils.ErrUploadImageCode, utils.ErrMsgUploadImage)
-		return nil
+		return nil, &processingError{http.StatusInternalServerError, utils.ErrUploadImageCode, utils.ErrMsgUploadImage, err}
 	}
 
-	return cloudResp
+	return cloudResp, nil
 }
 
-func (s *ApiServerRequestProcessor) storeToDb(userId string, imageId uint32, origImagePath, resizedImagePath string, width, height int,
-	w http.ResponseWriter,
+func (s *ApiServerRequestProcessor) storeToDb(ctx context.Context, userId string, imageId uint32, origImagePath, resizedImagePath string, variant *dto.VariantDto, format string,
+	originalSize, resizedSize int64,
 	answer *http_response_dto.ResizeImageResponseDto,
-	logEntity *logrus.Entry) error {
+	logEntity *logrus.Entry) *processingError {
 
 	// insert file info to DB
-	err := s.dbStore.Insert(&dto.DbImageStoreDAO{
+	_, span := tracing.Tracer().Start(ctx, "mongo.insert")
+	defer span.End()
+	started := time.Now()
+	now := started.UTC()
+	err := s.dbStore.Insert(ctx, &dto.DbImageStoreDAO{
 		UserId:           userId,
 		PicId:            imageId,
 		OriginalImageUrl: origImagePath,
 		ResizedImageUrl:  resizedImagePath,
-		ResizedWidth:     width,
-		ResizedHeight:    height,
+		ResizedWidth:     variant.Width,
+		ResizedHeight:    variant.Height,
+		Format:           format,
+		Mode:             variant.Mode,
+		Quality:          variant.Quality,
+		Preset:           variant.Preset,
+		OriginalSize:     originalSize,
+		ResizedSize:      resizedSize,
+		CreatedAt:        now,
+		LastAccessedAt:   now,
 	})
+	metrics.ObserveStage(metrics.StageInsert, started)
 
 	if err != nil {
 		logEntity.Errorf("%s. RequestId: %s. Err: %v", utils.ErrMsgSaveInfoToDB, answer.RequestId, err)
-		writeErrResponseResizeRequest(w, answer, http.StatusInternalServerError, utils.ErrSaveInfoToDBCode, utils.ErrMsgSaveInfoToDB)
-		return err
+		span.RecordError(err)
+		span.SetStatus(codes.Error, utils.ErrMsgSaveInfoToDB)
+		return &processingError{http.StatusInternalServerError, utils.ErrSaveInfoToDBCode, utils.ErrMsgSaveInfoToDB, err}
 	}
 	return nil
 }
 
+// Resize image, upload results to cloud and save info to DB.
+// Answer is filled by cloud paths of uploaded files.
+// Return bytes of resized image
 func (s *ApiServerRequestProcessor) processImageResizeWorkflow(
-	origFile io.Reader,
-	filename string,
-	width, height int,
+	ctx context.Context,
+	src *sourceImage,
+	variant *dto.VariantDto,
 	imageId uint32,
 	userId string,
-	w http.ResponseWriter,
 	answer *http_response_dto.ResizeImageResponseDto,
 	logEntity *logrus.Entry,
-	saveOriginal bool) {
-
-	// clone reader
-	buf, _ := ioutil.ReadAll(origFile)
-	bufToUpload := bytes.NewBuffer(buf)
-	bufToResize := bytes.NewBuffer(buf)
+	saveOriginal bool) (resized []byte, perr *processingError) {
+
+	ctx, span := tracing.Tracer().Start(ctx, "resize_workflow", trace.WithAttributes(
+		attribute.Int64("image.id", int64(imageId)),
+		attribute.String("user.id", userId),
+		attribute.String("image.preset", variant.Preset),
+	))
+	defer func() {
+		endSpan(span, perr)
+	}()
+
+	// reserve quotas before resizing, size of resized image is reserved before uploading.
+	// Reservation is kept until variant is stored to DB, so concurrent requests of user are counted
+	var reservation *quotaReservation
+	if s.quotasEnabled() && !isQuotaExempt(ctx) {
+		reservation, perr = s.reserveQuota(ctx, userId, imageId, variant, saveOriginal, len(src.content), logEntity)
+		if perr != nil {
+			return nil, perr
+		}
+		defer s.releaseQuota(reservation)
+	}
 
 	// resize image
-	resizedImg := s.resizeImg(bufToResize, filename, width, height, w, answer, logEntity)
-	if resizedImg == nil {
-		return
+	reportStage(ctx, dto.JobStageResizing)
+	resizedImg, perr := s.resizeImg(ctx, src, variant, logEntity)
+	if perr != nil {
+		return nil, perr
+	}
+
+	// keep resized bytes for caller, cloud store consumes buffer
+	resizedBuf, _ := ioutil.ReadAll(resizedImg.Buffer)
+	resizedImg.Buffer = bytes.NewReader(resizedBuf)
+	format, _ := utils.NormalizeImageFormat(filepath.Ext(resizedImg.Name))
+
+	if perr = s.reserveQuotaBytes(ctx, reservation, int64(len(resizedBuf)), logEntity); perr != nil {
+		return nil, perr
 	}
 
 	var upld []*dto.FileInfoDto
 	if saveOriginal {
 		upld = []*dto.FileInfoDto{{
-			Buffer: bufToUpload,
-			Name:   filename,
+			Buffer: bytes.NewReader(src.content),
+			Name:   src.name,
 			Type:   dto.SourceOriginal,
 		}, resizedImg}
 	} else {
@@ -343,10 +525,10 @@ func (s *ApiServerRequestProcessor) processImageResizeWorkflow(
 	}
 
 	// call uploading files
-	cloudResp := s.uploadFileToCloud(imageId, userId, upld, w, answer, logEntity)
-
-	if cloudResp == nil {
-		return
+	reportStage(ctx, dto.JobStageUploading)
+	cloudResp, perr := s.uploadFileToCloud(ctx, imageId, userId, upld, answer, logEntity)
+	if perr != nil {
+		return nil, perr
 	}
 
 	answer.ImageId = imageId
@@ -359,9 +541,12 @@ func (s *ApiServerRequestProcessor) processImageResizeWorkflow(
 	}
 
 	// call storing to DB
-	err := s.storeToDb(userId, imageId, answer.OriginalImagePath, answer.ResizedImagePath, width, height, w, answer, logEntity)
-	if err != nil {
-		return
+	reportStage(ctx, dto.JobStageSaving)
+	perr = s.storeToDb(ctx, userId, imageId, answer.OriginalImagePath, answer.ResizedImagePath, variant, format,
+		int64(len(src.content)), int64(len(resizedBuf)), answer, logEntity)
+	if perr != nil {
+		return nil, perr
 	}
 
+	return resizedBuf, nil
 }
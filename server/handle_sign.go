@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_request_dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// Function to handle user request for signed on-the-fly delivery urls
+// of one image with a set of transformation params
+func (s *ApiServerRequestProcessor) HandleSignUrlRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	answer := &http_response_dto.SignUrlResponseDto{}
+	jsonEncoder := json.NewEncoder(w)
+	s.log(r.Context()).Info("Got user request")
+
+	if len(s.cfg.Signing.Secret) == 0 {
+		s.log(r.Context()).Error(utils.ErrMsgSigningNotConfigured)
+		writeErrResponseSignRequest(w, answer, http.StatusNotImplemented, utils.ErrSigningNotConfiguredCode, utils.ErrMsgSigningNotConfigured)
+		err := jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+
+	if r.Body == nil {
+		s.log(r.Context()).Error(utils.ErrMsgEmptyRequest)
+		writeErrResponseSignRequest(w, answer, http.StatusBadRequest, utils.ErrEmptyRequestCode, utils.ErrMsgEmptyRequest)
+		err := jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+
+	rDto := http_request_dto.SignUrlRequestDto{}
+	err := json.NewDecoder(r.Body).Decode(&rDto)
+	if err != nil {
+		s.log(r.Context()).Errorf("Cannot parse request: %v", err)
+		writeErrResponseSignRequest(w, answer, http.StatusBadRequest, utils.ErrCannotParseRequestParamsCode, utils.ErrMsgCannotParseRequestParams)
+		err = jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+
+	// authenticated user can sign only his own images
+	rDto.UserId = authorizedUserId(r, rDto.UserId)
+
+	// validate user request after mapping
+	variants, err := s.validateSignUrlRequest(&rDto)
+	if err != nil {
+		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgInvalidRequestParamValues, err)
+		s.log(r.Context()).Errorf(errMsg)
+		writeErrResponseSignRequest(w, answer, http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg)
+		err = jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+
+	// save it for response identification on outside
+	answer.UserId = rDto.UserId
+	answer.RequestId = rDto.RequestId
+	answer.ImageId = rDto.ImageId
+
+	logEntry := s.log(r.Context()).WithFields(logrus.Fields{
+		"UserId":    rDto.UserId,
+		"RequestId": rDto.RequestId,
+		"ImageId":   rDto.ImageId,
+	})
+
+	// only images of user can be signed
+	img, err := s.dbStore.GetImageByImageId(r.Context(), rDto.UserId, rDto.ImageId)
+	if err != nil {
+		logEntry.Errorf("Cannot find image: %v", err)
+		perr := imageLookupError(err, http.StatusNotFound)
+		writeErrResponseSignRequest(w, answer, perr.serverCode, perr.errCode, perr.errMsg)
+		err = jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+
+	expiresAt := s.defaultUrlExpiry()
+	if rDto.ExpiresIn > 0 {
+		expiresAt = time.Now().Add(time.Duration(rDto.ExpiresIn) * time.Second)
+	}
+
+	// variants without format are delivered in format of original image
+	origFormat, _ := utils.NormalizeImageFormat(filepath.Ext(img.OriginalImageUrl))
+
+	answer.Urls = make([]*http_response_dto.SignedUrlDto, 0, len(variants))
+	for _, variant := range variants {
+		if len(variant.Format) == 0 {
+			variant.Format = origFormat
+		}
+		signed := &http_response_dto.SignedUrlDto{
+			Width:  variant.Width,
+			Height: variant.Height,
+			Format: variant.Format,
+			Preset: variant.Preset,
+			Url:    s.deliveryUrl(rDto.UserId, rDto.ImageId, variant, expiresAt),
+		}
+		if !expiresAt.IsZero() {
+			signed.ExpiresAt = expiresAt.Unix()
+		}
+		answer.Urls = append(answer.Urls, signed)
+	}
+
+	logEntry.Infof("Signed urls: %d", len(answer.Urls))
+
+	// send answer to caller
+	err = jsonEncoder.Encode(answer)
+	if err != nil {
+		s.log(r.Context()).Errorf("Cannot send response: %v", err)
+	}
+}
+
+// validate request and every requested variant, return params of requested variants
+func (s *ApiServerRequestProcessor) validateSignUrlRequest(rDto *http_request_dto.SignUrlRequestDto) ([]*dto.VariantDto, error) {
+	err := s.requestValidator.Validate(rDto)
+	if err != nil {
+		return nil, err
+	}
+	if len(rDto.Variants) == 0 {
+		return nil, fmt.Errorf("variants not set")
+	}
+	variants := make([]*dto.VariantDto, 0, len(rDto.Variants))
+	for _, v := range rDto.Variants {
+		if v == nil {
+			return nil, fmt.Errorf("empty variant")
+		}
+		variant, err := s.resolveVariant(&v.SizeRequestDto)
+		if err != nil {
+			return nil, err
+		}
+		err = s.requestValidator.Validate(v)
+		if err != nil {
+			return nil, err
+		}
+		// format of preset has priority
+		if len(variant.Format) == 0 && len(v.Format) > 0 {
+			variant.Format, err = utils.NormalizeImageFormat(v.Format)
+			if err != nil {
+				return nil, err
+			}
+		}
+		variants = append(variants, variant)
+	}
+	return variants, nil
+}
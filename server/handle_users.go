@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_request_dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/service"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// count of files deleted from cloud store between saves of erasure progress
+const ErasureBatchSize = 1000
+
+// Function to handle admin request for erasure of all user data: files under user prefix in cloud store,
+// images records, API keys, jobs and webhook deliveries. Response has signed report of erasure.
+// Progress is saved after every step, so interrupted erasure is continued by repeated request
+func (s *ApiServerRequestProcessor) HandleEraseUserRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	answer := &http_response_dto.UserErasureResponseDto{}
+	jsonEncoder := json.NewEncoder(w)
+	s.log(r.Context()).Info("Got admin request")
+
+	rDto := http_request_dto.EraseUserRequestDto{UserId: mux.Vars(r)["user_id"]}
+	answer.UserId = rDto.UserId
+	answer.RequestId = r.URL.Query().Get("request_id")
+
+	var perr *processingError
+	if err := s.requestValidator.Validate(rDto); err != nil {
+		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgInvalidRequestParamValues, err)
+		perr = &processingError{http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg, nil}
+	} else if len(s.cfg.Erasure.Secret) == 0 {
+		perr = &processingError{http.StatusNotImplemented, utils.ErrSigningNotConfiguredCode, "Erasure report signing is not configured", nil}
+	} else if _, running := s.erasures.LoadOrStore(rDto.UserId, true); running {
+		perr = &processingError{http.StatusConflict, utils.ErrErasureInProgressCode, utils.ErrMsgErasureInProgress, nil}
+	}
+	if perr != nil {
+		s.log(r.Context()).Error(perr.errMsg)
+		writeErrResponseUserErasureRequest(w, answer, perr)
+		if err := jsonEncoder.Encode(answer); err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+	defer s.erasures.Delete(rDto.UserId)
+
+	logEntity := s.log(r.Context()).WithField("userId", rDto.UserId)
+	erasure, perr := s.eraseUserData(r.Context(), rDto.UserId, logEntity)
+	if perr != nil {
+		writeErrResponseUserErasureRequest(w, answer, perr)
+		if err := jsonEncoder.Encode(answer); err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+
+	logEntity.WithFields(logrus.Fields{
+		"files":  erasure.Files,
+		"images": erasure.Images,
+	}).Info("User data erased")
+	answer.Report = erasureReport(erasure)
+	if err := jsonEncoder.Encode(answer); err != nil {
+		s.log(r.Context()).Errorf("Cannot send response: %v", err)
+	}
+}
+
+// Delete all user data step by step. Deleted counts are saved after every step, repeated steps are no-op
+// if data already deleted. Completed erasure is repeated to remove data created after it,
+// its report is changed only if something is deleted
+func (s *ApiServerRequestProcessor) eraseUserData(ctx context.Context, userId string, logEntity *logrus.Entry) (*dto.ErasureDto, *processingError) {
+	erasure, err := s.dbStore.GetErasure(ctx, userId)
+	if errors.Is(err, service.ErrNotFound) {
+		erasure = &dto.ErasureDto{UserId: userId, StartedAt: erasureTime()}
+	} else if err != nil {
+		logEntity.Errorf("Cannot get erasure state: %v", err)
+		return nil, erasureError(err)
+	}
+
+	started := false
+	saveProgress := func() *processingError {
+		if !started {
+			started = true
+			erasure.Attempts++
+			erasure.State = dto.ErasureStateInProgress
+			erasure.Signature = ""
+		}
+		erasure.UpdatedAt = erasureTime()
+		if err := s.dbStore.SaveErasure(ctx, erasure); err != nil {
+			logEntity.Errorf("Cannot save erasure state: %v", err)
+			return erasureError(err)
+		}
+		return nil
+	}
+	if erasure.State != dto.ErasureStateCompleted {
+		if perr := saveProgress(); perr != nil {
+			return nil, perr
+		}
+	}
+
+	// cached copies of user files are dropped before files, so they are not served after erasure
+	s.uncacheUser(userId)
+
+	// files are deleted first, so records of not deleted files are kept for next attempt
+	keys, err := s.cloudStore.ListUserFiles(ctx, userId)
+	if err != nil {
+		logEntity.Errorf("Cannot list user files: %v", err)
+		return nil, erasureError(err)
+	}
+	for start := 0; start < len(keys); start += ErasureBatchSize {
+		end := start + ErasureBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err = s.cloudStore.DeleteFiles(ctx, keys[start:end]); err != nil {
+			logEntity.Errorf("Cannot delete user files: %v", err)
+			return nil, erasureError(err)
+		}
+		erasure.Files += int64(end - start)
+		if perr := saveProgress(); perr != nil {
+			return nil, perr
+		}
+	}
+
+	steps := []struct {
+		name    string
+		deleted *int64
+		delete  func() (int64, error)
+	}{
+		{"images", &erasure.Images, func() (int64, error) { return s.dbStore.DeleteAllUserImages(ctx, userId) }},
+		{"API keys", &erasure.ApiKeys, func() (int64, error) { return s.dbStore.DeleteUserApiKeys(ctx, userId) }},
+		{"jobs", &erasure.Jobs, func() (int64, error) { return s.jobStore.DeleteUserJobs(userId) }},
+		{"webhook deliveries", &erasure.WebhookDeliveries, func() (int64, error) { return s.webhookLog.DeleteUserWebhookDeliveries(userId) }},
+	}
+	for _, step := range steps {
+		deleted, err := step.delete()
+		if err != nil {
+			logEntity.Errorf("Cannot delete user %s: %v", step.name, err)
+			return nil, erasureError(err)
+		}
+		if deleted == 0 {
+			continue
+		}
+		*step.deleted += deleted
+		if perr := saveProgress(); perr != nil {
+			return nil, perr
+		}
+	}
+
+	if !started {
+		return erasure, nil
+	}
+	erasure.State = dto.ErasureStateCompleted
+	erasure.CompletedAt = erasureTime()
+	erasure.Signature = utils.HmacSignature(s.cfg.Erasure.Secret, erasureReportPayload(erasureReport(erasure)))
+	if perr := saveProgress(); perr != nil {
+		return nil, perr
+	}
+	return erasure, nil
+}
+
+// Check erasure config. Empty secret disables erasure, secret of url signing cannot be reused for reports
+func ValidateErasure(cfg *dto.Config) error {
+	if len(cfg.Erasure.Secret) > 0 && cfg.Erasure.Secret == cfg.Signing.Secret {
+		return fmt.Errorf("erasure secret must differ from signing secret")
+	}
+	return nil
+}
+
+func erasureReport(erasure *dto.ErasureDto) *http_response_dto.ErasureReportDto {
+	return &http_response_dto.ErasureReportDto{
+		UserId:                   erasure.UserId,
+		State:                    erasure.State,
+		Attempts:                 erasure.Attempts,
+		FilesDeleted:             erasure.Files,
+		ImagesDeleted:            erasure.Images,
+		ApiKeysDeleted:           erasure.ApiKeys,
+		JobsDeleted:              erasure.Jobs,
+		WebhookDeliveriesDeleted: erasure.WebhookDeliveries,
+		StartedAt:                erasure.StartedAt,
+		CompletedAt:              erasure.CompletedAt,
+		Signature:                erasure.Signature,
+	}
+}
+
+// Payload for signing: report json without signature
+func erasureReportPayload(report *http_response_dto.ErasureReportDto) string {
+	unsigned := *report
+	unsigned.Signature = ""
+	payload, _ := json.Marshal(&unsigned)
+	return string(payload)
+}
+
+// Time of erasure events is stored in DB with millisecond precision,
+// so signed report is the same after erasure is loaded from DB
+func erasureTime() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// Failed erasure can be continued later
+func erasureError(err error) *processingError {
+	return &processingError{http.StatusServiceUnavailable, utils.ErrStorageUnavailableCode, utils.ErrMsgStorageUnavailable, err}
+}
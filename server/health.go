@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	HealthPath    = "/healthz"
+	ReadinessPath = "/readyz"
+
+	HealthStatusOk       = "ok"
+	HealthStatusFail     = "fail"
+	HealthStatusDraining = "draining"
+
+	// names of dependencies in readiness response
+	DependencyDb         = "mongo"
+	DependencyCloudStore = "s3"
+
+	DefaultHealthCacheTtl = 5 * time.Second
+	DefaultHealthTimeout  = 2 * time.Second
+)
+
+// Last result of dependency checks, shared by all readiness requests
+type readinessCache struct {
+	mu           sync.Mutex
+	checkedAt    time.Time
+	ready        bool
+	dependencies map[string]*http_response_dto.DependencyStatusDto
+}
+
+// Readiness check fails from this moment, requests are still processed
+func (s *ApiServerRequestProcessor) StartDraining() {
+	s.drainOnce.Do(func() {
+		close(s.draining)
+	})
+}
+
+func (s *ApiServerRequestProcessor) isDraining() bool {
+	select {
+	case <-s.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// Liveness check, process is able to serve http requests
+func (s *ApiServerRequestProcessor) HandleHealthRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	s.writeHealthResponse(w, http.StatusOK, &http_response_dto.HealthResponseDto{Status: HealthStatusOk})
+}
+
+// Readiness check, all dependencies are reachable and server is not shutting down
+func (s *ApiServerRequestProcessor) HandleReadinessRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	ready, dependencies := s.checkDependencies()
+	answer := &http_response_dto.HealthResponseDto{
+		Status:       HealthStatusOk,
+		Dependencies: dependencies,
+	}
+	serverCode := http.StatusOK
+	switch {
+	case s.isDraining():
+		answer.Status = HealthStatusDraining
+		serverCode = http.StatusServiceUnavailable
+	case !ready:
+		answer.Status = HealthStatusFail
+		serverCode = http.StatusServiceUnavailable
+	}
+	s.writeHealthResponse(w, serverCode, answer)
+}
+
+func (s *ApiServerRequestProcessor) writeHealthResponse(w http.ResponseWriter, serverCode int, answer *http_response_dto.HealthResponseDto) {
+	w.WriteHeader(serverCode)
+	if err := json.NewEncoder(w).Encode(answer); err != nil {
+		s.logger.Errorf("Cannot send response: %v", err)
+	}
+}
+
+// Ping all dependencies in parallel. Result is cached, so frequent probes do not load Mongo and S3
+func (s *ApiServerRequestProcessor) checkDependencies() (bool, map[string]*http_response_dto.DependencyStatusDto) {
+	cacheTtl := s.cfg.Health.CacheTtl.Duration
+	if cacheTtl <= 0 {
+		cacheTtl = DefaultHealthCacheTtl
+	}
+	timeout := s.cfg.Health.Timeout.Duration
+	if timeout <= 0 {
+		timeout = DefaultHealthTimeout
+	}
+
+	cache := &s.readiness
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.dependencies != nil && time.Since(cache.checkedAt) < cacheTtl {
+		return cache.ready, cache.dependencies
+	}
+
+	checks := map[string]func(ctx context.Context) error{
+		DependencyDb:         s.dbStore.Ping,
+		DependencyCloudStore: s.cloudStore.Ping,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	ready := true
+	dependencies := make(map[string]*http_response_dto.DependencyStatusDto, len(checks))
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) error) {
+			defer wg.Done()
+			started := time.Now()
+			err := check(ctx)
+			status := &http_response_dto.DependencyStatusDto{
+				Status:    HealthStatusOk,
+				LatencyMs: time.Since(started).Milliseconds(),
+				CheckedAt: started.Unix(),
+			}
+			if err != nil {
+				s.logger.Warnf("Readiness check of %s failed: %v", name, err)
+				status.Status = HealthStatusFail
+				status.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			dependencies[name] = status
+			if err != nil {
+				ready = false
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	cache.checkedAt = time.Now()
+	cache.ready = ready
+	cache.dependencies = dependencies
+	return ready, dependencies
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"image"
+	"os"
+)
+
+// Recently used originals and variants are kept in memory, so new variant of hot image is made
+// without download of original and hot variant is delivered without download from cloud.
+// Entries are keyed by user and cloud url, so all images of user can be dropped on erasure
+
+func imageCacheKey(userId, url string) string {
+	return userId + "/" + url
+}
+
+// Original of stored image from cache or cloud store. Returned image is not shared with other requests
+func (s *ApiServerRequestProcessor) loadOriginal(
+	ctx context.Context,
+	userId string,
+	imageId uint32,
+	url string,
+	errStatus int,
+	logEntity *logrus.Entry) (*sourceImage, *processingError) {
+
+	if cached, ok := s.originals.Get(imageCacheKey(userId, url)); ok {
+		src := *cached.(*sourceImage)
+		return &src, nil
+	}
+
+	file, err := s.cloudStore.Download(ctx, url, userId, imageId)
+	if err != nil {
+		logEntity.Errorf("Cannot download image from cloud store: %v", err)
+		return nil, downloadError(err, errStatus)
+	}
+	// delete downloaded file from FS
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	return newSourceImage(file, storedOriginalName(url)), nil
+}
+
+// Keep original after it was processed. Decoded image is kept only with Cache.DecodedOriginals,
+// its size is counted as 4 bytes per pixel
+func (s *ApiServerRequestProcessor) cacheOriginal(userId, url string, src *sourceImage) {
+	if !s.originals.Enabled() || len(url) == 0 {
+		return
+	}
+	cached := &sourceImage{name: src.name, content: src.content}
+	size := int64(len(src.content))
+	if s.cfg.Cache.DecodedOriginals && src.decoded != nil {
+		cached.decoded = src.decoded
+		size += decodedSize(src.decoded)
+	}
+	s.originals.Set(imageCacheKey(userId, url), cached, size)
+}
+
+func decodedSize(img image.Image) int64 {
+	bounds := img.Bounds()
+	return 4 * int64(bounds.Dx()) * int64(bounds.Dy())
+}
+
+func (s *ApiServerRequestProcessor) cachedVariant(userId, url string) []byte {
+	if cached, ok := s.variants.Get(imageCacheKey(userId, url)); ok {
+		return cached.([]byte)
+	}
+	return nil
+}
+
+func (s *ApiServerRequestProcessor) cacheVariant(userId, url string, content []byte) {
+	if len(url) == 0 {
+		return
+	}
+	s.variants.Set(imageCacheKey(userId, url), content, int64(len(content)))
+}
+
+// Drop cached files of image which are deleted from cloud store
+func (s *ApiServerRequestProcessor) uncacheImage(userId string, urls []string) {
+	for _, url := range urls {
+		s.originals.Delete(imageCacheKey(userId, url))
+		s.variants.Delete(imageCacheKey(userId, url))
+	}
+}
+
+// Drop all cached files of user
+func (s *ApiServerRequestProcessor) uncacheUser(userId string) {
+	s.originals.DeletePrefix(userId + "/")
+	s.variants.DeletePrefix(userId + "/")
+}
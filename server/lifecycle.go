@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/service/metrics"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+// Lifecycle policies delete stored images which are not needed anymore. Policies are applied in order:
+// retention of originals, expiration of not accessed variants, limit of variants per original.
+// Every record is one variant, original is deleted only with its last variant, so it stays reachable
+// for resize-by-id while it has any record
+
+// Count of deleted records by policy
+type LifecycleStats struct {
+	ExpiredOriginals int
+	ExpiredVariants  int
+	EvictedVariants  int
+}
+
+func (s *ApiServerRequestProcessor) lifecycleEnabled() bool {
+	cfg := s.cfg.Lifecycle
+	return cfg.VariantTtl.Duration > 0 || cfg.OriginalRetention.Duration > 0 || cfg.MaxVariants > 0
+}
+
+// Run lifecycle policies every Lifecycle.Interval until shutdown
+func (s *ApiServerRequestProcessor) StartLifecycleScheduler() {
+	interval := s.cfg.Lifecycle.Interval.Duration
+	if interval <= 0 || !s.lifecycleEnabled() {
+		return
+	}
+	s.logger.Infof("Lifecycle policies are applied every %s", interval)
+
+	s.backgroundTasks.Add(1)
+	go func() {
+		defer s.backgroundTasks.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stopping:
+				return
+			case <-ticker.C:
+			}
+
+			// run is interrupted on shutdown, policies are applied again on next start
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				select {
+				case <-s.stopping:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			stats, err := s.ApplyLifecyclePolicies(ctx)
+			cancel()
+			if err != nil {
+				s.logger.Errorf("Cannot apply lifecycle policies: %v", err)
+				continue
+			}
+			s.logger.WithFields(logrus.Fields{
+				"expiredOriginals": stats.ExpiredOriginals,
+				"expiredVariants":  stats.ExpiredVariants,
+				"evictedVariants":  stats.EvictedVariants,
+			}).Info("Lifecycle policies applied")
+		}
+	}()
+}
+
+// Original with its variants is identified by user and image id
+type lifecycleImageKey struct {
+	userId string
+	picId  uint32
+}
+
+// Apply all configured lifecycle policies once. Deleted records are counted even if run failed
+func (s *ApiServerRequestProcessor) ApplyLifecyclePolicies(ctx context.Context) (*LifecycleStats, error) {
+	cfg := s.cfg.Lifecycle
+	now := time.Now().UTC()
+	stats := &LifecycleStats{}
+
+	if cfg.OriginalRetention.Duration > 0 {
+		if err := s.expireOriginals(ctx, now.Add(-cfg.OriginalRetention.Duration), stats); err != nil {
+			return stats, err
+		}
+	}
+	if cfg.VariantTtl.Duration > 0 {
+		if err := s.expireVariants(ctx, now.Add(-cfg.VariantTtl.Duration), stats); err != nil {
+			return stats, err
+		}
+	}
+	if cfg.MaxVariants > 0 {
+		if err := s.evictVariants(ctx, cfg.MaxVariants, stats); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// Delete originals uploaded before deadline with all their variants.
+// Original is uploaded with its first variant, so it is expired if any its record is created before deadline
+func (s *ApiServerRequestProcessor) expireOriginals(ctx context.Context, deadline time.Time, stats *LifecycleStats) error {
+	records := s.dbStore.FindImagesCreatedBefore(ctx, deadline)
+	if records == nil {
+		return fmt.Errorf(utils.ErrMsgCannotGetUserImages)
+	}
+
+	// images of different users can have the same id
+	expired := map[lifecycleImageKey]bool{}
+	for _, img := range records {
+		key := lifecycleImageKey{img.UserId, img.PicId}
+		if expired[key] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		expired[key] = true
+
+		variants := s.dbStore.FindAllPictureByUserAndImageId(ctx, img.UserId, img.PicId)
+		if variants == nil {
+			return fmt.Errorf(utils.ErrMsgCannotGetUserImages)
+		}
+		urls := []string{img.OriginalImageUrl}
+		for _, variant := range variants {
+			urls = append(urls, variant.ResizedImageUrl)
+		}
+		// files are deleted first, so records of not deleted files are kept for next run
+		if err := s.cloudStore.DeleteImageFiles(ctx, img.UserId, img.PicId, urls); err != nil {
+			return err
+		}
+		s.uncacheImage(img.UserId, urls)
+		for _, variant := range variants {
+			if err := s.dbStore.DeleteImage(ctx, variant); err != nil {
+				return err
+			}
+			metrics.LifecycleDeleted.WithLabelValues(metrics.PolicyOriginalRetention).Inc()
+		}
+		stats.ExpiredOriginals++
+		s.logger.WithFields(logrus.Fields{
+			"UserId":  img.UserId,
+			"ImageId": img.PicId,
+		}).Info("Original expired")
+	}
+	return nil
+}
+
+// Delete variants not accessed since deadline, last variant of original is kept
+func (s *ApiServerRequestProcessor) expireVariants(ctx context.Context, deadline time.Time, stats *LifecycleStats) error {
+	records := s.dbStore.FindImagesAccessedBefore(ctx, deadline)
+	if records == nil {
+		return fmt.Errorf(utils.ErrMsgCannotGetUserImages)
+	}
+
+	for _, img := range records {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		variants := s.dbStore.FindAllPictureByUserAndImageId(ctx, img.UserId, img.PicId)
+		if variants == nil {
+			return fmt.Errorf(utils.ErrMsgCannotGetUserImages)
+		}
+		if len(variants) <= 1 {
+			continue
+		}
+		if err := s.deleteVariant(ctx, img, metrics.PolicyVariantTtl); err != nil {
+			return err
+		}
+		stats.ExpiredVariants++
+	}
+	return nil
+}
+
+// Keep max variants per original, least recently accessed variants are deleted
+func (s *ApiServerRequestProcessor) evictVariants(ctx context.Context, max int, stats *LifecycleStats) error {
+	records := s.dbStore.FindImagesWithVariantsOver(ctx, max)
+	if records == nil {
+		return fmt.Errorf(utils.ErrMsgCannotGetUserImages)
+	}
+
+	images := map[lifecycleImageKey][]*dto.DbImageStoreDAO{}
+	for _, img := range records {
+		key := lifecycleImageKey{img.UserId, img.PicId}
+		images[key] = append(images[key], img)
+	}
+	for _, variants := range images {
+		if len(variants) <= max {
+			continue
+		}
+		sort.Slice(variants, func(i, j int) bool {
+			return lastAccessed(variants[i]).After(lastAccessed(variants[j]))
+		})
+		for _, img := range variants[max:] {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := s.deleteVariant(ctx, img, metrics.PolicyMaxVariants); err != nil {
+				return err
+			}
+			stats.EvictedVariants++
+		}
+	}
+	return nil
+}
+
+func (s *ApiServerRequestProcessor) deleteVariant(ctx context.Context, img *dto.DbImageStoreDAO, policy string) error {
+	if err := s.cloudStore.DeleteImageFiles(ctx, img.UserId, img.PicId, []string{img.ResizedImageUrl}); err != nil {
+		return err
+	}
+	s.uncacheImage(img.UserId, []string{img.ResizedImageUrl})
+	if err := s.dbStore.DeleteImage(ctx, img); err != nil {
+		return err
+	}
+	metrics.LifecycleDeleted.WithLabelValues(policy).Inc()
+	s.logger.WithFields(logrus.Fields{
+		"UserId":  img.UserId,
+		"ImageId": img.PicId,
+		"Url":     img.ResizedImageUrl,
+		"Policy":  policy,
+	}).Info("Variant deleted")
+	return nil
+}
+
+// Records inserted before access time was stored are accessed last time on creation
+func lastAccessed(img *dto.DbImageStoreDAO) time.Time {
+	if img.LastAccessedAt.IsZero() {
+		return img.CreatedAt
+	}
+	return img.LastAccessedAt
+}
+
+// Save access time of variant found in DB, failed update only delays its expiration
+func (s *ApiServerRequestProcessor) touchVariant(ctx context.Context, img *dto.DbImageStoreDAO) {
+	now := time.Now().UTC()
+	if err := s.dbStore.TouchImage(ctx, img, now); err != nil {
+		s.log(ctx).Warnf("Cannot update access time of variant: %v", err)
+		return
+	}
+	img.LastAccessedAt = now
+}
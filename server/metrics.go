@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/service/metrics"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const MetricsPath = "/metrics"
+
+// keeps status code of response for request metrics
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// streaming responses flush every written part
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// gives http.ResponseController access to deadlines of connection
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := r.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("hijacking is not supported")
+}
+
+// Middleware counts requests and their latency by route template, so ids in path do not produce new series
+func (s *ApiServerRequestProcessor) InstrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		labels := []string{route, r.Method, strconv.Itoa(status)}
+		metrics.HttpRequests.WithLabelValues(labels...).Inc()
+		metrics.HttpRequestDuration.WithLabelValues(labels...).Observe(time.Since(started).Seconds())
+	})
+}
+
+// Search already generated variant of user in DB, result is counted as variant cache hit or miss.
+// Access time of found variant is updated for lifecycle policies
+func (s *ApiServerRequestProcessor) findVariant(ctx context.Context, userId string, imageId uint32, variant *dto.VariantDto) *dto.DbImageStoreDAO {
+	img := s.dbStore.GetImage(ctx, userId, imageId, variant)
+	if img != nil {
+		metrics.VariantCache.WithLabelValues(metrics.CacheHit).Inc()
+		s.touchVariant(ctx, img)
+	} else {
+		metrics.VariantCache.WithLabelValues(metrics.CacheMiss).Inc()
+	}
+	return img
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_request_dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"os"
+)
+
+// Check presets from config, application should not start with broken preset
+func ValidatePresets(presets map[string]dto.PresetConfig) error {
+	for name, p := range presets {
+		if p.Width < 1 || p.Height < 1 {
+			return fmt.Errorf("preset %q: width and height should be positive", name)
+		}
+		if !dto.IsValidResizeMode(p.Mode) {
+			return fmt.Errorf("preset %q: unknown mode %q", name, p.Mode)
+		}
+		if len(p.Format) > 0 {
+			if _, err := utils.NormalizeImageFormat(p.Format); err != nil {
+				return fmt.Errorf("preset %q: %v", name, err)
+			}
+		}
+		if p.Quality < 0 || p.Quality > 100 {
+			return fmt.Errorf("preset %q: quality should be in range 0-100", name)
+		}
+	}
+	return nil
+}
+
+func presetVariant(name string, p dto.PresetConfig) *dto.VariantDto {
+	format, _ := utils.NormalizeImageFormat(p.Format)
+	return &dto.VariantDto{
+		Width:   p.Width,
+		Height:  p.Height,
+		Format:  format,
+		Mode:    p.Mode,
+		Quality: p.Quality,
+		Preset:  name,
+	}
+}
+
+// Build variant params from request size params.
+// If preset set in request, its params are used and request size is filled by preset size
+func (s *ApiServerRequestProcessor) resolveVariant(size *http_request_dto.SizeRequestDto) (*dto.VariantDto, error) {
+	if len(size.Preset) == 0 {
+		return &dto.VariantDto{Width: size.Width, Height: size.Height}, nil
+	}
+	p, ok := s.cfg.Presets[size.Preset]
+	if !ok {
+		return nil, fmt.Errorf("unknown preset %q", size.Preset)
+	}
+	size.Width = p.Width
+	size.Height = p.Height
+	return presetVariant(size.Preset, p), nil
+}
+
+// Apply output params set in request to variant. Variant with own params is not a preset variant anymore
+func applyTransform(variant *dto.VariantDto, transform *http_request_dto.TransformRequestDto) error {
+	if !dto.IsValidResizeMode(transform.Mode) {
+		return fmt.Errorf("unknown mode %q", transform.Mode)
+	}
+	if len(transform.Format) > 0 {
+		format, err := utils.NormalizeImageFormat(transform.Format)
+		if err != nil {
+			return err
+		}
+		variant.Format = format
+		variant.Preset = ""
+	}
+	if len(transform.Mode) > 0 {
+		variant.Mode = transform.Mode
+		variant.Preset = ""
+	}
+	if transform.Quality > 0 {
+		variant.Quality = transform.Quality
+		variant.Preset = ""
+	}
+	return nil
+}
+
+// Check if image record was resized with the same params as variant
+func sameVariant(img *dto.DbImageStoreDAO, variant *dto.VariantDto) bool {
+	mode := img.Mode
+	if len(mode) == 0 {
+		mode = dto.ResizeModeResize
+	}
+	variantMode := variant.Mode
+	if len(variantMode) == 0 {
+		variantMode = dto.ResizeModeResize
+	}
+	return img.ResizedWidth == variant.Width &&
+		img.ResizedHeight == variant.Height &&
+		(len(variant.Format) == 0 || img.Format == variant.Format) &&
+		mode == variantMode &&
+		img.Quality == variant.Quality
+}
+
+// Regenerate all variants of preset which were made by previous preset definition.
+// Old variant records and files are replaced by new ones. Return count of regenerated variants,
+// outdated variants which new variant already exists for are only deleted
+func (s *ApiServerRequestProcessor) ReprocessPreset(name string) (int, error) {
+	p, ok := s.cfg.Presets[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown preset %q", name)
+	}
+	variant := presetVariant(name, p)
+
+	// regenerated variant replaces existing one, so it is not limited by quotas
+	ctx := withQuotaExempt(context.Background())
+	records := s.dbStore.FindAllPictureByPreset(ctx, name)
+	if records == nil {
+		return 0, fmt.Errorf(utils.ErrMsgCannotGetUserImages)
+	}
+
+	count := 0
+	for _, img := range records {
+		if sameVariant(img, variant) {
+			continue
+		}
+
+		logEntry := s.logger.WithFields(logrus.Fields{
+			"UserId":  img.UserId,
+			"ImageId": img.PicId,
+			"Preset":  name,
+		})
+
+		// new variant can be already made, e.g. by interrupted run or by request after preset changed
+		var newUrl string
+		if exist := s.dbStore.GetImage(ctx, img.UserId, img.PicId, variant); exist != nil {
+			newUrl = exist.ResizedImageUrl
+		} else {
+			var err error
+			if newUrl, err = s.regenerateVariant(ctx, img, variant, logEntry); err != nil {
+				return count, err
+			}
+			count++
+			logEntry.Info("Variant regenerated")
+		}
+
+		// file of new variant is never deleted, even if it replaced file of outdated one
+		if img.ResizedImageUrl != newUrl {
+			if err := s.cloudStore.DeleteImageFiles(ctx, img.UserId, img.PicId, []string{img.ResizedImageUrl}); err != nil {
+				logEntry.Errorf("Cannot delete file of outdated variant: %v", err)
+				return count, err
+			}
+			s.uncacheImage(img.UserId, []string{img.ResizedImageUrl})
+		}
+		if err := s.dbStore.DeleteImage(ctx, img); err != nil {
+			logEntry.Errorf("Cannot delete outdated variant: %v", err)
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// Make new variant from original of outdated one, return url of new variant
+func (s *ApiServerRequestProcessor) regenerateVariant(ctx context.Context, img *dto.DbImageStoreDAO, variant *dto.VariantDto, logEntity *logrus.Entry) (string, error) {
+	file, err := s.cloudStore.Download(ctx, img.OriginalImageUrl, img.UserId, img.PicId)
+	if err != nil {
+		logEntity.Errorf("Cannot download image from cloud store: %v", err)
+		return "", err
+	}
+	// delete downloaded file from FS
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	answer := &http_response_dto.ResizeImageResponseDto{}
+	answer.OriginalImagePath = img.OriginalImageUrl
+	_, perr := s.processImageResizeWorkflow(ctx, newSourceImage(file, storedOriginalName(img.OriginalImageUrl)), variant, img.PicId, img.UserId, answer, logEntity, false)
+	if perr != nil {
+		return "", fmt.Errorf("%s", perr.errMsg)
+	}
+	return answer.ResizedImagePath, nil
+}
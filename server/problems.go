@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/service"
+	"github.com/senseyman/image-media-processor/service/logging"
+	"github.com/senseyman/image-media-processor/utils"
+	"net/http"
+	"strconv"
+)
+
+// Errors of API v2 are reported as RFC 7807 problem details.
+// Handlers are shared with API v1, error written by handler is replaced by problem details response
+
+const (
+	ProblemContentType = "application/problem+json"
+	// problems are identified by numeric code, so type has no own semantics
+	ProblemTypeDefault = "about:blank"
+)
+
+// Status of API v2 response by error code, if it differs from API v1 status
+var problemStatuses = map[int]int{
+	utils.ErrInvalidRequestParamValuesCode:  http.StatusUnprocessableEntity,
+	utils.ErrImageNotFoundCode:              http.StatusNotFound,
+	utils.ErrImageIdGenerateCode:            http.StatusInternalServerError,
+	utils.ErrUploadImageCode:                http.StatusServiceUnavailable,
+	utils.ErrCannotGetUserImagesCode:        http.StatusServiceUnavailable,
+	utils.ErrCannotGetWebhookDeliveriesCode: http.StatusServiceUnavailable,
+	utils.ErrCannotGetApiKeysCode:           http.StatusServiceUnavailable,
+}
+
+// Status of API v2 response. Typed service error is more precise than error code,
+// e.g. failed download can be caused by missing file or by unavailable cloud store
+func problemStatus(perr *processingError) int {
+	switch {
+	case perr.cause == nil:
+	case errors.Is(perr.cause, service.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(perr.cause, service.ErrAlreadyExists):
+		return http.StatusConflict
+	case errors.Is(perr.cause, service.ErrUnsupportedMedia):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(perr.cause, service.ErrInvalidImage):
+		return http.StatusUnprocessableEntity
+	case errors.Is(perr.cause, service.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	}
+	if status, ok := problemStatuses[perr.errCode]; ok {
+		return status
+	}
+	return perr.serverCode
+}
+
+// Error of failed image lookup in DB, unavailable DB is not reported as missing image
+func imageLookupError(err error, notFoundStatus int) *processingError {
+	if errors.Is(err, service.ErrUnavailable) {
+		return &processingError{http.StatusServiceUnavailable, utils.ErrStorageUnavailableCode, utils.ErrMsgStorageUnavailable, err}
+	}
+	return &processingError{notFoundStatus, utils.ErrImageNotFoundCode, utils.ErrMsgImageNotFound, err}
+}
+
+// Error of failed download from cloud store, missing file and unavailable store are not reported as bad request
+func downloadError(err error, defaultStatus int) *processingError {
+	status := defaultStatus
+	switch {
+	case errors.Is(err, service.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, service.ErrUnavailable):
+		status = http.StatusServiceUnavailable
+	}
+	return &processingError{status, utils.ErrLoadFileCode, utils.ErrMsgLoadFile, err}
+}
+
+// Response writer of API v2 routes, keeps error of handler and drops its API v1 error body
+type problemWriter struct {
+	http.ResponseWriter
+	problem *processingError
+}
+
+func (w *problemWriter) Write(b []byte) (int, error) {
+	if w.problem != nil {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *problemWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok && w.problem == nil {
+		flusher.Flush()
+	}
+}
+
+func (w *problemWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Write status of failed request. On API v2 routes error is kept for problem details response
+func writeErrStatus(w http.ResponseWriter, perr *processingError) {
+	if pw, ok := w.(*problemWriter); ok {
+		pw.problem = perr
+		return
+	}
+	if perr.serverCode == http.StatusServiceUnavailable && len(w.Header().Get("Retry-After")) == 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(RetryAfterSeconds))
+	}
+	w.WriteHeader(perr.serverCode)
+}
+
+// Middleware of API v2, errors of handlers are sent as application/problem+json
+func (s *ApiServerRequestProcessor) ProblemDetails(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pw := &problemWriter{ResponseWriter: w}
+		next.ServeHTTP(pw, r)
+		if pw.problem != nil {
+			s.writeProblem(w, r, pw.problem)
+		}
+	})
+}
+
+func (s *ApiServerRequestProcessor) writeProblem(w http.ResponseWriter, r *http.Request, perr *processingError) {
+	status := problemStatus(perr)
+	if status == http.StatusServiceUnavailable && len(w.Header().Get("Retry-After")) == 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(RetryAfterSeconds))
+	}
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(status)
+
+	answer := &http_response_dto.ProblemDto{
+		Type:      ProblemTypeDefault,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    perr.errMsg,
+		Instance:  r.URL.Path,
+		Code:      perr.errCode,
+		RequestId: logging.RequestIdFromContext(r.Context()),
+	}
+	if err := json.NewEncoder(w).Encode(answer); err != nil {
+		s.log(r.Context()).Errorf("Cannot send response: %v", err)
+	}
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/schema"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_request_dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Per-user quotas of stored originals, variants, bytes and megapixels processed per day.
+// Usage is computed from records of user images, so it is shared by all instances
+
+type quotaExemptKey struct{}
+
+// Mark context of maintenance processing, like preset reprocessing, which is not limited by quotas
+func withQuotaExempt(ctx context.Context) context.Context {
+	return context.WithValue(ctx, quotaExemptKey{}, true)
+}
+
+func isQuotaExempt(ctx context.Context) bool {
+	exempt, _ := ctx.Value(quotaExemptKey{}).(bool)
+	return exempt
+}
+
+// usage of user and ids of his stored originals
+type userUsage struct {
+	dto.UsageDto
+	images map[uint32]bool
+}
+
+// Usage reserved by processing of users on this instance, which is not stored to DB yet.
+// Quota of user is checked and reserved under lock of user, so concurrent requests cannot exceed it together
+type quotaReservations struct {
+	mu    sync.Mutex
+	users map[string]*userReservations
+}
+
+type userReservations struct {
+	mu sync.Mutex
+	// count of requests holding or waiting for reservation
+	refs  int
+	usage dto.UsageDto
+	// count of reservations of not stored originals by their ids
+	images map[uint32]int
+}
+
+// usage reserved by one processing
+type quotaReservation struct {
+	userId  string
+	imageId uint32
+	usage   dto.UsageDto
+	user    *userReservations
+}
+
+func (q *quotaReservations) acquire(userId string) *userReservations {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.users == nil {
+		q.users = map[string]*userReservations{}
+	}
+	user, ok := q.users[userId]
+	if !ok {
+		user = &userReservations{images: map[uint32]int{}}
+		q.users[userId] = user
+	}
+	user.refs++
+	return user
+}
+
+func (q *quotaReservations) release(userId string, user *userReservations) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	user.refs--
+	if user.refs == 0 {
+		delete(q.users, userId)
+	}
+}
+
+// Usage of user stored in DB together with usage reserved on this instance, user reservations must be locked
+func (s *ApiServerRequestProcessor) reservedUsage(ctx context.Context, userId string, user *userReservations,
+	logEntity *logrus.Entry) (*userUsage, *processingError) {
+
+	usage, perr := s.loadUsage(ctx, userId, logEntity)
+	if perr != nil {
+		return nil, perr
+	}
+	usage.Originals += user.usage.Originals
+	usage.Variants += user.usage.Variants
+	usage.Bytes += user.usage.Bytes
+	usage.MegapixelsToday += user.usage.MegapixelsToday
+	for id := range user.images {
+		usage.images[id] = true
+	}
+	return usage, nil
+}
+
+// Check quota of user and reserve usage of new variant until it is stored to DB or processing failed
+func (s *ApiServerRequestProcessor) reserveQuota(ctx context.Context, userId string, imageId uint32, variant *dto.VariantDto,
+	saveOriginal bool, originalSize int, logEntity *logrus.Entry) (*quotaReservation, *processingError) {
+
+	user := s.quotaReservations.acquire(userId)
+	user.mu.Lock()
+	defer user.mu.Unlock()
+
+	usage, perr := s.reservedUsage(ctx, userId, user, logEntity)
+	if perr != nil {
+		s.quotaReservations.release(userId, user)
+		return nil, perr
+	}
+	planned := plannedUsage(usage, imageId, variant, saveOriginal, originalSize)
+	if perr = s.checkQuota(usage, planned, logEntity); perr != nil {
+		s.quotaReservations.release(userId, user)
+		return nil, perr
+	}
+
+	reservation := &quotaReservation{userId: userId, imageId: imageId, user: user}
+	reservation.add(planned)
+	return reservation, nil
+}
+
+// Check quota of user and add size of resized image to reservation, nil reservation means quotas are not checked
+func (s *ApiServerRequestProcessor) reserveQuotaBytes(ctx context.Context, reservation *quotaReservation, size int64,
+	logEntity *logrus.Entry) *processingError {
+
+	if reservation == nil {
+		return nil
+	}
+	reservation.user.mu.Lock()
+	defer reservation.user.mu.Unlock()
+
+	usage, perr := s.reservedUsage(ctx, reservation.userId, reservation.user, logEntity)
+	if perr != nil {
+		return perr
+	}
+	planned := &dto.UsageDto{Bytes: size}
+	if perr = s.checkQuota(usage, planned, logEntity); perr != nil {
+		return perr
+	}
+	reservation.add(planned)
+	return nil
+}
+
+// Remove reservation, processing is stored to DB or failed
+func (s *ApiServerRequestProcessor) releaseQuota(reservation *quotaReservation) {
+	if reservation == nil {
+		return
+	}
+	reservation.user.mu.Lock()
+	reservation.add(&dto.UsageDto{
+		Originals:       -reservation.usage.Originals,
+		Variants:        -reservation.usage.Variants,
+		Bytes:           -reservation.usage.Bytes,
+		MegapixelsToday: -reservation.usage.MegapixelsToday,
+	})
+	reservation.user.mu.Unlock()
+	s.quotaReservations.release(reservation.userId, reservation.user)
+}
+
+// Add usage to reservation and to reservations of user, negative usage removes it. User reservations must be locked
+func (r *quotaReservation) add(usage *dto.UsageDto) {
+	r.usage.Originals += usage.Originals
+	r.usage.Variants += usage.Variants
+	r.usage.Bytes += usage.Bytes
+	r.usage.MegapixelsToday += usage.MegapixelsToday
+
+	u := &r.user.usage
+	u.Originals += usage.Originals
+	u.Variants += usage.Variants
+	u.Bytes += usage.Bytes
+	u.MegapixelsToday += usage.MegapixelsToday
+	if usage.Originals != 0 {
+		r.user.images[r.imageId] += int(usage.Originals)
+		if r.user.images[r.imageId] <= 0 {
+			delete(r.user.images, r.imageId)
+		}
+	}
+}
+
+func (s *ApiServerRequestProcessor) quotasEnabled() bool {
+	q := s.cfg.Quotas
+	return q.MaxOriginals > 0 || q.MaxVariants > 0 || q.MaxBytes > 0 || q.MaxMegapixelsPerDay > 0
+}
+
+// Megapixels of processed variants are counted from start of current UTC day
+func startOfDay(now time.Time) time.Time {
+	return now.UTC().Truncate(24 * time.Hour)
+}
+
+// Compute usage of user by records of his images.
+// Original is counted once, even if it has many variants
+func (s *ApiServerRequestProcessor) loadUsage(ctx context.Context, userId string, logEntity *logrus.Entry) (*userUsage, *processingError) {
+	records := s.dbStore.FindAllPictureByUserId(ctx, userId)
+	if records == nil {
+		logEntity.Error(utils.ErrMsgCannotGetUserImages)
+		return nil, &processingError{http.StatusInternalServerError, utils.ErrCannotGetUserImagesCode, utils.ErrMsgCannotGetUserImages, nil}
+	}
+
+	since := startOfDay(time.Now())
+	usage := &userUsage{images: make(map[uint32]bool)}
+	for _, r := range records {
+		usage.Variants++
+		usage.Bytes += r.ResizedSize
+		if !usage.images[r.PicId] {
+			usage.images[r.PicId] = true
+			usage.Originals++
+			usage.Bytes += r.OriginalSize
+		}
+		if !r.CreatedAt.Before(since) {
+			usage.MegapixelsToday += megapixels(r.ResizedWidth, r.ResizedHeight)
+		}
+	}
+	return usage, nil
+}
+
+func megapixels(width, height int) float64 {
+	return float64(width) * float64(height) / 1e6
+}
+
+// Usage added by processing of new variant. Original is added only if it is uploaded first time
+func plannedUsage(usage *userUsage, imageId uint32, variant *dto.VariantDto, saveOriginal bool, originalSize int) *dto.UsageDto {
+	planned := &dto.UsageDto{
+		Variants:        1,
+		MegapixelsToday: megapixels(variant.Width, variant.Height),
+	}
+	if saveOriginal && (usage == nil || !usage.images[imageId]) {
+		planned.Originals = 1
+		planned.Bytes = int64(originalSize)
+	}
+	return planned
+}
+
+// Check that usage with planned processing fits quotas, nil usage means quotas are not checked
+func (s *ApiServerRequestProcessor) checkQuota(usage *userUsage, planned *dto.UsageDto, logEntity *logrus.Entry) *processingError {
+	if usage == nil {
+		return nil
+	}
+	q := s.cfg.Quotas
+	var exceeded string
+	switch {
+	case q.MaxOriginals > 0 && usage.Originals+planned.Originals > q.MaxOriginals:
+		exceeded = fmt.Sprintf("originals limit %d", q.MaxOriginals)
+	case q.MaxVariants > 0 && usage.Variants+planned.Variants > q.MaxVariants:
+		exceeded = fmt.Sprintf("variants limit %d", q.MaxVariants)
+	case q.MaxBytes > 0 && usage.Bytes+planned.Bytes > q.MaxBytes:
+		exceeded = fmt.Sprintf("storage limit %d bytes", q.MaxBytes)
+	case q.MaxMegapixelsPerDay > 0 && usage.MegapixelsToday+planned.MegapixelsToday > q.MaxMegapixelsPerDay:
+		exceeded = fmt.Sprintf("daily processing limit %g megapixels", q.MaxMegapixelsPerDay)
+	default:
+		return nil
+	}
+
+	errMsg := fmt.Sprintf("%s: %s", utils.ErrMsgQuotaExceeded, exceeded)
+	logEntity.Warn(errMsg)
+	return &processingError{http.StatusForbidden, utils.ErrQuotaExceededCode, errMsg, nil}
+}
+
+// Function to handle user request for his current consumption and quotas
+func (s *ApiServerRequestProcessor) HandleUsageRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+
+	answer := &http_response_dto.UsageResponseDto{}
+	jsonEncoder := json.NewEncoder(w)
+	s.log(r.Context()).Info("Got user request")
+
+	rDto := http_request_dto.BaseRequestDto{}
+
+	// try to decode request params
+	err := schema.NewDecoder().Decode(&rDto, r.URL.Query())
+	// authenticated user can see only his own usage
+	rDto.UserId = authorizedUserId(r, rDto.UserId)
+	if err == nil {
+		err = s.requestValidator.Validate(rDto)
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgInvalidRequestParamValues, err)
+		s.log(r.Context()).Errorf(errMsg)
+		writeErrResponseUsageRequest(w, answer, http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg)
+		err = jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+	answer.UserId = rDto.UserId
+	answer.RequestId = rDto.RequestId
+
+	logEntity := s.log(r.Context()).WithFields(logrus.Fields{
+		"userId":    rDto.UserId,
+		"requestId": rDto.RequestId,
+	})
+
+	usage, perr := s.loadUsage(r.Context(), rDto.UserId, logEntity)
+	if perr != nil {
+		writeErrResponseUsageRequest(w, answer, perr.serverCode, perr.errCode, perr.errMsg)
+		err = jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+
+	q := s.cfg.Quotas
+	answer.Usage = &http_response_dto.UsageInfoDto{
+		Originals:       usage.Originals,
+		Variants:        usage.Variants,
+		Bytes:           usage.Bytes,
+		MegapixelsToday: usage.MegapixelsToday,
+	}
+	answer.Limits = &http_response_dto.UsageInfoDto{
+		Originals:       q.MaxOriginals,
+		Variants:        q.MaxVariants,
+		Bytes:           q.MaxBytes,
+		MegapixelsToday: q.MaxMegapixelsPerDay,
+	}
+
+	err = jsonEncoder.Encode(answer)
+	if err != nil {
+		s.log(r.Context()).Errorf("Cannot send response: %v", err)
+	}
+}
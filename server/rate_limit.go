@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/utils"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limiting of /api requests by token bucket per caller.
+// Caller is identified by API key, authenticated user or client IP.
+// Cheap and expensive routes have separate buckets
+
+const (
+	RateLimitLimitHeader     = "X-RateLimit-Limit"
+	RateLimitRemainingHeader = "X-RateLimit-Remaining"
+	RateLimitResetHeader     = "X-RateLimit-Reset"
+
+	// how often idle buckets are removed
+	rateLimitSweepInterval = time.Minute
+)
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// Create limiter with rate tokens per second and bucket size burst, nil if rate is not limited
+func newRateLimiter(budget dto.RateLimitBudget) *rateLimiter {
+	if budget.Rate <= 0 {
+		return nil
+	}
+	burst := budget.Burst
+	if burst <= 0 {
+		burst = int(math.Ceil(budget.Rate))
+	}
+	return &rateLimiter{
+		rate:    budget.Rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Take one token from bucket of caller. Returns remaining tokens,
+// time until bucket is full and, for rejected request, time until next token
+func (l *rateLimiter) allow(key string) (allowed bool, remaining int, reset, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate)
+	bucket.updated = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		allowed = true
+	} else {
+		retryAfter = l.duration(1 - bucket.tokens)
+	}
+	return allowed, int(bucket.tokens), l.duration(l.burst - bucket.tokens), retryAfter
+}
+
+// remove buckets which are full again, they are equal to new ones
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// time to get count of tokens
+func (l *rateLimiter) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// Middleware for rate limiting of cheap routes, like list
+func (s *ApiServerRequestProcessor) RateLimitCheap(next http.Handler) http.Handler {
+	return s.rateLimit(s.cheapLimiter, next)
+}
+
+// Middleware for rate limiting of expensive routes, like resize
+func (s *ApiServerRequestProcessor) RateLimitExpensive(next http.Handler) http.Handler {
+	return s.rateLimit(s.expensiveLimiter, next)
+}
+
+func (s *ApiServerRequestProcessor) rateLimit(limiter *rateLimiter, next http.Handler) http.Handler {
+	if limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := s.rateLimitKey(r)
+		allowed, remaining, reset, retryAfter := limiter.allow(key)
+
+		w.Header().Set(RateLimitLimitHeader, strconv.Itoa(int(limiter.burst)))
+		w.Header().Set(RateLimitRemainingHeader, strconv.Itoa(remaining))
+		w.Header().Set(RateLimitResetHeader, strconv.Itoa(ceilSeconds(reset)))
+		if !allowed {
+			s.log(r.Context()).Warnf("%s: %s %s", utils.ErrMsgRateLimitExceeded, key, r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+			w.Header().Set("Content-Type", "application/json")
+			writeErrStatus(w, &processingError{http.StatusTooManyRequests, utils.ErrRateLimitExceededCode, utils.ErrMsgRateLimitExceeded, nil})
+			answer := &http_response_dto.BaseResponseDto{ErrCode: utils.ErrRateLimitExceededCode, ErrMsg: utils.ErrMsgRateLimitExceeded}
+			err := json.NewEncoder(w).Encode(answer)
+			if err != nil {
+				s.log(r.Context()).Errorf("Cannot send response: %v", err)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Identify caller: API key, authenticated user or client IP
+func (s *ApiServerRequestProcessor) rateLimitKey(r *http.Request) string {
+	if principal := principalFromContext(r.Context()); principal != nil {
+		if len(principal.KeyId) > 0 {
+			return "key:" + principal.KeyId
+		}
+		if len(principal.UserId) > 0 {
+			return "user:" + principal.UserId
+		}
+	}
+	return "ip:" + s.clientIp(r)
+}
+
+// Client address, X-Forwarded-For is used only if server is behind trusted proxy.
+// Proxy appends address of its client to the header, so only the rightmost entry is trusted:
+// entries before it are sent by client and can be spoofed
+func (s *ApiServerRequestProcessor) clientIp(r *http.Request) string {
+	if s.cfg.RateLimit.TrustForwardedFor {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			entries := strings.Split(values[len(values)-1], ",")
+			if last := strings.TrimSpace(entries[len(entries)-1]); len(last) > 0 {
+				return last
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"context"
+	"github.com/senseyman/image-media-processor/service/logging"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// Middleware assigns id to every request: valid X-Request-ID header is kept, otherwise new id is generated.
+// Id is returned in response header and attached to all log entries of request
+func (s *ApiServerRequestProcessor) AssignRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(logging.RequestIdHeader)
+		if !logging.ValidRequestId(requestId) {
+			var err error
+			requestId, err = utils.GenerateRandomId()
+			if err != nil {
+				s.logger.Errorf("Cannot generate request id: %v", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set(logging.RequestIdHeader, requestId)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestId(r.Context(), requestId)))
+	})
+}
+
+// Log entry with request id and trace of ctx
+func (s *ApiServerRequestProcessor) log(ctx context.Context) *logrus.Entry {
+	return s.logger.WithContext(ctx)
+}
@@ -1,39 +1,208 @@
 package server
 
 import (
+	"context"
+	"github.com/senseyman/image-media-processor/dto"
 	"github.com/senseyman/image-media-processor/dto/http_response_dto"
 	"github.com/senseyman/image-media-processor/service"
+	"github.com/senseyman/image-media-processor/service/auth"
+	"github.com/senseyman/image-media-processor/service/cache"
+	"github.com/senseyman/image-media-processor/service/fetch"
+	"github.com/senseyman/image-media-processor/service/metrics"
+	"github.com/senseyman/image-media-processor/service/webhooks"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/validator.v2"
 	"net/http"
+	"sync"
 )
 
 type ApiServerRequestProcessor struct {
 	logger           *logrus.Logger
+	cfg              *dto.Config
 	requestValidator *validator.Validator
 	imgProcessor     service.MediaProcessor
 	cloudStore       service.CloudStore
 	dbStore          service.DbStore
+	jobStore         service.JobStore
+	webhookLog       service.WebhookLogStore
+	webhooks         *webhooks.Client
+	fetcher          *fetch.Fetcher
+	tokenVerifier    service.TokenVerifier
+	cheapLimiter     *rateLimiter
+	expensiveLimiter *rateLimiter
+
+	// all image processing workflows are executed by workers
+	workers *workerPool
+	// limit of memory used by images resized at once
+	memory *memoryLimiter
+	// concurrent generations of the same variant are run once
+	variantFlights variantFlights
+	// quota usage of processing which is not stored to DB yet
+	quotaReservations quotaReservations
+	// recently used originals and variants
+	originals *cache.LRU
+	variants  *cache.LRU
+	// callbacks waiting for delivery by callback workers
+	callbacks     chan *callbackTask
+	callbackGuard *fetch.Guard
+	// processing which continues after response sent
+	backgroundTasks sync.WaitGroup
+	// closed on shutdown, interrupts waiting between webhook retries
+	stopping chan struct{}
+	stopOnce sync.Once
+	// closed when shutdown started, readiness check fails after that
+	draining  chan struct{}
+	drainOnce sync.Once
+	readiness readinessCache
+	// users which data is being erased by this instance
+	erasures sync.Map
+}
+
+// error of one image processing workflow step with info for http response
+type processingError struct {
+	serverCode int
+	errCode    int
+	errMsg     string
+	// typed service error which caused failure, defines status of API v2 response
+	cause error
 }
 
-func NewApiServerRequestProcessor(logger *logrus.Logger, imgProcessor service.MediaProcessor, cloudStore service.CloudStore, dbStore service.DbStore) *ApiServerRequestProcessor {
-	return &ApiServerRequestProcessor{
+func NewApiServerRequestProcessor(cfg *dto.Config, logger *logrus.Logger, imgProcessor service.MediaProcessor, cloudStore service.CloudStore, dbStore service.DbStore, jobStore service.JobStore, webhookLog service.WebhookLogStore) *ApiServerRequestProcessor {
+	webhookTimeout := cfg.Webhooks.Timeout.Duration
+	if webhookTimeout <= 0 {
+		webhookTimeout = DefaultWebhookTimeout
+	}
+	callbackQueueSize := cfg.Webhooks.QueueSize
+	if callbackQueueSize <= 0 {
+		callbackQueueSize = DefaultWebhookQueueSize
+	}
+	callbackGuard := fetch.NewGuard(cfg.Webhooks.AllowHosts, cfg.Webhooks.DenyHosts, cfg.Webhooks.AllowPrivate)
+	processor := &ApiServerRequestProcessor{
 		logger:           logger,
+		cfg:              cfg,
 		requestValidator: validator.NewValidator(),
 		imgProcessor:     imgProcessor,
 		cloudStore:       cloudStore,
 		dbStore:          dbStore,
+		jobStore:         jobStore,
+		webhookLog:       webhookLog,
+		webhooks:         webhooks.NewClient(cfg.Webhooks.Secret, webhookTimeout, callbackGuard),
+		callbacks:        make(chan *callbackTask, callbackQueueSize),
+		callbackGuard:    callbackGuard,
+		fetcher:          fetch.NewFetcher(&cfg.Fetch),
+		workers:          newWorkerPool(cfg.Jobs.Workers, cfg.Jobs.QueueSize, logger),
+		memory:           newMemoryLimiter(cfg.Jobs.MaxMemory),
+		originals:        cache.NewLRU(metrics.CacheOriginals, cfg.Cache.OriginalsMaxBytes, cfg.Cache.Ttl.Duration),
+		variants:         cache.NewLRU(metrics.CacheVariants, cfg.Cache.VariantsMaxBytes, cfg.Cache.Ttl.Duration),
+		cheapLimiter:     newRateLimiter(cfg.RateLimit.Cheap),
+		expensiveLimiter: newRateLimiter(cfg.RateLimit.Expensive),
+		stopping:         make(chan struct{}),
+		draining:         make(chan struct{}),
+	}
+
+	processor.startCallbackWorkers()
+
+	if cfg.Auth.Mode == AuthModeJwt {
+		verifier, err := auth.NewJwtVerifier(&cfg.Auth.Jwt)
+		if err != nil {
+			// all tokens are rejected, config is checked by ValidateAuth on start
+			logger.Errorf("Cannot create JWT verifier: %v", err)
+		} else {
+			processor.tokenVerifier = verifier
+		}
+	}
+	return processor
+}
+
+// Wait until all background processing finished
+func (s *ApiServerRequestProcessor) WaitBackgroundTasks() {
+	s.backgroundTasks.Wait()
+}
+
+// Wait until started background tasks finished or ctx is done.
+// Pending webhook retries are abandoned, jobs already in queue are completed
+func (s *ApiServerRequestProcessor) Shutdown(ctx context.Context) error {
+	s.StartDraining()
+	s.stopOnce.Do(func() {
+		close(s.stopping)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.backgroundTasks.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
 func writeErrResponseListRequest(w http.ResponseWriter, answer *http_response_dto.UserImagesListResponseDto, serverCode int, errCode int, errMsg string) {
-	w.WriteHeader(serverCode)
+	writeErrStatus(w, &processingError{serverCode, errCode, errMsg, nil})
+	answer.ErrCode = errCode
+	answer.ErrMsg = errMsg
+}
+
+func writeErrResponseResizeRequest(w http.ResponseWriter, answer *http_response_dto.ResizeImageResponseDto, perr *processingError) {
+	writeErrStatus(w, perr)
+	answer.ErrCode = perr.errCode
+	answer.ErrMsg = perr.errMsg
+}
+
+func writeErrResponseBatchRequest(w http.ResponseWriter, answer *http_response_dto.ResizeBatchResponseDto, serverCode int, errCode int, errMsg string) {
+	writeErrStatus(w, &processingError{serverCode, errCode, errMsg, nil})
+	answer.ErrCode = errCode
+	answer.ErrMsg = errMsg
+}
+
+func writeErrResponseExportRequest(w http.ResponseWriter, answer *http_response_dto.BaseResponseDto, serverCode int, errCode int, errMsg string) {
+	writeErrStatus(w, &processingError{serverCode, errCode, errMsg, nil})
+	answer.ErrCode = errCode
+	answer.ErrMsg = errMsg
+}
+
+func writeErrResponseUserErasureRequest(w http.ResponseWriter, answer *http_response_dto.UserErasureResponseDto, perr *processingError) {
+	writeErrStatus(w, perr)
+	answer.ErrCode = perr.errCode
+	answer.ErrMsg = perr.errMsg
+}
+
+func writeErrResponseSignRequest(w http.ResponseWriter, answer *http_response_dto.SignUrlResponseDto, serverCode int, errCode int, errMsg string) {
+	writeErrStatus(w, &processingError{serverCode, errCode, errMsg, nil})
+	answer.ErrCode = errCode
+	answer.ErrMsg = errMsg
+}
+
+func writeErrResponseJobRequest(w http.ResponseWriter, answer *http_response_dto.JobResponseDto, serverCode int, errCode int, errMsg string) {
+	writeErrStatus(w, &processingError{serverCode, errCode, errMsg, nil})
+	answer.ErrCode = errCode
+	answer.ErrMsg = errMsg
+}
+
+func writeErrResponseWebhookDeliveriesRequest(w http.ResponseWriter, answer *http_response_dto.WebhookDeliveriesResponseDto, serverCode int, errCode int, errMsg string) {
+	writeErrStatus(w, &processingError{serverCode, errCode, errMsg, nil})
+	answer.ErrCode = errCode
+	answer.ErrMsg = errMsg
+}
+
+func writeErrResponseApiKeyRequest(w http.ResponseWriter, answer *http_response_dto.ApiKeyResponseDto, serverCode int, errCode int, errMsg string) {
+	writeErrStatus(w, &processingError{serverCode, errCode, errMsg, nil})
+	answer.ErrCode = errCode
+	answer.ErrMsg = errMsg
+}
+
+func writeErrResponseApiKeysListRequest(w http.ResponseWriter, answer *http_response_dto.ApiKeysListResponseDto, serverCode int, errCode int, errMsg string) {
+	writeErrStatus(w, &processingError{serverCode, errCode, errMsg, nil})
 	answer.ErrCode = errCode
 	answer.ErrMsg = errMsg
 }
 
-func writeErrResponseResizeRequest(w http.ResponseWriter, answer *http_response_dto.ResizeImageResponseDto, serverCode int, errCode int, errMsg string) {
-	w.WriteHeader(serverCode)
+func writeErrResponseUsageRequest(w http.ResponseWriter, answer *http_response_dto.UsageResponseDto, serverCode int, errCode int, errMsg string) {
+	writeErrStatus(w, &processingError{serverCode, errCode, errMsg, nil})
 	answer.ErrCode = errCode
 	answer.ErrMsg = errMsg
 }
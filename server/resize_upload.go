@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/schema"
+	"github.com/senseyman/image-media-processor/dto/http_request_dto"
+	"github.com/senseyman/image-media-processor/utils"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// Readers of image and resize params for upload modes of resize request.
+// Image is nil if request has no image, params are validated by parseResizeRequest for all modes
+
+// prefix of headers which can be used instead of query params of raw upload, e.g. X-Image-Width
+const RawUploadHeaderPrefix = "X-Image-"
+
+// params of raw upload, the same as json params of other upload modes. File name is read separately
+var rawUploadParams = []string{"user_id", "request_id", "width", "height", "preset", "format", "mode", "quality", "callback_url", "source_url"}
+
+// Multipart request with image file in 'file' part and json params in 'params' field
+func (s *ApiServerRequestProcessor) readMultipartResizeRequest(r *http.Request) (
+	*http_request_dto.ResizeImageRequestParamsDto, *sourceImage, *processingError) {
+
+	if err := r.ParseMultipartForm(MaxUploadMemory); err != nil {
+		s.log(r.Context()).Errorf("Cannot pars multipart form: %v", err)
+		if isBodyTooLarge(err) {
+			return nil, nil, &processingError{http.StatusRequestEntityTooLarge, utils.ErrRequestTooLargeCode, utils.ErrMsgRequestTooLarge, nil}
+		}
+		return nil, nil, &processingError{http.StatusBadRequest, utils.ErrEmptyRequestCode, utils.ErrMsgEmptyRequest, nil}
+	}
+	// getting file from request using tag 'file', it can be omitted if source_url is set in params
+	file, handler, err := r.FormFile("file")
+	if err != nil && err != http.ErrMissingFile {
+		s.log(r.Context()).Errorf("%s : %v", utils.ErrMsgFileNotFoundInRequest, err)
+		return nil, nil, &processingError{http.StatusBadRequest, utils.ErrFileNotFoundInRequestCode, utils.ErrMsgFileNotFoundInRequest, nil}
+	}
+	var src *sourceImage
+	if file != nil {
+		defer file.Close()
+		src = newSourceImage(file, handler.Filename)
+	}
+
+	// getting params from request using param name 'params'
+	params := r.FormValue("params")
+	if len(params) == 0 {
+		s.log(r.Context()).Errorf("%s : %v", utils.ErrMsgParamsNotSetInRequest, err)
+		return nil, nil, &processingError{http.StatusBadRequest, utils.ErrParamsNotSetInRequestCode, utils.ErrMsgParamsNotSetInRequest, nil}
+	}
+
+	// decode params to struct
+	rDto := &http_request_dto.ResizeImageRequestParamsDto{}
+	err = json.Unmarshal([]byte(params), rDto)
+	if err != nil {
+		s.log(r.Context()).Errorf("%s : %v", utils.ErrMsgCannotParseRequestParams, err)
+		return nil, nil, &processingError{http.StatusBadRequest, utils.ErrCannotParseRequestParamsCode, utils.ErrMsgCannotParseRequestParams, nil}
+	}
+	return rDto, src, nil
+}
+
+// Request body is image itself, params are sent in query or in headers with X-Image- prefix.
+// File name is taken from 'filename' param or Content-Disposition header
+func (s *ApiServerRequestProcessor) readRawResizeRequest(r *http.Request) (
+	*http_request_dto.ResizeImageRequestParamsDto, *sourceImage, *processingError) {
+
+	query := r.URL.Query()
+	params := url.Values{}
+	for _, name := range rawUploadParams {
+		if value := rawUploadParam(r, query, name); len(value) > 0 {
+			params.Set(name, value)
+		}
+	}
+	rDto := &http_request_dto.ResizeImageRequestParamsDto{}
+	if err := schema.NewDecoder().Decode(rDto, params); err != nil {
+		s.log(r.Context()).Errorf("%s : %v", utils.ErrMsgCannotParseRequestParams, err)
+		return nil, nil, &processingError{http.StatusBadRequest, utils.ErrCannotParseRequestParamsCode, utils.ErrMsgCannotParseRequestParams, nil}
+	}
+
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.log(r.Context()).Errorf("Cannot read request body: %v", err)
+		if isBodyTooLarge(err) {
+			return nil, nil, &processingError{http.StatusRequestEntityTooLarge, utils.ErrRequestTooLargeCode, utils.ErrMsgRequestTooLarge, nil}
+		}
+		return nil, nil, &processingError{http.StatusBadRequest, utils.ErrEmptyRequestCode, utils.ErrMsgEmptyRequest, nil}
+	}
+	if len(content) == 0 {
+		return rDto, nil, nil
+	}
+
+	name := rawUploadParam(r, query, "filename")
+	if len(name) == 0 {
+		if _, dispParams, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+			name = dispParams["filename"]
+		}
+	}
+	return rDto, uploadedImage(content, name, r.Header.Get("Content-Type")), nil
+}
+
+// Json body with resize params and base64 encoded image in 'image' field
+func (s *ApiServerRequestProcessor) readJsonResizeRequest(r *http.Request) (
+	*http_request_dto.ResizeImageRequestParamsDto, *sourceImage, *processingError) {
+
+	jDto := &http_request_dto.ResizeImageJsonRequestDto{}
+	if err := json.NewDecoder(r.Body).Decode(jDto); err != nil {
+		s.log(r.Context()).Errorf("%s : %v", utils.ErrMsgCannotParseRequestParams, err)
+		switch {
+		case err == io.EOF:
+			return nil, nil, &processingError{http.StatusBadRequest, utils.ErrEmptyRequestCode, utils.ErrMsgEmptyRequest, nil}
+		case isBodyTooLarge(err):
+			return nil, nil, &processingError{http.StatusRequestEntityTooLarge, utils.ErrRequestTooLargeCode, utils.ErrMsgRequestTooLarge, nil}
+		}
+		return nil, nil, &processingError{http.StatusBadRequest, utils.ErrCannotParseRequestParamsCode, utils.ErrMsgCannotParseRequestParams, nil}
+	}
+	if len(jDto.Image) == 0 {
+		return &jDto.ResizeImageRequestParamsDto, nil, nil
+	}
+
+	content, contentType, err := decodeImageField(jDto.Image)
+	if err != nil {
+		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgInvalidRequestParamValues, err)
+		s.log(r.Context()).Errorf(errMsg)
+		return nil, nil, &processingError{http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg, nil}
+	}
+	return &jDto.ResizeImageRequestParamsDto, uploadedImage(content, jDto.Filename, contentType), nil
+}
+
+// Value of raw upload param from query, or from header if it is not set in query
+func rawUploadParam(r *http.Request, query url.Values, name string) string {
+	if value := query.Get(name); len(value) > 0 {
+		return value
+	}
+	return r.Header.Get(RawUploadHeaderPrefix + strings.ReplaceAll(name, "_", "-"))
+}
+
+// Decode base64 content or data uri, content type is returned for data uri only
+func decodeImageField(value string) ([]byte, string, error) {
+	contentType := ""
+	if strings.HasPrefix(value, "data:") {
+		comma := strings.Index(value, ",")
+		if comma < 0 || !strings.HasSuffix(value[:comma], ";base64") {
+			return nil, "", fmt.Errorf("Image data uri must be base64 encoded ")
+		}
+		contentType = strings.TrimSuffix(strings.TrimPrefix(value[:comma], "data:"), ";base64")
+		value = value[comma+1:]
+	}
+	content, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		// padding is optional
+		content, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("Image is not valid base64: %v ", err)
+	}
+	return content, contentType, nil
+}
+
+// Image of raw or json upload. Without file name it gets name by content hash with extension by content type
+func uploadedImage(content []byte, name, contentType string) *sourceImage {
+	// only base name is used, path in file name must not change location of image in cloud store
+	if name = filepath.Base(name); name == "." || name == string(filepath.Separator) {
+		name = withImageExtension(ContentImageName(content), contentType, content)
+	}
+	return newSourceImage(bytes.NewReader(content), name)
+}
+
+func isJsonRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+func isBodyTooLarge(err error) bool {
+	return strings.Contains(err.Error(), "request body too large")
+}
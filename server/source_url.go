@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/senseyman/image-media-processor/service/fetch"
+	"github.com/senseyman/image-media-processor/service/metrics"
+	"github.com/senseyman/image-media-processor/service/tracing"
+	"github.com/senseyman/image-media-processor/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// prefix of name of image if url path or upload request has no file name
+const DefaultImageName = "image"
+
+// Name of image without file name. Image id is made from name, so name is made from content hash:
+// different images never get the same id and overwrite each other
+func ContentImageName(content []byte) string {
+	sum := sha256.Sum256(content)
+	return DefaultImageName + "_" + hex.EncodeToString(sum[:8])
+}
+
+// Source url is alternative to multipart file, request with both of them is rejected
+func (s *ApiServerRequestProcessor) validateSourceUrl(sourceUrl string, hasFile bool) error {
+	if len(sourceUrl) == 0 {
+		return nil
+	}
+	if hasFile {
+		return fmt.Errorf("Only one of file and source_url can be set ")
+	}
+	return s.fetcher.CheckUrl(sourceUrl)
+}
+
+// Download image from source url to be processed like uploaded file
+func (s *ApiServerRequestProcessor) fetchSourceImage(ctx context.Context, src *sourceImage) *processingError {
+	ctx, span := tracing.Tracer().Start(ctx, "fetch", trace.WithAttributes(attribute.String("source.url", src.url)))
+	defer span.End()
+
+	started := time.Now()
+	content, contentType, err := s.fetcher.Fetch(ctx, src.url)
+	metrics.ObserveStage(metrics.StageFetch, started)
+
+	if err != nil {
+		s.log(ctx).Errorf("%s %s: %v", utils.ErrMsgFetchSource, src.url, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, utils.ErrMsgFetchSource)
+		switch {
+		case errors.Is(err, fetch.ErrBlocked):
+			errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgInvalidRequestParamValues, err)
+			return &processingError{http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg, nil}
+		case errors.Is(err, fetch.ErrTooLarge):
+			return &processingError{http.StatusRequestEntityTooLarge, utils.ErrRequestTooLargeCode, utils.ErrMsgRequestTooLarge, nil}
+		default:
+			return &processingError{http.StatusBadGateway, utils.ErrFetchSourceCode, utils.ErrMsgFetchSource, err}
+		}
+	}
+
+	src.name = sourceImageName(src.url, contentType, content)
+	src.content = content
+	return nil
+}
+
+// File name of downloaded image is taken from url path
+func sourceImageName(sourceUrl, contentType string, content []byte) string {
+	name := ContentImageName(content)
+	if u, err := url.Parse(sourceUrl); err == nil {
+		if base := path.Base(u.Path); base != "/" && base != "." {
+			name = base
+		}
+	}
+	return withImageExtension(name, contentType, content)
+}
+
+// If name has no known image extension, extension is added by content type or by content itself
+func withImageExtension(name, contentType string, content []byte) string {
+	if _, err := utils.NormalizeImageFormat(path.Ext(name)); err == nil {
+		return name
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "image/") {
+		mediaType = http.DetectContentType(content)
+	}
+	if format, err := utils.NormalizeImageFormat(strings.TrimPrefix(mediaType, "image/")); err == nil {
+		return name + "." + format
+	}
+	return name
+}
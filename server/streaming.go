@@ -0,0 +1,26 @@
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+// Middleware of routes which stream request or response, like export, batch and import.
+// Server read and write timeouts are sized for single image requests, so deadlines of streaming
+// request are replaced by Server.StreamTimeout (zero means no deadline)
+func (s *ApiServerRequestProcessor) Streaming(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var deadline time.Time
+		if timeout := s.cfg.Server.StreamTimeout.Duration; timeout > 0 {
+			deadline = time.Now().Add(timeout)
+		}
+		controller := http.NewResponseController(w)
+		if err := controller.SetReadDeadline(deadline); err != nil {
+			s.log(r.Context()).Warnf("Cannot set read deadline of streaming request: %v", err)
+		}
+		if err := controller.SetWriteDeadline(deadline); err != nil {
+			s.log(r.Context()).Warnf("Cannot set write deadline of streaming request: %v", err)
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/service/logging"
+	"github.com/senseyman/image-media-processor/service/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+// Middleware starts span of every request, trace is continued from traceparent header if it is present
+func (s *ApiServerRequestProcessor) TraceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		ctx, span := tracing.Tracer().Start(ctx, fmt.Sprintf("%s %s", r.Method, route),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("http.target", r.URL.RequestURI()),
+			))
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// Context for processing which continues after response sent.
+// It is not cancelled with request, but keeps its trace and request id
+func detachedContext(ctx context.Context) context.Context {
+	detached := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+	if requestId := logging.RequestIdFromContext(ctx); len(requestId) > 0 {
+		detached = logging.WithRequestId(detached, requestId)
+	}
+	return detached
+}
+
+// Finish span of workflow step, failed step is marked by error status
+func endSpan(span trace.Span, perr *processingError) {
+	if perr != nil {
+		span.SetStatus(codes.Error, perr.errMsg)
+		span.SetAttributes(attribute.Int("error.code", perr.errCode))
+	}
+	span.End()
+}
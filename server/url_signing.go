@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/utils"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Delivery urls are signed with HMAC over path and all query params (transformation params and expiry),
+// so client cannot request image sizes which were not issued by service
+const (
+	SignatureParam = "sig"
+	ExpiresParam   = "expires"
+)
+
+// Build delivery path of image variant
+func deliveryPath(userId string, imageId uint32, variant *dto.VariantDto) string {
+	return fmt.Sprintf("/img/%s/%d/%dx%d.%s", userId, imageId, variant.Width, variant.Height, variant.Format)
+}
+
+// Signing secret is required, otherwise delivery urls are not accepted at all
+func ValidateSigning(cfg *dto.SigningConfig) error {
+	if len(cfg.Secret) == 0 {
+		return fmt.Errorf("signing secret is not set")
+	}
+	return nil
+}
+
+// Build signed delivery url of image variant.
+// Preset name is passed as query param
+func (s *ApiServerRequestProcessor) deliveryUrl(userId string, imageId uint32, variant *dto.VariantDto, expiresAt time.Time) string {
+	path := deliveryPath(userId, imageId, variant)
+	query := url.Values{}
+	if len(variant.Preset) > 0 {
+		query.Set("preset", variant.Preset)
+	}
+	return s.cfg.Delivery.BaseUrl + s.signUrl(path, query, expiresAt)
+}
+
+// Expiry of signed url by default ttl from config, zero time means url without expiry
+func (s *ApiServerRequestProcessor) defaultUrlExpiry() time.Time {
+	if s.cfg.Signing.DefaultTtl.Duration > 0 {
+		return time.Now().Add(s.cfg.Signing.DefaultTtl.Duration)
+	}
+	return time.Time{}
+}
+
+// Payload for signing: path with sorted query params except signature
+func signingPayload(path string, query url.Values) string {
+	params := url.Values{}
+	for k, v := range query {
+		if k != SignatureParam {
+			params[k] = v
+		}
+	}
+	if len(params) == 0 {
+		return path
+	}
+	return path + "?" + params.Encode()
+}
+
+// Add expiry (if set) and signature to path with query params
+func (s *ApiServerRequestProcessor) signUrl(path string, query url.Values, expiresAt time.Time) string {
+	if query == nil {
+		query = url.Values{}
+	}
+	if !expiresAt.IsZero() {
+		query.Set(ExpiresParam, strconv.FormatInt(expiresAt.Unix(), 10))
+	}
+	query.Set(SignatureParam, utils.HmacSignature(s.cfg.Signing.Secret, signingPayload(path, query)))
+	return path + "?" + query.Encode()
+}
+
+// Check signature and expiry of request url
+func (s *ApiServerRequestProcessor) verifyUrlSignature(u *url.URL) error {
+	if len(s.cfg.Signing.Secret) == 0 {
+		return fmt.Errorf("signing secret is not set")
+	}
+	query := u.Query()
+	sig := query.Get(SignatureParam)
+	if len(sig) == 0 {
+		return fmt.Errorf("signature not set")
+	}
+	if !utils.CheckHmacSignature(s.cfg.Signing.Secret, signingPayload(u.Path, query), sig) {
+		return fmt.Errorf("signature mismatch")
+	}
+	if expires := query.Get(ExpiresParam); len(expires) > 0 {
+		ts, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid expiry value: %v", err)
+		}
+		if time.Now().Unix() > ts {
+			return fmt.Errorf("url expired")
+		}
+	}
+	return nil
+}
+
+// Middleware rejects delivery requests with missing, invalid or expired signature.
+// All requests are rejected if signing secret not configured
+func (s *ApiServerRequestProcessor) VerifyUrlSignature(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.verifyUrlSignature(r.URL); err != nil {
+			s.log(r.Context()).Errorf("%s: %s: %v", utils.ErrMsgInvalidSignature, r.URL.Path, err)
+			s.writeDeliveryError(w, &http_response_dto.ResizeImageResponseDto{},
+				&processingError{http.StatusForbidden, utils.ErrInvalidSignatureCode, utils.ErrMsgInvalidSignature, nil})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/schema"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_request_dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	DefaultWebhookTimeout     = 10 * time.Second
+	DefaultWebhookMaxAttempts = 5
+	DefaultWebhookBackoff     = time.Second
+	DefaultWebhookMaxBackoff  = 5 * time.Minute
+	DefaultWebhookWorkers     = 4
+	DefaultWebhookQueueSize   = 1000
+)
+
+// Empty secret means callbacks are not signed
+func ValidateWebhooks(cfg *dto.WebhooksConfig) error {
+	if isPlaceholderSecret(cfg.Secret) {
+		return fmt.Errorf("webhooks secret is placeholder value from example config")
+	}
+	return nil
+}
+
+// callback waiting in delivery queue
+type callbackTask struct {
+	ctx         context.Context
+	callbackUrl string
+	userId      string
+	requestId   string
+	payload     []byte
+}
+
+// Start workers which deliver queued callbacks
+func (s *ApiServerRequestProcessor) startCallbackWorkers() {
+	workers := s.cfg.Webhooks.Workers
+	if workers <= 0 {
+		workers = DefaultWebhookWorkers
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for task := range s.callbacks {
+				s.deliverCallback(task.ctx, task.callbackUrl, task.userId, task.requestId, task.payload)
+				s.backgroundTasks.Done()
+			}
+		}()
+	}
+}
+
+// Check that callback url is absolute http(s) url allowed by config. Empty url means callback is not requested.
+// Address of host is checked on delivery
+func (s *ApiServerRequestProcessor) validateCallbackUrl(callbackUrl string) error {
+	if len(callbackUrl) == 0 {
+		return nil
+	}
+	u, err := url.Parse(callbackUrl)
+	if err != nil {
+		return fmt.Errorf("Invalid callback url: %v ", err)
+	}
+	if err = s.callbackGuard.CheckUrl(u); err != nil {
+		return fmt.Errorf("Invalid callback url: %v ", err)
+	}
+	return nil
+}
+
+// Queue result of resize workflow for delivery to callback url, it is dropped if queue is full
+func (s *ApiServerRequestProcessor) notifyCallback(ctx context.Context, callbackUrl string, result *http_response_dto.ResizeImageResponseDto) {
+	if len(callbackUrl) == 0 {
+		return
+	}
+	payload, err := json.Marshal(result)
+	if err != nil {
+		s.log(ctx).Errorf("Cannot prepare callback payload: %v", err)
+		return
+	}
+
+	task := &callbackTask{
+		ctx:         detachedContext(ctx),
+		callbackUrl: callbackUrl,
+		userId:      result.UserId,
+		requestId:   result.RequestId,
+		payload:     payload,
+	}
+	s.backgroundTasks.Add(1)
+	select {
+	case s.callbacks <- task:
+	default:
+		s.backgroundTasks.Done()
+		s.log(ctx).Errorf("Callback to %s dropped: delivery queue is full", callbackUrl)
+	}
+}
+
+// Post payload to callback url, failed delivery is retried with exponential backoff.
+// Every attempt is saved to delivery log
+func (s *ApiServerRequestProcessor) deliverCallback(ctx context.Context, callbackUrl, userId, requestId string, payload []byte) {
+	logEntity := s.log(ctx).WithFields(logrus.Fields{
+		"userId":      userId,
+		"requestId":   requestId,
+		"callbackUrl": callbackUrl,
+	})
+
+	cfg := s.cfg.Webhooks
+	maxAttempts := cfg.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultWebhookMaxAttempts
+	}
+	backoff := cfg.InitialBackoff.Duration
+	if backoff <= 0 {
+		backoff = DefaultWebhookBackoff
+	}
+	maxBackoff := cfg.MaxBackoff.Duration
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultWebhookMaxBackoff
+	}
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		statusCode, err := s.webhooks.Send(callbackUrl, payload)
+
+		delivery := &dto.WebhookDeliveryDto{
+			RequestId:  requestId,
+			UserId:     userId,
+			Url:        callbackUrl,
+			Attempt:    attempt,
+			StatusCode: statusCode,
+			Delivered:  err == nil,
+			CreatedAt:  time.Now().UTC(),
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		if logErr := s.webhookLog.SaveWebhookDelivery(delivery); logErr != nil {
+			logEntity.Errorf("Cannot save webhook delivery: %v", logErr)
+		}
+
+		if err == nil {
+			logEntity.Infof("Callback delivered with attempt %d", attempt)
+			return
+		}
+		logEntity.Warnf("Cannot deliver callback, attempt %d of %d: %v", attempt, maxAttempts, err)
+
+		if attempt < maxAttempts {
+			select {
+			case <-time.After(backoff):
+			case <-s.stopping:
+				logEntity.Warnf("Server is shutting down, callback retries abandoned after attempt %d", attempt)
+				return
+			}
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+
+	logEntity.Errorf("Callback was not delivered after %d attempts", maxAttempts)
+}
+
+// Function to handle user request for callback delivery log of his resize request
+func (s *ApiServerRequestProcessor) HandleWebhookDeliveriesRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+
+	answer := &http_response_dto.WebhookDeliveriesResponseDto{}
+	jsonEncoder := json.NewEncoder(w)
+	s.log(r.Context()).Info("Got user request")
+
+	rDto := http_request_dto.BaseRequestDto{}
+
+	// try to decode request params
+	err := schema.NewDecoder().Decode(&rDto, r.URL.Query())
+	rDto.UserId = authorizedUserId(r, rDto.UserId)
+	if err == nil {
+		err = s.requestValidator.Validate(rDto)
+	}
+	if err == nil && (len(rDto.UserId) == 0 || len(rDto.RequestId) == 0) {
+		err = fmt.Errorf("user_id and request_id are required")
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("%s: %v", utils.ErrMsgInvalidRequestParamValues, err)
+		s.log(r.Context()).Errorf(errMsg)
+		writeErrResponseWebhookDeliveriesRequest(w, answer, http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode, errMsg)
+		err = jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+	answer.UserId = rDto.UserId
+	answer.RequestId = rDto.RequestId
+
+	deliveries := s.webhookLog.FindWebhookDeliveries(rDto.UserId, rDto.RequestId)
+	if deliveries == nil {
+		s.log(r.Context()).Errorf(utils.ErrMsgCannotGetWebhookDeliveries)
+		writeErrResponseWebhookDeliveriesRequest(w, answer, http.StatusInternalServerError, utils.ErrCannotGetWebhookDeliveriesCode, utils.ErrMsgCannotGetWebhookDeliveries)
+		err = jsonEncoder.Encode(answer)
+		if err != nil {
+			s.log(r.Context()).Errorf("Cannot send response: %v", err)
+		}
+		return
+	}
+
+	answer.Deliveries = make([]*http_response_dto.WebhookDeliveryInfoDto, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		answer.Deliveries = append(answer.Deliveries, &http_response_dto.WebhookDeliveryInfoDto{
+			Url:        delivery.Url,
+			Attempt:    delivery.Attempt,
+			StatusCode: delivery.StatusCode,
+			Error:      delivery.Error,
+			Delivered:  delivery.Delivered,
+			CreatedAt:  delivery.CreatedAt.Unix(),
+		})
+	}
+
+	err = jsonEncoder.Encode(answer)
+	if err != nil {
+		s.log(r.Context()).Errorf("Cannot send response: %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/service/metrics"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPoolQueueSize = 100
+
+	// value of Retry-After header for requests rejected because of busy server
+	RetryAfterSeconds = 5
+)
+
+var (
+	errQueueFull     = errors.New("processing queue is full")
+	errTaskFailed    = errors.New("processing task failed")
+	errOverMemoryCap = errors.New("estimated memory is over processing budget")
+)
+
+// Bounded pool of workers for image processing.
+// Tasks wait in queue with limited size, new tasks are rejected if queue is full
+type workerPool struct {
+	logger *logrus.Logger
+	tasks  chan func()
+}
+
+func newWorkerPool(workers, queueSize int, logger *logrus.Logger) *workerPool {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if queueSize <= 0 {
+		queueSize = DefaultPoolQueueSize
+	}
+	p := &workerPool{
+		logger: logger,
+		tasks:  make(chan func(), queueSize),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	for task := range p.tasks {
+		p.execute(task)
+	}
+}
+
+// panic in one task should not stop worker
+func (p *workerPool) execute(task func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.logger.Errorf("Processing task panic: %v", r)
+		}
+	}()
+	task()
+}
+
+// Queue task without waiting for its result
+func (p *workerPool) Submit(task func()) error {
+	queued := time.Now()
+	metrics.ProcessingQueueDepth.Inc()
+	select {
+	case p.tasks <- func() {
+		metrics.ProcessingQueueDepth.Dec()
+		metrics.ProcessingQueueWait.Observe(time.Since(queued).Seconds())
+		task()
+	}:
+		return nil
+	default:
+		metrics.ProcessingQueueDepth.Dec()
+		return errQueueFull
+	}
+}
+
+// Queue task and wait until it finished
+func (p *workerPool) Run(task func()) error {
+	done := make(chan bool, 1)
+	err := p.Submit(func() {
+		finished := false
+		defer func() { done <- finished }()
+		task()
+		finished = true
+	})
+	if err != nil {
+		return err
+	}
+	if !<-done {
+		return errTaskFailed
+	}
+	return nil
+}
+
+// Run processing task in worker pool and wait for its result
+func (s *ApiServerRequestProcessor) runInPool(task func() *processingError) *processingError {
+	var perr *processingError
+	err := s.workers.Run(func() {
+		perr = task()
+	})
+	if err == errQueueFull {
+		s.logger.Warn(utils.ErrMsgProcessingQueueFull)
+		return &processingError{http.StatusServiceUnavailable, utils.ErrProcessingQueueFullCode, utils.ErrMsgProcessingQueueFull, nil}
+	}
+	if err != nil {
+		return &processingError{http.StatusInternalServerError, utils.ErrCannotResizeImageCode, fmt.Sprintf("%s: %v", utils.ErrMsgCannotResizeImage, err), nil}
+	}
+	return perr
+}
+
+type workerContextKey struct{}
+
+// Mark context of task executed by worker, so its nested processing is not queued again
+func withinWorker(ctx context.Context) context.Context {
+	return context.WithValue(ctx, workerContextKey{}, true)
+}
+
+func isWithinWorker(ctx context.Context) bool {
+	inWorker, _ := ctx.Value(workerContextKey{}).(bool)
+	return inWorker
+}
+
+// Run processing task in worker pool, task of context which is already executed by worker is run in place
+func (s *ApiServerRequestProcessor) runInWorker(ctx context.Context, task func() *processingError) *processingError {
+	if isWithinWorker(ctx) {
+		return task()
+	}
+	return s.runInPool(task)
+}
+
+// Budget of estimated memory of images resized at once.
+// Worker waits until its image fits into budget, image over whole budget is never resized
+type memoryLimiter struct {
+	mu       sync.Mutex
+	released *sync.Cond
+	limit    int64
+	reserved int64
+}
+
+func newMemoryLimiter(limit int64) *memoryLimiter {
+	l := &memoryLimiter{limit: limit}
+	l.released = sync.NewCond(&l.mu)
+	return l
+}
+
+// Wait until size fits into budget and reserve it, zero limit disables budget
+func (l *memoryLimiter) Reserve(size int64) error {
+	if l.limit <= 0 {
+		return nil
+	}
+	if size > l.limit {
+		return errOverMemoryCap
+	}
+
+	started := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.reserved+size > l.limit {
+		l.released.Wait()
+	}
+	l.reserved += size
+	metrics.ProcessingMemoryWait.Observe(time.Since(started).Seconds())
+	metrics.ProcessingMemory.Set(float64(l.reserved))
+	return nil
+}
+
+func (l *memoryLimiter) Release(size int64) {
+	if l.limit <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reserved -= size
+	metrics.ProcessingMemory.Set(float64(l.reserved))
+	l.released.Broadcast()
+}
+
+// Estimated memory of one resize: decoded original, intermediate image of resampling
+// (width of result, height of original) and result, 4 bytes per pixel each
+func resizeMemory(srcWidth, srcHeight int, variant *dto.VariantDto) int64 {
+	const bytesPerPixel = 4
+	src := int64(srcWidth) * int64(srcHeight)
+	intermediate := int64(variant.Width) * int64(srcHeight)
+	dst := int64(variant.Width) * int64(variant.Height)
+	return bytesPerPixel * (src + intermediate + dst)
+}
@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Verification of JWT bearer tokens.
+// HS256 tokens are verified with shared secret, RS256 tokens with public keys from local JWKS file.
+// Token must have "exp" claim, "nbf" and "aud" are checked if present (aud is required if audience configured)
+
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+)
+
+type JwtVerifier struct {
+	secret   []byte
+	keys     map[string]*rsa.PublicKey
+	audience string
+	leeway   time.Duration
+	now      func() time.Time
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// key set in JWKS format, only RSA keys are used
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+func NewJwtVerifier(cfg *dto.JwtConfig) (*JwtVerifier, error) {
+	v := &JwtVerifier{
+		secret:   []byte(cfg.Secret),
+		keys:     make(map[string]*rsa.PublicKey),
+		audience: cfg.Audience,
+		leeway:   cfg.Leeway.Duration,
+		now:      time.Now,
+	}
+	if len(cfg.JwksFile) > 0 {
+		if err := v.loadJwks(cfg.JwksFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(v.secret) == 0 && len(v.keys) == 0 {
+		return nil, fmt.Errorf("JWT secret or JWKS file is required")
+	}
+	return v, nil
+}
+
+func (v *JwtVerifier) loadJwks(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read JWKS file: %v", err)
+	}
+	set := jwks{}
+	if err = json.Unmarshal(content, &set); err != nil {
+		return fmt.Errorf("cannot parse JWKS file: %v", err)
+	}
+	for _, key := range set.Keys {
+		if key.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return fmt.Errorf("invalid modulus of key %s: %v", key.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return fmt.Errorf("invalid exponent of key %s: %v", key.Kid, err)
+		}
+		v.keys[key.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(v.keys) == 0 {
+		return fmt.Errorf("no RSA keys in JWKS file")
+	}
+	return nil
+}
+
+// Check token signature and time/audience claims, return claims of valid token
+func (v *JwtVerifier) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	header := jwtHeader{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid token header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature: %v", err)
+	}
+	if err = v.verifySignature(&header, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{})
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %v", err)
+	}
+	if err = v.verifyClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *JwtVerifier) verifySignature(header *jwtHeader, signingInput string, signature []byte) error {
+	hash := sha256.Sum256([]byte(signingInput))
+	switch header.Alg {
+	case AlgHS256:
+		if len(v.secret) == 0 {
+			return fmt.Errorf("HS256 tokens are not accepted")
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		_, _ = mac.Write([]byte(signingInput))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	case AlgRS256:
+		key := v.keys[header.Kid]
+		if key == nil && len(header.Kid) == 0 && len(v.keys) == 1 {
+			for _, k := range v.keys {
+				key = k
+			}
+		}
+		if key == nil {
+			return fmt.Errorf("unknown token key %s", header.Kid)
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported token algorithm %s", header.Alg)
+	}
+}
+
+func (v *JwtVerifier) verifyClaims(claims map[string]interface{}) error {
+	now := v.now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("token has no expiration time")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(v.leeway)) {
+		return fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-v.leeway)) {
+		return fmt.Errorf("token is not valid yet")
+	}
+
+	if len(v.audience) > 0 && !containsString(StringsClaim(claims, "aud"), v.audience) {
+		return fmt.Errorf("token is not issued for audience %s", v.audience)
+	}
+	return nil
+}
+
+// Read claim which can be a string or array of strings.
+// String is split by spaces, like "scope" claim
+func StringsClaim(claims map[string]interface{}, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		result := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	default:
+		return nil
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	content, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"container/list"
+	"github.com/senseyman/image-media-processor/service/metrics"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Size-bounded LRU cache of images in memory, safe for concurrent use.
+// Least recently used entries are evicted when total size is over budget, entries expire after ttl.
+// Zero budget disables cache, zero ttl means entries never expire
+type LRU struct {
+	name     string
+	maxBytes int64
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	bytes int64
+	items map[string]*list.Element
+	// most recently used entry is in front
+	order *list.List
+}
+
+type entry struct {
+	key     string
+	value   interface{}
+	size    int64
+	expires time.Time
+}
+
+// Name is used as label of cache metrics
+func NewLRU(name string, maxBytes int64, ttl time.Duration) *LRU {
+	return &LRU{
+		name:     name,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *LRU) Enabled() bool {
+	return c.maxBytes > 0
+}
+
+// Value of key, lookup is counted as hit or miss
+func (c *LRU) Get(key string) (interface{}, bool) {
+	if !c.Enabled() {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if ok && c.ttl > 0 && time.Now().After(el.Value.(*entry).expires) {
+		c.remove(el)
+		ok = false
+	}
+	if !ok {
+		metrics.MemoryCache.WithLabelValues(c.name, metrics.CacheMiss).Inc()
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	metrics.MemoryCache.WithLabelValues(c.name, metrics.CacheHit).Inc()
+	return el.Value.(*entry).value, true
+}
+
+// Add or replace value of key, value larger than whole budget is not stored
+func (c *LRU) Set(key string, value interface{}, size int64) {
+	if !c.Enabled() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer func() {
+		metrics.MemoryCacheBytes.WithLabelValues(c.name).Set(float64(c.bytes))
+	}()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	if size > c.maxBytes {
+		return
+	}
+	e := &entry{key: key, value: value, size: size, expires: time.Now().Add(c.ttl)}
+	c.items[key] = c.order.PushFront(e)
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *LRU) Delete(key string) {
+	if !c.Enabled() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+		metrics.MemoryCacheBytes.WithLabelValues(c.name).Set(float64(c.bytes))
+	}
+}
+
+// Delete all entries which keys start with prefix
+func (c *LRU) DeletePrefix(prefix string) {
+	if !c.Enabled() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(el)
+		}
+	}
+	metrics.MemoryCacheBytes.WithLabelValues(c.name).Set(float64(c.bytes))
+}
+
+// Total size of cached values
+func (c *LRU) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+func (c *LRU) remove(el *list.Element) {
+	e := el.Value.(*entry)
+	c.order.Remove(el)
+	delete(c.items, e.key)
+	c.bytes -= e.size
+}
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/service"
+	"github.com/senseyman/image-media-processor/service/metrics"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"strings"
+	"time"
+)
+
+// Storage of hashed API keys in separate collection
+
+const DefaultApiKeysCollection = "apiKeys"
+
+func (m *MongoDbService) apiKeysCollection() string {
+	if len(m.ApiKeysCollection) == 0 {
+		return DefaultApiKeysCollection
+	}
+	return m.ApiKeysCollection
+}
+
+func (m *MongoDbService) InsertApiKey(ctx context.Context, key *dto.ApiKeyDto) error {
+	if key == nil {
+		return fmt.Errorf("Nil API key for inserting ")
+	}
+	col := m.client.Database(m.ImageStore).Collection(m.apiKeysCollection())
+	dbCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	leftRetry := Retry
+	currentSleepTime := SleepTime
+
+	var err error
+	for leftRetry > 0 {
+		_, err = col.InsertOne(dbCtx, key)
+		if isDuplicateKey(err) {
+			return fmt.Errorf("%w: %v", service.ErrAlreadyExists, err)
+		}
+		if err != nil {
+			m.logger.WithContext(ctx).Warnf("Cannot save API key to db. Retrying... Error: %v", err)
+			metrics.ObserveRetry(metrics.BackendMongo, "insert_api_key")
+			leftRetry--
+			time.Sleep(currentSleepTime)
+			currentSleepTime += SleepTime
+			continue
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: %v", service.ErrUnavailable, err)
+}
+
+// Searching API key by hash of key, nil if key not found
+func (m *MongoDbService) GetApiKeyByHash(ctx context.Context, keyHash string) *dto.ApiKeyDto {
+	col := m.client.Database(m.ImageStore).Collection(m.apiKeysCollection())
+	dbCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	res := dto.ApiKeyDto{}
+	leftRetry := Retry
+	currentSleepTime := SleepTime
+
+	var err error
+	for leftRetry > 0 {
+		err = col.FindOne(dbCtx, bson.D{primitive.E{Key: "keyhash", Value: keyHash}}).Decode(&res)
+
+		if err != nil {
+			if strings.Contains(err.Error(), "no documents in result") {
+				return nil
+			}
+			leftRetry--
+			m.logger.WithContext(ctx).Warnf("Cannot get API key from db. Retrying... Err: %v", err)
+			metrics.ObserveRetry(metrics.BackendMongo, "get_api_key")
+			time.Sleep(currentSleepTime)
+			currentSleepTime += SleepTime
+			continue
+		}
+		return &res
+	}
+
+	return nil
+}
+
+func (m *MongoDbService) FindAllApiKeys(ctx context.Context) []*dto.ApiKeyDto {
+	col := m.client.Database(m.ImageStore).Collection(m.apiKeysCollection())
+	dbCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	result := make([]*dto.ApiKeyDto, 0)
+
+	leftRetry := Retry
+	currentSleepTime := SleepTime
+
+	for leftRetry > 0 {
+		cursor, err := col.Find(dbCtx, bson.D{})
+		if err != nil {
+			leftRetry--
+			m.logger.WithContext(ctx).Warnf("Cannot get API keys from db. Retrying... Err: %v", err)
+			metrics.ObserveRetry(metrics.BackendMongo, "find_api_keys")
+			time.Sleep(currentSleepTime)
+			currentSleepTime += SleepTime
+			continue
+		}
+
+		err = cursor.All(context.TODO(), &result)
+		if err != nil {
+			m.logger.WithContext(ctx).Errorf("Cannot map cursor results to response array. Err: %v", err)
+			return nil
+		}
+
+		return result
+	}
+
+	return nil
+}
+
+// Delete API key by id, returns false if key not found
+func (m *MongoDbService) DeleteApiKey(ctx context.Context, id string) (bool, error) {
+	col := m.client.Database(m.ImageStore).Collection(m.apiKeysCollection())
+	dbCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	leftRetry := Retry
+	currentSleepTime := SleepTime
+
+	var (
+		res *mongo.DeleteResult
+		err error
+	)
+	for leftRetry > 0 {
+		res, err = col.DeleteOne(dbCtx, bson.D{primitive.E{Key: "id", Value: id}})
+		if err != nil {
+			m.logger.WithContext(ctx).Warnf("Cannot delete API key %s from db. Retrying... Error: %v", id, err)
+			metrics.ObserveRetry(metrics.BackendMongo, "delete_api_key")
+			leftRetry--
+			time.Sleep(currentSleepTime)
+			currentSleepTime += SleepTime
+			continue
+		}
+		return res.DeletedCount > 0, nil
+	}
+
+	return false, err
+}
+
+// Delete all API keys of user
+func (m *MongoDbService) DeleteUserApiKeys(ctx context.Context, userId string) (int64, error) {
+	return m.deleteMany(ctx, m.apiKeysCollection(), bson.D{primitive.E{Key: "userid", Value: userId}}, "delete_user_api_keys")
+}
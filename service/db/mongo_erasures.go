@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/service"
+	"github.com/senseyman/image-media-processor/service/metrics"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
+	"time"
+)
+
+// Storage of user erasures progress in separate collection, so interrupted erasure can be continued by any instance
+
+const DefaultErasuresCollection = "erasures"
+
+func (m *MongoDbService) erasuresCollection() string {
+	if len(m.ErasuresCollection) == 0 {
+		return DefaultErasuresCollection
+	}
+	return m.ErasuresCollection
+}
+
+// Insert new erasure or replace state of existing one
+func (m *MongoDbService) SaveErasure(ctx context.Context, erasure *dto.ErasureDto) error {
+	if erasure == nil {
+		return fmt.Errorf("Nil erasure for saving ")
+	}
+	col := m.client.Database(m.ImageStore).Collection(m.erasuresCollection())
+	dbCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	leftRetry := Retry
+	currentSleepTime := SleepTime
+
+	var err error
+	for leftRetry > 0 {
+		_, err = col.ReplaceOne(dbCtx, bson.D{primitive.E{Key: "userid", Value: erasure.UserId}}, erasure, options.Replace().SetUpsert(true))
+		if err != nil {
+			m.logger.WithContext(ctx).Warnf("Cannot save erasure of user %s to db. Retrying... Error: %v", erasure.UserId, err)
+			metrics.ObserveRetry(metrics.BackendMongo, "save_erasure")
+			leftRetry--
+			time.Sleep(currentSleepTime)
+			currentSleepTime += SleepTime
+			continue
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: %v", service.ErrUnavailable, err)
+}
+
+func (m *MongoDbService) GetErasure(ctx context.Context, userId string) (*dto.ErasureDto, error) {
+	col := m.client.Database(m.ImageStore).Collection(m.erasuresCollection())
+	dbCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	res := dto.ErasureDto{}
+	leftRetry := Retry
+	currentSleepTime := SleepTime
+
+	var err error
+	for leftRetry > 0 {
+		err = col.FindOne(dbCtx, bson.D{primitive.E{Key: "userid", Value: userId}}).Decode(&res)
+
+		if err != nil {
+			if strings.Contains(err.Error(), "no documents in result") {
+				return nil, fmt.Errorf("%w: %v", service.ErrNotFound, err)
+			}
+			leftRetry--
+			m.logger.WithContext(ctx).Warnf("Cannot get erasure of user %s from db. Retrying... Err: %v", userId, err)
+			metrics.ObserveRetry(metrics.BackendMongo, "get_erasure")
+			time.Sleep(currentSleepTime)
+			currentSleepTime += SleepTime
+			continue
+		}
+		return &res, nil
+	}
+
+	return nil, fmt.Errorf("%w: %v", service.ErrUnavailable, err)
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/service/metrics"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
+	"time"
+)
+
+// Storage of asynchronous jobs in separate collection, so job state is shared by all instances
+
+const DefaultJobsCollection = "jobs"
+
+func (m *MongoDbService) jobsCollection() string {
+	if len(m.JobsCollection) == 0 {
+		return DefaultJobsCollection
+	}
+	return m.JobsCollection
+}
+
+// Insert new job or replace state of existing one
+func (m *MongoDbService) SaveJob(job *dto.JobDto) error {
+	if job == nil {
+		return fmt.Errorf("Nil job for saving ")
+	}
+	col := m.client.Database(m.ImageStore).Collection(m.jobsCollection())
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	leftRetry := Retry
+	currentSleepTime := SleepTime
+
+	var err error
+	for leftRetry > 0 {
+		_, err = col.ReplaceOne(ctx, bson.D{primitive.E{Key: "id", Value: job.Id}}, job, options.Replace().SetUpsert(true))
+		if err != nil {
+			m.logger.Warnf("Cannot save job %s to db. Retrying... Error: %v", job.Id, err)
+			metrics.ObserveRetry(metrics.BackendMongo, "save_job")
+			leftRetry--
+			time.Sleep(currentSleepTime)
+			currentSleepTime += SleepTime
+			continue
+		}
+		return nil
+	}
+
+	return err
+}
+
+func (m *MongoDbService) GetJob(id string) *dto.JobDto {
+	col := m.client.Database(m.ImageStore).Collection(m.jobsCollection())
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	res := dto.JobDto{}
+	leftRetry := Retry
+	currentSleepTime := SleepTime
+
+	var err error
+	for leftRetry > 0 {
+		err = col.FindOne(ctx, bson.D{primitive.E{Key: "id", Value: id}}).Decode(&res)
+
+		if err != nil {
+			if strings.Contains(err.Error(), "no documents in result") {
+				return nil
+			}
+			leftRetry--
+			m.logger.Warnf("Cannot get job %s from db. Retrying... Err: %v", id, err)
+			metrics.ObserveRetry(metrics.BackendMongo, "get_job")
+			time.Sleep(currentSleepTime)
+			currentSleepTime += SleepTime
+			continue
+		}
+		return &res
+	}
+
+	return nil
+}
+
+// Delete all jobs of user
+func (m *MongoDbService) DeleteUserJobs(userId string) (int64, error) {
+	return m.deleteMany(context.Background(), m.jobsCollection(), bson.D{primitive.E{Key: "userid", Value: userId}}, "delete_user_jobs")
+}
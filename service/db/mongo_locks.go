@@ -0,0 +1,72 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/senseyman/image-media-processor/service"
+	"github.com/senseyman/image-media-processor/service/metrics"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// Locks shared by instances in separate collection, document id is key of lock.
+// Lock is taken by upsert, which matches only free or expired lock of key.
+// If lock is held by other owner, upsert tries to insert document with the same id and fails on unique index
+
+const DefaultLocksCollection = "locks"
+
+func (m *MongoDbService) locksCollection() string {
+	if len(m.LocksCollection) == 0 {
+		return DefaultLocksCollection
+	}
+	return m.LocksCollection
+}
+
+func (m *MongoDbService) AcquireLock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	col := m.client.Database(m.ImageStore).Collection(m.locksCollection())
+	dbCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	leftRetry := Retry
+	currentSleepTime := SleepTime
+
+	var err error
+	for leftRetry > 0 {
+		now := time.Now().UTC()
+		filter := bson.D{
+			primitive.E{Key: "_id", Value: key},
+			primitive.E{Key: "$or", Value: bson.A{
+				bson.D{primitive.E{Key: "owner", Value: owner}},
+				bson.D{primitive.E{Key: "expiresat", Value: bson.D{primitive.E{Key: "$lte", Value: now}}}},
+			}},
+		}
+		update := bson.D{primitive.E{Key: "$set", Value: bson.D{
+			primitive.E{Key: "owner", Value: owner},
+			primitive.E{Key: "expiresat", Value: now.Add(ttl)},
+		}}}
+		_, err = col.UpdateOne(dbCtx, filter, update, options.Update().SetUpsert(true))
+		if isDuplicateKey(err) {
+			return false, nil
+		}
+		if err != nil {
+			m.logger.WithContext(ctx).Warnf("Cannot acquire lock %s. Retrying... Error: %v", key, err)
+			metrics.ObserveRetry(metrics.BackendMongo, "acquire_lock")
+			leftRetry--
+			time.Sleep(currentSleepTime)
+			currentSleepTime += SleepTime
+			continue
+		}
+		return true, nil
+	}
+
+	return false, fmt.Errorf("%w: %v", service.ErrUnavailable, err)
+}
+
+func (m *MongoDbService) ReleaseLock(ctx context.Context, key, owner string) error {
+	_, err := m.deleteMany(ctx, m.locksCollection(), bson.D{
+		primitive.E{Key: "_id", Value: key},
+		primitive.E{Key: "owner", Value: owner},
+	}, "release_lock")
+	return err
+}
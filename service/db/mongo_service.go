@@ -2,13 +2,17 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/service"
+	"github.com/senseyman/image-media-processor/service/metrics"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"strings"
 	"time"
 )
@@ -19,13 +23,21 @@ import (
 const (
 	Retry     = 3
 	SleepTime = 100 * time.Millisecond
+
+	// code of write error on unique index violation
+	DuplicateKeyCode = 11000
 )
 
 type MongoDbService struct {
-	logger          *logrus.Logger
-	client          *mongo.Client
-	ImageStore      string
-	UsersCollection string
+	logger             *logrus.Logger
+	client             *mongo.Client
+	ImageStore         string
+	UsersCollection    string
+	JobsCollection     string
+	WebhooksCollection string
+	ApiKeysCollection  string
+	ErasuresCollection string
+	LocksCollection    string
 }
 
 func NewMongoDbService(cfg *dto.MongoDbConfig, logger *logrus.Logger) *MongoDbService {
@@ -33,6 +45,12 @@ func NewMongoDbService(cfg *dto.MongoDbConfig, logger *logrus.Logger) *MongoDbSe
 		logger:          logger,
 		ImageStore:      cfg.Store,
 		UsersCollection: cfg.Collection,
+		JobsCollection:  cfg.JobsCollection,
+
+		WebhooksCollection: cfg.WebhooksCollection,
+		ApiKeysCollection:  cfg.ApiKeysCollection,
+		ErasuresCollection: cfg.ErasuresCollection,
+		LocksCollection:    cfg.LocksCollection,
 	}
 	service.client = service.connect(cfg.Username, cfg.Password, cfg.Address)
 	return service
@@ -48,22 +66,50 @@ func (m *MongoDbService) connect(username, password, address string) *mongo.Clie
 	return client
 }
 
+// Duplicate key is reported by unique index, such insert is not retried
+func isDuplicateKey(err error) bool {
+	var writeErr mongo.WriteException
+	if !errors.As(err, &writeErr) {
+		return false
+	}
+	for _, e := range writeErr.WriteErrors {
+		if e.Code == DuplicateKeyCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Close connections to DB, should be called after all requests are finished
+func (m *MongoDbService) Disconnect(ctx context.Context) error {
+	return m.client.Disconnect(ctx)
+}
+
+// Check connection to primary node, without retries
+func (m *MongoDbService) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, readpref.Primary())
+}
+
 // Inserting total info of processed image to DB (original url, resized url, resize params)
-func (m *MongoDbService) Insert(storeDto *dto.DbImageStoreDAO) error {
+func (m *MongoDbService) Insert(ctx context.Context, storeDto *dto.DbImageStoreDAO) error {
 	if storeDto == nil {
 		return fmt.Errorf("Nil data for inserting ")
 	}
 	col := m.client.Database(m.ImageStore).Collection(m.UsersCollection)
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	dbCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 	leftRetry := Retry
 	currentSleepTime := SleepTime
 
 	var err error
 	for leftRetry > 0 {
-		_, err = col.InsertOne(ctx, storeDto)
+		_, err = col.InsertOne(dbCtx, storeDto)
+		if isDuplicateKey(err) {
+			return fmt.Errorf("%w: %v", service.ErrAlreadyExists, err)
+		}
 		if err != nil {
-			m.logger.Warnf("Cannot save data to db. Retrying... Error: %v", err)
+			m.logger.WithContext(ctx).Warnf("Cannot save data to db. Retrying... Error: %v", err)
+			metrics.ObserveRetry(metrics.BackendMongo, "insert")
 			leftRetry--
 			time.Sleep(currentSleepTime)
 			currentSleepTime += SleepTime
@@ -72,29 +118,47 @@ func (m *MongoDbService) Insert(storeDto *dto.DbImageStoreDAO) error {
 		return nil
 	}
 
-	return err
+	return fmt.Errorf("%w: %v", service.ErrUnavailable, err)
 }
 
-// Searching image by imageId and size params
-func (m *MongoDbService) GetImage(picId uint32, width, height int) *dto.DbImageStoreDAO {
+// Searching image of user by imageId and size params
+// Format is checked only if it set in variant. Default mode and quality also match
+// records inserted before these fields were stored
+func (m *MongoDbService) GetImage(ctx context.Context, userId string, picId uint32, variant *dto.VariantDto) *dto.DbImageStoreDAO {
 	col := m.client.Database(m.ImageStore).Collection(m.UsersCollection)
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	dbCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 
 	res := dto.DbImageStoreDAO{}
 	leftRetry := Retry
 	currentSleepTime := SleepTime
 
+	filter := bson.D{primitive.E{Key: "userid", Value: userId}, primitive.E{Key: "picid", Value: picId}, primitive.E{Key: "resizedwidth", Value: variant.Width}, primitive.E{Key: "resizedheight", Value: variant.Height}}
+	if len(variant.Format) > 0 {
+		filter = append(filter, primitive.E{Key: "format", Value: variant.Format})
+	}
+	if len(variant.Mode) > 0 && variant.Mode != dto.ResizeModeResize {
+		filter = append(filter, primitive.E{Key: "mode", Value: variant.Mode})
+	} else {
+		filter = append(filter, primitive.E{Key: "mode", Value: bson.D{primitive.E{Key: "$in", Value: bson.A{nil, "", dto.ResizeModeResize}}}})
+	}
+	if variant.Quality > 0 {
+		filter = append(filter, primitive.E{Key: "quality", Value: variant.Quality})
+	} else {
+		filter = append(filter, primitive.E{Key: "quality", Value: bson.D{primitive.E{Key: "$in", Value: bson.A{nil, 0}}}})
+	}
+
 	var err error
 	for leftRetry > 0 {
-		err = col.FindOne(ctx, bson.D{primitive.E{Key: "picid", Value: picId}, primitive.E{Key: "resizedwidth", Value: width}, primitive.E{Key: "resizedheight", Value: height}}).Decode(&res)
+		err = col.FindOne(dbCtx, filter).Decode(&res)
 
 		if err != nil {
 			if strings.Contains(err.Error(), "no documents in result") {
 				return nil
 			}
 			leftRetry--
-			m.logger.Warnf("Cannot get data from db by request (picid: %d, width: %d, height: %d). Retrying... Err: %v", picId, width, height, err)
+			m.logger.WithContext(ctx).Warnf("Cannot get data from db by request (userid: %s, picid: %d, width: %d, height: %d, format: %s). Retrying... Err: %v", userId, picId, variant.Width, variant.Height, variant.Format, err)
+			metrics.ObserveRetry(metrics.BackendMongo, "get_image")
 			time.Sleep(currentSleepTime)
 			currentSleepTime += SleepTime
 			continue
@@ -106,9 +170,10 @@ func (m *MongoDbService) GetImage(picId uint32, width, height int) *dto.DbImageS
 	return nil
 }
 
-func (m *MongoDbService) GetImageByImageId(picId uint32) *dto.DbImageStoreDAO {
+// Searching any record of user image by imageId, ErrNotFound if image never processed by user
+func (m *MongoDbService) GetImageByImageId(ctx context.Context, userId string, picId uint32) (*dto.DbImageStoreDAO, error) {
 	col := m.client.Database(m.ImageStore).Collection(m.UsersCollection)
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	dbCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 
 	res := dto.DbImageStoreDAO{}
@@ -117,41 +182,48 @@ func (m *MongoDbService) GetImageByImageId(picId uint32) *dto.DbImageStoreDAO {
 
 	var err error
 	for leftRetry > 0 {
-		err = col.FindOne(ctx, bson.D{primitive.E{Key: "picid", Value: picId}}).Decode(&res)
+		err = col.FindOne(dbCtx, bson.D{primitive.E{Key: "userid", Value: userId}, primitive.E{Key: "picid", Value: picId}}).Decode(&res)
 
 		if err != nil {
+			if strings.Contains(err.Error(), "no documents in result") {
+				return nil, fmt.Errorf("image %d of user %s: %w", picId, userId, service.ErrNotFound)
+			}
 			leftRetry--
-			m.logger.Warnf("Cannot get data from db by request (picid: %d). Retrying...  Err: %v", picId, err)
+			m.logger.WithContext(ctx).Warnf("Cannot get data from db by request (userid: %s, picid: %d). Retrying...  Err: %v", userId, picId, err)
+			metrics.ObserveRetry(metrics.BackendMongo, "get_image_by_image_id")
 			time.Sleep(currentSleepTime)
 			currentSleepTime += SleepTime
 			continue
 		}
-		return &res
+		return &res, nil
 	}
 
-	return nil
+	return nil, fmt.Errorf("%w: %v", service.ErrUnavailable, err)
 }
 
 // Collect all user images by userId
-func (m *MongoDbService) FindAllPictureByUserId(userId string) []*dto.DbImageStoreDAO {
+func (m *MongoDbService) FindAllPictureByUserId(ctx context.Context, userId string) []*dto.DbImageStoreDAO {
+	return m.findAll(bson.D{primitive.E{Key: "userid", Value: userId}}, m.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"userId": userId,
+	}))
+}
+
+func (m *MongoDbService) findAll(filter bson.D, logEntity *logrus.Entry) []*dto.DbImageStoreDAO {
 	col := m.client.Database(m.ImageStore).Collection(m.UsersCollection)
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 
-	logEntity := m.logger.WithFields(logrus.Fields{
-		"userId": userId,
-	})
-
 	result := make([]*dto.DbImageStoreDAO, 0)
 
 	leftRetry := Retry
 	currentSleepTime := SleepTime
 
 	for leftRetry > 0 {
-		cursor, err := col.Find(ctx, bson.D{primitive.E{Key: "userid", Value: userId}})
+		cursor, err := col.Find(ctx, filter)
 		if err != nil {
 			leftRetry--
 			logEntity.Warnf("Cannot get records from db. Retrying... Err: %v", err)
+			metrics.ObserveRetry(metrics.BackendMongo, "find_images")
 			time.Sleep(currentSleepTime)
 			currentSleepTime += SleepTime
 			continue
@@ -169,3 +241,206 @@ func (m *MongoDbService) FindAllPictureByUserId(userId string) []*dto.DbImageSto
 
 	return nil
 }
+
+// Collect all images resized by preset
+func (m *MongoDbService) FindAllPictureByPreset(ctx context.Context, preset string) []*dto.DbImageStoreDAO {
+	return m.findAll(bson.D{primitive.E{Key: "preset", Value: preset}}, m.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"preset": preset,
+	}))
+}
+
+// Delete one resized image record
+func (m *MongoDbService) DeleteImage(ctx context.Context, img *dto.DbImageStoreDAO) error {
+	if img == nil {
+		return fmt.Errorf("Nil data for deleting ")
+	}
+	col := m.client.Database(m.ImageStore).Collection(m.UsersCollection)
+	dbCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	leftRetry := Retry
+	currentSleepTime := SleepTime
+
+	filter := bson.D{
+		primitive.E{Key: "userid", Value: img.UserId},
+		primitive.E{Key: "picid", Value: img.PicId},
+		primitive.E{Key: "resizedimageurl", Value: img.ResizedImageUrl},
+	}
+
+	var err error
+	for leftRetry > 0 {
+		_, err = col.DeleteOne(dbCtx, filter)
+		if err != nil {
+			m.logger.WithContext(ctx).Warnf("Cannot delete data from db. Retrying... Error: %v", err)
+			metrics.ObserveRetry(metrics.BackendMongo, "delete_image")
+			leftRetry--
+			time.Sleep(currentSleepTime)
+			currentSleepTime += SleepTime
+			continue
+		}
+		return nil
+	}
+
+	return err
+}
+
+// Delete all images records of user, both originals and variants
+func (m *MongoDbService) DeleteAllUserImages(ctx context.Context, userId string) (int64, error) {
+	return m.deleteMany(ctx, m.UsersCollection, bson.D{primitive.E{Key: "userid", Value: userId}}, "delete_user_images")
+}
+
+// Delete all records matched by filter, returns count of deleted records
+func (m *MongoDbService) deleteMany(ctx context.Context, collection string, filter bson.D, operation string) (int64, error) {
+	col := m.client.Database(m.ImageStore).Collection(collection)
+	dbCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	leftRetry := Retry
+	currentSleepTime := SleepTime
+
+	var (
+		res *mongo.DeleteResult
+		err error
+	)
+	for leftRetry > 0 {
+		res, err = col.DeleteMany(dbCtx, filter)
+		if err != nil {
+			m.logger.WithContext(ctx).Warnf("Cannot delete data from %s collection. Retrying... Error: %v", collection, err)
+			metrics.ObserveRetry(metrics.BackendMongo, operation)
+			leftRetry--
+			time.Sleep(currentSleepTime)
+			currentSleepTime += SleepTime
+			continue
+		}
+		return res.DeletedCount, nil
+	}
+
+	return 0, fmt.Errorf("%w: %v", service.ErrUnavailable, err)
+}
+
+// Collect all records of user image: variants which share the same original
+func (m *MongoDbService) FindAllPictureByUserAndImageId(ctx context.Context, userId string, picId uint32) []*dto.DbImageStoreDAO {
+	filter := bson.D{
+		primitive.E{Key: "userid", Value: userId},
+		primitive.E{Key: "picid", Value: picId},
+	}
+	return m.findAll(filter, m.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"userId":  userId,
+		"imageId": picId,
+	}))
+}
+
+// Set last access time of variant, it is done on every cache hit
+func (m *MongoDbService) TouchImage(ctx context.Context, img *dto.DbImageStoreDAO, accessedAt time.Time) error {
+	if img == nil {
+		return fmt.Errorf("Nil data for updating ")
+	}
+	col := m.client.Database(m.ImageStore).Collection(m.UsersCollection)
+	dbCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	leftRetry := Retry
+	currentSleepTime := SleepTime
+
+	filter := bson.D{
+		primitive.E{Key: "userid", Value: img.UserId},
+		primitive.E{Key: "picid", Value: img.PicId},
+		primitive.E{Key: "resizedimageurl", Value: img.ResizedImageUrl},
+	}
+	update := bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "lastaccessedat", Value: accessedAt}}}}
+
+	var err error
+	for leftRetry > 0 {
+		_, err = col.UpdateOne(dbCtx, filter, update)
+		if err != nil {
+			m.logger.WithContext(ctx).Warnf("Cannot update access time in db. Retrying... Error: %v", err)
+			metrics.ObserveRetry(metrics.BackendMongo, "touch_image")
+			leftRetry--
+			time.Sleep(currentSleepTime)
+			currentSleepTime += SleepTime
+			continue
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: %v", service.ErrUnavailable, err)
+}
+
+// Collect records created before given time
+func (m *MongoDbService) FindImagesCreatedBefore(ctx context.Context, before time.Time) []*dto.DbImageStoreDAO {
+	filter := bson.D{primitive.E{Key: "createdat", Value: bson.D{primitive.E{Key: "$lt", Value: before}}}}
+	return m.findAll(filter, m.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"createdBefore": before,
+	}))
+}
+
+// Collect records not accessed since given time. Records inserted before access time was stored are matched by creation time
+func (m *MongoDbService) FindImagesAccessedBefore(ctx context.Context, before time.Time) []*dto.DbImageStoreDAO {
+	filter := bson.D{primitive.E{Key: "$or", Value: bson.A{
+		bson.D{primitive.E{Key: "lastaccessedat", Value: bson.D{primitive.E{Key: "$lt", Value: before}}}},
+		bson.D{
+			primitive.E{Key: "lastaccessedat", Value: bson.D{primitive.E{Key: "$exists", Value: false}}},
+			primitive.E{Key: "createdat", Value: bson.D{primitive.E{Key: "$lt", Value: before}}},
+		},
+	}}}
+	return m.findAll(filter, m.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"accessedBefore": before,
+	}))
+}
+
+// Collect all records of images which have more than max variants.
+// Images of different users can have the same id, so records are grouped by user and image id
+func (m *MongoDbService) FindImagesWithVariantsOver(ctx context.Context, max int) []*dto.DbImageStoreDAO {
+	logEntity := m.logger.WithContext(ctx).WithField("maxVariants", max)
+	col := m.client.Database(m.ImageStore).Collection(m.UsersCollection)
+	dbCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	pipeline := mongo.Pipeline{
+		bson.D{primitive.E{Key: "$group", Value: bson.D{
+			primitive.E{Key: "_id", Value: bson.D{
+				primitive.E{Key: "u", Value: "$userid"},
+				primitive.E{Key: "p", Value: "$picid"},
+			}},
+			primitive.E{Key: "count", Value: bson.D{primitive.E{Key: "$sum", Value: 1}}},
+		}}},
+		bson.D{primitive.E{Key: "$match", Value: bson.D{primitive.E{Key: "count", Value: bson.D{primitive.E{Key: "$gt", Value: max}}}}}},
+	}
+	groups := make([]struct {
+		Id struct {
+			UserId string `bson:"u"`
+			PicId  uint32 `bson:"p"`
+		} `bson:"_id"`
+	}, 0)
+
+	leftRetry := Retry
+	currentSleepTime := SleepTime
+
+	for leftRetry > 0 {
+		cursor, err := col.Aggregate(dbCtx, pipeline)
+		if err != nil {
+			leftRetry--
+			logEntity.Warnf("Cannot count variants in db. Retrying... Err: %v", err)
+			metrics.ObserveRetry(metrics.BackendMongo, "count_variants")
+			time.Sleep(currentSleepTime)
+			currentSleepTime += SleepTime
+			continue
+		}
+
+		if err = cursor.All(context.TODO(), &groups); err != nil {
+			logEntity.Errorf("Cannot map cursor results to response array. Err: %v", err)
+			return nil
+		}
+
+		images := make(bson.A, 0, len(groups))
+		for _, group := range groups {
+			images = append(images, bson.D{
+				primitive.E{Key: "userid", Value: group.Id.UserId},
+				primitive.E{Key: "picid", Value: group.Id.PicId},
+			})
+		}
+		if len(images) == 0 {
+			return make([]*dto.DbImageStoreDAO, 0)
+		}
+		return m.findAll(bson.D{primitive.E{Key: "$or", Value: images}}, logEntity)
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/service/metrics"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// Log of callback deliveries in separate collection, so it is shared by all instances
+
+const DefaultWebhooksCollection = "webhookDeliveries"
+
+func (m *MongoDbService) webhooksCollection() string {
+	if len(m.WebhooksCollection) == 0 {
+		return DefaultWebhooksCollection
+	}
+	return m.WebhooksCollection
+}
+
+func (m *MongoDbService) SaveWebhookDelivery(delivery *dto.WebhookDeliveryDto) error {
+	if delivery == nil {
+		return fmt.Errorf("Nil webhook delivery for saving ")
+	}
+	col := m.client.Database(m.ImageStore).Collection(m.webhooksCollection())
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	leftRetry := Retry
+	currentSleepTime := SleepTime
+
+	var err error
+	for leftRetry > 0 {
+		_, err = col.InsertOne(ctx, delivery)
+		if err != nil {
+			m.logger.Warnf("Cannot save webhook delivery to db. Retrying... Error: %v", err)
+			metrics.ObserveRetry(metrics.BackendMongo, "save_webhook_delivery")
+			leftRetry--
+			time.Sleep(currentSleepTime)
+			currentSleepTime += SleepTime
+			continue
+		}
+		return nil
+	}
+
+	return err
+}
+
+// Collect all delivery attempts of user request in order they were made
+func (m *MongoDbService) FindWebhookDeliveries(userId, requestId string) []*dto.WebhookDeliveryDto {
+	logEntity := m.logger.WithFields(logrus.Fields{
+		"userId":    userId,
+		"requestId": requestId,
+	})
+	col := m.client.Database(m.ImageStore).Collection(m.webhooksCollection())
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	filter := bson.D{primitive.E{Key: "userid", Value: userId}, primitive.E{Key: "requestid", Value: requestId}}
+	findOptions := options.Find().SetSort(bson.D{primitive.E{Key: "createdat", Value: 1}})
+	result := make([]*dto.WebhookDeliveryDto, 0)
+
+	leftRetry := Retry
+	currentSleepTime := SleepTime
+
+	for leftRetry > 0 {
+		cursor, err := col.Find(ctx, filter, findOptions)
+		if err != nil {
+			leftRetry--
+			logEntity.Warnf("Cannot get webhook deliveries from db. Retrying... Err: %v", err)
+			metrics.ObserveRetry(metrics.BackendMongo, "find_webhook_deliveries")
+			time.Sleep(currentSleepTime)
+			currentSleepTime += SleepTime
+			continue
+		}
+
+		err = cursor.All(context.TODO(), &result)
+		if err != nil {
+			logEntity.Errorf("Cannot map cursor results to response array. Err: %v", err)
+			return nil
+		}
+
+		return result
+	}
+
+	return nil
+}
+
+// Delete all delivery attempts of user requests
+func (m *MongoDbService) DeleteUserWebhookDeliveries(userId string) (int64, error) {
+	return m.deleteMany(context.Background(), m.webhooksCollection(), bson.D{primitive.E{Key: "userid", Value: userId}}, "delete_user_webhook_deliveries")
+}
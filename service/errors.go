@@ -0,0 +1,18 @@
+package service
+
+import "errors"
+
+// Typed errors of services. Implementations wrap their errors with one of them,
+// so callers can tell missing data from unavailable backend by errors.Is
+var (
+	// requested record or file does not exist
+	ErrNotFound = errors.New("not found")
+	// record with the same key already exists
+	ErrAlreadyExists = errors.New("already exists")
+	// image format is not supported by media processor
+	ErrUnsupportedMedia = errors.New("unsupported media type")
+	// image content is broken and cannot be decoded
+	ErrInvalidImage = errors.New("invalid image")
+	// backend is not reachable, operation can succeed later
+	ErrUnavailable = errors.New("service unavailable")
+)
@@ -0,0 +1,119 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/service"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Client for downloading source images from remote urls.
+// Original url and every redirect target are checked by Guard
+
+const (
+	DefaultMaxSize      = 100 << 20
+	DefaultTimeout      = 10 * time.Second
+	DefaultMaxRedirects = 3
+)
+
+var (
+	// url is not allowed by config or resolved to internal address
+	ErrBlocked = errors.New("url is not allowed")
+	// remote image is larger than configured limit
+	ErrTooLarge = errors.New("source image is too large")
+)
+
+type Fetcher struct {
+	guard        *Guard
+	maxSize      int64
+	maxRedirects int
+	httpClient   *http.Client
+}
+
+func NewFetcher(cfg *dto.FetchConfig) *Fetcher {
+	f := &Fetcher{
+		guard:        NewGuard(cfg.AllowHosts, cfg.DenyHosts, cfg.AllowPrivate),
+		maxSize:      cfg.MaxSize,
+		maxRedirects: cfg.MaxRedirects,
+	}
+	if f.maxSize <= 0 {
+		f.maxSize = DefaultMaxSize
+	}
+	if f.maxRedirects == 0 {
+		f.maxRedirects = DefaultMaxRedirects
+	}
+	timeout := cfg.Timeout.Duration
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	f.httpClient = &http.Client{
+		Timeout:       timeout,
+		Transport:     f.guard.Transport(timeout),
+		CheckRedirect: f.checkRedirect,
+	}
+	return f
+}
+
+// Check scheme and host of url by config, address of host is checked on connection
+func (f *Fetcher) CheckUrl(rawUrl string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBlocked, err)
+	}
+	return f.guard.CheckUrl(u)
+}
+
+// Download content of url. Missing remote file is reported as service.ErrNotFound,
+// other failed responses and network errors as service.ErrUnavailable
+func (f *Fetcher) Fetch(ctx context.Context, rawUrl string) ([]byte, string, error) {
+	if err := f.CheckUrl(rawUrl); err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawUrl, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrBlocked, err)
+	}
+
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		if errors.Is(err, ErrBlocked) {
+			return nil, "", err
+		}
+		return nil, "", fmt.Errorf("%w: %v", service.ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return nil, "", fmt.Errorf("%w: source url responded with status %d", service.ErrNotFound, resp.StatusCode)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, "", fmt.Errorf("%w: source url responded with status %d", service.ErrUnavailable, resp.StatusCode)
+	case resp.ContentLength > f.maxSize:
+		return nil, "", fmt.Errorf("%w: %d bytes, limit is %d", ErrTooLarge, resp.ContentLength, f.maxSize)
+	}
+
+	// one byte more than limit is read to detect too large body without Content-Length
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.maxSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", service.ErrUnavailable, err)
+	}
+	if int64(len(content)) > f.maxSize {
+		return nil, "", fmt.Errorf("%w: limit is %d bytes", ErrTooLarge, f.maxSize)
+	}
+	return content, resp.Header.Get("Content-Type"), nil
+}
+
+// Every redirect target is checked like original url
+func (f *Fetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > f.maxRedirects {
+		return fmt.Errorf("%w: stopped after %d redirects", ErrBlocked, f.maxRedirects)
+	}
+	return f.guard.CheckUrl(req.URL)
+}
@@ -0,0 +1,122 @@
+package fetch
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ranges of private, loopback, link-local and other internal addresses
+var blockedNetworks = parseNetworks(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+// Check of outgoing requests to user provided urls, used for source images and callbacks.
+// Url is checked by host lists, address is checked after DNS resolution when connection is made,
+// so host name resolved to internal address is rejected too
+type Guard struct {
+	allowHosts   []string
+	denyHosts    []string
+	allowPrivate bool
+}
+
+func NewGuard(allowHosts, denyHosts []string, allowPrivate bool) *Guard {
+	return &Guard{
+		allowHosts:   allowHosts,
+		denyHosts:    denyHosts,
+		allowPrivate: allowPrivate,
+	}
+}
+
+// Check scheme and host of url, address of host is checked on connection
+func (g *Guard) CheckUrl(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: only http and https urls are supported", ErrBlocked)
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if len(host) == 0 {
+		return fmt.Errorf("%w: host is not set", ErrBlocked)
+	}
+	if matchHost(host, g.denyHosts) {
+		return fmt.Errorf("%w: host %s is denied", ErrBlocked, host)
+	}
+	if len(g.allowHosts) > 0 && !matchHost(host, g.allowHosts) {
+		return fmt.Errorf("%w: host %s is not in allowed hosts", ErrBlocked, host)
+	}
+	return nil
+}
+
+// Transport which connects only to addresses allowed by guard
+func (g *Guard) Transport(timeout time.Duration) *http.Transport {
+	dialer := &net.Dialer{Timeout: timeout, Control: g.checkAddress}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// proxy would connect to target instead of us, so its address cannot be checked
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+// Called by dialer with resolved address before connection is made
+func (g *Guard) checkAddress(network, address string, _ syscall.RawConn) error {
+	if g.allowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBlocked, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || isInternal(ip) {
+		return fmt.Errorf("%w: address %s is internal", ErrBlocked, host)
+	}
+	return nil
+}
+
+func isInternal(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Host matches list entry if it is equal to entry or is its subdomain
+func matchHost(host string, hosts []string) bool {
+	for _, h := range hosts {
+		h = strings.ToLower(strings.TrimSuffix(h, "."))
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -1,23 +1,90 @@
 package service
 
 import (
+	"context"
 	"github.com/senseyman/image-media-processor/dto"
+	"image"
 	"io"
 	"os"
+	"time"
 )
 
+// ctx of processing methods carries trace of workflow
 type MediaProcessor interface {
-	Resize(buffer io.Reader, name string, width, height int) (*dto.FileInfoDto, error)
+	// size of image read from its header without decoding
+	DecodeConfig(ctx context.Context, buffer io.Reader) (image.Config, error)
+	Decode(ctx context.Context, buffer io.Reader) (image.Image, error)
+	Resize(ctx context.Context, src image.Image, name string, variant *dto.VariantDto) (*dto.FileInfoDto, error)
 }
 
 type CloudStore interface {
-	Upload(id uint32, userId string, data []*dto.FileInfoDto) (*dto.CloudResponseDto, error)
-	Download(url string, userId string, imageId uint32) (*os.File, error)
+	// check that storage is reachable, used by readiness check
+	Ping(ctx context.Context) error
+	Upload(ctx context.Context, id uint32, userId string, data []*dto.FileInfoDto) (*dto.CloudResponseDto, error)
+	Download(ctx context.Context, url string, userId string, imageId uint32) (*os.File, error)
+	// keys of all files stored under prefix of user
+	ListUserFiles(ctx context.Context, userId string) ([]string, error)
+	// delete files by keys, missing files are not reported as error
+	DeleteFiles(ctx context.Context, keys []string) error
+	// delete files of image by their urls
+	DeleteImageFiles(ctx context.Context, userId string, imageId uint32, urls []string) error
 }
 
+// ctx carries request id and trace for logs, DB operations have own timeouts and are not cancelled with request
 type DbStore interface {
-	Insert(storeDto *dto.DbImageStoreDAO) error
-	GetImage(picId uint32, width, height int) *dto.DbImageStoreDAO
-	GetImageByImageId(picId uint32) *dto.DbImageStoreDAO
-	FindAllPictureByUserId(userId string) []*dto.DbImageStoreDAO
+	// check that DB is reachable, used by readiness check
+	Ping(ctx context.Context) error
+	Insert(ctx context.Context, storeDto *dto.DbImageStoreDAO) error
+	// images are searched among records of user only, images of different users can have the same id
+	GetImage(ctx context.Context, userId string, picId uint32, variant *dto.VariantDto) *dto.DbImageStoreDAO
+	// ErrNotFound if image never processed by user
+	GetImageByImageId(ctx context.Context, userId string, picId uint32) (*dto.DbImageStoreDAO, error)
+	FindAllPictureByUserId(ctx context.Context, userId string) []*dto.DbImageStoreDAO
+	FindAllPictureByPreset(ctx context.Context, preset string) []*dto.DbImageStoreDAO
+	FindAllPictureByUserAndImageId(ctx context.Context, userId string, picId uint32) []*dto.DbImageStoreDAO
+	DeleteImage(ctx context.Context, img *dto.DbImageStoreDAO) error
+	// set last access time of variant on cache hit
+	TouchImage(ctx context.Context, img *dto.DbImageStoreDAO, accessedAt time.Time) error
+
+	// lookups of lifecycle policies, records without access time are matched by creation time
+	FindImagesCreatedBefore(ctx context.Context, before time.Time) []*dto.DbImageStoreDAO
+	FindImagesAccessedBefore(ctx context.Context, before time.Time) []*dto.DbImageStoreDAO
+	// all records of images which have more than max variants, image is identified by user and image id
+	FindImagesWithVariantsOver(ctx context.Context, max int) []*dto.DbImageStoreDAO
+
+	InsertApiKey(ctx context.Context, key *dto.ApiKeyDto) error
+	GetApiKeyByHash(ctx context.Context, keyHash string) *dto.ApiKeyDto
+	FindAllApiKeys(ctx context.Context) []*dto.ApiKeyDto
+	DeleteApiKey(ctx context.Context, id string) (bool, error)
+
+	// erasure of user data, methods return count of deleted records
+	DeleteAllUserImages(ctx context.Context, userId string) (int64, error)
+	DeleteUserApiKeys(ctx context.Context, userId string) (int64, error)
+	// ErrNotFound if erasure of user never started
+	GetErasure(ctx context.Context, userId string) (*dto.ErasureDto, error)
+	SaveErasure(ctx context.Context, erasure *dto.ErasureDto) error
+
+	// lock shared by instances, false if it is held by other owner and not expired yet
+	AcquireLock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error)
+	// lock is released only by its owner
+	ReleaseLock(ctx context.Context, key, owner string) error
+}
+
+// Storage of asynchronous jobs state
+type JobStore interface {
+	SaveJob(job *dto.JobDto) error
+	GetJob(id string) *dto.JobDto
+	DeleteUserJobs(userId string) (int64, error)
+}
+
+// Verification of bearer tokens, returns claims of valid token
+type TokenVerifier interface {
+	Verify(token string) (map[string]interface{}, error)
+}
+
+// Log of callback delivery attempts
+type WebhookLogStore interface {
+	SaveWebhookDelivery(delivery *dto.WebhookDeliveryDto) error
+	FindWebhookDeliveries(userId, requestId string) []*dto.WebhookDeliveryDto
+	DeleteUserWebhookDeliveries(userId string) (int64, error)
 }
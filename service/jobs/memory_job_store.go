@@ -0,0 +1,71 @@
+package jobs
+
+import (
+	"github.com/senseyman/image-media-processor/dto"
+	"sync"
+	"time"
+)
+
+// In-memory storage of jobs for single instance deployment.
+// Finished jobs are removed after retention period
+type MemoryJobStore struct {
+	mu        sync.RWMutex
+	retention time.Duration
+	jobs      map[string]*dto.JobDto
+}
+
+func NewMemoryJobStore(retention time.Duration) *MemoryJobStore {
+	return &MemoryJobStore{
+		retention: retention,
+		jobs:      make(map[string]*dto.JobDto),
+	}
+}
+
+// Save copy of job state, so caller can continue changing it
+func (m *MemoryJobStore) SaveJob(job *dto.JobDto) error {
+	cp := *job
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[job.Id] = &cp
+	m.cleanup()
+	return nil
+}
+
+func (m *MemoryJobStore) GetJob(id string) *dto.JobDto {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil
+	}
+	cp := *job
+	return &cp
+}
+
+// Delete all jobs of user, including not finished ones
+func (m *MemoryJobStore) DeleteUserJobs(userId string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deleted int64
+	for id, job := range m.jobs {
+		if job.UserId == userId {
+			delete(m.jobs, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// remove finished jobs older than retention period
+func (m *MemoryJobStore) cleanup() {
+	if m.retention <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-m.retention)
+	for id, job := range m.jobs {
+		finished := job.State == dto.JobStateSucceeded || job.State == dto.JobStateFailed
+		if finished && job.UpdatedAt.Before(deadline) {
+			delete(m.jobs, id)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"regexp"
+)
+
+// Logger of application. Entries created with context (logger.WithContext) get request id and trace id of request
+
+const (
+	RequestIdHeader = "X-Request-ID"
+
+	FormatText = "text"
+	FormatJson = "json"
+
+	FieldRequestId = "request_id"
+	FieldTraceId   = "trace_id"
+)
+
+// request id from client is accepted only if it is safe for logs and headers
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIdKey struct{}
+
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, requestId)
+}
+
+func RequestIdFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+func ValidRequestId(requestId string) bool {
+	return requestIdPattern.MatchString(requestId)
+}
+
+// Hook adds static fields and ids from entry context to every entry
+type contextHook struct {
+	requestIdField string
+	traceIdField   string
+	fields         logrus.Fields
+}
+
+func (h *contextHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Data of entry can be shared with other goroutines, so fields are added to its copy
+func (h *contextHook) Fire(entry *logrus.Entry) error {
+	data := make(logrus.Fields, len(entry.Data)+len(h.fields)+2)
+	for k, v := range h.fields {
+		data[k] = v
+	}
+	for k, v := range entry.Data {
+		data[k] = v
+	}
+	if entry.Context != nil {
+		if requestId := RequestIdFromContext(entry.Context); len(requestId) > 0 {
+			data[h.requestIdField] = requestId
+		}
+		if spanContext := trace.SpanContextFromContext(entry.Context); spanContext.HasTraceID() {
+			data[h.traceIdField] = spanContext.TraceID().String()
+		}
+	}
+	entry.Data = data
+	return nil
+}
+
+func ValidateLog(cfg *dto.LogConfig) error {
+	switch cfg.Format {
+	case "", FormatText, FormatJson:
+	default:
+		return fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+	for field := range cfg.FieldNames {
+		switch field {
+		case logrus.FieldKeyTime, logrus.FieldKeyLevel, logrus.FieldKeyMsg, FieldRequestId, FieldTraceId:
+		default:
+			return fmt.Errorf("unknown log field %q", field)
+		}
+	}
+	return nil
+}
+
+// Create logger with configured level, format and fields
+func NewLogger(level string, cfg *dto.LogConfig) (*logrus.Logger, error) {
+	logLevel, err := logrus.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	if err = ValidateLog(cfg); err != nil {
+		return nil, err
+	}
+
+	fieldName := func(field string) string {
+		if name, ok := cfg.FieldNames[field]; ok && len(name) > 0 {
+			return name
+		}
+		return field
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logLevel)
+
+	if cfg.Format == FormatJson {
+		logger.SetFormatter(&logrus.JSONFormatter{
+			FieldMap: logrus.FieldMap{
+				logrus.FieldKeyTime:  fieldName(logrus.FieldKeyTime),
+				logrus.FieldKeyLevel: fieldName(logrus.FieldKeyLevel),
+				logrus.FieldKeyMsg:   fieldName(logrus.FieldKeyMsg),
+			},
+		})
+	} else {
+		logger.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp: true,
+		})
+	}
+
+	fields := make(logrus.Fields, len(cfg.Fields))
+	for k, v := range cfg.Fields {
+		fields[k] = v
+	}
+	logger.AddHook(&contextHook{
+		requestIdField: fieldName(FieldRequestId),
+		traceIdField:   fieldName(FieldTraceId),
+		fields:         fields,
+	})
+	return logger, nil
+}
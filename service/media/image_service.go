@@ -2,12 +2,23 @@ package media
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/disintegration/imaging"
 	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/service"
+	"github.com/senseyman/image-media-processor/service/metrics"
+	"github.com/senseyman/image-media-processor/service/tracing"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"image"
 	"io"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 // Service for processing images
@@ -20,31 +31,86 @@ func NewImageService(log *logrus.Logger) *ImageService {
 	return &ImageService{logger: log}
 }
 
-// Function for changing image size (width and height)
-// Input params: fileInfo and new size values
-// Output - fileInfo and error
-// FileInfo include io.Reader and filename
-func (i *ImageService) Resize(buffer io.Reader, name string, width, height int) (*dto.FileInfoDto, error) {
+// Function for decoding image, format is detected by content.
+// Decoded image can be resized several times. Unknown format is ErrUnsupportedMedia, broken content is ErrInvalidImage
+func (i *ImageService) Decode(ctx context.Context, buffer io.Reader) (image.Image, error) {
+	_, span := tracing.Tracer().Start(ctx, "decode")
+	defer span.End()
+
 	// open file
+	started := time.Now()
 	src, err := imaging.Decode(buffer)
 
 	if err != nil {
-		i.logger.Errorf("failed to open image: %v", err)
-		return nil, err
+		i.logger.WithContext(ctx).Errorf("failed to open image: %v", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		if errors.Is(err, image.ErrFormat) {
+			return nil, fmt.Errorf("%w: %v", service.ErrUnsupportedMedia, err)
+		}
+		return nil, fmt.Errorf("%w: %v", service.ErrInvalidImage, err)
 	}
+	metrics.ObserveStage(metrics.StageDecode, started)
+	bounds := src.Bounds()
+	metrics.ObserveImageMegapixels(metrics.DirectionInput, bounds.Dx(), bounds.Dy())
+	return src, nil
+}
+
+// Function for reading size of image, only header of image is decoded
+func (i *ImageService) DecodeConfig(ctx context.Context, buffer io.Reader) (image.Config, error) {
+	cfg, _, err := image.DecodeConfig(buffer)
+	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			return cfg, fmt.Errorf("%w: %v", service.ErrUnsupportedMedia, err)
+		}
+		return cfg, fmt.Errorf("%w: %v", service.ErrInvalidImage, err)
+	}
+	return cfg, nil
+}
 
+// Function for changing image size (width and height)
+// Input params: decoded image, original filename and variant params
+// Output - fileInfo and error
+// FileInfo include io.Reader and filename
+func (i *ImageService) Resize(ctx context.Context, src image.Image, name string, variant *dto.VariantDto) (*dto.FileInfoDto, error) {
 	// call image resizing
-	dst := imaging.Resize(src, width, height, imaging.Lanczos)
+	_, span := tracing.Tracer().Start(ctx, "resize", trace.WithAttributes(
+		attribute.Int("image.width", variant.Width),
+		attribute.Int("image.height", variant.Height),
+		attribute.String("image.mode", variant.Mode),
+	))
+	started := time.Now()
+	var dst *image.NRGBA
+	switch variant.Mode {
+	case dto.ResizeModeFit:
+		dst = imaging.Fit(src, variant.Width, variant.Height, imaging.Lanczos)
+	case dto.ResizeModeFill:
+		dst = imaging.Fill(src, variant.Width, variant.Height, imaging.Center, imaging.Lanczos)
+	default:
+		dst = imaging.Resize(src, variant.Width, variant.Height, imaging.Lanczos)
+	}
+	metrics.ObserveStage(metrics.StageResize, started)
+	span.End()
 
 	format, err := imaging.FormatFromFilename(name)
+	if len(variant.Format) > 0 {
+		format, err = imaging.FormatFromExtension(variant.Format)
+	}
 	if err != nil {
-		i.logger.Errorf("failed to get image format: %v", err)
-		return nil, err
+		i.logger.WithContext(ctx).Errorf("failed to get image format: %v", err)
+		return nil, fmt.Errorf("%w: %v", service.ErrUnsupportedMedia, err)
 	}
 
 	buff := new(bytes.Buffer)
 	// encode image to buffer
-	err = imaging.Encode(buff, dst, format)
+	var opts []imaging.EncodeOption
+	if variant.Quality > 0 {
+		opts = append(opts, imaging.JPEGQuality(variant.Quality))
+	}
+	_, span = tracing.Tracer().Start(ctx, "encode", trace.WithAttributes(attribute.String("image.format", format.String())))
+	defer span.End()
+	started = time.Now()
+	err = imaging.Encode(buff, dst, format, opts...)
 	if err != nil {
 		fmt.Println("failed to create buffer", err)
 	}
@@ -52,14 +118,30 @@ func (i *ImageService) Resize(buffer io.Reader, name string, width, height int)
 	reader := bytes.NewReader(buff.Bytes())
 
 	if err != nil {
-		i.logger.Errorf("failed to encode dst image: %v", err)
+		i.logger.WithContext(ctx).Errorf("failed to encode dst image: %v", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return nil, err
 	}
+	metrics.ObserveStage(metrics.StageEncode, started)
+	metrics.ObserveImageBytes(metrics.DirectionOutput, buff.Len())
+	metrics.ObserveImageMegapixels(metrics.DirectionOutput, dst.Bounds().Dx(), dst.Bounds().Dy())
+	span.SetAttributes(attribute.Int("image.bytes", buff.Len()))
 
-	origFileExt := strings.Split(name, ".")
-	fileNameWithoutExt := strings.ReplaceAll(name, fmt.Sprintf(".%s", origFileExt[1]), "")
-	newFileName := fmt.Sprintf("%s_%dx%d.%s", fileNameWithoutExt, width, height, strings.ToLower(format.String()))
+	return &dto.FileInfoDto{Buffer: reader, Name: variantFileName(name, variant, format), Type: dto.SourceResized}, nil
 
-	return &dto.FileInfoDto{Buffer: reader, Name: newFileName, Type: dto.SourceResized}, nil
+}
 
+// Build name of resized file, every variant param that changes output is included,
+// so different variants never share one file in cloud store
+func variantFileName(name string, variant *dto.VariantDto, format imaging.Format) string {
+	fileNameWithoutExt := strings.TrimSuffix(name, filepath.Ext(name))
+	newFileName := fmt.Sprintf("%s_%dx%d", fileNameWithoutExt, variant.Width, variant.Height)
+	if len(variant.Mode) > 0 && variant.Mode != dto.ResizeModeResize {
+		newFileName = fmt.Sprintf("%s_%s", newFileName, variant.Mode)
+	}
+	if variant.Quality > 0 {
+		newFileName = fmt.Sprintf("%s_q%d", newFileName, variant.Quality)
+	}
+	return fmt.Sprintf("%s.%s", newFileName, strings.ToLower(format.String()))
 }
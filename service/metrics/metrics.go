@@ -0,0 +1,174 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+// Prometheus metrics of application, exposed by api server on /metrics
+
+const Namespace = "imp"
+
+// stages of image processing workflow
+const (
+	StageFetch  = "fetch"
+	StageDecode = "decode"
+	StageResize = "resize"
+	StageEncode = "encode"
+	StageUpload = "upload"
+	StageInsert = "insert"
+)
+
+// direction of processed image: original or generated variant
+const (
+	DirectionInput  = "input"
+	DirectionOutput = "output"
+)
+
+// result of variant lookup in DB before processing
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+// in-memory caches of images
+const (
+	CacheOriginals = "originals"
+	CacheVariants  = "variants"
+)
+
+// lifecycle policies which delete stored images
+const (
+	PolicyVariantTtl        = "variant_ttl"
+	PolicyOriginalRetention = "original_retention"
+	PolicyMaxVariants       = "max_variants"
+)
+
+// backends with retry loops
+const (
+	BackendMongo = "mongo"
+	BackendS3    = "s3"
+)
+
+var (
+	HttpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "http_requests_total",
+		Help:      "Count of http requests by route template, method and response status.",
+	}, []string{"route", "method", "status"})
+
+	HttpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of http requests by route template, method and response status.",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"route", "method", "status"})
+
+	StageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "processing_stage_duration_seconds",
+		Help:      "Duration of image processing stages.",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"stage"})
+
+	ImageBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "image_bytes",
+		Help:      "Size of original (input) and generated (output) images in bytes.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+	}, []string{"direction"})
+
+	ImageMegapixels = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "image_megapixels",
+		Help:      "Megapixels of original (input) and generated (output) images.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2, 5, 10, 25, 50, 100},
+	}, []string{"direction"})
+
+	VariantCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "variant_cache_requests_total",
+		Help:      "Lookups of already generated variants in DB by result.",
+	}, []string{"result"})
+
+	LifecycleDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "lifecycle_deleted_images_total",
+		Help:      "Records of images deleted by lifecycle policies.",
+	}, []string{"policy"})
+
+	MemoryCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "memory_cache_requests_total",
+		Help:      "Lookups of images in in-memory caches by cache and result.",
+	}, []string{"cache", "result"})
+
+	MemoryCacheBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "memory_cache_bytes",
+		Help:      "Size of images kept in in-memory caches.",
+	}, []string{"cache"})
+
+	CoalescedRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "coalesced_requests_total",
+		Help:      "Requests of missing variant answered by result of concurrent request.",
+	})
+
+	ProcessingQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "processing_queue_depth",
+		Help:      "Processing tasks waiting in queue of worker pool.",
+	})
+
+	ProcessingQueueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "processing_queue_wait_seconds",
+		Help:      "Time processing tasks waited in queue before worker started them.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 4, 9),
+	})
+
+	ProcessingMemory = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "processing_memory_reserved_bytes",
+		Help:      "Estimated memory of images which are resized now.",
+	})
+
+	ProcessingMemoryWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "processing_memory_wait_seconds",
+		Help:      "Time workers waited for memory budget before resizing image.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 4, 9),
+	})
+
+	BackendRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "backend_retries_total",
+		Help:      "Failed attempts of backend operations which were retried.",
+	}, []string{"backend", "operation"})
+)
+
+// Save duration of stage started at given time
+func ObserveStage(stage string, started time.Time) {
+	StageDuration.WithLabelValues(stage).Observe(time.Since(started).Seconds())
+}
+
+func ObserveImageBytes(direction string, size int) {
+	ImageBytes.WithLabelValues(direction).Observe(float64(size))
+}
+
+func ObserveImageMegapixels(direction string, width, height int) {
+	ImageMegapixels.WithLabelValues(direction).Observe(float64(width) * float64(height) / 1e6)
+}
+
+func ObserveRetry(backend, operation string) {
+	BackendRetries.WithLabelValues(backend, operation).Inc()
+}
+
+// Handler for scraping all registered metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -1,14 +1,24 @@
 package store
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/service"
+	"github.com/senseyman/image-media-processor/service/metrics"
+	"github.com/senseyman/image-media-processor/service/tracing"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
 	"os"
 	"strings"
 	"time"
@@ -17,6 +27,9 @@ import (
 const (
 	Retry     = 3
 	SleepTime = 100 * time.Millisecond
+
+	// limit of keys in one DeleteObjects request
+	MaxDeleteKeys = 1000
 )
 
 // Service for manage user files in Amazon S3 bucket
@@ -30,12 +43,16 @@ type AwsService struct {
 
 func NewAwsService(config *dto.AwsConfig, logger *logrus.Logger) *AwsService {
 
-	sess, err := session.NewSession(
-		&aws.Config{
-			Region:      aws.String(config.AwsRegion),
-			Credentials: credentials.NewStaticCredentials(config.AwsAccessKeyId, config.AwsSecretAccessKey, ""),
-		},
-	)
+	awsConfig := &aws.Config{
+		Region:      aws.String(config.AwsRegion),
+		Credentials: credentials.NewStaticCredentials(config.AwsAccessKeyId, config.AwsSecretAccessKey, ""),
+	}
+	if len(config.AwsEndpoint) > 0 {
+		// S3 compatible storage usually has no bucket subdomains
+		awsConfig.Endpoint = aws.String(config.AwsEndpoint)
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+	sess, err := session.NewSession(awsConfig)
 	if err != nil {
 		panic(err)
 	}
@@ -48,15 +65,26 @@ func NewAwsService(config *dto.AwsConfig, logger *logrus.Logger) *AwsService {
 	}
 }
 
-// Upload user files to bucket
-func (m *AwsService) Upload(id uint32, userId string, data []*dto.FileInfoDto) (*dto.CloudResponseDto, error) {
-	uploader := s3manager.NewUploader(m.session)
+// Check that bucket exists and is accessible with configured credentials
+func (m *AwsService) Ping(ctx context.Context) error {
+	_, err := s3.New(m.session).HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(m.bucket),
+	})
+	return err
+}
 
-	target := fmt.Sprintf("%s/%d/", userId, id)
+// Upload user files to bucket, every file is traced by separate span
+func (m *AwsService) Upload(ctx context.Context, id uint32, userId string, data []*dto.FileInfoDto) (*dto.CloudResponseDto, error) {
+	uploader := s3manager.NewUploader(m.session)
 
 	respArr := make([]*dto.FileCloudStoreDto, 0)
 
 	for _, v := range data {
+		key := fileKey(userId, id, v.Name)
+		_, span := tracing.Tracer().Start(ctx, "s3.upload", trace.WithAttributes(
+			attribute.String("s3.bucket", m.bucket),
+			attribute.String("s3.key", key),
+		))
 		leftRetry := Retry
 		currentSleepTime := SleepTime
 
@@ -68,12 +96,13 @@ func (m *AwsService) Upload(id uint32, userId string, data []*dto.FileInfoDto) (
 		for leftRetry > 0 {
 			output, err = uploader.Upload(&s3manager.UploadInput{
 				Bucket: aws.String(m.bucket),
-				Key:    aws.String(fmt.Sprintf("%s/%s", target, v.Name)),
+				Key:    aws.String(key),
 				Body:   v.Buffer,
 			})
 			if err != nil {
 				leftRetry--
-				m.logger.Warnf("Cannot upload original file to aws store. Retrying... Err: %v", err)
+				m.logger.WithContext(ctx).Warnf("Cannot upload original file to aws store. Retrying... Err: %v", err)
+				metrics.ObserveRetry(metrics.BackendS3, "upload")
 				time.Sleep(currentSleepTime)
 				currentSleepTime += SleepTime
 				continue
@@ -81,8 +110,13 @@ func (m *AwsService) Upload(id uint32, userId string, data []*dto.FileInfoDto) (
 			break
 		}
 		if err != nil {
-			return nil, err
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
+			return nil, fmt.Errorf("%w: %v", service.ErrUnavailable, err)
 		}
+		span.SetAttributes(attribute.Int("s3.attempts", Retry-leftRetry+1))
+		span.End()
 
 		respArr = append(respArr, &dto.FileCloudStoreDto{
 			Id:   id,
@@ -96,7 +130,7 @@ func (m *AwsService) Upload(id uint32, userId string, data []*dto.FileInfoDto) (
 }
 
 // Downloading file from amazon s3 bucket using userId and imageId, and original url path
-func (m *AwsService) Download(url string, userId string, imageId uint32) (*os.File, error) {
+func (m *AwsService) Download(ctx context.Context, url string, userId string, imageId uint32) (*os.File, error) {
 	urls := strings.Split(url, "/")
 
 	if len(urls) == 0 {
@@ -105,23 +139,28 @@ func (m *AwsService) Download(url string, userId string, imageId uint32) (*os.Fi
 
 	filepath := urls[len(urls)-1] // separate url to get file name
 
-	file, _ := os.Create(filepath)
+	file, err := os.Create(filepath)
+	if err != nil {
+		return nil, err
+	}
 
 	downloader := s3manager.NewDownloader(m.session)
 
 	leftRetry := Retry
 	currentSleepTime := SleepTime
 
-	var err error
-
 	for leftRetry > 0 {
 		_, err = downloader.Download(file, &s3.GetObjectInput{
 			Bucket: aws.String(m.bucket),
-			Key:    aws.String(fmt.Sprintf("%v/%v/%v", userId, imageId, filepath)),
+			Key:    aws.String(fileKey(userId, imageId, filepath)),
 		})
+		if isNotFound(err) {
+			break
+		}
 		if err != nil {
 			leftRetry--
-			m.logger.Warnf("Unable to download item %q. Retrying... Err: %v", filepath, err)
+			m.logger.WithContext(ctx).Warnf("Unable to download item %q. Retrying... Err: %v", filepath, err)
+			metrics.ObserveRetry(metrics.BackendS3, "download")
 			time.Sleep(currentSleepTime)
 			currentSleepTime += SleepTime
 			continue
@@ -130,9 +169,123 @@ func (m *AwsService) Download(url string, userId string, imageId uint32) (*os.Fi
 	}
 
 	if err != nil {
-		return nil, err
+		file.Close()
+		os.Remove(file.Name())
+		if isNotFound(err) {
+			return nil, fmt.Errorf("%w: %v", service.ErrNotFound, err)
+		}
+		return nil, fmt.Errorf("%w: %v", service.ErrUnavailable, err)
 	}
 
 	return file, nil
 
 }
+
+// Missing object is not retried
+func isNotFound(err error) bool {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		return reqErr.StatusCode() == http.StatusNotFound
+	}
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey
+}
+
+// Collect keys of all user files, files of user are stored under "userId/" prefix, see Upload
+func (m *AwsService) ListUserFiles(ctx context.Context, userId string) ([]string, error) {
+	client := s3.New(m.session)
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(m.bucket),
+		Prefix: aws.String(userId + "/"),
+	}
+
+	leftRetry := Retry
+	currentSleepTime := SleepTime
+
+	var (
+		keys []string
+		err  error
+	)
+	for leftRetry > 0 {
+		keys = make([]string, 0)
+		err = client.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				keys = append(keys, aws.StringValue(object.Key))
+			}
+			return true
+		})
+		if err != nil && ctx.Err() == nil {
+			leftRetry--
+			m.logger.WithContext(ctx).Warnf("Cannot list files of user %q. Retrying... Err: %v", userId, err)
+			metrics.ObserveRetry(metrics.BackendS3, "list")
+			time.Sleep(currentSleepTime)
+			currentSleepTime += SleepTime
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", service.ErrUnavailable, err)
+	}
+	return keys, nil
+}
+
+// Delete files by keys, one request deletes up to MaxDeleteKeys files
+func (m *AwsService) DeleteFiles(ctx context.Context, keys []string) error {
+	client := s3.New(m.session)
+	for start := 0; start < len(keys); start += MaxDeleteKeys {
+		end := start + MaxDeleteKeys
+		if end > len(keys) {
+			end = len(keys)
+		}
+		objects := make([]*s3.ObjectIdentifier, 0, end-start)
+		for _, key := range keys[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		input := &s3.DeleteObjectsInput{
+			Bucket: aws.String(m.bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		}
+
+		leftRetry := Retry
+		currentSleepTime := SleepTime
+
+		var err error
+		for leftRetry > 0 {
+			var output *s3.DeleteObjectsOutput
+			output, err = client.DeleteObjectsWithContext(ctx, input)
+			if err == nil && len(output.Errors) > 0 {
+				err = fmt.Errorf("Cannot delete %d files, first error: %s ", len(output.Errors), aws.StringValue(output.Errors[0].Message))
+			}
+			if err != nil && ctx.Err() == nil {
+				leftRetry--
+				m.logger.WithContext(ctx).Warnf("Cannot delete files from aws store. Retrying... Err: %v", err)
+				metrics.ObserveRetry(metrics.BackendS3, "delete")
+				time.Sleep(currentSleepTime)
+				currentSleepTime += SleepTime
+				continue
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", service.ErrUnavailable, err)
+		}
+	}
+	return nil
+}
+
+// Delete files of image, key of every file is built from its name like in Upload
+func (m *AwsService) DeleteImageFiles(ctx context.Context, userId string, imageId uint32, urls []string) error {
+	keys := make([]string, 0, len(urls))
+	for _, url := range urls {
+		urls := strings.Split(url, "/")
+		keys = append(keys, fileKey(userId, imageId, urls[len(urls)-1]))
+	}
+	return m.DeleteFiles(ctx, keys)
+}
+
+// Key of image file in bucket, all files of user are stored under "userId/" prefix.
+// It is used by all operations, so file is read and deleted by the key it was uploaded with
+func fileKey(userId string, imageId uint32, name string) string {
+	return fmt.Sprintf("%s/%d/%s", userId, imageId, name)
+}
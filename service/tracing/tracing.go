@@ -0,0 +1,115 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+)
+
+// OpenTelemetry tracing of http requests and image processing workflow
+
+const (
+	TracerName         = "github.com/senseyman/image-media-processor"
+	DefaultServiceName = "image-media-processor"
+
+	ExporterNone   = ""
+	ExporterOtlp   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+// Tracer used by all application spans, it is no-op until Init is called with exporter
+func Tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+func ValidateTracing(cfg *dto.TracingConfig) error {
+	switch cfg.Exporter {
+	case ExporterNone, ExporterOtlp, ExporterStdout:
+	case ExporterFile:
+		if len(cfg.File) == 0 {
+			return fmt.Errorf("file is required for %q exporter", ExporterFile)
+		}
+	default:
+		return fmt.Errorf("unknown exporter %q", cfg.Exporter)
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return fmt.Errorf("sample ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// Register global W3C trace context propagator and tracer provider with configured exporter.
+// Returned function flushes pending spans and closes exporter
+func Init(cfg *dto.TracingConfig) (func(ctx context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var (
+		exporter sdktrace.SpanExporter
+		file     *os.File
+		err      error
+	)
+	switch cfg.Exporter {
+	case ExporterNone:
+		return func(ctx context.Context) error { return nil }, nil
+	case ExporterOtlp:
+		opts := []otlptracehttp.Option{}
+		if len(cfg.Endpoint) > 0 {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case ExporterFile:
+		file, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		}
+	default:
+		err = fmt.Errorf("unknown exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	}
+
+	serviceName := cfg.ServiceName
+	if len(serviceName) == 0 {
+		serviceName = DefaultServiceName
+	}
+	sampler := sdktrace.AlwaysSample()
+	if cfg.SampleRatio > 0 {
+		sampler = sdktrace.TraceIDRatioBased(cfg.SampleRatio)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}, nil
+}
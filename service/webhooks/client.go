@@ -0,0 +1,75 @@
+package webhooks
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/senseyman/image-media-processor/service/fetch"
+	"github.com/senseyman/image-media-processor/utils"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Client for sending resize results to callback urls.
+// If secret is set, every request is signed: signature header contains
+// "sha256=" + hex HMAC-SHA256 of "<timestamp>.<body>", timestamp is sent in separate header.
+// Callback address is checked by guard, redirects are not followed, redirect response is failed delivery
+
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	TimestampHeader = "X-Webhook-Timestamp"
+
+	// max size of callback response read before connection reuse
+	maxResponseSize = 64 << 10
+)
+
+type Client struct {
+	secret     string
+	httpClient *http.Client
+}
+
+func NewClient(secret string, timeout time.Duration, guard *fetch.Guard) *Client {
+	return &Client{
+		secret: secret,
+		httpClient: &http.Client{
+			Timeout:   timeout,
+			Transport: guard.Transport(timeout),
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Calculate signature header value of callback body
+func Signature(secret, timestamp string, payload []byte) string {
+	return "sha256=" + utils.HmacSignature(secret, timestamp+"."+string(payload))
+}
+
+// Post json payload to callback url. Response with status other than 2xx is an error
+func (c *Client) Send(url string, payload []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(c.secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, Signature(c.secret, timestamp, payload))
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxResponseSize))
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return resp.StatusCode, fmt.Errorf("Unexpected callback response status %d ", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,89 @@
+package webhooks
+
+import (
+	"github.com/senseyman/image-media-processor/dto"
+	"sync"
+	"time"
+)
+
+// In-memory log of callback deliveries for single instance deployment.
+// Records are removed after retention period
+type MemoryDeliveryLog struct {
+	mu         sync.RWMutex
+	retention  time.Duration
+	deliveries map[string][]*dto.WebhookDeliveryDto
+}
+
+func NewMemoryDeliveryLog(retention time.Duration) *MemoryDeliveryLog {
+	return &MemoryDeliveryLog{
+		retention:  retention,
+		deliveries: make(map[string][]*dto.WebhookDeliveryDto),
+	}
+}
+
+func (m *MemoryDeliveryLog) SaveWebhookDelivery(delivery *dto.WebhookDeliveryDto) error {
+	cp := *delivery
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deliveries[delivery.RequestId] = append(m.deliveries[delivery.RequestId], &cp)
+	m.cleanup()
+	return nil
+}
+
+// Collect all delivery attempts of user request in order they were made
+func (m *MemoryDeliveryLog) FindWebhookDeliveries(userId, requestId string) []*dto.WebhookDeliveryDto {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := make([]*dto.WebhookDeliveryDto, 0)
+	for _, delivery := range m.deliveries[requestId] {
+		if delivery.UserId == userId {
+			cp := *delivery
+			result = append(result, &cp)
+		}
+	}
+	return result
+}
+
+// Delete all delivery attempts of user requests
+func (m *MemoryDeliveryLog) DeleteUserWebhookDeliveries(userId string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deleted int64
+	for requestId, deliveries := range m.deliveries {
+		actual := deliveries[:0]
+		for _, delivery := range deliveries {
+			if delivery.UserId == userId {
+				deleted++
+			} else {
+				actual = append(actual, delivery)
+			}
+		}
+		if len(actual) == 0 {
+			delete(m.deliveries, requestId)
+		} else {
+			m.deliveries[requestId] = actual
+		}
+	}
+	return deleted, nil
+}
+
+// remove records older than retention period
+func (m *MemoryDeliveryLog) cleanup() {
+	if m.retention <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-m.retention)
+	for requestId, deliveries := range m.deliveries {
+		actual := deliveries[:0]
+		for _, delivery := range deliveries {
+			if !delivery.CreatedAt.Before(deadline) {
+				actual = append(actual, delivery)
+			}
+		}
+		if len(actual) == 0 {
+			delete(m.deliveries, requestId)
+		} else {
+			m.deliveries[requestId] = actual
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+	Cases:
++	- image which estimated memory is over budget is rejected
++	- images are resized at once only while their memory fits into budget
++	- requests over queue size are rejected with Retry-After
++	- queue depth, queue wait and memory wait are exposed
+*/
+
+// budget for one resize of 100x100 original to 10..20 pixels wide variant
+const OneImageMemory = 50000
+
+func AdmissionConfig(workers, queueSize int, maxMemory int64) *dto.Config {
+	return &dto.Config{Jobs: dto.JobsConfig{Workers: workers, QueueSize: queueSize, MaxMemory: maxMemory}}
+}
+
+// resize-by-id requests of different variants, so they are not coalesced
+func sendDifferentVariants(cfg *dto.Config, mediaProcessor *MediaProcessorMock, count int) []*httptest.ResponseRecorder {
+	router := CoalescingRouter(cfg, mediaProcessor, &DbStoreMock{})
+	responses := make([]*httptest.ResponseRecorder, count)
+	wg := sync.WaitGroup{}
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			requestDto := GenerateResizeByIdRequestBody()
+			requestDto.Width += i
+			responses[i] = sendResizeByIdRequest(router, ApiPathResizeById, requestDto)
+		}(i)
+	}
+	wg.Wait()
+	return responses
+}
+
+func TestAdmission_ImageOverBudget(t *testing.T) {
+	mediaProcessor := &MediaProcessorMock{SourceWidth: 100, SourceHeight: 100}
+	responses := sendDifferentVariants(AdmissionConfig(2, 10, OneImageMemory/10), mediaProcessor, 1)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, responses[0].Code, "Incorrect server response code")
+	responseDto := http_response_dto.ResizeImageResponseDto{}
+	if err := json.Unmarshal(responses[0].Body.Bytes(), &responseDto); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, utils.ErrImageTooLargeCode, responseDto.ErrCode, "Wrong error code")
+	assert.Equal(t, 0, mediaProcessor.ResizeCount, "Image over budget is resized")
+}
+
+func TestAdmission_MemoryBudget(t *testing.T) {
+	mediaProcessor := &MediaProcessorMock{SourceWidth: 100, SourceHeight: 100, ResizeDelay: 100 * time.Millisecond}
+	responses := sendDifferentVariants(AdmissionConfig(4, 10, OneImageMemory), mediaProcessor, 3)
+
+	for _, response := range responses {
+		assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	}
+	assert.Equal(t, 3, mediaProcessor.ResizeCount, "Wrong count of resized images")
+	assert.Equal(t, 1, mediaProcessor.MaxActive, "Images over memory budget are resized at once")
+
+	scraped := scrapeMetrics(t)
+	assert.Contains(t, scraped, "imp_processing_queue_depth", "Queue depth not exposed")
+	assert.Contains(t, scraped, "imp_processing_queue_wait_seconds_count", "Queue wait not observed")
+	assert.Contains(t, scraped, "imp_processing_memory_wait_seconds_count", "Memory wait not observed")
+}
+
+func TestAdmission_QueueFull(t *testing.T) {
+	mediaProcessor := &MediaProcessorMock{ResizeDelay: 300 * time.Millisecond}
+	responses := sendDifferentVariants(AdmissionConfig(1, 1, 0), mediaProcessor, 5)
+
+	rejected := 0
+	for _, response := range responses {
+		if response.Code != http.StatusServiceUnavailable {
+			assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+			continue
+		}
+		rejected++
+		assert.Equal(t, strconv.Itoa(server.RetryAfterSeconds), response.Header().Get("Retry-After"), "Wrong Retry-After header")
+	}
+	assert.GreaterOrEqual(t, rejected, 3, "Requests over queue size are not rejected")
+}
@@ -0,0 +1,202 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_request_dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/service/jobs"
+	"github.com/senseyman/image-media-processor/service/webhooks"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+	Cases:
++	- unknown auth mode, missing or placeholder admin key
++	- request without key
++	- request with invalid key
++	- admin endpoint with user key
++	- create, list and delete key, key of invalid user id is rejected
++	- user id is taken from key
++	- images of other user with the same image id are not returned
++	- delete unknown key
+*/
+
+const AdminKey = "admin-key"
+
+func ApiKeyConfig() *dto.Config {
+	return &dto.Config{Auth: dto.AuthConfig{Mode: server.AuthModeApiKey, AdminKey: AdminKey}}
+}
+
+func sendAuthRequest(router *mux.Router, method, path, key string, body io.Reader) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(method, path, body)
+	if len(key) > 0 {
+		request.Header.Set(server.ApiKeyHeader, key)
+	}
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func createApiKey(t *testing.T, router *mux.Router, userId string) *http_response_dto.ApiKeyResponseDto {
+	body := MarshalRequestDto(&http_request_dto.ApiKeyRequestDto{UserId: userId, Name: "test"})
+	response := sendAuthRequest(router, http.MethodPost, ApiPathAdminKeys, AdminKey, body)
+	assert.Equal(t, http.StatusCreated, response.Code, "Incorrect server response code")
+
+	responseDto := &http_response_dto.ApiKeyResponseDto{}
+	err := json.Unmarshal(response.Body.Bytes(), responseDto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return responseDto
+}
+
+func TestAuth_UnknownMode(t *testing.T) {
+	assert.Error(t, server.ValidateAuth(&dto.AuthConfig{Mode: "unknown"}), "Unknown auth mode accepted")
+}
+
+func TestAuth_AdminKeyValidation(t *testing.T) {
+	assert.NoError(t, server.ValidateAuth(&ApiKeyConfig().Auth), "Valid admin key rejected")
+	assert.NoError(t, server.ValidateAuth(&dto.AuthConfig{}), "Empty admin key rejected without authentication")
+	assert.Error(t, server.ValidateAuth(&dto.AuthConfig{Mode: server.AuthModeApiKey}), "API key mode accepted without admin key")
+	assert.Error(t, server.ValidateAuth(&dto.AuthConfig{Mode: server.AuthModeApiKey, AdminKey: "change-me-admin"}),
+		"Placeholder admin key accepted")
+	assert.Error(t, server.ValidateAuth(&dto.AuthConfig{AdminKey: "CHANGEME"}), "Placeholder admin key accepted")
+}
+
+func TestAuth_NoKey(t *testing.T) {
+	response := sendAuthRequest(AuthRouter(ApiKeyConfig()), http.MethodGet, ApiPathList+"?user_id=sss", "", nil)
+
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Incorrect server response code")
+	responseDto := &http_response_dto.BaseResponseDto{}
+	_ = json.Unmarshal(response.Body.Bytes(), responseDto)
+	assert.Equal(t, utils.ErrUnauthorizedCode, responseDto.ErrCode, "Wrong error code")
+}
+
+func TestAuth_InvalidKey(t *testing.T) {
+	response := sendAuthRequest(AuthRouter(ApiKeyConfig()), http.MethodGet, ApiPathList+"?user_id=sss", "imp_unknown", nil)
+
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Incorrect server response code")
+}
+
+func TestAuth_AdminEndpoint_UserKey(t *testing.T) {
+	router := AuthRouter(ApiKeyConfig())
+	key := createApiKey(t, router, "owner")
+
+	response := sendAuthRequest(router, http.MethodGet, ApiPathAdminKeys, key.Key, nil)
+
+	assert.Equal(t, http.StatusForbidden, response.Code, "Incorrect server response code")
+}
+
+func TestAuth_AdminEndpoint_InvalidUserId(t *testing.T) {
+	body := MarshalRequestDto(&http_request_dto.ApiKeyRequestDto{UserId: "../owner", Name: "test"})
+	response := sendAuthRequest(AuthRouter(ApiKeyConfig()), http.MethodPost, ApiPathAdminKeys, AdminKey, body)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Key created for user id with not allowed characters")
+}
+
+func TestAuth_AdminEndpoint_Disabled(t *testing.T) {
+	response := sendAuthRequest(AuthRouter(&dto.Config{}), http.MethodGet, ApiPathAdminKeys, AdminKey, nil)
+
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Admin endpoint available without admin key in config")
+}
+
+func TestAuth_UserIdFromKey(t *testing.T) {
+	router := AuthRouter(ApiKeyConfig())
+	key := createApiKey(t, router, "owner")
+	assert.NotEmpty(t, key.Key, "Empty API key")
+	assert.NotEmpty(t, key.KeyId, "Empty API key id")
+
+	response := sendAuthRequest(router, http.MethodGet, ApiPathList+"?user_id=other&request_id=ddd", key.Key, nil)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	responseDto := &http_response_dto.UserImagesListResponseDto{}
+	err := json.Unmarshal(response.Body.Bytes(), responseDto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "owner", responseDto.UserId, "User id is not taken from API key")
+	if assert.NotEmpty(t, responseDto.Data, "Empty list") {
+		assert.Len(t, responseDto.Data, 1, "Wrong list size")
+	}
+}
+
+// router of resize APIs over DB with images of other users
+func TenantRouter(dbStore *DbStoreMock) *mux.Router {
+	router := mux.NewRouter()
+	processor := server.NewApiServerRequestProcessor(ApiKeyConfig(), logrus.New(), &MediaProcessorMock{}, &CloudStoreMock{}, dbStore,
+		jobs.NewMemoryJobStore(0), webhooks.NewMemoryDeliveryLog(0))
+	api := router.PathPrefix("/api").Subrouter()
+	api.Use(processor.Authenticate)
+	api.HandleFunc("/v1/resize", processor.HandleResizeRequest).Methods(http.MethodPost)
+	api.HandleFunc("/v1/resize-by-id", processor.HandleResizeByIdRequest).Methods(http.MethodPost)
+	api.Handle("/v1/admin/keys", processor.RequireAdmin(http.HandlerFunc(processor.HandleCreateApiKeyRequest))).Methods(http.MethodPost)
+	return router
+}
+
+func TestAuth_ImagesOfOtherUser(t *testing.T) {
+	uploadId, _ := utils.GenerateImageIdByOriginalName(ImageName)
+	dbStore := &DbStoreMock{Records: []*dto.DbImageStoreDAO{
+		{UserId: "asdad", PicId: 10, OriginalImageUrl: "tenant_orig", ResizedImageUrl: "tenant_resized", ResizedWidth: 13, ResizedHeight: 13},
+		{UserId: "asdad", PicId: uploadId, OriginalImageUrl: "tenant_orig", ResizedImageUrl: "tenant_resized", ResizedWidth: 10, ResizedHeight: 10},
+	}}
+	router := TenantRouter(dbStore)
+	key := createApiKey(t, router, "intruder")
+
+	response := sendAuthRequest(router, http.MethodPost, ApiPathResizeById, key.Key, MarshalRequestDto(GenerateResizeByIdRequestBody()))
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Image of other user resized")
+	assert.NotContains(t, response.Body.String(), "tenant_", "Url of other user returned")
+	responseDto := &http_response_dto.ResizeImageResponseDto{}
+	_ = json.Unmarshal(response.Body.Bytes(), responseDto)
+	assert.Equal(t, utils.ErrImageNotFoundCode, responseDto.ErrCode, "Wrong error code")
+
+	body, contentType := prepareRequestValueForResizeApi(MarshalRequestDto(GenerateResizeRequestBody()), true, ImageTag, ImageName)
+	request, _ := http.NewRequest(http.MethodPost, ApiPathResize, body)
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set(server.ApiKeyHeader, key.Key)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	assert.NotContains(t, response.Body.String(), "tenant_", "Url of other user returned")
+}
+
+func TestAuth_ListAndDeleteKey(t *testing.T) {
+	router := AuthRouter(ApiKeyConfig())
+	key := createApiKey(t, router, "owner")
+
+	response := sendAuthRequest(router, http.MethodGet, ApiPathAdminKeys, AdminKey, nil)
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	listDto := &http_response_dto.ApiKeysListResponseDto{}
+	err := json.Unmarshal(response.Body.Bytes(), listDto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, listDto.Keys, 1, "Wrong count of keys") {
+		assert.Equal(t, key.KeyId, listDto.Keys[0].KeyId, "Wrong key id")
+		assert.Equal(t, "owner", listDto.Keys[0].UserId, "Wrong key user")
+	}
+	assert.NotContains(t, response.Body.String(), key.Key, "API key returned in list")
+
+	response = sendAuthRequest(router, http.MethodDelete, ApiPathAdminKeys+"/"+key.KeyId, AdminKey, nil)
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+
+	response = sendAuthRequest(router, http.MethodGet, ApiPathList+"?request_id=ddd", key.Key, nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Deleted key accepted")
+}
+
+func TestAuth_DeleteUnknownKey(t *testing.T) {
+	response := sendAuthRequest(AuthRouter(ApiKeyConfig()), http.MethodDelete, ApiPathAdminKeys+"/unknown", AdminKey, nil)
+
+	assert.Equal(t, http.StatusNotFound, response.Code, "Incorrect server response code")
+	responseDto := &http_response_dto.ApiKeyResponseDto{}
+	_ = json.Unmarshal(response.Body.Bytes(), responseDto)
+	assert.Equal(t, utils.ErrApiKeyNotFoundCode, responseDto.ErrCode, "Wrong error code")
+}
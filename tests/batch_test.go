@@ -0,0 +1,199 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_request_dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+	Cases:
++	- every file is resized to own or shared sizes, results are ordered by index
++	- failed item does not fail other items
++	- results are streamed as NDJSON
++	- invalid params, missing files and too many items fail whole batch
+*/
+
+const ApiPathResizeBatch = "/api/v1/resize-batch"
+
+func BatchRouter(cfg *dto.Config, mediaProcessor *MediaProcessorMock) *mux.Router {
+	router := mux.NewRouter()
+	processor := NewProcessor(cfg, mediaProcessor)
+	router.HandleFunc(ApiPathResizeBatch, processor.HandleResizeBatchRequest).Methods(http.MethodPost)
+	return router
+}
+
+func BatchConfig() *dto.Config {
+	cfg := PresetsConfig()
+	cfg.Batch = dto.BatchConfig{MaxItems: 5, Concurrency: 2}
+	return cfg
+}
+
+func GenerateBatchRequestBody() *http_request_dto.ResizeBatchRequestDto {
+	return &http_request_dto.ResizeBatchRequestDto{
+		BaseRequestDto: http_request_dto.BaseRequestDto{
+			UserId:    "wsss",
+			RequestId: "qqq",
+		},
+		Sizes: []*http_request_dto.SizeRequestDto{{Width: 10, Height: 10}, {Preset: "thumb"}},
+		Items: []*http_request_dto.ResizeBatchItemDto{
+			{File: "cover.jpeg", Sizes: []*http_request_dto.SizeRequestDto{{Width: 30, Height: 30}}},
+		},
+	}
+}
+
+func newBatchRequest(t *testing.T, requestDto interface{}, filenames ...string) *http.Request {
+	content, err := ioutil.ReadFile(ImageName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, name := range filenames {
+		part, _ := writer.CreateFormFile("files", name)
+		part.Write(content)
+	}
+	if requestDto != nil {
+		params, _ := json.Marshal(requestDto)
+		writer.WriteField("params", string(params))
+	}
+	writer.Close()
+
+	request, _ := http.NewRequest(http.MethodPost, ApiPathResizeBatch, body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	return request
+}
+
+func sendBatchRequest(t *testing.T, router *mux.Router, request *http.Request) (int, *http_response_dto.ResizeBatchResponseDto) {
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	responseDto := &http_response_dto.ResizeBatchResponseDto{}
+	if err := json.Unmarshal(response.Body.Bytes(), responseDto); err != nil {
+		t.Fatal(err)
+	}
+	return response.Code, responseDto
+}
+
+func TestResizeBatch_Positive(t *testing.T) {
+	mediaProcessor := &MediaProcessorMock{}
+	request := newBatchRequest(t, GenerateBatchRequestBody(), "cover.jpeg", "a.jpeg", "b.jpeg")
+	status, responseDto := sendBatchRequest(t, BatchRouter(BatchConfig(), mediaProcessor), request)
+
+	assert.Equal(t, http.StatusOK, status, "Incorrect server response code")
+	assert.Equal(t, 0, responseDto.ErrCode, "Unexpected error: %s", responseDto.ErrMsg)
+	assert.Equal(t, "wsss", responseDto.UserId, "Wrong user id")
+	if !assert.Len(t, responseDto.Results, 5, "Wrong count of results") {
+		return
+	}
+
+	expected := []struct {
+		file          string
+		width, height int
+	}{{"cover.jpeg", 30, 30}, {"a.jpeg", 10, 10}, {"a.jpeg", 20, 20}, {"b.jpeg", 10, 10}, {"b.jpeg", 20, 20}}
+	for i, e := range expected {
+		result := responseDto.Results[i]
+		assert.Equal(t, i, result.Index, "Results not ordered")
+		assert.Equal(t, e.file, result.File, "Wrong file of item %d", i)
+		assert.Equal(t, e.width, result.Width, "Wrong width of item %d", i)
+		assert.Equal(t, e.height, result.Height, "Wrong height of item %d", i)
+		assert.Equal(t, 0, result.ErrCode, "Unexpected error of item %d: %s", i, result.ErrMsg)
+		imageId, _ := utils.GenerateImageIdByOriginalName(e.file)
+		assert.Equal(t, imageId, result.ImageId, "Wrong image id of item %d", i)
+		assert.NotEmpty(t, result.OriginalImagePath, "Original path of item %d is empty", i)
+		assert.NotEmpty(t, result.ResizedImagePath, "Resized path of item %d is empty", i)
+	}
+	// every file is decoded once
+	assert.Equal(t, 3, mediaProcessor.DecodeCount, "Files decoded more than once")
+}
+
+func TestResizeBatch_PartialFailure(t *testing.T) {
+	mediaProcessor := &MediaProcessorMock{FailName: "a.jpeg"}
+	requestDto := GenerateBatchRequestBody()
+	requestDto.Items = nil
+	request := newBatchRequest(t, requestDto, "a.jpeg", "b.jpeg")
+	status, responseDto := sendBatchRequest(t, BatchRouter(BatchConfig(), mediaProcessor), request)
+
+	assert.Equal(t, http.StatusOK, status, "Incorrect server response code")
+	assert.Equal(t, 0, responseDto.ErrCode, "Whole batch failed")
+	if !assert.Len(t, responseDto.Results, 4, "Wrong count of results") {
+		return
+	}
+	for _, result := range responseDto.Results {
+		if result.File == "a.jpeg" {
+			assert.Equal(t, utils.ErrCannotResizeImageCode, result.ErrCode, "Wrong error code of failed item")
+		} else {
+			assert.Equal(t, 0, result.ErrCode, "Unexpected error: %s", result.ErrMsg)
+		}
+	}
+}
+
+func TestResizeBatch_Ndjson(t *testing.T) {
+	requestDto := GenerateBatchRequestBody()
+	requestDto.Items = nil
+	request := newBatchRequest(t, requestDto, "a.jpeg", "b.jpeg")
+	request.Header.Set("Accept", server.NdjsonContentType)
+	response := httptest.NewRecorder()
+	BatchRouter(BatchConfig(), &MediaProcessorMock{}).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	assert.Equal(t, server.NdjsonContentType, response.Header().Get("Content-Type"), "Wrong content type")
+	assert.True(t, response.Flushed, "Results not flushed")
+
+	indexes := map[int]bool{}
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		result := http_response_dto.ResizeBatchItemResultDto{}
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 0, result.ErrCode, "Unexpected error: %s", result.ErrMsg)
+		indexes[result.Index] = true
+	}
+	assert.Len(t, indexes, 4, "Not all results streamed")
+}
+
+func TestResizeBatch_Invalid(t *testing.T) {
+	router := BatchRouter(BatchConfig(), &MediaProcessorMock{})
+
+	status, responseDto := sendBatchRequest(t, router, newBatchRequest(t, nil, "a.jpeg"))
+	assert.Equal(t, http.StatusBadRequest, status, "Incorrect server response code")
+	assert.Equal(t, utils.ErrParamsNotSetInRequestCode, responseDto.ErrCode, "Wrong error code")
+
+	status, responseDto = sendBatchRequest(t, router, newBatchRequest(t, GenerateBatchRequestBody()))
+	assert.Equal(t, http.StatusBadRequest, status, "Incorrect server response code")
+	assert.Equal(t, utils.ErrFileNotFoundInRequestCode, responseDto.ErrCode, "Wrong error code")
+
+	invalid := map[string]func(dto *http_request_dto.ResizeBatchRequestDto){
+		"too many items":  func(dto *http_request_dto.ResizeBatchRequestDto) {},
+		"unknown preset":  func(dto *http_request_dto.ResizeBatchRequestDto) { dto.Sizes[1].Preset = "aaa" },
+		"invalid size":    func(dto *http_request_dto.ResizeBatchRequestDto) { dto.Sizes[0].Width = -1 },
+		"no sizes":        func(dto *http_request_dto.ResizeBatchRequestDto) { dto.Sizes = nil },
+		"unknown item":    func(dto *http_request_dto.ResizeBatchRequestDto) { dto.Items[0].File = "zzz.jpeg" },
+		"invalid user id": func(dto *http_request_dto.ResizeBatchRequestDto) { dto.UserId = "@@" },
+	}
+	for name, change := range invalid {
+		requestDto := GenerateBatchRequestBody()
+		change(requestDto)
+		files := []string{"cover.jpeg", "a.jpeg"}
+		if name == "too many items" {
+			files = append(files, "b.jpeg", "c.jpeg")
+		}
+		status, responseDto = sendBatchRequest(t, router, newBatchRequest(t, requestDto, files...))
+		assert.Equal(t, http.StatusBadRequest, status, "Incorrect server response code: %s", name)
+		assert.Equal(t, utils.ErrInvalidRequestParamValuesCode, responseDto.ErrCode, "Wrong error code: %s", name)
+		assert.Empty(t, responseDto.Results, "Results of invalid batch: %s", name)
+	}
+}
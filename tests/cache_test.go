@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/service/cache"
+	"github.com/senseyman/image-media-processor/service/jobs"
+	"github.com/senseyman/image-media-processor/service/webhooks"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+/*
+	Cases:
++	- new variants of the same image are made from original downloaded once
++	- decoded original is kept only if it is enabled in config
++	- hot variant is delivered without download from cloud store
++	- cached images expire after ttl
++	- least recently used entries are evicted when cache is over budget
++	- value larger than budget is not cached, zero budget disables cache
++	- cache hits and misses are exposed
+*/
+
+func CacheConfig(decoded bool, ttl time.Duration) *dto.Config {
+	return &dto.Config{Cache: dto.CacheConfig{
+		OriginalsMaxBytes: 1 << 20,
+		DecodedOriginals:  decoded,
+		VariantsMaxBytes:  1 << 20,
+		Ttl:               dto.Duration{Duration: ttl},
+	}}
+}
+
+func CacheRouter(cfg *dto.Config, mediaProcessor *MediaProcessorMock, cloudStore *CloudStoreMock, dbStore *DbStoreMock) *mux.Router {
+	router := mux.NewRouter()
+	processor := server.NewApiServerRequestProcessor(cfg, logrus.New(), mediaProcessor, cloudStore, dbStore,
+		jobs.NewMemoryJobStore(0), webhooks.NewMemoryDeliveryLog(0))
+	router.HandleFunc(server.DeliveryRoutePath, processor.HandleImageDeliveryRequest).Methods(http.MethodGet)
+	router.HandleFunc(ApiPathResizeById, processor.HandleResizeByIdRequest).Methods(http.MethodPost)
+	return router
+}
+
+// resize stored image to variants of different width
+func resizeStoredImage(t *testing.T, router *mux.Router, widths ...int) {
+	for _, width := range widths {
+		requestDto := GenerateResizeByIdRequestBody()
+		requestDto.Width = width
+		response := sendResizeByIdRequest(router, ApiPathResizeById, requestDto)
+		assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	}
+}
+
+func TestCache_Originals(t *testing.T) {
+	mediaProcessor := &MediaProcessorMock{}
+	cloudStore := &CloudStoreMock{}
+	router := CacheRouter(CacheConfig(false, 0), mediaProcessor, cloudStore, &DbStoreMock{})
+
+	resizeStoredImage(t, router, 13, 14, 15)
+
+	assert.Equal(t, 1, cloudStore.DownloadCount, "Original is downloaded more than once")
+	assert.Equal(t, 3, mediaProcessor.DecodeCount, "Decoded original is cached")
+	assert.Equal(t, 3, mediaProcessor.ResizeCount, "Wrong count of resized images")
+
+	scraped := scrapeMetrics(t)
+	assert.Contains(t, scraped, `imp_memory_cache_requests_total{cache="originals",result="hit"}`, "Cache hits not exposed")
+	assert.Contains(t, scraped, `imp_memory_cache_bytes{cache="originals"}`, "Cache size not exposed")
+}
+
+func TestCache_DecodedOriginals(t *testing.T) {
+	mediaProcessor := &MediaProcessorMock{}
+	cloudStore := &CloudStoreMock{}
+	router := CacheRouter(CacheConfig(true, 0), mediaProcessor, cloudStore, &DbStoreMock{})
+
+	resizeStoredImage(t, router, 13, 14, 15)
+
+	assert.Equal(t, 1, cloudStore.DownloadCount, "Original is downloaded more than once")
+	assert.Equal(t, 1, mediaProcessor.DecodeCount, "Original is decoded more than once")
+	assert.Equal(t, 3, mediaProcessor.ResizeCount, "Wrong count of resized images")
+}
+
+func TestCache_Disabled(t *testing.T) {
+	cloudStore := &CloudStoreMock{}
+	router := CacheRouter(&dto.Config{}, &MediaProcessorMock{}, cloudStore, &DbStoreMock{})
+
+	resizeStoredImage(t, router, 13, 14)
+
+	assert.Equal(t, 2, cloudStore.DownloadCount, "Original is cached when cache is disabled")
+}
+
+func TestCache_Variants(t *testing.T) {
+	cloudStore := &CloudStoreMock{}
+	dbStore := &DbStoreMock{}
+	dbStore.AddRecord(&dto.DbImageStoreDAO{UserId: "asdad", PicId: 10, ResizedImageUrl: "hot_url", ResizedWidth: 20, ResizedHeight: 20})
+	router := CacheRouter(CacheConfig(false, 0), &MediaProcessorMock{}, cloudStore, dbStore)
+
+	for i := 0; i < 3; i++ {
+		response := sendDeliveryRequest(router)
+		assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+		assert.Equal(t, readTestImage(t), response.Body.Bytes(), "Wrong image content")
+	}
+	assert.Equal(t, 1, cloudStore.DownloadCount, "Hot variant is downloaded more than once")
+}
+
+func TestCache_Ttl(t *testing.T) {
+	cloudStore := &CloudStoreMock{}
+	router := CacheRouter(CacheConfig(false, 50*time.Millisecond), &MediaProcessorMock{}, cloudStore, &DbStoreMock{})
+
+	resizeStoredImage(t, router, 13)
+	time.Sleep(100 * time.Millisecond)
+	resizeStoredImage(t, router, 14)
+
+	assert.Equal(t, 2, cloudStore.DownloadCount, "Expired original is not downloaded again")
+}
+
+func TestCache_Eviction(t *testing.T) {
+	lru := cache.NewLRU("test", 10, 0)
+	lru.Set("a", "a", 4)
+	lru.Set("b", "b", 4)
+	// "a" becomes most recently used, so "b" is evicted
+	_, ok := lru.Get("a")
+	assert.True(t, ok, "Entry is not cached")
+	lru.Set("c", "c", 4)
+
+	_, ok = lru.Get("b")
+	assert.False(t, ok, "Least recently used entry is not evicted")
+	_, ok = lru.Get("a")
+	assert.True(t, ok, "Recently used entry is evicted")
+	assert.Equal(t, int64(8), lru.Bytes(), "Wrong size of cache")
+
+	lru.DeletePrefix("")
+	assert.Equal(t, int64(0), lru.Bytes(), "Entries are not deleted")
+}
+
+func TestCache_Budget(t *testing.T) {
+	lru := cache.NewLRU("test", 10, 0)
+	lru.Set("a", "a", 11)
+	_, ok := lru.Get("a")
+	assert.False(t, ok, "Entry larger than budget is cached")
+
+	disabled := cache.NewLRU("test", 0, 0)
+	disabled.Set("a", "a", 1)
+	_, ok = disabled.Get("a")
+	assert.False(t, ok, "Entry is cached by disabled cache")
+}
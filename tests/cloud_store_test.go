@@ -0,0 +1,117 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/service"
+	"github.com/senseyman/image-media-processor/service/store"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+/*
+	Cases:
++	- file is downloaded and deleted by the same key it was uploaded with
++	- missing file reported as not found
+*/
+
+// Fake S3 compatible storage, objects are kept by request path "/bucket/key"
+type s3Fake struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *s3Fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := ioutil.ReadAll(r.Body)
+		f.objects[r.URL.Path] = body
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodPost:
+		// DeleteObjects request
+		deleteInput := struct {
+			Keys []string `xml:"Object>Key"`
+		}{}
+		if err := xml.NewDecoder(r.Body).Decode(&deleteInput); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, key := range deleteInput.Keys {
+			delete(f.objects, r.URL.Path+"/"+key)
+		}
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><DeleteResult></DeleteResult>`))
+	case http.MethodGet:
+		body, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>missing</Message></Error>`))
+			return
+		}
+		if len(r.Header.Get("Range")) > 0 {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(body)-1, len(body)))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		w.Write(body)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newAwsServiceWithFake(t *testing.T) (*store.AwsService, *s3Fake, func()) {
+	fake := &s3Fake{objects: map[string][]byte{}}
+	srv := httptest.NewServer(fake)
+	awsService := store.NewAwsService(&dto.AwsConfig{
+		AwsAccessKeyId:     "id",
+		AwsSecretAccessKey: "secret",
+		AwsRegion:          "eu-central-1",
+		AwsBucket:          "bucket",
+		AwsEndpoint:        srv.URL,
+	}, logrus.New())
+	return awsService, fake, srv.Close
+}
+
+func TestCloudStore_UploadDownloadKey(t *testing.T) {
+	awsService, fake, closeFake := newAwsServiceWithFake(t)
+	defer closeFake()
+
+	uploaded, err := awsService.Upload(context.Background(), 10, "wsss", []*dto.FileInfoDto{
+		{Buffer: bytes.NewBufferString("content"), Name: "photo_10x10.jpeg", Type: dto.SourceResized},
+	})
+	if !assert.NoError(t, err, "Cannot upload file") {
+		return
+	}
+	assert.Contains(t, fake.objects, "/bucket/wsss/10/photo_10x10.jpeg", "Unexpected key of uploaded file")
+
+	file, err := awsService.Download(context.Background(), uploaded.Data[0].Url, "wsss", 10)
+	if !assert.NoError(t, err, "File is not downloaded by key it was uploaded with") {
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	content, _ := ioutil.ReadFile(file.Name())
+	assert.Equal(t, "content", string(content), "Wrong content of downloaded file")
+
+	err = awsService.DeleteImageFiles(context.Background(), "wsss", 10, []string{uploaded.Data[0].Url})
+	assert.NoError(t, err, "Cannot delete file")
+	assert.Empty(t, fake.objects, "File is not deleted by key it was uploaded with")
+}
+
+func TestCloudStore_DownloadMissing(t *testing.T) {
+	awsService, _, closeFake := newAwsServiceWithFake(t)
+	defer closeFake()
+
+	_, err := awsService.Download(context.Background(), "https://bucket/wsss/10//missing.jpeg", "wsss", 10)
+	assert.True(t, errors.Is(err, service.ErrNotFound), "Missing file not reported as not found: %v", err)
+}
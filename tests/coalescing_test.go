@@ -0,0 +1,163 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/service/jobs"
+	"github.com/senseyman/image-media-processor/service/webhooks"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+	Cases:
++	- concurrent delivery requests of missing variant resize original once
++	- disconnect of client which started generation does not fail waiting requests
++	- concurrent resize-by-id requests of missing variant resize original once
++	- variant generated by other instance holding lock is served without resizing
++	- variant is generated without lock if other instance does not release it in time
++	- lock is released after variant generated
+*/
+
+const CoalescedRequests = 10
+
+func CoalescingRouter(cfg *dto.Config, mediaProcessor *MediaProcessorMock, dbStore *DbStoreMock) *mux.Router {
+	router := mux.NewRouter()
+	processor := server.NewApiServerRequestProcessor(cfg, logrus.New(), mediaProcessor, &CloudStoreMock{}, dbStore,
+		jobs.NewMemoryJobStore(0), webhooks.NewMemoryDeliveryLog(0))
+	router.HandleFunc(server.DeliveryRoutePath, processor.HandleImageDeliveryRequest).Methods(http.MethodGet)
+	router.HandleFunc(ApiPathResizeById, processor.HandleResizeByIdRequest).Methods(http.MethodPost)
+	return router
+}
+
+func LockConfig(wait time.Duration) *dto.Config {
+	return &dto.Config{Coalescing: dto.CoalescingConfig{DistributedLock: true, LockWait: dto.Duration{Duration: wait}}}
+}
+
+// send the same request from many clients at once
+func sendConcurrently(send func() *httptest.ResponseRecorder) []*httptest.ResponseRecorder {
+	responses := make([]*httptest.ResponseRecorder, CoalescedRequests)
+	wg := sync.WaitGroup{}
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = send()
+		}(i)
+	}
+	wg.Wait()
+	return responses
+}
+
+func sendDeliveryRequest(router *mux.Router) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodGet, ApiPathDelivery, nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func TestCoalescing_Delivery(t *testing.T) {
+	mediaProcessor := &MediaProcessorMock{ResizeDelay: 300 * time.Millisecond}
+	router := CoalescingRouter(&dto.Config{}, mediaProcessor, &DbStoreMock{})
+
+	responses := sendConcurrently(func() *httptest.ResponseRecorder {
+		return sendDeliveryRequest(router)
+	})
+
+	for _, response := range responses {
+		assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+		assert.Equal(t, ResizedImageContent, response.Body.String(), "Wrong image content")
+	}
+	assert.Equal(t, 1, mediaProcessor.ResizeCount, "Variant is resized more than once")
+}
+
+func TestCoalescing_FirstClientDisconnected(t *testing.T) {
+	mediaProcessor := &MediaProcessorMock{ResizeDelay: 300 * time.Millisecond}
+	router := CoalescingRouter(&dto.Config{}, mediaProcessor, &DbStoreMock{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan struct{})
+	go func() {
+		defer close(first)
+		request, _ := http.NewRequestWithContext(ctx, http.MethodGet, ApiPathDelivery, nil)
+		router.ServeHTTP(httptest.NewRecorder(), request)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	response := sendDeliveryRequest(router)
+	<-first
+
+	assert.Equal(t, http.StatusOK, response.Code, "Waiting request failed after first client disconnected")
+	assert.Equal(t, ResizedImageContent, response.Body.String(), "Wrong image content")
+	assert.Equal(t, 1, mediaProcessor.ResizeCount, "Variant is resized more than once")
+}
+
+func TestCoalescing_ResizeById(t *testing.T) {
+	mediaProcessor := &MediaProcessorMock{ResizeDelay: 300 * time.Millisecond}
+	router := CoalescingRouter(&dto.Config{}, mediaProcessor, &DbStoreMock{})
+
+	responses := sendConcurrently(func() *httptest.ResponseRecorder {
+		return sendResizeByIdRequest(router, ApiPathResizeById, GenerateResizeByIdRequestBody())
+	})
+
+	for _, response := range responses {
+		assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+		responseDto := http_response_dto.ResizeImageResponseDto{}
+		if err := json.Unmarshal(response.Body.Bytes(), &responseDto); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "ddd", responseDto.RequestId, "Wrong request id")
+		assert.Equal(t, "orig_url", responseDto.OriginalImagePath, "Wrong original path")
+		assert.Equal(t, "resized_url", responseDto.ResizedImagePath, "Wrong resized path")
+	}
+	assert.Equal(t, 1, mediaProcessor.ResizeCount, "Variant is resized more than once")
+}
+
+func TestCoalescing_VariantOfOtherInstance(t *testing.T) {
+	mediaProcessor := &MediaProcessorMock{}
+	dbStore := &DbStoreMock{LockedByOther: true}
+	router := CoalescingRouter(LockConfig(5*time.Second), mediaProcessor, dbStore)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		dbStore.AddRecord(&dto.DbImageStoreDAO{UserId: "asdad", PicId: 10, ResizedImageUrl: "other_url", ResizedWidth: 20, ResizedHeight: 20})
+	}()
+	response := sendDeliveryRequest(router)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	assert.Equal(t, readTestImage(t), response.Body.Bytes(), "Wrong image content")
+	assert.Equal(t, 0, mediaProcessor.ResizeCount, "Variant of other instance is resized again")
+}
+
+func TestCoalescing_LockWaitExpired(t *testing.T) {
+	mediaProcessor := &MediaProcessorMock{}
+	router := CoalescingRouter(LockConfig(100*time.Millisecond), mediaProcessor, &DbStoreMock{LockedByOther: true})
+
+	response := sendDeliveryRequest(router)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	assert.Equal(t, ResizedImageContent, response.Body.String(), "Wrong image content")
+	assert.Equal(t, 1, mediaProcessor.ResizeCount, "Variant is not generated without lock")
+}
+
+func TestCoalescing_LockReleased(t *testing.T) {
+	dbStore := &DbStoreMock{}
+	router := CoalescingRouter(LockConfig(0), &MediaProcessorMock{}, dbStore)
+
+	response := sendDeliveryRequest(router)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	assert.Equal(t, 0, dbStore.LockCount(), "Lock of variant is not released")
+}
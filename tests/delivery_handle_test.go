@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+	Cases:
++	- wrong request type
++	- unsupported format, user id with not allowed characters
++	- image of another user
++	- positive (variant generated on a miss)
++	- not modified by etag
++	- range request
+*/
+
+const (
+	ApiPathDelivery            = "/img/asdad/10/20x20.jpg"
+	ApiPathDeliveryUnsupported = "/img/asdad/10/20x20.webp"
+	ApiPathDeliveryOtherUser   = "/img/other/10/20x20.jpg"
+	ApiPathDeliveryInvalidUser = "/img/as.dad/10/20x20.jpg"
+)
+
+func TestDelivery_WrongRequestType(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodPost, ApiPathDelivery, nil)
+	response := httptest.NewRecorder()
+
+	DeliveryRouter(SigningConfig()).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, response.Code, "Incorrect response status code on wrong request type")
+}
+
+func TestDelivery_InvalidParams_UnsupportedFormat(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, signedPath(ApiPathDeliveryUnsupported), nil)
+	response := httptest.NewRecorder()
+
+	DeliveryRouter(SigningConfig()).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Incorrect server response code")
+	responseDto := http_response_dto.ResizeImageResponseDto{}
+	err := json.Unmarshal(response.Body.Bytes(), &responseDto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, utils.ErrInvalidRequestParamValuesCode, responseDto.ErrCode, "Wrong error code")
+	assert.Contains(t, responseDto.ErrMsg, utils.ErrMsgInvalidRequestParamValues, "Wrong error message")
+}
+
+func TestDelivery_InvalidParams_UserId(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, signedPath(ApiPathDeliveryInvalidUser), nil)
+	response := httptest.NewRecorder()
+
+	DeliveryRouter(SigningConfig()).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code, "User id with not allowed characters accepted")
+}
+
+func TestDelivery_ImageOfAnotherUser(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, signedPath(ApiPathDeliveryOtherUser), nil)
+	response := httptest.NewRecorder()
+
+	DeliveryRouter(SigningConfig()).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusNotFound, response.Code, "Incorrect server response code")
+	responseDto := http_response_dto.ResizeImageResponseDto{}
+	err := json.Unmarshal(response.Body.Bytes(), &responseDto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, utils.ErrImageNotFoundCode, responseDto.ErrCode, "Wrong error code")
+}
+
+func TestDelivery_Positive(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, signedPath(ApiPathDelivery), nil)
+	response := httptest.NewRecorder()
+
+	DeliveryRouter(SigningConfig()).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	assert.Equal(t, ResizedImageContent, response.Body.String(), "Wrong image content")
+	assert.Equal(t, "image/jpeg", response.Header().Get("Content-Type"), "Wrong content type")
+	assert.Equal(t, server.DefaultDeliveryCacheControl, response.Header().Get("Cache-Control"), "Wrong cache control")
+	assert.NotEmpty(t, response.Header().Get("ETag"), "ETag is empty")
+	assert.NotEmpty(t, response.Header().Get("Last-Modified"), "Last-Modified is empty")
+}
+
+func TestDelivery_NotModified(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, signedPath(ApiPathDelivery), nil)
+	response := httptest.NewRecorder()
+	DeliveryRouter(SigningConfig()).ServeHTTP(response, request)
+	etag := response.Header().Get("ETag")
+
+	request, _ = http.NewRequest(http.MethodGet, signedPath(ApiPathDelivery), nil)
+	request.Header.Set("If-None-Match", etag)
+	response = httptest.NewRecorder()
+	DeliveryRouter(SigningConfig()).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusNotModified, response.Code, "Incorrect server response code")
+	assert.Empty(t, response.Body.String(), "Body not empty")
+}
+
+func TestDelivery_Range(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, signedPath(ApiPathDelivery), nil)
+	request.Header.Set("Range", "bytes=0-6")
+	response := httptest.NewRecorder()
+
+	DeliveryRouter(SigningConfig()).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusPartialContent, response.Code, "Incorrect server response code")
+	assert.Equal(t, ResizedImageContent[:7], response.Body.String(), "Wrong image range")
+}
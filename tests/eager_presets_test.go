@@ -0,0 +1,78 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+	Cases:
++	- eager preset not defined in config
++	- eager presets generated in request, original decoded once
++	- eager presets generated in background
+*/
+
+func EagerConfig(async bool) *dto.Config {
+	cfg := PresetsConfig()
+	cfg.Presets["medium"] = dto.PresetConfig{Width: 40, Height: 30, Mode: dto.ResizeModeFit}
+	cfg.Eager = dto.EagerConfig{Presets: []string{"thumb", "medium"}, Async: async}
+	return cfg
+}
+
+func sendEagerResizeRequest(t *testing.T, cfg *dto.Config, mediaProcessor *MediaProcessorMock) *http_response_dto.ResizeImageResponseDto {
+	body, contentType := prepareRequestValueForResizeApi(MarshalRequestDto(GenerateResizeRequestBody()), true, ImageTag, ImageName)
+	request, _ := http.NewRequest(http.MethodPost, ApiPathResize, body)
+	request.Header.Add("Content-Type", contentType)
+	response := httptest.NewRecorder()
+
+	router, processor := EagerResizeRouter(cfg, mediaProcessor)
+	router.ServeHTTP(response, request)
+	processor.WaitBackgroundTasks()
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	responseDto := &http_response_dto.ResizeImageResponseDto{}
+	err := json.Unmarshal(response.Body.Bytes(), responseDto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return responseDto
+}
+
+func TestEagerPresets_NotDefined(t *testing.T) {
+	cfg := PresetsConfig()
+	cfg.Eager.Presets = []string{"unknown"}
+
+	assert.Error(t, server.ValidateEagerPresets(cfg), "Undefined eager preset accepted")
+}
+
+func TestEagerPresets_Sync(t *testing.T) {
+	mediaProcessor := &MediaProcessorMock{}
+	responseDto := sendEagerResizeRequest(t, EagerConfig(false), mediaProcessor)
+
+	assert.Len(t, responseDto.Variants, 2, "Wrong count of planned variants")
+	assert.Equal(t, "thumb", responseDto.Variants[0].Preset, "Wrong preset")
+	assert.Equal(t, "png", responseDto.Variants[0].Format, "Wrong preset format")
+	assert.Equal(t, "jpeg", responseDto.Variants[1].Format, "Preset without format should use original format")
+	assert.Equal(t, signedPath(fmt.Sprintf("/img/wsss/%d/20x20.png?preset=thumb", responseDto.ImageId)), responseDto.Variants[0].Url, "Wrong delivery url")
+	assert.NotEmpty(t, responseDto.Variants[0].ResizedImagePath, "Variant not generated")
+	assert.Equal(t, 1, mediaProcessor.DecodeCount, "Original decoded more than once")
+	assert.Equal(t, 3, mediaProcessor.ResizeCount, "Wrong count of resized variants")
+}
+
+func TestEagerPresets_Async(t *testing.T) {
+	mediaProcessor := &MediaProcessorMock{}
+	responseDto := sendEagerResizeRequest(t, EagerConfig(true), mediaProcessor)
+
+	assert.Len(t, responseDto.Variants, 2, "Wrong count of planned variants")
+	assert.NotEmpty(t, responseDto.Variants[0].Url, "Empty delivery url")
+	assert.Empty(t, responseDto.Variants[0].ResizedImagePath, "Variant path known before generation")
+	assert.Equal(t, 1, mediaProcessor.DecodeCount, "Original decoded more than once")
+	assert.Equal(t, 3, mediaProcessor.ResizeCount, "Wrong count of resized variants")
+}
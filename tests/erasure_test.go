@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/service"
+	"github.com/senseyman/image-media-processor/service/jobs"
+	"github.com/senseyman/image-media-processor/service/webhooks"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+	Cases:
++	- all user files and records are deleted, other users data is kept
++	- report is signed, repeated request returns the same report
++	- interrupted erasure is continued by next request
++	- invalid user id and not configured signing are rejected
++	- signing secret is not used for erasure reports
+*/
+
+const (
+	ApiPathUsers  = "/api/v1/users/{user_id}"
+	ErasureSecret = "erasure-secret"
+)
+
+type erasureFixture struct {
+	router     *mux.Router
+	cloudStore *CloudStoreMock
+	dbStore    *DbStoreMock
+	jobStore   *jobs.MemoryJobStore
+	webhookLog *webhooks.MemoryDeliveryLog
+}
+
+func newErasureFixture(secret string) *erasureFixture {
+	f := &erasureFixture{
+		cloudStore: &CloudStoreMock{Files: []string{"wsss/1/a.jpeg", "wsss/1/a_10x10.jpeg", "wsss/2/b.jpeg", "other/3/c.jpeg"}},
+		dbStore:    &DbStoreMock{UserImages: 3},
+		jobStore:   jobs.NewMemoryJobStore(0),
+		webhookLog: webhooks.NewMemoryDeliveryLog(0),
+	}
+	f.dbStore.InsertApiKey(context.Background(), &dto.ApiKeyDto{Id: "1", UserId: "wsss"})
+	f.dbStore.InsertApiKey(context.Background(), &dto.ApiKeyDto{Id: "2", UserId: "other"})
+	f.jobStore.SaveJob(&dto.JobDto{Id: "job1", UserId: "wsss"})
+	f.jobStore.SaveJob(&dto.JobDto{Id: "job2", UserId: "other"})
+	f.webhookLog.SaveWebhookDelivery(&dto.WebhookDeliveryDto{RequestId: "qqq", UserId: "wsss"})
+
+	cfg := &dto.Config{Erasure: dto.ErasureConfig{Secret: secret}, Signing: SigningConfig().Signing}
+	processor := server.NewApiServerRequestProcessor(cfg, logrus.New(), &MediaProcessorMock{}, f.cloudStore, f.dbStore, f.jobStore, f.webhookLog)
+	f.router = mux.NewRouter()
+	f.router.HandleFunc(ApiPathUsers, processor.HandleEraseUserRequest).Methods(http.MethodDelete)
+	return f
+}
+
+func (f *erasureFixture) erase(t *testing.T, userId string) (int, *http_response_dto.UserErasureResponseDto) {
+	request, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("/api/v1/users/%s?request_id=qqq", userId), nil)
+	response := httptest.NewRecorder()
+	f.router.ServeHTTP(response, request)
+
+	responseDto := &http_response_dto.UserErasureResponseDto{}
+	if err := json.Unmarshal(response.Body.Bytes(), responseDto); err != nil {
+		t.Fatal(err)
+	}
+	return response.Code, responseDto
+}
+
+// signature is checked as client does it: over report json without signature field
+func checkErasureSignature(t *testing.T, report *http_response_dto.ErasureReportDto) {
+	unsigned := *report
+	unsigned.Signature = ""
+	payload, _ := json.Marshal(&unsigned)
+	assert.True(t, utils.CheckHmacSignature(ErasureSecret, string(payload), report.Signature), "Invalid report signature")
+}
+
+func TestEraseUser_Positive(t *testing.T) {
+	f := newErasureFixture(ErasureSecret)
+	status, responseDto := f.erase(t, "wsss")
+
+	assert.Equal(t, http.StatusOK, status, "Incorrect server response code")
+	assert.Equal(t, 0, responseDto.ErrCode, "Unexpected error: %s", responseDto.ErrMsg)
+	report := responseDto.Report
+	if !assert.NotNil(t, report, "Report is empty") {
+		return
+	}
+	assert.Equal(t, dto.ErasureStateCompleted, report.State, "Erasure not completed")
+	assert.Equal(t, 1, report.Attempts, "Wrong count of attempts")
+	assert.Equal(t, int64(3), report.FilesDeleted, "Wrong count of deleted files")
+	assert.Equal(t, int64(3), report.ImagesDeleted, "Wrong count of deleted images")
+	assert.Equal(t, int64(1), report.ApiKeysDeleted, "Wrong count of deleted API keys")
+	assert.Equal(t, int64(1), report.JobsDeleted, "Wrong count of deleted jobs")
+	assert.Equal(t, int64(1), report.WebhookDeliveriesDeleted, "Wrong count of deleted webhook deliveries")
+	checkErasureSignature(t, report)
+
+	// data of other users is kept
+	assert.Equal(t, []string{"other/3/c.jpeg"}, f.cloudStore.Files, "Wrong files left")
+	assert.Len(t, f.dbStore.FindAllApiKeys(context.Background()), 1, "Wrong API keys left")
+	assert.Nil(t, f.jobStore.GetJob("job1"), "Job of user not deleted")
+	assert.NotNil(t, f.jobStore.GetJob("job2"), "Job of other user deleted")
+
+	// repeated erasure has nothing to delete and returns the same report
+	status, repeated := f.erase(t, "wsss")
+	assert.Equal(t, http.StatusOK, status, "Incorrect server response code")
+	assert.Equal(t, report, repeated.Report, "Report of repeated erasure changed")
+}
+
+func TestEraseUser_Resume(t *testing.T) {
+	f := newErasureFixture(ErasureSecret)
+	f.cloudStore.DeleteErr = fmt.Errorf("%w: timeout", service.ErrUnavailable)
+
+	status, responseDto := f.erase(t, "wsss")
+	assert.Equal(t, http.StatusServiceUnavailable, status, "Incorrect server response code")
+	assert.Equal(t, utils.ErrStorageUnavailableCode, responseDto.ErrCode, "Wrong error code")
+	assert.Nil(t, responseDto.Report, "Report of failed erasure")
+	erasure, err := f.dbStore.GetErasure(context.Background(), "wsss")
+	if assert.NoError(t, err, "Progress of erasure not saved") {
+		assert.Equal(t, dto.ErasureStateInProgress, erasure.State, "Wrong state of interrupted erasure")
+	}
+
+	f.cloudStore.DeleteErr = nil
+	status, responseDto = f.erase(t, "wsss")
+	assert.Equal(t, http.StatusOK, status, "Incorrect server response code")
+	if !assert.NotNil(t, responseDto.Report, "Report is empty") {
+		return
+	}
+	assert.Equal(t, dto.ErasureStateCompleted, responseDto.Report.State, "Erasure not completed")
+	assert.Equal(t, 2, responseDto.Report.Attempts, "Wrong count of attempts")
+	assert.Equal(t, int64(3), responseDto.Report.FilesDeleted, "Wrong count of deleted files")
+	checkErasureSignature(t, responseDto.Report)
+}
+
+func TestEraseUser_Invalid(t *testing.T) {
+	for _, userId := range []string{"@@", "ws@ss"} {
+		status, responseDto := newErasureFixture(ErasureSecret).erase(t, userId)
+		assert.Equal(t, http.StatusBadRequest, status, "Incorrect server response code for %s", userId)
+		assert.Equal(t, utils.ErrInvalidRequestParamValuesCode, responseDto.ErrCode, "Wrong error code for %s", userId)
+	}
+
+	// signing secret of fixture is not used instead of erasure secret
+	f := newErasureFixture("")
+	status, responseDto := f.erase(t, "wsss")
+	assert.Equal(t, http.StatusNotImplemented, status, "Incorrect server response code")
+	assert.Equal(t, utils.ErrSigningNotConfiguredCode, responseDto.ErrCode, "Wrong error code")
+	assert.Len(t, f.cloudStore.Files, 4, "Files deleted without signing")
+}
+
+func TestEraseUser_ValidateConfig(t *testing.T) {
+	cfg := SigningConfig()
+	assert.NoError(t, server.ValidateErasure(cfg), "Empty erasure secret rejected")
+
+	cfg.Erasure.Secret = ErasureSecret
+	assert.NoError(t, server.ValidateErasure(cfg), "Dedicated erasure secret rejected")
+
+	cfg.Erasure.Secret = cfg.Signing.Secret
+	assert.Error(t, server.ValidateErasure(cfg), "Signing secret accepted as erasure secret")
+}
@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/service"
+	"github.com/senseyman/image-media-processor/service/fetch"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+	Cases:
++	- loopback address is blocked after resolution
++	- denied and not allowed hosts, unsupported schemes are blocked
++	- too large image and too many redirects are rejected
++	- missing remote image reported as not found
++	- resize request with source_url processes downloaded image
++	- request with both file and source_url is rejected
+*/
+
+const SourceImagePath = "/photos/photo.jpeg"
+
+// Server of source images, redirects from /redirect/{n} to /redirect/{n-1} and finally to image
+func SourceServer(t *testing.T) *httptest.Server {
+	content, err := ioutil.ReadFile(ImageName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc(SourceImagePath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(content)
+	})
+	router.HandleFunc("/redirect/{n:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		n := mux.Vars(r)["n"]
+		if n == "0" {
+			http.Redirect(w, r, SourceImagePath, http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/redirect/"+string(n[0]-1), http.StatusFound)
+	})
+	return httptest.NewServer(router)
+}
+
+func TestFetch_LoopbackBlocked(t *testing.T) {
+	srv := SourceServer(t)
+	defer srv.Close()
+
+	_, _, err := fetch.NewFetcher(&dto.FetchConfig{}).Fetch(context.Background(), srv.URL+SourceImagePath)
+	assert.True(t, errors.Is(err, fetch.ErrBlocked), "Loopback address not blocked: %v", err)
+
+	content, contentType, err := fetch.NewFetcher(&dto.FetchConfig{AllowPrivate: true}).Fetch(context.Background(), srv.URL+SourceImagePath)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, content, "Image not downloaded")
+	assert.Equal(t, "image/jpeg", contentType, "Wrong content type")
+}
+
+func TestFetch_HostLists(t *testing.T) {
+	fetcher := fetch.NewFetcher(&dto.FetchConfig{
+		AllowHosts: []string{"cdn.example.com"},
+		DenyHosts:  []string{"private.cdn.example.com"},
+	})
+
+	assert.Nil(t, fetcher.CheckUrl("https://cdn.example.com/a.jpeg"))
+	assert.Nil(t, fetcher.CheckUrl("https://img.CDN.example.com/a.jpeg"), "Subdomain not allowed")
+	for _, u := range []string{
+		"https://private.cdn.example.com/a.jpeg",
+		"https://other.com/a.jpeg",
+		"https://evilcdn.example.com/a.jpeg",
+		"ftp://cdn.example.com/a.jpeg",
+		"file:///etc/passwd",
+		"/a.jpeg",
+	} {
+		assert.True(t, errors.Is(fetcher.CheckUrl(u), fetch.ErrBlocked), "Url %s not blocked", u)
+	}
+}
+
+func TestFetch_Limits(t *testing.T) {
+	srv := SourceServer(t)
+	defer srv.Close()
+
+	fetcher := fetch.NewFetcher(&dto.FetchConfig{AllowPrivate: true, MaxSize: 100})
+	_, _, err := fetcher.Fetch(context.Background(), srv.URL+SourceImagePath)
+	assert.True(t, errors.Is(err, fetch.ErrTooLarge), "Size limit not applied: %v", err)
+
+	fetcher = fetch.NewFetcher(&dto.FetchConfig{AllowPrivate: true, MaxRedirects: 2})
+	_, _, err = fetcher.Fetch(context.Background(), srv.URL+"/redirect/1")
+	assert.Nil(t, err)
+	_, _, err = fetcher.Fetch(context.Background(), srv.URL+"/redirect/2")
+	assert.True(t, errors.Is(err, fetch.ErrBlocked), "Redirect limit not applied: %v", err)
+
+	_, _, err = fetcher.Fetch(context.Background(), srv.URL+"/missing.jpeg")
+	assert.True(t, errors.Is(err, service.ErrNotFound), "Missing image not reported: %v", err)
+}
+
+func sendSourceUrlRequest(t *testing.T, cfg *dto.Config, sourceUrl string, includeImage bool) (int, *http_response_dto.ResizeImageResponseDto) {
+	requestDto := GenerateResizeRequestBody()
+	requestDto.SourceUrl = sourceUrl
+	body, contentType := prepareRequestValueForResizeApi(MarshalRequestDto(requestDto), includeImage, ImageTag, ImageName)
+
+	request, _ := http.NewRequest(http.MethodPost, ApiPathResize, body)
+	request.Header.Add("Content-Type", contentType)
+	response := httptest.NewRecorder()
+	ResizeRouterWithConfig(cfg).ServeHTTP(response, request)
+
+	responseDto := &http_response_dto.ResizeImageResponseDto{}
+	if err := json.Unmarshal(response.Body.Bytes(), responseDto); err != nil {
+		t.Fatal(err)
+	}
+	return response.Code, responseDto
+}
+
+func TestResizeImage_SourceUrl(t *testing.T) {
+	srv := SourceServer(t)
+	defer srv.Close()
+	cfg := &dto.Config{Fetch: dto.FetchConfig{AllowPrivate: true}}
+
+	status, responseDto := sendSourceUrlRequest(t, cfg, srv.URL+SourceImagePath, false)
+	assert.Equal(t, http.StatusOK, status, "Incorrect server response code")
+	assert.Equal(t, 0, responseDto.ErrCode, "Unexpected error: %s", responseDto.ErrMsg)
+	imageId, _ := utils.GenerateImageIdByOriginalName("photo.jpeg")
+	assert.Equal(t, imageId, responseDto.ImageId, "Image id not generated from url path")
+	assert.NotEmpty(t, responseDto.ResizedImagePath, "Resized image path is empty")
+
+	status, responseDto = sendSourceUrlRequest(t, cfg, srv.URL+"/missing.jpeg", false)
+	assert.Equal(t, http.StatusBadGateway, status, "Incorrect server response code")
+	assert.Equal(t, utils.ErrFetchSourceCode, responseDto.ErrCode, "Wrong error code")
+}
+
+func TestResizeImage_SourceUrl_Rejected(t *testing.T) {
+	srv := SourceServer(t)
+	defer srv.Close()
+
+	// loopback address of test server is blocked by default
+	status, responseDto := sendSourceUrlRequest(t, &dto.Config{}, srv.URL+SourceImagePath, false)
+	assert.Equal(t, http.StatusBadRequest, status, "Incorrect server response code")
+	assert.Equal(t, utils.ErrInvalidRequestParamValuesCode, responseDto.ErrCode, "Wrong error code")
+
+	cfg := &dto.Config{Fetch: dto.FetchConfig{AllowPrivate: true}}
+	status, responseDto = sendSourceUrlRequest(t, cfg, srv.URL+SourceImagePath, true)
+	assert.Equal(t, http.StatusBadRequest, status, "Incorrect server response code")
+	assert.Equal(t, utils.ErrInvalidRequestParamValuesCode, responseDto.ErrCode, "Wrong error code")
+
+	status, responseDto = sendSourceUrlRequest(t, cfg, "ftp://example.com/photo.jpeg", false)
+	assert.Equal(t, http.StatusBadRequest, status, "Incorrect server response code")
+	assert.Equal(t, utils.ErrInvalidRequestParamValuesCode, responseDto.ErrCode, "Wrong error code")
+}
@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+/*
+	Cases:
++	- liveness
++	- ready, all dependencies reachable
++	- not ready, S3 is not reachable
++	- readiness result cached
++	- not ready while draining
+*/
+
+func getHealth(t *testing.T, router *mux.Router, path string) (int, *http_response_dto.HealthResponseDto) {
+	request, _ := http.NewRequest(http.MethodGet, path, nil)
+	response := httptest.NewRecorder()
+
+	router.ServeHTTP(response, request)
+
+	responseDto := &http_response_dto.HealthResponseDto{}
+	err := json.Unmarshal(response.Body.Bytes(), responseDto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.Code, responseDto
+}
+
+func TestHealth_Liveness(t *testing.T) {
+	router, _ := HealthRouter(&dto.Config{}, &CloudStoreMock{PingErr: errors.New("unreachable")}, &DbStoreMock{})
+	code, responseDto := getHealth(t, router, server.HealthPath)
+
+	assert.Equal(t, http.StatusOK, code, "Incorrect server response code")
+	assert.Equal(t, server.HealthStatusOk, responseDto.Status, "Wrong status")
+}
+
+func TestHealth_Ready_Positive(t *testing.T) {
+	router, _ := HealthRouter(&dto.Config{}, &CloudStoreMock{}, &DbStoreMock{})
+	code, responseDto := getHealth(t, router, server.ReadinessPath)
+
+	assert.Equal(t, http.StatusOK, code, "Incorrect server response code")
+	assert.Equal(t, server.HealthStatusOk, responseDto.Status, "Wrong status")
+	if assert.Len(t, responseDto.Dependencies, 2, "Wrong count of dependencies") {
+		assert.Equal(t, server.HealthStatusOk, responseDto.Dependencies[server.DependencyDb].Status, "Wrong db status")
+		assert.Equal(t, server.HealthStatusOk, responseDto.Dependencies[server.DependencyCloudStore].Status, "Wrong cloud store status")
+	}
+}
+
+func TestHealth_Ready_DependencyFailed(t *testing.T) {
+	router, _ := HealthRouter(&dto.Config{}, &CloudStoreMock{PingErr: errors.New("unreachable")}, &DbStoreMock{})
+	code, responseDto := getHealth(t, router, server.ReadinessPath)
+
+	assert.Equal(t, http.StatusServiceUnavailable, code, "Incorrect server response code")
+	assert.Equal(t, server.HealthStatusFail, responseDto.Status, "Wrong status")
+	if assert.Contains(t, responseDto.Dependencies, server.DependencyCloudStore, "Cloud store status not found") {
+		assert.Equal(t, server.HealthStatusFail, responseDto.Dependencies[server.DependencyCloudStore].Status, "Wrong cloud store status")
+		assert.Equal(t, "unreachable", responseDto.Dependencies[server.DependencyCloudStore].Error, "Wrong cloud store error")
+	}
+	assert.Equal(t, server.HealthStatusOk, responseDto.Dependencies[server.DependencyDb].Status, "Wrong db status")
+}
+
+func TestHealth_Ready_Cached(t *testing.T) {
+	dbStore := &DbStoreMock{}
+	cfg := &dto.Config{Health: dto.HealthConfig{CacheTtl: dto.Duration{Duration: time.Minute}}}
+	router, _ := HealthRouter(cfg, &CloudStoreMock{}, dbStore)
+
+	getHealth(t, router, server.ReadinessPath)
+	dbStore.PingErr = errors.New("unreachable")
+	code, _ := getHealth(t, router, server.ReadinessPath)
+
+	assert.Equal(t, http.StatusOK, code, "Cached result not used")
+	assert.Equal(t, 1, dbStore.PingCount, "Dependency checked more than once")
+}
+
+func TestHealth_Ready_Draining(t *testing.T) {
+	router, processor := HealthRouter(&dto.Config{}, &CloudStoreMock{}, &DbStoreMock{})
+	processor.StartDraining()
+	code, responseDto := getHealth(t, router, server.ReadinessPath)
+
+	assert.Equal(t, http.StatusServiceUnavailable, code, "Incorrect server response code")
+	assert.Equal(t, server.HealthStatusDraining, responseDto.Status, "Wrong status")
+
+	code, _ = getHealth(t, router, server.HealthPath)
+	assert.Equal(t, http.StatusOK, code, "Liveness failed while draining")
+}
@@ -0,0 +1,249 @@
+package tests
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/service/jobs"
+	"github.com/senseyman/image-media-processor/service/webhooks"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+/*
+	Cases:
++	- every image of archive is resized, metadata and not image entries are skipped
++	- archive with zip slip path is rejected
++	- archive with too many images, too many variants or too large image is rejected
++	- not zip file is rejected
++	- export archive has originals, variants and manifest
++	- file which cannot be downloaded is described in manifest
++	- streaming response is not cut by server write timeout
+*/
+
+const (
+	ApiPathImport = "/api/v1/import"
+	ApiPathExport = "/api/v1/export"
+)
+
+func ImportExportRouter(cfg *dto.Config, cloudStore *CloudStoreMock) *mux.Router {
+	router := mux.NewRouter()
+	processor := server.NewApiServerRequestProcessor(cfg, logrus.New(), &MediaProcessorMock{}, cloudStore, &DbStoreMock{},
+		jobs.NewMemoryJobStore(0), webhooks.NewMemoryDeliveryLog(0))
+	router.HandleFunc(ApiPathImport, processor.HandleImportRequest).Methods(http.MethodPost)
+	router.HandleFunc(ApiPathExport, processor.HandleExportRequest).Methods(http.MethodGet)
+	return router
+}
+
+func ImportConfig() *dto.Config {
+	cfg := PresetsConfig()
+	cfg.Import = dto.ImportConfig{MaxEntries: 3, MaxEntrySize: 1 << 20}
+	return cfg
+}
+
+// archive with test image under every name
+func newTestArchive(t *testing.T, names ...string) []byte {
+	content := readTestImage(t)
+	body := &bytes.Buffer{}
+	writer := zip.NewWriter(body)
+	for _, name := range names {
+		entry, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.Write(content)
+	}
+	writer.Close()
+	return body.Bytes()
+}
+
+func newImportRequest(archive []byte) *http.Request {
+	requestDto := GenerateBatchRequestBody()
+	requestDto.Items = nil
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "library.zip")
+	part.Write(archive)
+	params, _ := json.Marshal(requestDto)
+	writer.WriteField("params", string(params))
+	writer.Close()
+
+	request, _ := http.NewRequest(http.MethodPost, ApiPathImport, body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	return request
+}
+
+func sendImportRequest(t *testing.T, cfg *dto.Config, request *http.Request) (int, *http_response_dto.ResizeBatchResponseDto) {
+	response := httptest.NewRecorder()
+	ImportExportRouter(cfg, &CloudStoreMock{}).ServeHTTP(response, request)
+
+	responseDto := &http_response_dto.ResizeBatchResponseDto{}
+	if err := json.Unmarshal(response.Body.Bytes(), responseDto); err != nil {
+		t.Fatal(err)
+	}
+	return response.Code, responseDto
+}
+
+func sendExportRequest(t *testing.T, cloudStore *CloudStoreMock) (map[string][]byte, *http_response_dto.ExportManifestDto) {
+	request, _ := http.NewRequest(http.MethodGet, ApiPathExport+"?user_id=wsss&request_id=qqq", nil)
+	response := httptest.NewRecorder()
+	ImportExportRouter(&dto.Config{}, cloudStore).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	assert.Equal(t, "application/zip", response.Header().Get("Content-Type"), "Wrong content type")
+	assert.Contains(t, response.Header().Get("Content-Disposition"), "export-wsss.zip", "Wrong file name")
+
+	archive, err := zip.NewReader(bytes.NewReader(response.Body.Bytes()), int64(response.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, entry := range archive.File {
+		reader, err := entry.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name], _ = ioutil.ReadAll(reader)
+		reader.Close()
+	}
+	manifest := &http_response_dto.ExportManifestDto{}
+	if err := json.Unmarshal(files[server.ExportManifestName], manifest); err != nil {
+		t.Fatal(err)
+	}
+	return files, manifest
+}
+
+func TestImport_Positive(t *testing.T) {
+	archive := newTestArchive(t, "a.jpeg", "dir/b.jpeg", "__MACOSX/._a.jpeg", ".DS_Store", "notes.txt")
+	status, responseDto := sendImportRequest(t, ImportConfig(), newImportRequest(archive))
+
+	assert.Equal(t, http.StatusOK, status, "Incorrect server response code")
+	assert.Equal(t, 0, responseDto.ErrCode, "Unexpected error: %s", responseDto.ErrMsg)
+	if !assert.Len(t, responseDto.Results, 4, "Wrong count of results") {
+		return
+	}
+	files := map[string]bool{}
+	for _, result := range responseDto.Results {
+		assert.Equal(t, 0, result.ErrCode, "Unexpected error: %s", result.ErrMsg)
+		files[result.File] = true
+	}
+	assert.Equal(t, map[string]bool{"a.jpeg": true, "dir/b.jpeg": true}, files, "Wrong imported files")
+}
+
+func TestImport_Invalid(t *testing.T) {
+	cases := []struct {
+		name       string
+		archive    []byte
+		serverCode int
+		errCode    int
+	}{
+		{"zip slip", newTestArchive(t, "a.jpeg", "../evil.jpeg"), http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode},
+		{"absolute path", newTestArchive(t, "/etc/evil.jpeg"), http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode},
+		{"too many images", newTestArchive(t, "a.jpeg", "b.jpeg", "c.jpeg", "d.jpeg"), http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode},
+		{"no images", newTestArchive(t, "notes.txt"), http.StatusBadRequest, utils.ErrFileNotFoundInRequestCode},
+		{"not zip", readTestImage(t), http.StatusBadRequest, utils.ErrInvalidRequestParamValuesCode},
+	}
+	for _, c := range cases {
+		status, responseDto := sendImportRequest(t, ImportConfig(), newImportRequest(c.archive))
+		assert.Equal(t, c.serverCode, status, "Incorrect server response code: %s", c.name)
+		assert.Equal(t, c.errCode, responseDto.ErrCode, "Wrong error code: %s", c.name)
+		assert.Empty(t, responseDto.Results, "Results of invalid archive: %s", c.name)
+	}
+
+	// every image has two sizes
+	cfg := ImportConfig()
+	cfg.Import.MaxItems = 3
+	status, responseDto := sendImportRequest(t, cfg, newImportRequest(newTestArchive(t, "a.jpeg", "b.jpeg")))
+	assert.Equal(t, http.StatusBadRequest, status, "Import over limit of items accepted")
+	assert.Equal(t, utils.ErrInvalidRequestParamValuesCode, responseDto.ErrCode, "Wrong error code")
+	assert.Empty(t, responseDto.Results, "Results of import over limit of items")
+
+	cfg = ImportConfig()
+	cfg.Import.MaxEntrySize = 10
+	status, responseDto = sendImportRequest(t, cfg, newImportRequest(newTestArchive(t, "a.jpeg")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status, "Incorrect server response code")
+	assert.Equal(t, utils.ErrRequestTooLargeCode, responseDto.ErrCode, "Wrong error code")
+}
+
+func TestExport_Positive(t *testing.T) {
+	files, manifest := sendExportRequest(t, &CloudStoreMock{})
+
+	assert.Equal(t, "wsss", manifest.UserId, "Wrong user id")
+	if !assert.Len(t, manifest.Images, 1, "Wrong count of images") {
+		return
+	}
+	image := manifest.Images[0]
+	assert.Equal(t, uint32(1), image.ImageId, "Wrong image id")
+	assert.Equal(t, "1/orig_url", image.Original.Path, "Wrong path of original")
+	if !assert.Len(t, image.Variants, 1, "Wrong count of variants") {
+		return
+	}
+	assert.Equal(t, "1/resized_url", image.Variants[0].Path, "Wrong path of variant")
+	assert.Equal(t, 10, image.Variants[0].Width, "Wrong width of variant")
+
+	content := readTestImage(t)
+	for _, name := range []string{image.Original.Path, image.Variants[0].Path} {
+		assert.Equal(t, content, files[name], fmt.Sprintf("Wrong content of %s", name))
+	}
+	assert.Equal(t, int64(len(content)), image.Original.Size, "Wrong size of original")
+}
+
+func TestExport_DownloadError(t *testing.T) {
+	files, manifest := sendExportRequest(t, &CloudStoreMock{DownloadErr: fmt.Errorf("not found")})
+
+	assert.Len(t, files, 1, "Only manifest expected in archive")
+	if !assert.Len(t, manifest.Images, 1, "Wrong count of images") {
+		return
+	}
+	assert.Empty(t, manifest.Images[0].Original.Path, "Path of not downloaded file")
+	assert.NotEmpty(t, manifest.Images[0].Original.Error, "Error of download is not described")
+}
+
+func TestExport_StreamingTimeout(t *testing.T) {
+	processor := server.NewApiServerRequestProcessor(&dto.Config{}, logrus.New(), &MediaProcessorMock{}, &CloudStoreMock{}, &DbStoreMock{},
+		jobs.NewMemoryJobStore(0), webhooks.NewMemoryDeliveryLog(0))
+	slowStream := func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte("part"))
+			w.(http.Flusher).Flush()
+		}
+	}
+	router := mux.NewRouter()
+	router.Use(processor.InstrumentRequests)
+	router.HandleFunc("/plain", slowStream)
+	router.HandleFunc("/streaming", processor.Streaming(slowStream))
+
+	srv := httptest.NewUnstartedServer(router)
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/plain")
+	if err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	assert.Error(t, err, "Response is not cut by write timeout")
+
+	resp, err = http.Get(srv.URL + "/streaming")
+	if assert.NoError(t, err, "Streaming request failed") {
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "Streaming response is cut")
+		assert.Equal(t, "partpartpart", string(body), "Wrong streaming response")
+	}
+}
@@ -0,0 +1,136 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+	Cases:
++	- wrong request type
++	- unknown job
++	- invalid request params
++	- resize job with uploaded file
++	- resize job by image id
++	- failed job
+*/
+
+func createJob(t *testing.T, router *mux.Router, body io.Reader, contentType string) (int, *http_response_dto.JobResponseDto) {
+	request, _ := http.NewRequest(http.MethodPost, ApiPathJobs, body)
+	request.Header.Set("Content-Type", contentType)
+	response := httptest.NewRecorder()
+
+	router.ServeHTTP(response, request)
+
+	responseDto := &http_response_dto.JobResponseDto{}
+	err := json.Unmarshal(response.Body.Bytes(), responseDto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.Code, responseDto
+}
+
+func getJob(t *testing.T, router *mux.Router, jobId string) (int, *http_response_dto.JobResponseDto) {
+	request, _ := http.NewRequest(http.MethodGet, ApiPathJobs+"/"+jobId, nil)
+	response := httptest.NewRecorder()
+
+	router.ServeHTTP(response, request)
+
+	responseDto := &http_response_dto.JobResponseDto{}
+	err := json.Unmarshal(response.Body.Bytes(), responseDto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.Code, responseDto
+}
+
+func TestJobs_WrongRequestType(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, ApiPathJobs, nil)
+	response := httptest.NewRecorder()
+
+	router, _ := JobsRouter(&dto.Config{}, &MediaProcessorMock{})
+	router.ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, response.Code, "Incorrect response status code on wrong request type")
+}
+
+func TestJobs_NotFound(t *testing.T) {
+	router, _ := JobsRouter(&dto.Config{}, &MediaProcessorMock{})
+	code, responseDto := getJob(t, router, "unknown")
+
+	assert.Equal(t, http.StatusNotFound, code, "Incorrect server response code")
+	assert.Equal(t, utils.ErrJobNotFoundCode, responseDto.ErrCode, "Wrong error code")
+}
+
+func TestJobs_InvalidParams(t *testing.T) {
+	requestDto := GenerateResizeByIdRequestBody()
+	requestDto.Width = 0
+
+	router, _ := JobsRouter(&dto.Config{}, &MediaProcessorMock{})
+	code, responseDto := createJob(t, router, MarshalRequestDto(requestDto), "application/json")
+
+	assert.Equal(t, http.StatusBadRequest, code, "Incorrect server response code")
+	assert.Equal(t, utils.ErrInvalidRequestParamValuesCode, responseDto.ErrCode, "Wrong error code")
+	assert.Empty(t, responseDto.JobId, "Job created for invalid request")
+}
+
+func TestJobs_Resize_Positive(t *testing.T) {
+	body, contentType := prepareRequestValueForResizeApi(MarshalRequestDto(GenerateResizeRequestBody()), true, ImageTag, ImageName)
+
+	router, processor := JobsRouter(&dto.Config{}, &MediaProcessorMock{})
+	code, responseDto := createJob(t, router, body, contentType)
+
+	assert.Equal(t, http.StatusAccepted, code, "Incorrect server response code")
+	assert.NotEmpty(t, responseDto.JobId, "Empty job id")
+
+	processor.WaitBackgroundTasks()
+	code, responseDto = getJob(t, router, responseDto.JobId)
+
+	assert.Equal(t, http.StatusOK, code, "Incorrect server response code")
+	assert.Equal(t, dto.JobStateSucceeded, responseDto.State, "Wrong job state")
+	assert.Equal(t, dto.JobStageDone, responseDto.Stage, "Wrong job stage")
+	if assert.NotNil(t, responseDto.Result, "Empty job result") {
+		assert.Equal(t, 0, responseDto.Result.ErrCode, "Job finished with error")
+		assert.NotEmpty(t, responseDto.Result.ResizedImagePath, "Empty resized image path")
+	}
+}
+
+func TestJobs_ResizeById_Positive(t *testing.T) {
+	requestDto := GenerateResizeByIdRequestBody()
+	requestDto.UserId = "asdad"
+
+	router, processor := JobsRouter(&dto.Config{}, &MediaProcessorMock{})
+	code, responseDto := createJob(t, router, MarshalRequestDto(requestDto), "application/json")
+	assert.Equal(t, http.StatusAccepted, code, "Incorrect server response code")
+
+	processor.WaitBackgroundTasks()
+	_, responseDto = getJob(t, router, responseDto.JobId)
+
+	assert.Equal(t, dto.JobStateSucceeded, responseDto.State, "Wrong job state")
+	if assert.NotNil(t, responseDto.Result, "Empty job result") {
+		assert.Equal(t, requestDto.ImageId, responseDto.Result.ImageId, "Wrong image id")
+	}
+}
+
+func TestJobs_Failed(t *testing.T) {
+	body, contentType := prepareRequestValueForResizeApi(MarshalRequestDto(GenerateResizeRequestBody()), true, ImageTag, ImageName)
+
+	router, processor := JobsRouter(&dto.Config{}, &MediaProcessorMock{ReturnError: true})
+	_, responseDto := createJob(t, router, body, contentType)
+
+	processor.WaitBackgroundTasks()
+	_, responseDto = getJob(t, router, responseDto.JobId)
+
+	assert.Equal(t, dto.JobStateFailed, responseDto.State, "Wrong job state")
+	if assert.NotNil(t, responseDto.Result, "Empty job result") {
+		assert.NotEqual(t, 0, responseDto.Result.ErrCode, "Empty error code of failed job")
+	}
+}
@@ -0,0 +1,172 @@
+package tests
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+/*
+	Cases:
++	- jwt mode without secret and JWKS file
++	- valid HS256 token, user id from claim
++	- valid RS256 token from JWKS file
++	- expired token
++	- token not valid yet
++	- wrong audience
++	- unsigned token
++	- token without required scope
+*/
+
+const JwtSecret = "jwt-secret"
+
+func JwtConfig() *dto.Config {
+	return &dto.Config{Auth: dto.AuthConfig{Mode: server.AuthModeJwt, Jwt: dto.JwtConfig{
+		Secret:   JwtSecret,
+		Audience: "images",
+	}}}
+}
+
+func jwtClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":   "owner",
+		"aud":   []string{"images"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": server.ScopeImagesRead + " " + server.ScopeImagesWrite,
+	}
+}
+
+func jwtSegment(v interface{}) string {
+	content, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+func hs256Token(claims map[string]interface{}) string {
+	input := jwtSegment(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + jwtSegment(claims)
+	mac := hmac.New(sha256.New, []byte(JwtSecret))
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func rs256Token(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	input := jwtSegment(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid}) + "." + jwtSegment(claims)
+	hash := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func sendBearerRequest(cfg *dto.Config, method, path, token string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(method, path, nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	response := httptest.NewRecorder()
+	AuthRouter(cfg).ServeHTTP(response, request)
+	return response
+}
+
+func TestJwt_NotConfigured(t *testing.T) {
+	assert.Error(t, server.ValidateAuth(&dto.AuthConfig{Mode: server.AuthModeJwt}), "JWT mode accepted without keys")
+}
+
+func TestJwt_HS256_Positive(t *testing.T) {
+	response := sendBearerRequest(JwtConfig(), http.MethodGet, ApiPathList+"?user_id=other&request_id=ddd", hs256Token(jwtClaims()))
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	responseDto := &http_response_dto.UserImagesListResponseDto{}
+	err := json.Unmarshal(response.Body.Bytes(), responseDto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "owner", responseDto.UserId, "User id is not taken from token")
+}
+
+func TestJwt_RS256_Positive(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile, err := ioutil.TempFile("", "jwks*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(jwksFile.Name())
+	jwks := map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "key1",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}}
+	_ = json.NewEncoder(jwksFile).Encode(jwks)
+	_ = jwksFile.Close()
+
+	cfg := JwtConfig()
+	cfg.Auth.Jwt.Secret = ""
+	cfg.Auth.Jwt.JwksFile = jwksFile.Name()
+	assert.NoError(t, server.ValidateAuth(&cfg.Auth), "Valid JWKS file rejected")
+
+	response := sendBearerRequest(cfg, http.MethodGet, ApiPathList+"?request_id=ddd", rs256Token(t, key, "key1", jwtClaims()))
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+
+	response = sendBearerRequest(cfg, http.MethodGet, ApiPathList+"?request_id=ddd", hs256Token(jwtClaims()))
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "HS256 token accepted without secret")
+}
+
+func TestJwt_Expired(t *testing.T) {
+	claims := jwtClaims()
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	response := sendBearerRequest(JwtConfig(), http.MethodGet, ApiPathList+"?request_id=ddd", hs256Token(claims))
+
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Expired token accepted")
+}
+
+func TestJwt_NotBefore(t *testing.T) {
+	claims := jwtClaims()
+	claims["nbf"] = time.Now().Add(time.Hour).Unix()
+	response := sendBearerRequest(JwtConfig(), http.MethodGet, ApiPathList+"?request_id=ddd", hs256Token(claims))
+
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Token accepted before nbf")
+}
+
+func TestJwt_WrongAudience(t *testing.T) {
+	claims := jwtClaims()
+	claims["aud"] = "other"
+	response := sendBearerRequest(JwtConfig(), http.MethodGet, ApiPathList+"?request_id=ddd", hs256Token(claims))
+
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Token for other audience accepted")
+}
+
+func TestJwt_Unsigned(t *testing.T) {
+	token := jwtSegment(map[string]string{"alg": "none"}) + "." + jwtSegment(jwtClaims()) + "."
+	response := sendBearerRequest(JwtConfig(), http.MethodGet, ApiPathList+"?request_id=ddd", token)
+
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Unsigned token accepted")
+}
+
+func TestJwt_Scopes(t *testing.T) {
+	claims := jwtClaims()
+	claims["scope"] = server.ScopeImagesRead
+	token := hs256Token(claims)
+
+	response := sendBearerRequest(JwtConfig(), http.MethodGet, ApiPathList+"?request_id=ddd", token)
+	assert.Equal(t, http.StatusOK, response.Code, "Read scope is not accepted")
+
+	response = sendBearerRequest(JwtConfig(), http.MethodPost, ApiPathResize, token)
+	assert.Equal(t, http.StatusForbidden, response.Code, "Write route accepted token without write scope")
+}
@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/service/jobs"
+	"github.com/senseyman/image-media-processor/service/webhooks"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+)
+
+/*
+	Cases:
++	- originals older than retention are deleted with all variants
++	- variants not accessed longer than ttl are deleted, last variant of original is kept
++	- least recently accessed variants over limit are evicted
++	- disabled policies delete nothing
++	- images of different users with the same id are handled separately
++	- access time of variant is updated on cache hit
+*/
+
+const Day = 24 * time.Hour
+
+func LifecycleConfig() *dto.Config {
+	return &dto.Config{Lifecycle: dto.LifecycleConfig{
+		VariantTtl:        dto.Duration{Duration: 30 * Day},
+		OriginalRetention: dto.Duration{Duration: 365 * Day},
+		MaxVariants:       2,
+	}}
+}
+
+func newLifecycleProcessor(cfg *dto.Config, cloudStore *CloudStoreMock, dbStore *DbStoreMock) *server.ApiServerRequestProcessor {
+	return server.NewApiServerRequestProcessor(cfg, logrus.New(), &MediaProcessorMock{}, cloudStore, dbStore,
+		jobs.NewMemoryJobStore(0), webhooks.NewMemoryDeliveryLog(0))
+}
+
+// variant of image created and accessed given count of days ago, zero access means access time is not stored
+func lifecycleRecord(picId uint32, width, createdDaysAgo, accessedDaysAgo int) *dto.DbImageStoreDAO {
+	now := time.Now().UTC()
+	img := &dto.DbImageStoreDAO{
+		UserId:           "wsss",
+		PicId:            picId,
+		OriginalImageUrl: fmt.Sprintf("orig_%d", picId),
+		ResizedImageUrl:  fmt.Sprintf("resized_%d_%d", picId, width),
+		ResizedWidth:     width,
+		ResizedHeight:    width,
+		CreatedAt:        now.Add(-time.Duration(createdDaysAgo) * Day),
+	}
+	if accessedDaysAgo > 0 {
+		img.LastAccessedAt = now.Add(-time.Duration(accessedDaysAgo) * Day)
+	}
+	return img
+}
+
+// the same record of other user, files of users have different urls
+func otherUserRecord(img *dto.DbImageStoreDAO) *dto.DbImageStoreDAO {
+	img.UserId = "other"
+	img.OriginalImageUrl = "other_" + img.OriginalImageUrl
+	img.ResizedImageUrl = "other_" + img.ResizedImageUrl
+	return img
+}
+
+func lifecycleStores(records ...*dto.DbImageStoreDAO) (*CloudStoreMock, *DbStoreMock) {
+	files := map[string]bool{}
+	for _, img := range records {
+		files[img.OriginalImageUrl] = true
+		files[img.ResizedImageUrl] = true
+	}
+	cloudStore := &CloudStoreMock{}
+	for file := range files {
+		cloudStore.Files = append(cloudStore.Files, file)
+	}
+	sort.Strings(cloudStore.Files)
+	return cloudStore, &DbStoreMock{Records: records}
+}
+
+func recordUrls(dbStore *DbStoreMock) []string {
+	urls := make([]string, 0)
+	for _, img := range dbStore.Records {
+		urls = append(urls, img.ResizedImageUrl)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+func TestLifecycle_Policies(t *testing.T) {
+	cloudStore, dbStore := lifecycleStores(
+		// expired by ttl, except recently accessed one
+		lifecycleRecord(1, 10, 60, 40), lifecycleRecord(1, 20, 60, 1), lifecycleRecord(1, 30, 50, 0),
+		// last variant is kept even if not accessed
+		lifecycleRecord(2, 10, 100, 100),
+		// original expired by retention
+		lifecycleRecord(3, 10, 400, 1), lifecycleRecord(3, 20, 10, 1),
+		// two least recently accessed variants are evicted
+		lifecycleRecord(4, 10, 5, 4), lifecycleRecord(4, 20, 5, 1), lifecycleRecord(4, 30, 5, 3), lifecycleRecord(4, 40, 5, 2),
+	)
+	stats, err := newLifecycleProcessor(LifecycleConfig(), cloudStore, dbStore).ApplyLifecyclePolicies(context.Background())
+
+	assert.NoError(t, err, "Policies not applied")
+	assert.Equal(t, &server.LifecycleStats{ExpiredOriginals: 1, ExpiredVariants: 2, EvictedVariants: 2}, stats, "Wrong stats")
+	assert.Equal(t, []string{"resized_1_20", "resized_2_10", "resized_4_20", "resized_4_40"}, recordUrls(dbStore), "Wrong records left")
+	assert.Equal(t, []string{"orig_1", "orig_2", "orig_4", "resized_1_20", "resized_2_10", "resized_4_20", "resized_4_40"},
+		cloudStore.Files, "Wrong files left")
+}
+
+func TestLifecycle_UsersWithSameImageId(t *testing.T) {
+	cloudStore, dbStore := lifecycleStores(
+		// last variant of user is kept though other user has variant of the same image id
+		lifecycleRecord(1, 10, 100, 100), otherUserRecord(lifecycleRecord(1, 20, 1, 1)),
+		// expired original of user does not expire original of other user
+		lifecycleRecord(3, 10, 400, 1), otherUserRecord(lifecycleRecord(3, 10, 10, 1)),
+		// variants of users are not counted together
+		lifecycleRecord(4, 10, 5, 4), lifecycleRecord(4, 20, 5, 1), otherUserRecord(lifecycleRecord(4, 30, 5, 3)),
+	)
+	stats, err := newLifecycleProcessor(LifecycleConfig(), cloudStore, dbStore).ApplyLifecyclePolicies(context.Background())
+
+	assert.NoError(t, err, "Policies not applied")
+	assert.Equal(t, &server.LifecycleStats{ExpiredOriginals: 1}, stats, "Wrong stats")
+	assert.Equal(t, []string{"other_resized_1_20", "other_resized_3_10", "other_resized_4_30", "resized_1_10", "resized_4_10", "resized_4_20"},
+		recordUrls(dbStore), "Wrong records left")
+	assert.Equal(t, []string{"orig_1", "orig_4", "other_orig_1", "other_orig_3", "other_orig_4",
+		"other_resized_1_20", "other_resized_3_10", "other_resized_4_30", "resized_1_10", "resized_4_10", "resized_4_20"},
+		cloudStore.Files, "Wrong files left")
+}
+
+func TestLifecycle_Disabled(t *testing.T) {
+	cloudStore, dbStore := lifecycleStores(lifecycleRecord(1, 10, 400, 400), lifecycleRecord(1, 20, 400, 400))
+	stats, err := newLifecycleProcessor(&dto.Config{}, cloudStore, dbStore).ApplyLifecyclePolicies(context.Background())
+
+	assert.NoError(t, err, "Policies not applied")
+	assert.Equal(t, &server.LifecycleStats{}, stats, "Wrong stats")
+	assert.Len(t, dbStore.Records, 2, "Records deleted by disabled policies")
+}
+
+func TestLifecycle_TouchOnCacheHit(t *testing.T) {
+	record := lifecycleRecord(10, 13, 60, 0)
+	cloudStore, dbStore := lifecycleStores(record)
+	router := mux.NewRouter()
+	router.HandleFunc(ApiPathResizeById, newLifecycleProcessor(LifecycleConfig(), cloudStore, dbStore).HandleResizeByIdRequest).
+		Methods(http.MethodPost)
+
+	requestDto := GenerateResizeByIdRequestBody()
+	requestDto.UserId = record.UserId
+	started := time.Now().UTC()
+	response := sendResizeByIdRequest(router, ApiPathResizeById, requestDto)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	assert.False(t, record.LastAccessedAt.Before(started), "Access time is not updated")
+}
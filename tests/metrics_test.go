@@ -0,0 +1,56 @@
+package tests
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/service/metrics"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+	Cases:
++	- request counted by route template and status
++	- upload and insert stages, variant cache miss
+*/
+
+func scrapeMetrics(t *testing.T) string {
+	request, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+	response := httptest.NewRecorder()
+
+	metrics.Handler().ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	return response.Body.String()
+}
+
+func TestMetrics_Resize(t *testing.T) {
+	router := mux.NewRouter()
+	processor := NewProcessor(&dto.Config{}, &MediaProcessorMock{})
+	router.Use(processor.InstrumentRequests)
+	router.HandleFunc(ApiPathResize, processor.HandleResizeRequest).Methods(http.MethodPost)
+	router.HandleFunc(ApiPathJobs+"/{id}", processor.HandleGetJobRequest).Methods(http.MethodGet)
+
+	body, contentType := prepareRequestValueForResizeApi(MarshalRequestDto(GenerateResizeRequestBody()), true, ImageTag, ImageName)
+	request, _ := http.NewRequest(http.MethodPost, ApiPathResize, body)
+	request.Header.Add("Content-Type", contentType)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+
+	request, _ = http.NewRequest(http.MethodGet, ApiPathJobs+"/unknown", nil)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusNotFound, response.Code, "Incorrect server response code")
+
+	scraped := scrapeMetrics(t)
+	assert.Contains(t, scraped, `imp_http_requests_total{method="POST",route="/api/v1/resize",status="200"}`, "Resize request not counted")
+	assert.Contains(t, scraped, `imp_http_requests_total{method="GET",route="/api/v1/jobs/{id}",status="404"}`, "Request not counted by route template")
+	assert.Contains(t, scraped, `imp_http_request_duration_seconds_count{method="POST",route="/api/v1/resize",status="200"}`, "Latency not observed")
+	assert.Contains(t, scraped, `imp_processing_stage_duration_seconds_count{stage="upload"}`, "Upload stage not observed")
+	assert.Contains(t, scraped, `imp_processing_stage_duration_seconds_count{stage="insert"}`, "Insert stage not observed")
+	assert.Contains(t, scraped, `imp_image_bytes_count{direction="input"}`, "Input bytes not observed")
+	assert.Contains(t, scraped, `imp_variant_cache_requests_total{result="miss"}`, "Variant cache miss not counted")
+}
@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/service/jobs"
+	"github.com/senseyman/image-media-processor/service/webhooks"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+	Cases:
++	- invalid preset in config
++	- resize with unknown preset
++	- resize with preset
++	- resize by id with preset
++	- delivery url does not match preset
++	- delivery with preset
++	- reprocess preset, variant is named by stored original
++	- reprocess replaces files of outdated variants, variants of other user are not used
+*/
+
+func TestPresets_InvalidConfig(t *testing.T) {
+	err := server.ValidatePresets(map[string]dto.PresetConfig{"thumb": {Width: 10, Height: 10, Mode: "crop"}})
+	assert.Error(t, err, "Unknown mode accepted")
+
+	err = server.ValidatePresets(map[string]dto.PresetConfig{"thumb": {Width: 10, Height: 10, Format: "webp"}})
+	if assert.Error(t, err, "Unsupported format accepted") {
+		assert.Contains(t, err.Error(), "no webp encoder", "Reason of unsupported format not reported")
+	}
+
+	err = server.ValidatePresets(PresetsConfig().Presets)
+	assert.NoError(t, err, "Valid preset rejected")
+}
+
+func TestPresets_Resize_UnknownPreset(t *testing.T) {
+	requestDto := GenerateResizeRequestBody()
+	requestDto.Preset = "unknown"
+	body, contentType := prepareRequestValueForResizeApi(MarshalRequestDto(requestDto), true, ImageTag, ImageName)
+
+	request, _ := http.NewRequest(http.MethodPost, ApiPathResize, body)
+	request.Header.Add("Content-Type", contentType)
+	response := httptest.NewRecorder()
+
+	ResizeRouterWithConfig(PresetsConfig()).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Incorrect server response code")
+	responseDto := http_response_dto.ResizeImageResponseDto{}
+	err := json.Unmarshal(response.Body.Bytes(), &responseDto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, utils.ErrInvalidRequestParamValuesCode, responseDto.ErrCode, "Wrong error code")
+}
+
+func TestPresets_Resize_Positive(t *testing.T) {
+	requestDto := GenerateResizeRequestBody()
+	requestDto.Width = 0
+	requestDto.Height = 0
+	requestDto.Preset = "thumb"
+	body, contentType := prepareRequestValueForResizeApi(MarshalRequestDto(requestDto), true, ImageTag, ImageName)
+
+	request, _ := http.NewRequest(http.MethodPost, ApiPathResize, body)
+	request.Header.Add("Content-Type", contentType)
+	response := httptest.NewRecorder()
+
+	ResizeRouterWithConfig(PresetsConfig()).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	responseDto := http_response_dto.ResizeImageResponseDto{}
+	err := json.Unmarshal(response.Body.Bytes(), &responseDto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, responseDto.ErrCode, "Error code not empty")
+	assert.NotEmpty(t, responseDto.ResizedImagePath, "ResizedImagePath is empty")
+}
+
+func TestPresets_ResizeById_Positive(t *testing.T) {
+	requestDto := GenerateResizeByIdRequestBody()
+	requestDto.Width = 0
+	requestDto.Height = 0
+	requestDto.Preset = "thumb"
+
+	request, _ := http.NewRequest(http.MethodPost, ApiPathResizeById, MarshalRequestDto(requestDto))
+	request.Header.Add("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+
+	ResizeRouterWithConfig(PresetsConfig()).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+}
+
+func TestPresets_Delivery_NotMatchPreset(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, signedPath("/img/asdad/10/30x30.png?preset=thumb"), nil)
+	response := httptest.NewRecorder()
+
+	DeliveryRouter(PresetsConfig()).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Incorrect server response code")
+}
+
+func TestPresets_Delivery_Positive(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, signedPath("/img/asdad/10/20x20.png?preset=thumb"), nil)
+	response := httptest.NewRecorder()
+
+	DeliveryRouter(PresetsConfig()).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	assert.Equal(t, "image/png", response.Header().Get("Content-Type"), "Wrong content type")
+}
+
+func TestPresets_Reprocess(t *testing.T) {
+	processor := NewProcessor(PresetsConfig(), &MediaProcessorMock{})
+
+	_, err := processor.ReprocessPreset("unknown")
+	assert.Error(t, err, "Unknown preset reprocessed")
+
+	count, err := processor.ReprocessPreset("thumb")
+	assert.NoError(t, err, "Cannot reprocess preset")
+	assert.Equal(t, 1, count, "Wrong count of regenerated variants")
+}
+
+func TestPresets_Reprocess_OriginalName(t *testing.T) {
+	dbStore := &DbStoreMock{Records: []*dto.DbImageStoreDAO{{UserId: "asdad", PicId: 1, ResizedImageUrl: "old_url",
+		OriginalImageUrl: "https://bucket.s3.amazonaws.com/asdad/1/photo.png", ResizedWidth: 10, ResizedHeight: 10, Preset: "thumb"}}}
+	mediaProcessor := &MediaProcessorMock{}
+	processor := server.NewApiServerRequestProcessor(PresetsConfig(), logrus.New(), mediaProcessor, &CloudStoreMock{}, dbStore,
+		jobs.NewMemoryJobStore(0), webhooks.NewMemoryDeliveryLog(0))
+
+	count, err := processor.ReprocessPreset("thumb")
+
+	assert.NoError(t, err, "Cannot reprocess preset")
+	assert.Equal(t, 1, count, "Wrong count of regenerated variants")
+	assert.Equal(t, "photo.png", mediaProcessor.LastName, "Variant is not named by stored original")
+}
+
+func TestPresets_Reprocess_Files(t *testing.T) {
+	thumb := PresetsConfig().Presets["thumb"]
+	outdated := func(userId, url string) *dto.DbImageStoreDAO {
+		return &dto.DbImageStoreDAO{UserId: userId, PicId: 1, OriginalImageUrl: "orig_url", ResizedImageUrl: url,
+			ResizedWidth: 10, ResizedHeight: 10, Preset: "thumb"}
+	}
+	actual := &dto.DbImageStoreDAO{UserId: "other", PicId: 1, OriginalImageUrl: "orig_url", ResizedImageUrl: "other_new_url",
+		ResizedWidth: thumb.Width, ResizedHeight: thumb.Height, Mode: thumb.Mode, Format: thumb.Format, Quality: thumb.Quality, Preset: "thumb"}
+	dbStore := &DbStoreMock{Records: []*dto.DbImageStoreDAO{outdated("asdad", "old_url"), outdated("other", "other_old_url"), actual}}
+	cloudStore := &CloudStoreMock{Files: []string{"old_url", "other_new_url", "other_old_url"}}
+	processor := server.NewApiServerRequestProcessor(PresetsConfig(), logrus.New(), &MediaProcessorMock{}, cloudStore, dbStore,
+		jobs.NewMemoryJobStore(0), webhooks.NewMemoryDeliveryLog(0))
+
+	count, err := processor.ReprocessPreset("thumb")
+
+	assert.NoError(t, err, "Cannot reprocess preset")
+	assert.Equal(t, 1, count, "Wrong count of regenerated variants")
+	assert.Equal(t, []*dto.DbImageStoreDAO{actual}, dbStore.Records, "Outdated records are not deleted")
+	assert.Equal(t, []string{"other_new_url"}, cloudStore.Files, "Wrong files left")
+}
@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/service"
+	"github.com/senseyman/image-media-processor/service/jobs"
+	"github.com/senseyman/image-media-processor/service/webhooks"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+	Cases:
++	- invalid params reported as 422 problem
++	- missing image and unavailable DB are reported with different statuses
++	- missing file in cloud store reported as 404, unavailable cloud store as 503 by both API versions
++	- authentication error reported as problem
+*/
+
+const (
+	ApiPathV2List       = "/api/v2/list"
+	ApiPathV2ResizeById = "/api/v2/resize-by-id"
+)
+
+// Router with API v1 and v2 resize-by-id and list routes, like in api server
+func ProblemRouter(cfg *dto.Config, cloudStore *CloudStoreMock, dbStore *DbStoreMock) *mux.Router {
+	router := mux.NewRouter()
+	processor := server.NewApiServerRequestProcessor(cfg, logrus.New(), &MediaProcessorMock{}, cloudStore, dbStore,
+		jobs.NewMemoryJobStore(0), webhooks.NewMemoryDeliveryLog(0))
+
+	apiV2 := router.PathPrefix("/api/v2").Subrouter()
+	apiV2.Use(processor.ProblemDetails)
+	apiV2.Use(processor.Authenticate)
+	apiV2.HandleFunc("/resize-by-id", processor.HandleResizeByIdRequest).Methods(http.MethodPost)
+	apiV2.HandleFunc("/list", processor.HandleListHistoryRequest).Methods(http.MethodGet)
+
+	router.HandleFunc(ApiPathResizeById, processor.HandleResizeByIdRequest).Methods(http.MethodPost)
+	return router
+}
+
+func sendResizeByIdRequest(router *mux.Router, path string, requestDto interface{}) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodPost, path, MarshalRequestDto(requestDto))
+	request.Header.Set("Content-type", "application/json")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func checkProblem(t *testing.T, response *httptest.ResponseRecorder, status, code int) {
+	assert.Equal(t, status, response.Code, "Incorrect server response code")
+	assert.Equal(t, server.ProblemContentType, response.Header().Get("Content-Type"), "Wrong content type")
+
+	problem := http_response_dto.ProblemDto{}
+	if err := json.Unmarshal(response.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, status, problem.Status, "Wrong status in problem")
+	assert.Equal(t, http.StatusText(status), problem.Title, "Wrong title of problem")
+	assert.Equal(t, code, problem.Code, "Wrong error code")
+	assert.NotEmpty(t, problem.Type, "Problem type not set")
+	assert.NotEmpty(t, problem.Instance, "Problem instance not set")
+}
+
+func TestProblems_InvalidParams(t *testing.T) {
+	requestDto := GenerateResizeByIdRequestBody()
+	requestDto.Width = -1
+	response := sendResizeByIdRequest(ProblemRouter(&dto.Config{}, &CloudStoreMock{}, &DbStoreMock{}), ApiPathV2ResizeById, requestDto)
+
+	checkProblem(t, response, http.StatusUnprocessableEntity, utils.ErrInvalidRequestParamValuesCode)
+}
+
+func TestProblems_ImageLookup(t *testing.T) {
+	notFound := &DbStoreMock{GetImageErr: fmt.Errorf("image 10: %w", service.ErrNotFound)}
+	response := sendResizeByIdRequest(ProblemRouter(&dto.Config{}, &CloudStoreMock{}, notFound), ApiPathV2ResizeById, GenerateResizeByIdRequestBody())
+	checkProblem(t, response, http.StatusNotFound, utils.ErrImageNotFoundCode)
+
+	unavailable := &DbStoreMock{GetImageErr: fmt.Errorf("%w: connection refused", service.ErrUnavailable)}
+	router := ProblemRouter(&dto.Config{}, &CloudStoreMock{}, unavailable)
+	response = sendResizeByIdRequest(router, ApiPathV2ResizeById, GenerateResizeByIdRequestBody())
+	checkProblem(t, response, http.StatusServiceUnavailable, utils.ErrStorageUnavailableCode)
+	assert.NotEmpty(t, response.Header().Get("Retry-After"), "Retry-After header not set")
+
+	// outage is not reported as missing image in API v1 too
+	response = sendResizeByIdRequest(router, ApiPathResizeById, GenerateResizeByIdRequestBody())
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code, "Incorrect server response code")
+	responseDto := http_response_dto.ResizeImageResponseDto{}
+	if err := json.Unmarshal(response.Body.Bytes(), &responseDto); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, utils.ErrStorageUnavailableCode, responseDto.ErrCode, "Wrong error code")
+}
+
+func TestProblems_DownloadFailed(t *testing.T) {
+	cloudStore := &CloudStoreMock{DownloadErr: fmt.Errorf("%w: NoSuchKey", service.ErrNotFound)}
+	router := ProblemRouter(&dto.Config{}, cloudStore, &DbStoreMock{})
+
+	response := sendResizeByIdRequest(router, ApiPathV2ResizeById, GenerateResizeByIdRequestBody())
+	checkProblem(t, response, http.StatusNotFound, utils.ErrLoadFileCode)
+
+	response = sendResizeByIdRequest(router, ApiPathResizeById, GenerateResizeByIdRequestBody())
+	assert.Equal(t, http.StatusNotFound, response.Code, "Missing file reported with wrong API v1 status")
+
+	cloudStore.DownloadErr = fmt.Errorf("%w: RequestTimeout", service.ErrUnavailable)
+	response = sendResizeByIdRequest(router, ApiPathV2ResizeById, GenerateResizeByIdRequestBody())
+	checkProblem(t, response, http.StatusServiceUnavailable, utils.ErrLoadFileCode)
+
+	response = sendResizeByIdRequest(router, ApiPathResizeById, GenerateResizeByIdRequestBody())
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code, "Unavailable cloud store reported with wrong API v1 status")
+	assert.NotEmpty(t, response.Header().Get("Retry-After"), "Retry-After is not set")
+}
+
+func TestProblems_Unauthorized(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, ApiPathV2List+"?user_id=sss", nil)
+	response := httptest.NewRecorder()
+	ProblemRouter(ApiKeyConfig(), &CloudStoreMock{}, &DbStoreMock{}).ServeHTTP(response, request)
+
+	checkProblem(t, response, http.StatusUnauthorized, utils.ErrUnauthorizedCode)
+}
@@ -0,0 +1,141 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+	Cases:
++	- variants quota exceeded before resizing
++	- storage quota exceeded by resized image before uploading
++	- daily megapixels quota exceeded
++	- resize within quotas
++	- concurrent requests cannot exceed quota together
++	- usage of user
+*/
+
+func sendQuotaResizeRequest(t *testing.T, cfg *dto.Config, mediaProcessor *MediaProcessorMock) (int, *http_response_dto.ResizeImageResponseDto) {
+	body, contentType := prepareRequestValueForResizeApi(MarshalRequestDto(GenerateResizeRequestBody()), true, ImageTag, ImageName)
+	request, _ := http.NewRequest(http.MethodPost, ApiPathResize, body)
+	request.Header.Add("Content-Type", contentType)
+	response := httptest.NewRecorder()
+
+	QuotaRouter(cfg, mediaProcessor).ServeHTTP(response, request)
+
+	responseDto := &http_response_dto.ResizeImageResponseDto{}
+	err := json.Unmarshal(response.Body.Bytes(), responseDto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.Code, responseDto
+}
+
+func TestQuotas_Variants(t *testing.T) {
+	mediaProcessor := &MediaProcessorMock{}
+	code, responseDto := sendQuotaResizeRequest(t, &dto.Config{Quotas: dto.QuotaConfig{MaxVariants: 1}}, mediaProcessor)
+
+	assert.Equal(t, http.StatusForbidden, code, "Incorrect server response code")
+	assert.Equal(t, utils.ErrQuotaExceededCode, responseDto.ErrCode, "Wrong error code")
+	assert.Equal(t, 0, mediaProcessor.ResizeCount, "Image resized over quota")
+}
+
+func TestQuotas_Bytes(t *testing.T) {
+	info, err := os.Stat(ImageName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// original fits, but not together with resized image
+	maxBytes := 1000 + 100 + info.Size() + 1
+
+	mediaProcessor := &MediaProcessorMock{}
+	code, responseDto := sendQuotaResizeRequest(t, &dto.Config{Quotas: dto.QuotaConfig{MaxBytes: maxBytes}}, mediaProcessor)
+
+	assert.Equal(t, http.StatusForbidden, code, "Incorrect server response code")
+	assert.Equal(t, utils.ErrQuotaExceededCode, responseDto.ErrCode, "Wrong error code")
+	assert.Equal(t, 1, mediaProcessor.ResizeCount, "Wrong count of resizes")
+	assert.Empty(t, responseDto.ResizedImagePath, "Image uploaded over quota")
+}
+
+func TestQuotas_Megapixels(t *testing.T) {
+	code, responseDto := sendQuotaResizeRequest(t, &dto.Config{Quotas: dto.QuotaConfig{MaxMegapixelsPerDay: 0.00001}}, &MediaProcessorMock{})
+
+	assert.Equal(t, http.StatusForbidden, code, "Incorrect server response code")
+	assert.Equal(t, utils.ErrQuotaExceededCode, responseDto.ErrCode, "Wrong error code")
+}
+
+func TestQuotas_Concurrent(t *testing.T) {
+	const requests = 4
+	// user has one variant, so only one of concurrent requests fits quota
+	cfg := &dto.Config{Quotas: dto.QuotaConfig{MaxVariants: 2}, Jobs: dto.JobsConfig{Workers: requests}}
+	mediaProcessor := &MediaProcessorMock{ResizeDelay: 200 * time.Millisecond}
+	router := QuotaRouter(cfg, mediaProcessor)
+
+	codes := make([]int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body, contentType := prepareRequestValueForResizeApi(MarshalRequestDto(GenerateResizeRequestBody()), true, ImageTag, ImageName)
+			request, _ := http.NewRequest(http.MethodPost, ApiPathResize, body)
+			request.Header.Add("Content-Type", contentType)
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, request)
+			codes[i] = response.Code
+		}(i)
+	}
+	wg.Wait()
+
+	accepted := 0
+	for _, code := range codes {
+		if code == http.StatusOK {
+			accepted++
+		} else {
+			assert.Equal(t, http.StatusForbidden, code, "Incorrect server response code")
+		}
+	}
+	assert.Equal(t, 1, accepted, "Concurrent requests exceeded quota")
+	assert.Equal(t, 1, mediaProcessor.ResizeCount, "Image resized over quota")
+}
+
+func TestQuotas_Positive(t *testing.T) {
+	cfg := &dto.Config{Quotas: dto.QuotaConfig{MaxOriginals: 2, MaxVariants: 2, MaxBytes: 1 << 20, MaxMegapixelsPerDay: 1}}
+	code, responseDto := sendQuotaResizeRequest(t, cfg, &MediaProcessorMock{})
+
+	assert.Equal(t, http.StatusOK, code, "Incorrect server response code")
+	assert.NotEmpty(t, responseDto.ResizedImagePath, "Empty resized image path")
+}
+
+func TestQuotas_Usage(t *testing.T) {
+	cfg := &dto.Config{Quotas: dto.QuotaConfig{MaxOriginals: 10, MaxBytes: 1 << 20}}
+	request, _ := http.NewRequest(http.MethodGet, ApiPathUsage+"?user_id=sss&request_id=ddd", nil)
+	response := httptest.NewRecorder()
+
+	QuotaRouter(cfg, &MediaProcessorMock{}).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	responseDto := &http_response_dto.UsageResponseDto{}
+	err := json.Unmarshal(response.Body.Bytes(), responseDto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, responseDto.Usage, "Empty usage") {
+		assert.Equal(t, int64(1), responseDto.Usage.Originals, "Wrong count of originals")
+		assert.Equal(t, int64(1), responseDto.Usage.Variants, "Wrong count of variants")
+		assert.Equal(t, int64(1100), responseDto.Usage.Bytes, "Wrong stored bytes")
+	}
+	if assert.NotNil(t, responseDto.Limits, "Empty limits") {
+		assert.Equal(t, int64(10), responseDto.Limits.Originals, "Wrong originals limit")
+		assert.Equal(t, int64(0), responseDto.Limits.Variants, "Wrong variants limit")
+	}
+}
@@ -0,0 +1,136 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+	Cases:
++	- requests over burst rejected with headers
++	- callers are limited separately
++	- cheap and expensive routes have separate budgets
++	- limit by API key
++	- client address is the rightmost X-Forwarded-For entry, spoofed entries are ignored
+*/
+
+const rateLimitedListPath = ApiPathList + "?user_id=sss&request_id=ddd"
+
+func RateLimitConfig() *dto.Config {
+	return &dto.Config{RateLimit: dto.RateLimitConfig{
+		Cheap:     dto.RateLimitBudget{Rate: 0.001, Burst: 2},
+		Expensive: dto.RateLimitBudget{Rate: 0.001, Burst: 1},
+	}}
+}
+
+func sendRateLimitedRequest(router *mux.Router, method, path, remoteAddr string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, nil)
+	request.RemoteAddr = remoteAddr
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func TestRateLimit_Exceeded(t *testing.T) {
+	router := AuthRouter(RateLimitConfig())
+
+	response := sendRateLimitedRequest(router, http.MethodGet, rateLimitedListPath, "10.0.0.1:1000")
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	assert.Equal(t, "2", response.Header().Get(server.RateLimitLimitHeader), "Wrong limit header")
+	assert.Equal(t, "1", response.Header().Get(server.RateLimitRemainingHeader), "Wrong remaining header")
+
+	sendRateLimitedRequest(router, http.MethodGet, rateLimitedListPath, "10.0.0.1:1000")
+	response = sendRateLimitedRequest(router, http.MethodGet, rateLimitedListPath, "10.0.0.1:1000")
+
+	assert.Equal(t, http.StatusTooManyRequests, response.Code, "Request over limit accepted")
+	assert.Equal(t, "0", response.Header().Get(server.RateLimitRemainingHeader), "Wrong remaining header")
+	assert.NotEmpty(t, response.Header().Get("Retry-After"), "Empty Retry-After header")
+	assert.NotEmpty(t, response.Header().Get(server.RateLimitResetHeader), "Empty reset header")
+	responseDto := &http_response_dto.BaseResponseDto{}
+	err := json.Unmarshal(response.Body.Bytes(), responseDto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, utils.ErrRateLimitExceededCode, responseDto.ErrCode, "Wrong error code")
+}
+
+func TestRateLimit_SeparateCallers(t *testing.T) {
+	router := AuthRouter(RateLimitConfig())
+
+	sendRateLimitedRequest(router, http.MethodGet, rateLimitedListPath, "10.0.0.1:1000")
+	sendRateLimitedRequest(router, http.MethodGet, rateLimitedListPath, "10.0.0.1:1000")
+	response := sendRateLimitedRequest(router, http.MethodGet, rateLimitedListPath, "10.0.0.2:1000")
+
+	assert.Equal(t, http.StatusOK, response.Code, "Request of other caller rejected")
+}
+
+func TestRateLimit_SeparateBudgets(t *testing.T) {
+	router := AuthRouter(RateLimitConfig())
+
+	response := sendRateLimitedRequest(router, http.MethodPost, ApiPathResize, "10.0.0.1:1000")
+	assert.NotEqual(t, http.StatusTooManyRequests, response.Code, "First expensive request rejected")
+	response = sendRateLimitedRequest(router, http.MethodPost, ApiPathResize, "10.0.0.1:1000")
+	assert.Equal(t, http.StatusTooManyRequests, response.Code, "Expensive request over limit accepted")
+
+	response = sendRateLimitedRequest(router, http.MethodGet, rateLimitedListPath, "10.0.0.1:1000")
+	assert.Equal(t, http.StatusOK, response.Code, "Cheap request limited by expensive budget")
+}
+
+func TestRateLimit_ApiKey(t *testing.T) {
+	cfg := ApiKeyConfig()
+	cfg.RateLimit = RateLimitConfig().RateLimit
+	router := AuthRouter(cfg)
+	key := createApiKey(t, router, "owner")
+
+	// same client address, but different callers
+	for i := 0; i < 2; i++ {
+		request := httptest.NewRequest(http.MethodGet, rateLimitedListPath, nil)
+		request.Header.Set(server.ApiKeyHeader, key.Key)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		assert.Equal(t, http.StatusOK, response.Code, "Request with API key rejected")
+	}
+	request := httptest.NewRequest(http.MethodGet, rateLimitedListPath, nil)
+	request.Header.Set(server.ApiKeyHeader, key.Key)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusTooManyRequests, response.Code, "Request over limit of API key accepted")
+
+	response = sendRateLimitedRequest(router, http.MethodGet, rateLimitedListPath, "192.0.2.1:1234")
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Caller without key is limited by API key budget")
+}
+
+func TestRateLimit_ForwardedForSpoofed(t *testing.T) {
+	cfg := RateLimitConfig()
+	cfg.RateLimit.TrustForwardedFor = true
+	router := AuthRouter(cfg)
+
+	// client puts new address in front of header on every request, proxy appends real one
+	for i, spoofed := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"} {
+		request := httptest.NewRequest(http.MethodGet, rateLimitedListPath, nil)
+		request.RemoteAddr = "10.0.0.100:1000"
+		request.Header.Set("X-Forwarded-For", spoofed+", 203.0.113.7")
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if i < 2 {
+			assert.Equal(t, http.StatusOK, response.Code, "Request within limit rejected")
+		} else {
+			assert.Equal(t, http.StatusTooManyRequests, response.Code, "Spoofed X-Forwarded-For bypassed limit")
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodGet, rateLimitedListPath, nil)
+	request.RemoteAddr = "10.0.0.100:1000"
+	request.Header.Set("X-Forwarded-For", "203.0.113.8")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code, "Request of other client behind proxy rejected")
+}
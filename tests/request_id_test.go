@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/service/jobs"
+	"github.com/senseyman/image-media-processor/service/logging"
+	"github.com/senseyman/image-media-processor/service/webhooks"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+	Cases:
++	- invalid log config
++	- request id generated if header is missing or invalid
++	- request id from header kept and added to every json log entry
+*/
+
+const RequestId = "test-request-1"
+
+// Router with request id middleware, log entries are written as json to buffer
+func RequestIdRouter(logCfg *dto.LogConfig) (*mux.Router, *bytes.Buffer) {
+	logger, err := logging.NewLogger("info", logCfg)
+	if err != nil {
+		panic(err)
+	}
+	output := new(bytes.Buffer)
+	logger.SetOutput(output)
+
+	router := mux.NewRouter()
+	processor := server.NewApiServerRequestProcessor(&dto.Config{}, logger, &MediaProcessorMock{}, &CloudStoreMock{}, &DbStoreMock{},
+		jobs.NewMemoryJobStore(0), webhooks.NewMemoryDeliveryLog(0))
+	router.Use(processor.AssignRequestId)
+	router.HandleFunc(ApiPathResize, processor.HandleResizeRequest).Methods(http.MethodPost)
+	return router, output
+}
+
+func sendResizeRequest(router *mux.Router, requestId string) *httptest.ResponseRecorder {
+	body, contentType := prepareRequestValueForResizeApi(MarshalRequestDto(GenerateResizeRequestBody()), true, ImageTag, ImageName)
+	request, _ := http.NewRequest(http.MethodPost, ApiPathResize, body)
+	request.Header.Add("Content-Type", contentType)
+	if len(requestId) > 0 {
+		request.Header.Add(logging.RequestIdHeader, requestId)
+	}
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func TestRequestId_InvalidLogConfig(t *testing.T) {
+	assert.Error(t, logging.ValidateLog(&dto.LogConfig{Format: "xml"}), "Unknown format accepted")
+	assert.Error(t, logging.ValidateLog(&dto.LogConfig{FieldNames: map[string]string{"user": "u"}}), "Unknown field accepted")
+	assert.NoError(t, logging.ValidateLog(&dto.LogConfig{Format: logging.FormatJson}), "Valid config rejected")
+}
+
+func TestRequestId_Generated(t *testing.T) {
+	router, _ := RequestIdRouter(&dto.LogConfig{})
+
+	for _, requestId := range []string{"", "bad id with spaces"} {
+		response := sendResizeRequest(router, requestId)
+		assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+		generated := response.Header().Get(logging.RequestIdHeader)
+		assert.True(t, logging.ValidRequestId(generated), "Request id is not generated")
+		assert.NotEqual(t, requestId, generated, "Invalid request id kept")
+	}
+}
+
+func TestRequestId_JsonLogs(t *testing.T) {
+	router, output := RequestIdRouter(&dto.LogConfig{
+		Format:     logging.FormatJson,
+		FieldNames: map[string]string{"msg": "message", logging.FieldRequestId: "rid"},
+		Fields:     map[string]string{"service": "imp"},
+	})
+
+	response := sendResizeRequest(router, RequestId)
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	assert.Equal(t, RequestId, response.Header().Get(logging.RequestIdHeader), "Request id is not returned")
+
+	entries := 0
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		entry := make(map[string]interface{})
+		if !assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry), "Log entry is not json") {
+			continue
+		}
+		entries++
+		assert.Equal(t, RequestId, entry["rid"], "Log entry has no request id")
+		assert.Equal(t, "imp", entry["service"], "Log entry has no static field")
+		assert.Contains(t, entry, "message", "Message field is not renamed")
+	}
+	assert.NotZero(t, entries, "Nothing logged")
+}
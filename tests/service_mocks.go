@@ -2,32 +2,107 @@ package tests
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/service"
+	"image"
 	"io"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 type MediaProcessorMock struct {
+	mu          sync.Mutex
 	ReturnError bool
+	// resize of image with this name fails
+	FailName    string
+	DecodeCount int
+	ResizeCount int
+	// duration of every resize
+	ResizeDelay time.Duration
+	// max count of images resized at once
+	MaxActive int
+	active    int
+	// size of original, 1x1 by default
+	SourceWidth  int
+	SourceHeight int
+	// params and original name of last resized variant
+	LastVariant dto.VariantDto
+	LastName    string
 }
 
-func (m *MediaProcessorMock) Resize(buffer io.Reader, name string, width, height int) (*dto.FileInfoDto, error) {
-	if m.ReturnError {
+func (m *MediaProcessorMock) DecodeConfig(ctx context.Context, buffer io.Reader) (image.Config, error) {
+	if m.SourceWidth == 0 || m.SourceHeight == 0 {
+		return image.Config{Width: 1, Height: 1}, nil
+	}
+	return image.Config{Width: m.SourceWidth, Height: m.SourceHeight}, nil
+}
+
+const ResizedImageContent = "resized image content"
+
+func (m *MediaProcessorMock) Decode(ctx context.Context, buffer io.Reader) (image.Image, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.DecodeCount++
+	return image.NewNRGBA(image.Rect(0, 0, 1, 1)), nil
+}
+
+func (m *MediaProcessorMock) Resize(ctx context.Context, src image.Image, name string, variant *dto.VariantDto) (*dto.FileInfoDto, error) {
+	m.mu.Lock()
+	m.ResizeCount++
+	m.LastVariant = *variant
+	m.LastName = name
+	m.active++
+	if m.active > m.MaxActive {
+		m.MaxActive = m.active
+	}
+	m.mu.Unlock()
+
+	time.Sleep(m.ResizeDelay)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active--
+	if m.ReturnError || (len(m.FailName) > 0 && name == m.FailName) {
 		return nil, fmt.Errorf("AAAAA")
 	}
-	bytes.NewBuffer([]byte(""))
+	// resize of cancelled request is interrupted
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	return &dto.FileInfoDto{
-		Buffer: bytes.NewBuffer([]byte("")),
+		Buffer: bytes.NewBuffer([]byte(ResizedImageContent)),
 		Name:   "name",
 		Type:   dto.SourceResized,
 	}, nil
 }
 
 type CloudStoreMock struct {
+	mu            sync.Mutex
+	DownloadCount int
+
+	PingErr     error
+	DownloadErr error
+	DeleteErr   error
+	// keys of stored files, deleted by DeleteFiles
+	Files []string
+	// keys of files passed to Upload
+	Uploaded []string
+}
+
+func (c *CloudStoreMock) Ping(ctx context.Context) error {
+	return c.PingErr
 }
 
-func (c *CloudStoreMock) Upload(id uint32, userId string, data []*dto.FileInfoDto) (*dto.CloudResponseDto, error) {
+func (c *CloudStoreMock) Upload(ctx context.Context, id uint32, userId string, data []*dto.FileInfoDto) (*dto.CloudResponseDto, error) {
+	c.mu.Lock()
+	for _, file := range data {
+		c.Uploaded = append(c.Uploaded, fmt.Sprintf("%s/%d/%s", userId, id, file.Name))
+	}
+	c.mu.Unlock()
 	return &dto.CloudResponseDto{
 		Data: []*dto.FileCloudStoreDto{
 			{
@@ -45,7 +120,13 @@ func (c *CloudStoreMock) Upload(id uint32, userId string, data []*dto.FileInfoDt
 		},
 	}, nil
 }
-func (c *CloudStoreMock) Download(url string, userId string, imageId uint32) (*os.File, error) {
+func (c *CloudStoreMock) Download(ctx context.Context, url string, userId string, imageId uint32) (*os.File, error) {
+	c.mu.Lock()
+	c.DownloadCount++
+	c.mu.Unlock()
+	if c.DownloadErr != nil {
+		return nil, c.DownloadErr
+	}
 	from, err := os.Open(ImageName)
 	if err != nil {
 		return nil, err
@@ -61,26 +142,106 @@ func (c *CloudStoreMock) Download(url string, userId string, imageId uint32) (*o
 	if err != nil {
 		return nil, err
 	}
+	// file is read from start like file written by s3 downloader
+	_, err = to.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
 	return to, nil
 }
 
+func (c *CloudStoreMock) ListUserFiles(ctx context.Context, userId string) ([]string, error) {
+	keys := make([]string, 0)
+	for _, key := range c.Files {
+		if strings.HasPrefix(key, userId+"/") {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (c *CloudStoreMock) DeleteImageFiles(ctx context.Context, userId string, imageId uint32, urls []string) error {
+	return c.DeleteFiles(ctx, urls)
+}
+
+func (c *CloudStoreMock) DeleteFiles(ctx context.Context, keys []string) error {
+	if c.DeleteErr != nil {
+		return c.DeleteErr
+	}
+	deleted := map[string]bool{}
+	for _, key := range keys {
+		deleted[key] = true
+	}
+	actual := make([]string, 0)
+	for _, key := range c.Files {
+		if !deleted[key] {
+			actual = append(actual, key)
+		}
+	}
+	c.Files = actual
+	return nil
+}
+
 type DbStoreMock struct {
+	mu       sync.Mutex
+	apiKeys  []*dto.ApiKeyDto
+	erasures map[string]*dto.ErasureDto
+	// owners of locks by key, locks never expire
+	locks map[string]string
+	// count of user images records, deleted by DeleteAllUserImages
+	UserImages int64
+	// variants found by GetImage and lifecycle lookups
+	Records []*dto.DbImageStoreDAO
+
+	PingErr     error
+	PingCount   int
+	GetImageErr error
+	LockErr     error
+	// all locks are held by other instance
+	LockedByOther bool
 }
 
-func (d *DbStoreMock) Insert(storeDto *dto.DbImageStoreDAO) error                    { return nil }
-func (d *DbStoreMock) GetImage(picId uint32, width, height int) *dto.DbImageStoreDAO { return nil }
-func (d *DbStoreMock) GetImageByImageId(picId uint32) *dto.DbImageStoreDAO {
+func (d *DbStoreMock) Ping(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.PingCount++
+	return d.PingErr
+}
+
+func (d *DbStoreMock) Insert(ctx context.Context, storeDto *dto.DbImageStoreDAO) error { return nil }
+func (d *DbStoreMock) GetImage(ctx context.Context, userId string, picId uint32, variant *dto.VariantDto) *dto.DbImageStoreDAO {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, img := range d.Records {
+		if img.UserId == userId && img.PicId == picId && img.ResizedWidth == variant.Width && img.ResizedHeight == variant.Height {
+			cp := *img
+			return &cp
+		}
+	}
+	return nil
+}
+
+// users of test requests, every image is processed by them
+var ImageOwners = map[string]bool{"asdad": true, "sss": true, "wsss": true}
+
+func (d *DbStoreMock) GetImageByImageId(ctx context.Context, userId string, picId uint32) (*dto.DbImageStoreDAO, error) {
+	if d.GetImageErr != nil {
+		return nil, d.GetImageErr
+	}
+	if !ImageOwners[userId] {
+		return nil, fmt.Errorf("image %d of user %s: %w", picId, userId, service.ErrNotFound)
+	}
 	return &dto.DbImageStoreDAO{
-		UserId:           "asdad",
+		UserId:           userId,
 		PicId:            picId,
 		OriginalImageUrl: "orig",
 		ResizedImageUrl:  "resized",
 		ResizedWidth:     10,
 		ResizedHeight:    10,
-	}
+	}, nil
 }
 
-func (d *DbStoreMock) FindAllPictureByUserId(userId string) []*dto.DbImageStoreDAO {
+func (d *DbStoreMock) FindAllPictureByUserId(ctx context.Context, userId string) []*dto.DbImageStoreDAO {
 	return []*dto.DbImageStoreDAO{
 		{
 			UserId:           userId,
@@ -89,6 +250,227 @@ func (d *DbStoreMock) FindAllPictureByUserId(userId string) []*dto.DbImageStoreD
 			ResizedImageUrl:  "resized_url",
 			ResizedWidth:     10,
 			ResizedHeight:    10,
+			OriginalSize:     1000,
+			ResizedSize:      100,
 		},
 	}
 }
+
+func (d *DbStoreMock) FindAllPictureByPreset(ctx context.Context, preset string) []*dto.DbImageStoreDAO {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.Records != nil {
+		result := make([]*dto.DbImageStoreDAO, 0)
+		for _, img := range d.Records {
+			if img.Preset == preset {
+				result = append(result, img)
+			}
+		}
+		return result
+	}
+	return []*dto.DbImageStoreDAO{
+		{
+			UserId:           "asdad",
+			PicId:            1,
+			OriginalImageUrl: "orig_url",
+			ResizedImageUrl:  "resized_url",
+			ResizedWidth:     10,
+			ResizedHeight:    10,
+			Preset:           preset,
+		},
+	}
+}
+
+func (d *DbStoreMock) DeleteImage(ctx context.Context, img *dto.DbImageStoreDAO) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.filterRecords(func(r *dto.DbImageStoreDAO) bool {
+		return r.UserId == img.UserId && r.PicId == img.PicId && r.ResizedImageUrl == img.ResizedImageUrl
+	})
+}
+
+// remove matched records
+func (d *DbStoreMock) filterRecords(match func(img *dto.DbImageStoreDAO) bool) error {
+	actual := make([]*dto.DbImageStoreDAO, 0)
+	for _, img := range d.Records {
+		if !match(img) {
+			actual = append(actual, img)
+		}
+	}
+	d.Records = actual
+	return nil
+}
+
+// copies of matched records
+func (d *DbStoreMock) findRecords(match func(img *dto.DbImageStoreDAO) bool) []*dto.DbImageStoreDAO {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	result := make([]*dto.DbImageStoreDAO, 0)
+	for _, img := range d.Records {
+		if match(img) {
+			cp := *img
+			result = append(result, &cp)
+		}
+	}
+	return result
+}
+
+func (d *DbStoreMock) FindAllPictureByUserAndImageId(ctx context.Context, userId string, picId uint32) []*dto.DbImageStoreDAO {
+	return d.findRecords(func(img *dto.DbImageStoreDAO) bool { return img.UserId == userId && img.PicId == picId })
+}
+
+func (d *DbStoreMock) TouchImage(ctx context.Context, img *dto.DbImageStoreDAO, accessedAt time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, r := range d.Records {
+		if r.UserId == img.UserId && r.PicId == img.PicId && r.ResizedImageUrl == img.ResizedImageUrl {
+			r.LastAccessedAt = accessedAt
+		}
+	}
+	return nil
+}
+
+func (d *DbStoreMock) FindImagesCreatedBefore(ctx context.Context, before time.Time) []*dto.DbImageStoreDAO {
+	return d.findRecords(func(img *dto.DbImageStoreDAO) bool { return img.CreatedAt.Before(before) })
+}
+
+func (d *DbStoreMock) FindImagesAccessedBefore(ctx context.Context, before time.Time) []*dto.DbImageStoreDAO {
+	return d.findRecords(func(img *dto.DbImageStoreDAO) bool {
+		if img.LastAccessedAt.IsZero() {
+			return img.CreatedAt.Before(before)
+		}
+		return img.LastAccessedAt.Before(before)
+	})
+}
+
+func (d *DbStoreMock) FindImagesWithVariantsOver(ctx context.Context, max int) []*dto.DbImageStoreDAO {
+	counts := map[string]int{}
+	for _, img := range d.findRecords(func(img *dto.DbImageStoreDAO) bool { return true }) {
+		counts[fmt.Sprintf("%s/%d", img.UserId, img.PicId)]++
+	}
+	return d.findRecords(func(img *dto.DbImageStoreDAO) bool { return counts[fmt.Sprintf("%s/%d", img.UserId, img.PicId)] > max })
+}
+
+func (d *DbStoreMock) InsertApiKey(ctx context.Context, key *dto.ApiKeyDto) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.apiKeys = append(d.apiKeys, key)
+	return nil
+}
+
+func (d *DbStoreMock) GetApiKeyByHash(ctx context.Context, keyHash string) *dto.ApiKeyDto {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, key := range d.apiKeys {
+		if key.KeyHash == keyHash {
+			return key
+		}
+	}
+	return nil
+}
+
+func (d *DbStoreMock) FindAllApiKeys(ctx context.Context) []*dto.ApiKeyDto {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*dto.ApiKeyDto{}, d.apiKeys...)
+}
+
+func (d *DbStoreMock) DeleteApiKey(ctx context.Context, id string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, key := range d.apiKeys {
+		if key.Id == id {
+			d.apiKeys = append(d.apiKeys[:i], d.apiKeys[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (d *DbStoreMock) DeleteAllUserImages(ctx context.Context, userId string) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	deleted := d.UserImages
+	d.UserImages = 0
+	return deleted, nil
+}
+
+func (d *DbStoreMock) DeleteUserApiKeys(ctx context.Context, userId string) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var deleted int64
+	actual := make([]*dto.ApiKeyDto, 0)
+	for _, key := range d.apiKeys {
+		if key.UserId == userId {
+			deleted++
+		} else {
+			actual = append(actual, key)
+		}
+	}
+	d.apiKeys = actual
+	return deleted, nil
+}
+
+func (d *DbStoreMock) GetErasure(ctx context.Context, userId string) (*dto.ErasureDto, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	erasure, ok := d.erasures[userId]
+	if !ok {
+		return nil, service.ErrNotFound
+	}
+	cp := *erasure
+	return &cp, nil
+}
+
+func (d *DbStoreMock) SaveErasure(ctx context.Context, erasure *dto.ErasureDto) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.erasures == nil {
+		d.erasures = make(map[string]*dto.ErasureDto)
+	}
+	cp := *erasure
+	d.erasures[erasure.UserId] = &cp
+	return nil
+}
+
+// Add variant while requests are processed, like other instance does
+func (d *DbStoreMock) AddRecord(img *dto.DbImageStoreDAO) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Records = append(d.Records, img)
+}
+
+func (d *DbStoreMock) AcquireLock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.LockErr != nil {
+		return false, d.LockErr
+	}
+	if d.LockedByOther {
+		return false, nil
+	}
+	if d.locks == nil {
+		d.locks = make(map[string]string)
+	}
+	if current, ok := d.locks[key]; ok && current != owner {
+		return false, nil
+	}
+	d.locks[key] = owner
+	return true, nil
+}
+
+func (d *DbStoreMock) ReleaseLock(ctx context.Context, key, owner string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.locks[key] == owner {
+		delete(d.locks, key)
+	}
+	return nil
+}
+
+// Count of locks which are held now
+func (d *DbStoreMock) LockCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.locks)
+}
@@ -0,0 +1,66 @@
+package tests
+
+import (
+	"context"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/service/jobs"
+	"github.com/senseyman/image-media-processor/service/webhooks"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+/*
+	Cases:
++	- started server stopped by shutdown
++	- pending webhook retries abandoned on shutdown
+*/
+
+func TestShutdown_Server(t *testing.T) {
+	cfg := &dto.Config{Server: dto.ServerConfig{
+		ServerPort:  "127.0.0.1:0",
+		ReadTimeout: dto.Duration{Duration: time.Second},
+	}}
+	apiServer := server.NewAPIServer(cfg, logrus.New(), &MediaProcessorMock{}, &CloudStoreMock{}, &DbStoreMock{}, jobs.NewMemoryJobStore(0), webhooks.NewMemoryDeliveryLog(0))
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- apiServer.Start()
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, apiServer.Shutdown(ctx), "Server was not stopped gracefully")
+
+	select {
+	case err := <-serverErr:
+		assert.NoError(t, err, "Start returned error after shutdown")
+	case <-time.After(time.Second):
+		t.Fatal("Server was not stopped")
+	}
+}
+
+func TestShutdown_WebhookRetriesAbandoned(t *testing.T) {
+	receiver := &callbackReceiver{statusCode: http.StatusInternalServerError}
+	callbackServer := httptest.NewServer(receiver)
+	defer callbackServer.Close()
+
+	cfg := WebhooksConfig()
+	cfg.Webhooks.InitialBackoff = dto.Duration{Duration: time.Hour}
+	router, processor := JobsRouter(cfg, &MediaProcessorMock{})
+	response := sendResizeWithCallback(t, router, callbackServer.URL)
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, processor.Shutdown(ctx), "Background tasks were not finished")
+
+	code, responseDto := getDeliveries(t, router, "?user_id=wsss&request_id=qqq")
+	assert.Equal(t, http.StatusOK, code, "Incorrect server response code")
+	assert.Len(t, responseDto.Deliveries, 1, "Callback was retried after shutdown")
+}
@@ -0,0 +1,158 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_request_dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+/*
+	Cases:
++	- signing not configured
++	- request without variants
++	- image of another user
++	- positive, signed url is accepted by delivery
++	- unsigned delivery request
++	- delivery request when signing not configured
++	- tampered delivery request
++	- expired delivery request
+*/
+
+func GenerateSignRequestBody() *http_request_dto.SignUrlRequestDto {
+	return &http_request_dto.SignUrlRequestDto{
+		BaseRequestDto: http_request_dto.BaseRequestDto{
+			UserId:    "asdad",
+			RequestId: "ddd",
+		},
+		ImageId: 10,
+		Variants: []*http_request_dto.VariantRequestDto{
+			{SizeRequestDto: http_request_dto.SizeRequestDto{Width: 20, Height: 20}, Format: "jpg"},
+		},
+	}
+}
+
+// Sign path with query params in sorted order by secret of SigningConfig
+func signedPath(path string) string {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return path + separator + "sig=" + utils.HmacSignature(SigningConfig().Signing.Secret, path)
+}
+
+func signUrls(t *testing.T, cfg *dto.Config, requestDto *http_request_dto.SignUrlRequestDto) (*httptest.ResponseRecorder, *http_response_dto.SignUrlResponseDto) {
+	request, _ := http.NewRequest(http.MethodPost, ApiPathSign, MarshalRequestDto(requestDto))
+	request.Header.Add("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+
+	SignRouter(cfg).ServeHTTP(response, request)
+
+	responseDto := &http_response_dto.SignUrlResponseDto{}
+	err := json.Unmarshal(response.Body.Bytes(), responseDto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, responseDto
+}
+
+func TestSign_NotConfigured(t *testing.T) {
+	response, responseDto := signUrls(t, &dto.Config{}, GenerateSignRequestBody())
+
+	assert.Equal(t, http.StatusNotImplemented, response.Code, "Incorrect server response code")
+	assert.Equal(t, utils.ErrSigningNotConfiguredCode, responseDto.ErrCode, "Wrong error code")
+}
+
+func TestSign_InvalidParams_WithoutVariants(t *testing.T) {
+	requestDto := GenerateSignRequestBody()
+	requestDto.Variants = nil
+	response, responseDto := signUrls(t, SigningConfig(), requestDto)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Incorrect server response code")
+	assert.Equal(t, utils.ErrInvalidRequestParamValuesCode, responseDto.ErrCode, "Wrong error code")
+	assert.Empty(t, responseDto.Urls, "Urls not empty")
+}
+
+func TestSign_ImageOfAnotherUser(t *testing.T) {
+	requestDto := GenerateSignRequestBody()
+	requestDto.UserId = "other"
+	response, responseDto := signUrls(t, SigningConfig(), requestDto)
+
+	assert.Equal(t, http.StatusNotFound, response.Code, "Incorrect server response code")
+	assert.Equal(t, utils.ErrImageNotFoundCode, responseDto.ErrCode, "Wrong error code")
+}
+
+func TestSign_Positive(t *testing.T) {
+	cfg := SigningConfig()
+	requestDto := GenerateSignRequestBody()
+	requestDto.ExpiresIn = 60
+	response, responseDto := signUrls(t, cfg, requestDto)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	assert.Empty(t, responseDto.ErrCode, "Error code not empty")
+	assert.Len(t, responseDto.Urls, 1, "Wrong urls count")
+	assert.Equal(t, "jpeg", responseDto.Urls[0].Format, "Wrong format")
+	assert.NotEmpty(t, responseDto.Urls[0].ExpiresAt, "Empty expiry")
+
+	request, _ := http.NewRequest(http.MethodGet, responseDto.Urls[0].Url, nil)
+	deliveryResponse := httptest.NewRecorder()
+	DeliveryRouter(cfg).ServeHTTP(deliveryResponse, request)
+
+	assert.Equal(t, http.StatusOK, deliveryResponse.Code, "Signed url rejected")
+}
+
+func TestDelivery_Unsigned(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, ApiPathDelivery, nil)
+	response := httptest.NewRecorder()
+
+	DeliveryRouter(SigningConfig()).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusForbidden, response.Code, "Incorrect server response code")
+	responseDto := http_response_dto.ResizeImageResponseDto{}
+	err := json.Unmarshal(response.Body.Bytes(), &responseDto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, utils.ErrInvalidSignatureCode, responseDto.ErrCode, "Wrong error code")
+}
+
+func TestDelivery_SigningNotConfigured(t *testing.T) {
+	cfg := &dto.Config{}
+	assert.Error(t, server.ValidateSigning(&cfg.Signing), "Empty signing secret accepted")
+
+	request, _ := http.NewRequest(http.MethodGet, signedPath(ApiPathDelivery), nil)
+	response := httptest.NewRecorder()
+	DeliveryRouter(cfg).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusForbidden, response.Code, "Delivery request accepted without signing secret")
+}
+
+func TestDelivery_Tampered(t *testing.T) {
+	cfg := SigningConfig()
+	_, responseDto := signUrls(t, cfg, GenerateSignRequestBody())
+
+	request, _ := http.NewRequest(http.MethodGet, strings.Replace(responseDto.Urls[0].Url, "20x20", "2000x2000", 1), nil)
+	response := httptest.NewRecorder()
+	DeliveryRouter(cfg).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusForbidden, response.Code, "Tampered url accepted")
+}
+
+func TestDelivery_Expired(t *testing.T) {
+	cfg := SigningConfig()
+	payload := ApiPathDelivery + "?expires=1"
+	signedUrl := payload + "&sig=" + utils.HmacSignature(cfg.Signing.Secret, payload)
+
+	request, _ := http.NewRequest(http.MethodGet, signedUrl, nil)
+	response := httptest.NewRecorder()
+	DeliveryRouter(cfg).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusForbidden, response.Code, "Expired url accepted")
+}
@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
 	"github.com/senseyman/image-media-processor/dto/http_request_dto"
 	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/service/jobs"
+	"github.com/senseyman/image-media-processor/service/webhooks"
 	"github.com/sirupsen/logrus"
 	"io"
 	"mime/multipart"
@@ -21,6 +24,11 @@ const (
 	ApiPathList       = "/api/v1/list"
 	ApiPathResize     = "/api/v1/resize"
 	ApiPathResizeById = "/api/v1/resize-by-id"
+	ApiPathSign       = "/api/v1/sign"
+	ApiPathJobs       = "/api/v1/jobs"
+	ApiPathDeliveries = "/api/v1/webhooks/deliveries"
+	ApiPathAdminKeys  = "/api/v1/admin/keys"
+	ApiPathUsage      = "/api/v1/usage"
 
 	ImageTag             = "file"
 	ImageName            = "image.jpeg"
@@ -29,28 +37,117 @@ const (
 
 func ResizeRouter(returnResizeError bool) *mux.Router {
 	router := mux.NewRouter()
-	logger := logrus.New()
-	processor := server.NewApiServerRequestProcessor(logger, &MediaProcessorMock{ReturnError: returnResizeError}, &CloudStoreMock{}, &DbStoreMock{})
+	processor := NewProcessor(&dto.Config{}, &MediaProcessorMock{ReturnError: returnResizeError})
 	router.HandleFunc(ApiPathResize, processor.HandleResizeRequest).Methods(http.MethodPost)
 	return router
 }
 
 func ResizeByIdRouterRouter() *mux.Router {
 	router := mux.NewRouter()
-	logger := logrus.New()
-	processor := server.NewApiServerRequestProcessor(logger, &MediaProcessorMock{}, &CloudStoreMock{}, &DbStoreMock{})
+	processor := NewProcessor(&dto.Config{}, &MediaProcessorMock{})
 	router.HandleFunc(ApiPathResizeById, processor.HandleResizeByIdRequest).Methods(http.MethodPost)
 	return router
 }
 
 func ListRouter() *mux.Router {
 	router := mux.NewRouter()
-	logger := logrus.New()
-	processor := server.NewApiServerRequestProcessor(logger, &MediaProcessorMock{}, &CloudStoreMock{}, &DbStoreMock{})
+	processor := NewProcessor(&dto.Config{}, &MediaProcessorMock{})
 	router.HandleFunc(ApiPathList, processor.HandleListHistoryRequest).Methods(http.MethodGet)
 	return router
 }
 
+func DeliveryRouter(cfg *dto.Config) *mux.Router {
+	router := mux.NewRouter()
+	processor := NewProcessor(cfg, &MediaProcessorMock{})
+	router.Handle(server.DeliveryRoutePath, processor.VerifyUrlSignature(http.HandlerFunc(processor.HandleImageDeliveryRequest))).
+		Methods(http.MethodGet, http.MethodHead)
+	return router
+}
+
+func SignRouter(cfg *dto.Config) *mux.Router {
+	router := mux.NewRouter()
+	processor := NewProcessor(cfg, &MediaProcessorMock{})
+	router.HandleFunc(ApiPathSign, processor.HandleSignUrlRequest).Methods(http.MethodPost)
+	return router
+}
+
+func NewProcessor(cfg *dto.Config, mediaProcessor *MediaProcessorMock) *server.ApiServerRequestProcessor {
+	return server.NewApiServerRequestProcessor(cfg, logrus.New(), mediaProcessor, &CloudStoreMock{}, &DbStoreMock{},
+		jobs.NewMemoryJobStore(0), webhooks.NewMemoryDeliveryLog(0))
+}
+
+func HealthRouter(cfg *dto.Config, cloudStore *CloudStoreMock, dbStore *DbStoreMock) (*mux.Router, *server.ApiServerRequestProcessor) {
+	router := mux.NewRouter()
+	processor := server.NewApiServerRequestProcessor(cfg, logrus.New(), &MediaProcessorMock{}, cloudStore, dbStore,
+		jobs.NewMemoryJobStore(0), webhooks.NewMemoryDeliveryLog(0))
+	router.HandleFunc(server.HealthPath, processor.HandleHealthRequest).Methods(http.MethodGet)
+	router.HandleFunc(server.ReadinessPath, processor.HandleReadinessRequest).Methods(http.MethodGet)
+	return router, processor
+}
+
+func PresetsConfig() *dto.Config {
+	return &dto.Config{Signing: SigningConfig().Signing, Presets: map[string]dto.PresetConfig{
+		"thumb": {Width: 20, Height: 20, Mode: dto.ResizeModeFill, Format: "png", Quality: 80},
+	}}
+}
+
+func ResizeRouterWithConfig(cfg *dto.Config) *mux.Router {
+	router := mux.NewRouter()
+	processor := NewProcessor(cfg, &MediaProcessorMock{})
+	router.HandleFunc(ApiPathResize, processor.HandleResizeRequest).Methods(http.MethodPost)
+	router.HandleFunc(ApiPathResizeById, processor.HandleResizeByIdRequest).Methods(http.MethodPost)
+	return router
+}
+
+func EagerResizeRouter(cfg *dto.Config, mediaProcessor *MediaProcessorMock) (*mux.Router, *server.ApiServerRequestProcessor) {
+	router := mux.NewRouter()
+	processor := NewProcessor(cfg, mediaProcessor)
+	router.HandleFunc(ApiPathResize, processor.HandleResizeRequest).Methods(http.MethodPost)
+	return router, processor
+}
+
+func JobsRouter(cfg *dto.Config, mediaProcessor *MediaProcessorMock) (*mux.Router, *server.ApiServerRequestProcessor) {
+	router := mux.NewRouter()
+	processor := NewProcessor(cfg, mediaProcessor)
+	router.HandleFunc(ApiPathResize, processor.HandleResizeRequest).Methods(http.MethodPost)
+	router.HandleFunc(ApiPathJobs, processor.HandleCreateJobRequest).Methods(http.MethodPost)
+	router.HandleFunc(ApiPathJobs+"/{id}", processor.HandleGetJobRequest).Methods(http.MethodGet)
+	router.HandleFunc(ApiPathDeliveries, processor.HandleWebhookDeliveriesRequest).Methods(http.MethodGet)
+	return router, processor
+}
+
+func QuotaRouter(cfg *dto.Config, mediaProcessor *MediaProcessorMock) *mux.Router {
+	router := mux.NewRouter()
+	processor := NewProcessor(cfg, mediaProcessor)
+	router.HandleFunc(ApiPathResize, processor.HandleResizeRequest).Methods(http.MethodPost)
+	router.HandleFunc(ApiPathResizeById, processor.HandleResizeByIdRequest).Methods(http.MethodPost)
+	router.HandleFunc(ApiPathUsage, processor.HandleUsageRequest).Methods(http.MethodGet)
+	return router
+}
+
+// router with authentication and rate limiting middlewares, like in api server
+func AuthRouter(cfg *dto.Config) *mux.Router {
+	router := mux.NewRouter()
+	processor := NewProcessor(cfg, &MediaProcessorMock{})
+	api := router.PathPrefix("/api").Subrouter()
+	api.Use(processor.Authenticate)
+	api.Handle("/v1/list", processor.RateLimitCheap(processor.RequireScope(server.ScopeImagesRead, processor.HandleListHistoryRequest))).
+		Methods(http.MethodGet)
+	api.Handle("/v1/resize", processor.RateLimitExpensive(processor.RequireScope(server.ScopeImagesWrite, processor.HandleResizeRequest))).
+		Methods(http.MethodPost)
+
+	admin := api.PathPrefix("/v1/admin").Subrouter()
+	admin.Use(processor.RequireAdmin)
+	admin.HandleFunc("/keys", processor.HandleCreateApiKeyRequest).Methods(http.MethodPost)
+	admin.HandleFunc("/keys", processor.HandleListApiKeysRequest).Methods(http.MethodGet)
+	admin.HandleFunc("/keys/{id}", processor.HandleDeleteApiKeyRequest).Methods(http.MethodDelete)
+	return router
+}
+
+func SigningConfig() *dto.Config {
+	return &dto.Config{Signing: dto.SigningConfig{Secret: "secret"}}
+}
+
 func GenerateResizeRequestBody() *http_request_dto.ResizeImageRequestParamsDto {
 	return &http_request_dto.ResizeImageRequestParamsDto{
 		BaseRequestDto: http_request_dto.BaseRequestDto{
@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/service/tracing"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+	Cases:
++	- invalid tracing config
++	- trace continued from traceparent header, workflow steps traced
++	- spans exported to file
+*/
+
+const (
+	TraceParent  = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	TraceId      = "4bf92f3577b34da6a3ce929d0e0e4736"
+	ParentSpanId = "00f067aa0ba902b7"
+)
+
+func TestTracing_InvalidConfig(t *testing.T) {
+	assert.Error(t, tracing.ValidateTracing(&dto.TracingConfig{Exporter: "zipkin"}), "Unknown exporter accepted")
+	assert.Error(t, tracing.ValidateTracing(&dto.TracingConfig{Exporter: tracing.ExporterFile}), "File exporter without file accepted")
+	assert.Error(t, tracing.ValidateTracing(&dto.TracingConfig{SampleRatio: 2}), "Invalid sample ratio accepted")
+	assert.NoError(t, tracing.ValidateTracing(&dto.TracingConfig{Exporter: tracing.ExporterStdout}), "Valid config rejected")
+}
+
+func TestTracing_Resize(t *testing.T) {
+	if _, err := tracing.Init(&dto.TracingConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	router := mux.NewRouter()
+	processor := NewProcessor(&dto.Config{}, &MediaProcessorMock{})
+	router.Use(processor.TraceRequests)
+	router.HandleFunc(ApiPathResize, processor.HandleResizeRequest).Methods(http.MethodPost)
+
+	body, contentType := prepareRequestValueForResizeApi(MarshalRequestDto(GenerateResizeRequestBody()), true, ImageTag, ImageName)
+	request, _ := http.NewRequest(http.MethodPost, ApiPathResize, body)
+	request.Header.Add("Content-Type", contentType)
+	request.Header.Add("traceparent", TraceParent)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+		assert.Equal(t, TraceId, span.SpanContext().TraceID().String(), "Span is not in trace of request")
+	}
+	if handlerSpan, ok := spans["POST "+ApiPathResize]; assert.True(t, ok, "Handler span not found") {
+		assert.Equal(t, ParentSpanId, handlerSpan.Parent().SpanID().String(), "Handler span is not child of traceparent")
+		if workflowSpan, ok := spans["resize_workflow"]; assert.True(t, ok, "Workflow span not found") {
+			assert.Equal(t, handlerSpan.SpanContext().SpanID(), workflowSpan.Parent().SpanID(), "Workflow span is not child of handler span")
+		}
+	}
+	assert.Contains(t, spans, "mongo.insert", "Insert span not found")
+}
+
+func TestTracing_FileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "traces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "traces.json")
+
+	shutdown, err := tracing.Init(&dto.TracingConfig{Exporter: tracing.ExporterFile, File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	_, span := tracing.Tracer().Start(context.Background(), "test_span")
+	span.End()
+	assert.NoError(t, shutdown(context.Background()), "Cannot flush traces")
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(content), "test_span", "Span not exported to file")
+}
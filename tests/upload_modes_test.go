@@ -0,0 +1,232 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_request_dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/service/jobs"
+	"github.com/senseyman/image-media-processor/service/webhooks"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+	Cases:
++	- raw upload with params in query
++	- raw upload with params in headers and file name in Content-Disposition
++	- raw upload without body or with invalid params
++	- raw upload with output params and with source_url
++	- json upload with base64 image and with data uri
++	- json upload with invalid base64
++	- two different images without file name get different ids
+*/
+
+const ApiPathImages = "/api/v1/images"
+
+func UploadRouter() *mux.Router {
+	return uploadRouterWithCloud(&CloudStoreMock{})
+}
+
+func uploadRouterWithCloud(cloudStore *CloudStoreMock) *mux.Router {
+	router := mux.NewRouter()
+	processor := server.NewApiServerRequestProcessor(&dto.Config{}, logrus.New(), &MediaProcessorMock{}, cloudStore, &DbStoreMock{},
+		jobs.NewMemoryJobStore(0), webhooks.NewMemoryDeliveryLog(0))
+	router.HandleFunc(ApiPathResize, processor.HandleResizeRequest).Methods(http.MethodPost)
+	router.HandleFunc(ApiPathImages, processor.HandleResizeRequest).Methods(http.MethodPut)
+	return router
+}
+
+func readTestImage(t *testing.T) []byte {
+	content, err := ioutil.ReadFile(ImageName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func sendUploadRequest(t *testing.T, request *http.Request) (int, *http_response_dto.ResizeImageResponseDto) {
+	return sendUploadRequestTo(t, UploadRouter(), request)
+}
+
+func sendUploadRequestTo(t *testing.T, router *mux.Router, request *http.Request) (int, *http_response_dto.ResizeImageResponseDto) {
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	responseDto := &http_response_dto.ResizeImageResponseDto{}
+	if err := json.Unmarshal(response.Body.Bytes(), responseDto); err != nil {
+		t.Fatal(err)
+	}
+	return response.Code, responseDto
+}
+
+func checkUploadedImage(t *testing.T, status int, responseDto *http_response_dto.ResizeImageResponseDto, filename string) {
+	assert.Equal(t, http.StatusOK, status, "Incorrect server response code")
+	assert.Equal(t, 0, responseDto.ErrCode, "Unexpected error: %s", responseDto.ErrMsg)
+	assert.Equal(t, "wsss", responseDto.UserId, "Wrong user id")
+	imageId, _ := utils.GenerateImageIdByOriginalName(filename)
+	assert.Equal(t, imageId, responseDto.ImageId, "Image id not generated from file name")
+	assert.NotEmpty(t, responseDto.ResizedImagePath, "Resized image path is empty")
+}
+
+func newJsonUploadRequest(image, filename string) *http.Request {
+	requestDto := &http_request_dto.ResizeImageJsonRequestDto{
+		ResizeImageRequestParamsDto: *GenerateResizeRequestBody(),
+		Image:                       image,
+		Filename:                    filename,
+	}
+	request, _ := http.NewRequest(http.MethodPost, ApiPathResize, MarshalRequestDto(requestDto))
+	request.Header.Set("Content-Type", "application/json")
+	return request
+}
+
+func TestUpload_RawQueryParams(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodPut, ApiPathImages+"?user_id=wsss&request_id=qqq&width=10&height=10&filename=photo.jpeg",
+		bytes.NewReader(readTestImage(t)))
+	request.Header.Set("Content-Type", "image/jpeg")
+
+	status, responseDto := sendUploadRequest(t, request)
+	checkUploadedImage(t, status, responseDto, "photo.jpeg")
+	assert.Equal(t, "qqq", responseDto.RequestId, "Wrong request id")
+}
+
+func TestUpload_RawHeaderParams(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodPut, ApiPathImages+"?width=10", bytes.NewReader(readTestImage(t)))
+	request.Header.Set("X-Image-User-Id", "wsss")
+	request.Header.Set("X-Image-Request-Id", "qqq")
+	request.Header.Set("X-Image-Width", "20")
+	request.Header.Set("X-Image-Height", "10")
+	request.Header.Set("Content-Disposition", `attachment; filename="../../header.jpeg"`)
+
+	status, responseDto := sendUploadRequest(t, request)
+	checkUploadedImage(t, status, responseDto, "header.jpeg")
+
+	// without file name image gets name by content hash
+	request, _ = http.NewRequest(http.MethodPut, ApiPathImages+"?user_id=wsss&request_id=qqq&width=10&height=10", bytes.NewReader(readTestImage(t)))
+	status, responseDto = sendUploadRequest(t, request)
+	checkUploadedImage(t, status, responseDto, server.ContentImageName(readTestImage(t))+".jpeg")
+}
+
+func TestUpload_RawInvalid(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodPut, ApiPathImages+"?user_id=wsss&width=10&height=10", http.NoBody)
+	status, responseDto := sendUploadRequest(t, request)
+	assert.Equal(t, http.StatusBadRequest, status, "Incorrect server response code")
+	assert.Equal(t, utils.ErrFileNotFoundInRequestCode, responseDto.ErrCode, "Wrong error code")
+
+	request, _ = http.NewRequest(http.MethodPut, ApiPathImages+"?user_id=wsss&width=ten&height=10", bytes.NewReader(readTestImage(t)))
+	status, responseDto = sendUploadRequest(t, request)
+	assert.Equal(t, http.StatusBadRequest, status, "Incorrect server response code")
+	assert.Equal(t, utils.ErrCannotParseRequestParamsCode, responseDto.ErrCode, "Wrong error code")
+
+	request, _ = http.NewRequest(http.MethodPut, ApiPathImages+"?user_id=wsss&width=0&height=10", bytes.NewReader(readTestImage(t)))
+	status, responseDto = sendUploadRequest(t, request)
+	assert.Equal(t, http.StatusBadRequest, status, "Incorrect server response code")
+	assert.Equal(t, utils.ErrInvalidRequestParamValuesCode, responseDto.ErrCode, "Wrong error code")
+}
+
+func TestUpload_RawTransformParams(t *testing.T) {
+	mediaProcessor := &MediaProcessorMock{}
+	router := mux.NewRouter()
+	processor := NewProcessor(&dto.Config{}, mediaProcessor)
+	router.HandleFunc(ApiPathImages, processor.HandleResizeRequest).Methods(http.MethodPut)
+
+	request, _ := http.NewRequest(http.MethodPut, ApiPathImages+"?user_id=wsss&request_id=qqq&width=10&height=10&format=png&filename=photo.jpeg",
+		bytes.NewReader(readTestImage(t)))
+	request.Header.Set("X-Image-Mode", "fill")
+	request.Header.Set("X-Image-Quality", "80")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	assert.Equal(t, dto.VariantDto{Width: 10, Height: 10, Format: "png", Mode: dto.ResizeModeFill, Quality: 80}, mediaProcessor.LastVariant,
+		"Output params of request not applied")
+
+	for _, query := range []string{"&mode=crop", "&format=webp", "&quality=101"} {
+		request, _ = http.NewRequest(http.MethodPut, ApiPathImages+"?user_id=wsss&width=10&height=10"+query, bytes.NewReader(readTestImage(t)))
+		status, responseDto := sendUploadRequest(t, request)
+		assert.Equal(t, http.StatusBadRequest, status, "Incorrect server response code for %s", query)
+		assert.Equal(t, utils.ErrInvalidRequestParamValuesCode, responseDto.ErrCode, "Wrong error code for %s", query)
+	}
+}
+
+func TestUpload_RawSourceUrl(t *testing.T) {
+	srv := SourceServer(t)
+	defer srv.Close()
+
+	router := mux.NewRouter()
+	processor := NewProcessor(&dto.Config{Fetch: dto.FetchConfig{AllowPrivate: true}}, &MediaProcessorMock{})
+	router.HandleFunc(ApiPathImages, processor.HandleResizeRequest).Methods(http.MethodPut)
+
+	request, _ := http.NewRequest(http.MethodPut, ApiPathImages+"?user_id=wsss&request_id=qqq&width=10&height=10", http.NoBody)
+	request.Header.Set("X-Image-Source-Url", srv.URL+SourceImagePath)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	responseDto := &http_response_dto.ResizeImageResponseDto{}
+	if err := json.Unmarshal(response.Body.Bytes(), responseDto); err != nil {
+		t.Fatal(err)
+	}
+	checkUploadedImage(t, response.Code, responseDto, "photo.jpeg")
+}
+
+func TestUpload_JsonBase64(t *testing.T) {
+	image := base64.StdEncoding.EncodeToString(readTestImage(t))
+
+	status, responseDto := sendUploadRequest(t, newJsonUploadRequest(image, "photo.jpeg"))
+	checkUploadedImage(t, status, responseDto, "photo.jpeg")
+
+	status, responseDto = sendUploadRequest(t, newJsonUploadRequest("data:image/jpeg;base64,"+image, ""))
+	checkUploadedImage(t, status, responseDto, server.ContentImageName(readTestImage(t))+".jpeg")
+}
+
+func TestUpload_WithoutNameDifferentImages(t *testing.T) {
+	first := readTestImage(t)
+	second := append(readTestImage(t), 0)
+	cloudStore := &CloudStoreMock{}
+	router := uploadRouterWithCloud(cloudStore)
+
+	request, _ := http.NewRequest(http.MethodPut, ApiPathImages+"?user_id=wsss&request_id=qqq&width=10&height=10", bytes.NewReader(first))
+	status, firstDto := sendUploadRequestTo(t, router, request)
+	checkUploadedImage(t, status, firstDto, server.ContentImageName(first)+".jpeg")
+
+	request, _ = http.NewRequest(http.MethodPut, ApiPathImages+"?user_id=wsss&request_id=qqq&width=10&height=10", bytes.NewReader(second))
+	status, secondDto := sendUploadRequestTo(t, router, request)
+	checkUploadedImage(t, status, secondDto, server.ContentImageName(second)+".jpeg")
+
+	assert.NotEqual(t, firstDto.ImageId, secondDto.ImageId, "Different images got the same id")
+	// files of second image do not overwrite files of first one
+	assert.Len(t, cloudStore.Uploaded, 4, "Wrong count of uploaded files")
+	keys := make(map[string]bool)
+	for _, key := range cloudStore.Uploaded {
+		keys[key] = true
+	}
+	assert.Len(t, keys, 4, "Different images were stored by the same keys")
+}
+
+func TestUpload_JsonInvalid(t *testing.T) {
+	status, responseDto := sendUploadRequest(t, newJsonUploadRequest("not base64!", "photo.jpeg"))
+	assert.Equal(t, http.StatusBadRequest, status, "Incorrect server response code")
+	assert.Equal(t, utils.ErrInvalidRequestParamValuesCode, responseDto.ErrCode, "Wrong error code")
+
+	status, responseDto = sendUploadRequest(t, newJsonUploadRequest("data:image/jpeg,abc", "photo.jpeg"))
+	assert.Equal(t, utils.ErrInvalidRequestParamValuesCode, responseDto.ErrCode, "Wrong error code")
+
+	status, responseDto = sendUploadRequest(t, newJsonUploadRequest("", "photo.jpeg"))
+	assert.Equal(t, http.StatusBadRequest, status, "Incorrect server response code")
+	assert.Equal(t, utils.ErrFileNotFoundInRequestCode, responseDto.ErrCode, "Wrong error code")
+
+	request, _ := http.NewRequest(http.MethodPost, ApiPathResize, bytes.NewReader([]byte(`{"user_id":`)))
+	request.Header.Set("Content-Type", "application/json")
+	status, responseDto = sendUploadRequest(t, request)
+	assert.Equal(t, http.StatusBadRequest, status, "Incorrect server response code")
+	assert.Equal(t, utils.ErrCannotParseRequestParamsCode, responseDto.ErrCode, "Wrong error code")
+}
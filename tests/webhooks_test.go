@@ -0,0 +1,220 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/senseyman/image-media-processor/dto"
+	"github.com/senseyman/image-media-processor/dto/http_response_dto"
+	"github.com/senseyman/image-media-processor/server"
+	"github.com/senseyman/image-media-processor/service/webhooks"
+	"github.com/senseyman/image-media-processor/utils"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+	Cases:
++	- invalid callback url, callback url with denied host
++	- deliveries request without request id
++	- callback of resize request, signed
++	- callback of job
++	- failed callback retried and logged
++	- callback to internal address is blocked
++	- redirect of callback is not followed
++	- placeholder secret is rejected
+*/
+
+// test receiver of callbacks
+type callbackReceiver struct {
+	mu         sync.Mutex
+	statusCode int
+	bodies     [][]byte
+	headers    []http.Header
+}
+
+func (c *callbackReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bodies = append(c.bodies, body)
+	c.headers = append(c.headers, r.Header)
+	if c.statusCode != 0 {
+		w.WriteHeader(c.statusCode)
+	}
+}
+
+func WebhooksConfig() *dto.Config {
+	return &dto.Config{Webhooks: dto.WebhooksConfig{
+		Secret:         "secret",
+		MaxAttempts:    3,
+		InitialBackoff: dto.Duration{Duration: time.Millisecond},
+		DenyHosts:      []string{"metadata.google.internal"},
+		// test receivers listen on loopback address
+		AllowPrivate: true,
+	}}
+}
+
+func sendResizeWithCallback(t *testing.T, router *mux.Router, callbackUrl string) *httptest.ResponseRecorder {
+	requestDto := GenerateResizeRequestBody()
+	requestDto.CallbackUrl = callbackUrl
+	body, contentType := prepareRequestValueForResizeApi(MarshalRequestDto(requestDto), true, ImageTag, ImageName)
+	request, _ := http.NewRequest(http.MethodPost, ApiPathResize, body)
+	request.Header.Add("Content-Type", contentType)
+	response := httptest.NewRecorder()
+
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func getDeliveries(t *testing.T, router *mux.Router, query string) (int, *http_response_dto.WebhookDeliveriesResponseDto) {
+	request, _ := http.NewRequest(http.MethodGet, ApiPathDeliveries+query, nil)
+	response := httptest.NewRecorder()
+
+	router.ServeHTTP(response, request)
+
+	responseDto := &http_response_dto.WebhookDeliveriesResponseDto{}
+	err := json.Unmarshal(response.Body.Bytes(), responseDto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.Code, responseDto
+}
+
+func TestWebhooks_InvalidCallbackUrl(t *testing.T) {
+	router, _ := JobsRouter(WebhooksConfig(), &MediaProcessorMock{})
+	response := sendResizeWithCallback(t, router, "ftp://example.com/callback")
+
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Incorrect server response code")
+
+	response = sendResizeWithCallback(t, router, "http://metadata.google.internal/callback")
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Callback url with denied host accepted")
+}
+
+func TestWebhooks_Deliveries_InvalidParams(t *testing.T) {
+	router, _ := JobsRouter(WebhooksConfig(), &MediaProcessorMock{})
+	code, responseDto := getDeliveries(t, router, "?user_id=wsss")
+
+	assert.Equal(t, http.StatusBadRequest, code, "Incorrect server response code")
+	assert.Equal(t, utils.ErrInvalidRequestParamValuesCode, responseDto.ErrCode, "Wrong error code")
+}
+
+func TestWebhooks_Resize_Positive(t *testing.T) {
+	receiver := &callbackReceiver{}
+	callbackServer := httptest.NewServer(receiver)
+	defer callbackServer.Close()
+
+	router, processor := JobsRouter(WebhooksConfig(), &MediaProcessorMock{})
+	response := sendResizeWithCallback(t, router, callbackServer.URL)
+	processor.WaitBackgroundTasks()
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	if assert.Len(t, receiver.bodies, 1, "Wrong count of callbacks") {
+		assert.JSONEq(t, response.Body.String(), string(receiver.bodies[0]), "Callback payload differs from response")
+		timestamp := receiver.headers[0].Get(webhooks.TimestampHeader)
+		assert.Equal(t, webhooks.Signature("secret", timestamp, receiver.bodies[0]), receiver.headers[0].Get(webhooks.SignatureHeader), "Wrong callback signature")
+	}
+
+	code, responseDto := getDeliveries(t, router, "?user_id=wsss&request_id=qqq")
+	assert.Equal(t, http.StatusOK, code, "Incorrect server response code")
+	if assert.Len(t, responseDto.Deliveries, 1, "Wrong count of deliveries") {
+		assert.True(t, responseDto.Deliveries[0].Delivered, "Delivery not marked as delivered")
+		assert.Equal(t, http.StatusOK, responseDto.Deliveries[0].StatusCode, "Wrong delivery status code")
+	}
+}
+
+func TestWebhooks_Job_Positive(t *testing.T) {
+	receiver := &callbackReceiver{}
+	callbackServer := httptest.NewServer(receiver)
+	defer callbackServer.Close()
+
+	requestDto := GenerateResizeRequestBody()
+	requestDto.CallbackUrl = callbackServer.URL
+	body, contentType := prepareRequestValueForResizeApi(MarshalRequestDto(requestDto), true, ImageTag, ImageName)
+
+	router, processor := JobsRouter(WebhooksConfig(), &MediaProcessorMock{})
+	code, _ := createJob(t, router, body, contentType)
+	processor.WaitBackgroundTasks()
+
+	assert.Equal(t, http.StatusAccepted, code, "Incorrect server response code")
+	if assert.Len(t, receiver.bodies, 1, "Wrong count of callbacks") {
+		result := &http_response_dto.ResizeImageResponseDto{}
+		err := json.Unmarshal(receiver.bodies[0], result)
+		assert.NoError(t, err, "Cannot parse callback payload")
+		assert.Equal(t, "qqq", result.RequestId, "Wrong request id in callback")
+		assert.NotEmpty(t, result.ResizedImagePath, "Empty resized image path in callback")
+	}
+}
+
+func TestWebhooks_Retry(t *testing.T) {
+	receiver := &callbackReceiver{statusCode: http.StatusInternalServerError}
+	callbackServer := httptest.NewServer(receiver)
+	defer callbackServer.Close()
+
+	router, processor := JobsRouter(WebhooksConfig(), &MediaProcessorMock{})
+	sendResizeWithCallback(t, router, callbackServer.URL)
+	processor.WaitBackgroundTasks()
+
+	assert.Len(t, receiver.bodies, 3, "Wrong count of delivery attempts")
+
+	_, responseDto := getDeliveries(t, router, "?user_id=wsss&request_id=qqq")
+	if assert.Len(t, responseDto.Deliveries, 3, "Wrong count of logged deliveries") {
+		for i, delivery := range responseDto.Deliveries {
+			assert.Equal(t, i+1, delivery.Attempt, "Wrong attempt number")
+			assert.False(t, delivery.Delivered, "Failed delivery marked as delivered")
+			assert.Equal(t, http.StatusInternalServerError, delivery.StatusCode, "Wrong delivery status code")
+			assert.NotEmpty(t, delivery.Error, "Empty delivery error")
+		}
+	}
+}
+
+func TestWebhooks_InternalAddressBlocked(t *testing.T) {
+	receiver := &callbackReceiver{}
+	callbackServer := httptest.NewServer(receiver)
+	defer callbackServer.Close()
+
+	cfg := WebhooksConfig()
+	cfg.Webhooks.AllowPrivate = false
+	router, processor := JobsRouter(cfg, &MediaProcessorMock{})
+	response := sendResizeWithCallback(t, router, callbackServer.URL)
+	processor.WaitBackgroundTasks()
+
+	assert.Equal(t, http.StatusOK, response.Code, "Incorrect server response code")
+	assert.Len(t, receiver.bodies, 0, "Callback sent to internal address")
+
+	_, responseDto := getDeliveries(t, router, "?user_id=wsss&request_id=qqq")
+	if assert.NotEmpty(t, responseDto.Deliveries, "Blocked delivery not logged") {
+		assert.False(t, responseDto.Deliveries[0].Delivered, "Blocked delivery marked as delivered")
+		assert.Contains(t, responseDto.Deliveries[0].Error, "is internal", "Wrong delivery error")
+	}
+}
+
+func TestWebhooks_RedirectNotFollowed(t *testing.T) {
+	receiver := &callbackReceiver{}
+	callbackServer := httptest.NewServer(receiver)
+	defer callbackServer.Close()
+	redirectServer := httptest.NewServer(http.RedirectHandler(callbackServer.URL, http.StatusTemporaryRedirect))
+	defer redirectServer.Close()
+
+	router, processor := JobsRouter(WebhooksConfig(), &MediaProcessorMock{})
+	sendResizeWithCallback(t, router, redirectServer.URL)
+	processor.WaitBackgroundTasks()
+
+	assert.Len(t, receiver.bodies, 0, "Callback redirect followed")
+
+	_, responseDto := getDeliveries(t, router, "?user_id=wsss&request_id=qqq")
+	if assert.Len(t, responseDto.Deliveries, 3, "Wrong count of logged deliveries") {
+		assert.False(t, responseDto.Deliveries[0].Delivered, "Redirected delivery marked as delivered")
+		assert.Equal(t, http.StatusTemporaryRedirect, responseDto.Deliveries[0].StatusCode, "Wrong delivery status code")
+	}
+}
+
+func TestWebhooks_SecretValidation(t *testing.T) {
+	assert.NoError(t, server.ValidateWebhooks(&dto.WebhooksConfig{}), "Empty secret rejected")
+	assert.NoError(t, server.ValidateWebhooks(&dto.WebhooksConfig{Secret: "c9f1d7e2a4"}), "Valid secret rejected")
+	assert.Error(t, server.ValidateWebhooks(&dto.WebhooksConfig{Secret: "change-me-too"}), "Placeholder secret accepted")
+}
@@ -14,20 +14,52 @@ const (
 	ErrImageNotFoundCode
 	ErrLoadFileCode
 	ErrImageIdGenerateCode
+	ErrInvalidSignatureCode
+	ErrSigningNotConfiguredCode
+	ErrProcessingQueueFullCode
+	ErrJobNotFoundCode
+	ErrCannotGetWebhookDeliveriesCode
+	ErrUnauthorizedCode
+	ErrForbiddenCode
+	ErrApiKeyNotFoundCode
+	ErrCannotGetApiKeysCode
+	ErrRateLimitExceededCode
+	ErrQuotaExceededCode
+	ErrStorageUnavailableCode
+	ErrRequestTooLargeCode
+	ErrFetchSourceCode
+	ErrErasureInProgressCode
+	ErrImageTooLargeCode
 )
 
 // error messages
 const (
-	ErrMsgEmptyRequest              = "Empty request"
-	ErrMsgFileNotFoundInRequest     = "File not found in request"
-	ErrMsgParamsNotSetInRequest     = "Params not set in request"
-	ErrMsgCannotParseRequestParams  = "Cannot parse request params"
-	ErrMsgInvalidRequestParamValues = "Invalid values in request params"
-	ErrMsgCannotResizeImage         = "Cannot resize image"
-	ErrMsgUploadImage               = "Cannot upload image to cloud store"
-	ErrMsgSaveInfoToDB              = "Cannot save request results to DB"
-	ErrMsgCannotGetUserImages       = "Cannot get user images from DB"
-	ErrMsgImageNotFound             = "Image not found"
-	ErrMsgLoadFile                  = "Cannot download file"
-	ErrImageIdGenerate              = "Cannot generate image id"
+	ErrMsgEmptyRequest               = "Empty request"
+	ErrMsgFileNotFoundInRequest      = "File not found in request"
+	ErrMsgParamsNotSetInRequest      = "Params not set in request"
+	ErrMsgCannotParseRequestParams   = "Cannot parse request params"
+	ErrMsgInvalidRequestParamValues  = "Invalid values in request params"
+	ErrMsgCannotResizeImage          = "Cannot resize image"
+	ErrMsgUploadImage                = "Cannot upload image to cloud store"
+	ErrMsgSaveInfoToDB               = "Cannot save request results to DB"
+	ErrMsgCannotGetUserImages        = "Cannot get user images from DB"
+	ErrMsgImageNotFound              = "Image not found"
+	ErrMsgLoadFile                   = "Cannot download file"
+	ErrImageIdGenerate               = "Cannot generate image id"
+	ErrMsgInvalidSignature           = "Invalid or expired url signature"
+	ErrMsgSigningNotConfigured       = "Url signing is not configured"
+	ErrMsgProcessingQueueFull        = "Processing queue is full, retry later"
+	ErrMsgJobNotFound                = "Job not found"
+	ErrMsgCannotGetWebhookDeliveries = "Cannot get webhook deliveries"
+	ErrMsgUnauthorized               = "Missing or invalid credentials"
+	ErrMsgForbidden                  = "Access denied"
+	ErrMsgApiKeyNotFound             = "API key not found"
+	ErrMsgCannotGetApiKeys           = "Cannot get API keys"
+	ErrMsgRateLimitExceeded          = "Rate limit exceeded, retry later"
+	ErrMsgQuotaExceeded              = "Quota exceeded"
+	ErrMsgStorageUnavailable         = "Storage is temporarily unavailable, retry later"
+	ErrMsgRequestTooLarge            = "Request body is too large"
+	ErrMsgFetchSource                = "Cannot download image from source url"
+	ErrMsgErasureInProgress          = "Erasure of user is already in progress"
+	ErrMsgImageTooLarge              = "Image is too large for processing"
 )
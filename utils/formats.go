@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// supported image formats by file extension
+var imageFormats = map[string]string{
+	"jpg":  "jpeg",
+	"jpeg": "jpeg",
+	"png":  "png",
+	"gif":  "gif",
+	"tif":  "tiff",
+	"tiff": "tiff",
+	"bmp":  "bmp",
+}
+
+// known formats which variants cannot be made in, with the reason
+var unsupportedFormats = map[string]string{
+	"webp": "image library has no webp encoder",
+}
+
+// Return canonical format name by file extension (with or without leading dot)
+func NormalizeImageFormat(ext string) (string, error) {
+	name := strings.ToLower(strings.TrimPrefix(ext, "."))
+	if reason, ok := unsupportedFormats[name]; ok {
+		return "", fmt.Errorf("unsupported image format %q: %s", ext, reason)
+	}
+	format, ok := imageFormats[name]
+	if !ok {
+		return "", fmt.Errorf("unsupported image format %q", ext)
+	}
+	return format, nil
+}
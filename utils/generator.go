@@ -1,10 +1,15 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"hash/fnv"
 	"strings"
 )
 
+// prefix of generated API keys, helps to recognize leaked keys
+const ApiKeyPrefix = "imp_"
+
 func GenerateImageIdByOriginalName(fileName string) (uint32, error) {
 	s := strings.Split(fileName, ".")
 	return hash(s[0])
@@ -18,3 +23,21 @@ func hash(s string) (uint32, error) {
 	}
 	return h.Sum32(), nil
 }
+
+// Generate random identifier as hex string
+func GenerateRandomId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Generate new API key, it is shown to user only once
+func GenerateApiKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return ApiKeyPrefix + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Calculate HMAC-SHA256 signature of payload, return it as hex string
+func HmacSignature(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Compare signature with HMAC-SHA256 signature of payload in constant time
+func CheckHmacSignature(secret, payload, signature string) bool {
+	expected := HmacSignature(secret, payload)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// Calculate SHA256 hash of API key for storing and lookup, key itself is never stored
+func HashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}